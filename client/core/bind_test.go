@@ -0,0 +1,110 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBindError(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply answers the bind request, the IQ's id is passed as
+		// the argument.
+		reply         string
+		wantCondition string
+	}{
+		{
+			name: "conflict",
+			reply: "<iq type='error' id='%s'><error type='cancel'>" +
+				"<conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			wantCondition: "conflict",
+		},
+		{
+			name: "not allowed",
+			reply: "<iq type='error' id='%s'><error type='cancel'>" +
+				"<not-allowed xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>" +
+				"<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>Too many resources</text></error></iq>",
+			wantCondition: "not-allowed",
+		},
+		{
+			name: "bad request",
+			reply: "<iq type='error' id='%s'><error type='modify'>" +
+				"<bad-request xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			wantCondition: "bad-request",
+		},
+		// A result without a JID isn't a BindError, but it mustn't
+		// leave the connection bound either.
+		{
+			name:  "missing JID",
+			reply: "<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></iq>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+
+			errc := make(chan error, 1)
+			go func() {
+				err := func() error {
+					if _, err := s.ReadStreamHeader(); err != nil {
+						return err
+					}
+					s.OpenStream(mechanisms)
+					if _, err := s.NextElement(); err != nil {
+						return err
+					}
+					s.Send("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+					if _, err := s.RestartStream(); err != nil {
+						return err
+					}
+					s.OpenStream(bind)
+					iq, err := s.NextElement()
+					if err != nil {
+						return err
+					}
+					if iq.XMLName.Local != "iq" || iq.Attribute("type") != "set" {
+						return fmt.Errorf("got <%s> %v, want a bind request", iq.XMLName.Local, iq.Attr)
+					}
+					return s.Sendf(tt.reply, iq.Attribute("id"))
+				}()
+				if err != nil {
+					// Unblock the client.
+					s.Conn.Close()
+				}
+				errc <- err
+			}()
+
+			errs := c.Dial()
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if len(errs) != 1 {
+				t.Fatalf("got errors %v, want one", errs)
+			}
+			var bindErr core.BindError
+			isBindErr := errors.As(errs[0], &bindErr)
+			if tt.wantCondition == "" {
+				if isBindErr {
+					t.Errorf("got %v, want an error other than BindError", errs[0])
+				}
+			} else {
+				if !isBindErr || bindErr.Condition != tt.wantCondition {
+					t.Fatalf("got %v, want a BindError with condition %s", errs[0], tt.wantCondition)
+				}
+				if bindErr.Err == nil {
+					t.Error("BindError doesn't carry the stanza error")
+				}
+			}
+			if c.State() != core.StateDisconnected || c.JID() != "" {
+				t.Errorf("got state %v and JID %q, want to be disconnected", c.State(), c.JID())
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"honnef.co/go/xmpp/client/internal/clock"
+
+	"encoding/xml"
+	"errors"
+	"time"
+)
+
+// SendPresenceTracked is like SendPresence but additionally reports
+// whether the server or the recipient bounced the presence with an
+// error. Presence isn't acknowledged otherwise, so the returned
+// channel receives the bounce's *Error, or nil if no bounce arrived
+// within timeout. If the connection is lost before that, ErrClosed is
+// received instead.
+//
+// Bounced presences are still delivered by NextStanza, too.
+func (c *Conn) SendPresenceTracked(p Presence, timeout time.Duration) (cookie string, errc <-chan error, err error) {
+	// The ID has to be known before sending, so that a fast bounce
+	// can't be missed.
+	p.Id = c.getCookie()
+	ch := make(chan error, 1)
+
+	c.mu.Lock()
+	if c.bounces == nil {
+		c.bounces = make(map[string]chan error)
+	}
+	c.bounces[p.Id] = ch
+	c.mu.Unlock()
+
+	cookie, err = c.sendPresence(p)
+	if err != nil {
+		c.resolveBounce(p.Id, nil)
+		return cookie, nil, err
+	}
+
+	clock.AfterFunc(timeout, func() { c.resolveBounce(p.Id, nil) })
+	return cookie, ch, nil
+}
+
+// resolveBounce delivers the outcome of a tracked presence, if it is
+// still being tracked.
+func (c *Conn) resolveBounce(id string, err error) {
+	c.mu.Lock()
+	ch, ok := c.bounces[id]
+	delete(c.bounces, id)
+	c.mu.Unlock()
+
+	if ok {
+		ch <- err
+	}
+}
+
+// checkBounce resolves the tracked presence that p is a bounce of.
+func (c *Conn) checkBounce(p *Presence) {
+	if p.Type != "error" || p.Error == nil {
+		return
+	}
+	c.resolveBounce(p.Id, p.Error)
+}
+
+// failBounces stops tracking all presences. The caller must hold mu.
+func (c *Conn) failBounces() {
+	for _, ch := range c.bounces {
+		ch <- ErrClosed
+	}
+	c.bounces = nil
+}
+
+const nsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+// ErrUnknownCondition is returned by BounceMessage for conditions
+// that aren't defined by RFC 6120.
+var ErrUnknownCondition = errors.New("xmpp: unknown stanza error condition")
+
+// conditionTypes maps the stanza error conditions of RFC 6120 to the
+// error types they are usually sent with (RFC 6120 8.3.3).
+var conditionTypes = map[string]string{
+	"bad-request":             "modify",
+	"conflict":                "cancel",
+	"feature-not-implemented": "cancel",
+	"forbidden":               "auth",
+	"gone":                    "cancel",
+	"internal-server-error":   "cancel",
+	"item-not-found":          "cancel",
+	"jid-malformed":           "modify",
+	"not-acceptable":          "modify",
+	"not-allowed":             "cancel",
+	"not-authorized":          "auth",
+	"policy-violation":        "modify",
+	"recipient-unavailable":   "wait",
+	"redirect":                "modify",
+	"registration-required":   "auth",
+	"remote-server-not-found": "cancel",
+	"remote-server-timeout":   "wait",
+	"resource-constraint":     "wait",
+	"service-unavailable":     "cancel",
+	"subscription-required":   "auth",
+	"undefined-condition":     "modify",
+	"unexpected-request":      "wait",
+}
+
+// BounceMessage rejects a received message by sending it back as an
+// error with the given stanza error condition, like "not-acceptable"
+// or "service-unavailable". The bounce is addressed to the sender,
+// keeps the message's ID and echoes its content, so that the sender
+// can tell which message has been rejected. Error messages are never
+// bounced, to prevent loops.
+func (c *Conn) BounceMessage(orig *Message, condition string) error {
+	typ, ok := conditionTypes[condition]
+	if !ok {
+		return ErrUnknownCondition
+	}
+	if orig.Type == "error" {
+		return nil
+	}
+
+	return c.Encode(Message{
+		Header: Header{
+			From: orig.To,
+			To:   orig.From,
+			Id:   orig.Id,
+			Type: "error",
+		},
+		// The inner XML of a received message holds all of its
+		// content, including the body.
+		Inner: orig.Inner,
+		Error: &Error{
+			Type:   typ,
+			Errors: XMPPErrors{errTypes[xml.Name{Space: nsStanzas, Local: condition}]},
+		},
+	})
+}
@@ -0,0 +1,102 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestBounceMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		typ       string
+		condition string
+		// wantType is the bounce's error type, or empty if nothing may
+		// be sent.
+		wantType string
+		wantErr  error
+	}{
+		{name: "not acceptable", typ: "chat", condition: "not-acceptable", wantType: "modify"},
+		{name: "service unavailable", typ: "normal", condition: "service-unavailable", wantType: "cancel"},
+		{name: "forbidden", typ: "chat", condition: "forbidden", wantType: "auth"},
+		{name: "unknown condition", typ: "chat", condition: "go-away", wantErr: core.ErrUnknownCondition},
+		// Bouncing errors could bounce back and forth forever.
+		{name: "error", typ: "error", condition: "not-acceptable"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Sendf("<message xmlns='jabber:client' from='bob@example.com/phone' to='alice@example.com/xmpptest' type='%s' id='cmd1'>"+
+				"<body>reboot</body><thread>t1</thread></message>", tt.typ)
+			var msg *core.Message
+			select {
+			case stanza := <-stanzas:
+				msg = stanza.(*core.Message)
+			case <-time.After(5 * time.Second):
+				t.Fatal("message wasn't delivered")
+			}
+
+			// The sentinel marks the end of what the bounce sent.
+			errc := make(chan error, 1)
+			go func() {
+				err := c.BounceMessage(msg, tt.condition)
+				c.Encode(core.Message{Header: core.Header{Id: "sentinel"}})
+				errc <- err
+			}()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantType == "" {
+				if e.Attribute("id") != "sentinel" {
+					t.Errorf("got <%s> %v, want nothing to be sent", e.XMLName.Local, e.Attr)
+				}
+				if err := <-errc; err != tt.wantErr {
+					t.Errorf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if _, err := s.NextElement(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if e.XMLName.Local != "message" || e.Attribute("type") != "error" || e.Attribute("id") != "cmd1" ||
+				e.Attribute("to") != "bob@example.com/phone" || e.Attribute("from") != "alice@example.com/xmpptest" {
+				t.Errorf("got <%s> %v, want an error message with ID cmd1 from alice@example.com/xmpptest to bob@example.com/phone", e.XMLName.Local, e.Attr)
+			}
+			var got struct {
+				Bodies  []string `xml:"body"`
+				Threads []string `xml:"thread"`
+				Error   struct {
+					Type       string `xml:"type,attr"`
+					Conditions []struct {
+						XMLName xml.Name
+					} `xml:",any"`
+				} `xml:"error"`
+			}
+			if err := xml.Unmarshal([]byte("<message>"+string(e.Inner)+"</message>"), &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Bodies) != 1 || got.Bodies[0] != "reboot" || len(got.Threads) != 1 || got.Threads[0] != "t1" {
+				t.Errorf("got %s, want the original content once", e.Inner)
+			}
+			want := xml.Name{Space: "urn:ietf:params:xml:ns:xmpp-stanzas", Local: tt.condition}
+			if got.Error.Type != tt.wantType || len(got.Error.Conditions) != 1 || got.Error.Conditions[0].XMLName != want {
+				t.Errorf("got error %+v, want %s of type %s", got.Error, tt.condition, tt.wantType)
+			}
+		})
+	}
+}
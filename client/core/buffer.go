@@ -0,0 +1,101 @@
+package core
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSendBufferFull is returned when sending a stanza while the
+// connection isn't ready and the send buffer is full, if
+// SendBufferPolicy is RejectWhenFull.
+var ErrSendBufferFull = errors.New("xmpp: send buffer full")
+
+// A BufferPolicy decides what happens to stanzas sent while the send
+// buffer is full.
+type BufferPolicy int
+
+const (
+	// RejectWhenFull fails sending with ErrSendBufferFull.
+	RejectWhenFull BufferPolicy = iota
+	// DropOldest discards the stanza that has been buffered the
+	// longest to make room.
+	DropOldest
+)
+
+// sendBuffer holds stanzas sent while the connection wasn't ready.
+type sendBuffer struct {
+	mu    sync.Mutex
+	queue []interface{}
+}
+
+// bufferable reports whether v is a stanza that may be buffered. IQ
+// requests aren't, because their replies would be waited for across
+// sessions, see SendBuffer.
+func bufferable(v interface{}) bool {
+	var typ string
+	switch v := v.(type) {
+	case Message, *Message, Presence, *Presence:
+		return true
+	case IQ:
+		typ = v.Type
+	case *IQ:
+		typ = v.Type
+	case outgoingIQ:
+		typ = v.Type
+	case *outgoingIQ:
+		typ = v.Type
+	default:
+		return false
+	}
+	return typ == "result" || typ == "error"
+}
+
+// buffer queues v if the connection isn't ready, or if older stanzas
+// are still waiting to be sent. It reports whether v has been taken
+// care of, in which case err is the result of sending it.
+func (c *Conn) buffer(v interface{}) (ok bool, err error) {
+	if c.SendBuffer <= 0 || !bufferable(v) {
+		return false, nil
+	}
+
+	c.sendBuffer.mu.Lock()
+	defer c.sendBuffer.mu.Unlock()
+	if len(c.sendBuffer.queue) == 0 && c.State() == StateBound {
+		return false, nil
+	}
+	if c.isClosing() {
+		// Fail like any other send on a closed connection.
+		return false, nil
+	}
+	if len(c.sendBuffer.queue) >= c.SendBuffer {
+		if c.SendBufferPolicy != DropOldest {
+			return true, ErrSendBufferFull
+		}
+		c.sendBuffer.queue = c.sendBuffer.queue[1:]
+	}
+	c.sendBuffer.queue = append(c.sendBuffer.queue, v)
+	return true, nil
+}
+
+// flushSendBuffer sends the buffered stanzas, in order. If sending
+// fails, the remaining stanzas stay buffered until the connection is
+// ready again.
+func (c *Conn) flushSendBuffer() {
+	c.sendBuffer.mu.Lock()
+	defer c.sendBuffer.mu.Unlock()
+	for len(c.sendBuffer.queue) > 0 {
+		if err := c.encode(c.sendBuffer.queue[0]); err != nil {
+			return
+		}
+		c.sendBuffer.queue[0] = nil
+		c.sendBuffer.queue = c.sendBuffer.queue[1:]
+	}
+	c.sendBuffer.queue = nil
+}
+
+// dropSendBuffer discards the buffered stanzas.
+func (c *Conn) dropSendBuffer() {
+	c.sendBuffer.mu.Lock()
+	c.sendBuffer.queue = nil
+	c.sendBuffer.mu.Unlock()
+}
@@ -0,0 +1,167 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestSendBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		policy core.BufferPolicy
+		// send are the stanzas sent while the connection is lost.
+		send []interface{}
+		// wantErr are the errors of sending them, nil if they all
+		// succeed.
+		wantErr []bool
+		// want are the IDs of the stanzas received after
+		// reconnecting.
+		want []string
+	}{
+		{
+			name: "in order",
+			size: 4,
+			send: []interface{}{
+				core.Message{Header: core.Header{To: "bob@example.com", Id: "m1"}, Body: "one"},
+				&core.Presence{Header: core.Header{Id: "p1"}, Show: core.ShowAway},
+				core.IQ{Header: core.Header{To: "bob@example.com", Type: "result", Id: "r1"}},
+				&core.Message{Header: core.Header{To: "bob@example.com", Id: "m2"}, Body: "two"},
+			},
+			want: []string{"m1", "p1", "r1", "m2"},
+		},
+		{
+			// Replies to IQ requests from an earlier session would
+			// never arrive.
+			name: "IQ request",
+			size: 4,
+			send: []interface{}{
+				core.Message{Header: core.Header{To: "bob@example.com", Id: "m1"}, Body: "one"},
+				core.IQ{Header: core.Header{To: "bob@example.com", Type: "get", Id: "q1"}},
+			},
+			wantErr: []bool{false, true},
+			want:    []string{"m1"},
+		},
+		{
+			name: "full",
+			size: 2,
+			send: []interface{}{
+				core.Message{Header: core.Header{Id: "m1"}},
+				core.Message{Header: core.Header{Id: "m2"}},
+				core.Message{Header: core.Header{Id: "m3"}},
+			},
+			wantErr: []bool{false, false, true},
+			want:    []string{"m1", "m2"},
+		},
+		{
+			name:   "full, dropping the oldest",
+			size:   2,
+			policy: core.DropOldest,
+			send: []interface{}{
+				core.Message{Header: core.Header{Id: "m1"}},
+				core.Message{Header: core.Header{Id: "m2"}},
+				core.Message{Header: core.Header{Id: "m3"}},
+			},
+			want: []string{"m2", "m3"},
+		},
+		{
+			name:    "disabled",
+			send:    []interface{}{core.Message{Header: core.Header{Id: "m1"}}},
+			wantErr: []bool{true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.AllowReconnect = true
+			c.SendBuffer = tt.size
+			c.SendBufferPolicy = tt.policy
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				s.Send("<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>")
+				s.Conn.Close()
+			}()
+			if _, err := c.NextStanza(); err == nil {
+				t.Fatal("connection wasn't lost")
+			}
+			for i, v := range tt.send {
+				err := c.Encode(v)
+				if want := tt.wantErr != nil && tt.wantErr[i]; (err != nil) != want {
+					t.Errorf("sending stanza %d returned %v, want an error: %t", i, err, want)
+				}
+			}
+
+			// The server collects what arrives in the new session, up
+			// to a sentinel sent once the connection is ready.
+			conn2, s2 := xmpptest.Pipe()
+			defer s2.Conn.Close()
+			received := make(chan []string, 1)
+			go func() {
+				var got []string
+				if err := s2.Negotiate(); err != nil {
+					received <- []string{err.Error()}
+					return
+				}
+				for {
+					e, err := s2.NextElement()
+					if err != nil || e.Attribute("id") == "sentinel" {
+						break
+					}
+					got = append(got, e.Attribute("id"))
+				}
+				received <- got
+			}()
+			if errs := c.Reconnect(conn2); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := c.Encode(core.Message{Header: core.Header{Id: "sentinel"}}); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-received; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	msg := core.Message{Header: core.Header{To: "bob@example.com", Type: "chat"}, Body: "hi"}
+	tests := []struct {
+		name   string
+		buffer int
+	}{
+		{name: "unbuffered"},
+		// Once the connection is ready, stanzas only pass by the
+		// buffer.
+		{name: "buffered", buffer: 100},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			c, s := benchConn(b, func(c *core.Conn) { c.SendBuffer = tt.buffer })
+			go io.Copy(io.Discard, s.Conn)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Encode(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// newDecoder returns a decoder reading from the connection. Unless
+// StrictUTF8 is set, streams that declare a legacy encoding are
+// converted to UTF-8.
+func (c *Conn) newDecoder() *xml.Decoder {
+	d := xml.NewDecoder(transport{c})
+	if !c.StrictUTF8 {
+		d.CharsetReader = charsetReader
+	}
+	return d
+}
+
+// charsetReader supports the encodings that non-compliant gateways
+// have been seen to use. XMPP mandates UTF-8, so this is purely a
+// compatibility measure.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1", "l1", "us-ascii", "ascii":
+		// ASCII is a subset of Latin-1, and the first 256 code
+		// points of Unicode are identical to Latin-1.
+		return &latin1Reader{r: input}, nil
+	default:
+		return nil, fmt.Errorf("xmpp: unsupported charset %q", charset)
+	}
+}
+
+// latin1Reader converts ISO-8859-1 to UTF-8.
+type latin1Reader struct {
+	r   io.Reader
+	buf []byte
+	// pending holds converted bytes that didn't fit into the last
+	// read.
+	pending []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	if len(l.pending) > 0 {
+		n := copy(p, l.pending)
+		l.pending = l.pending[n:]
+		return n, nil
+	}
+
+	// Every byte expands to at most two bytes.
+	size := (len(p) + 1) / 2
+	if cap(l.buf) < size {
+		l.buf = make([]byte, size)
+	}
+	n, err := l.r.Read(l.buf[:size])
+
+	var out []byte
+	for _, b := range l.buf[:n] {
+		out = utf8.AppendRune(out, rune(b))
+	}
+	m := copy(p, out)
+	l.pending = out[m:]
+	return m, err
+}
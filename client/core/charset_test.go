@@ -0,0 +1,95 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"fmt"
+	"testing"
+)
+
+func TestCharset(t *testing.T) {
+	tests := []struct {
+		name string
+		// encoding is declared by the server's stream headers.
+		encoding string
+		strict   bool
+		// body is sent in the encoding's raw bytes.
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "utf-8", encoding: "UTF-8", body: "caf\xc3\xa9 \xc3\xbc", want: "café ü"},
+		{name: "utf-8, strict", encoding: "UTF-8", strict: true, body: "caf\xc3\xa9 \xc3\xbc", want: "café ü"},
+		{name: "latin-1", encoding: "ISO-8859-1", body: "caf\xe9 \xfc", want: "café ü"},
+		{name: "latin-1, lower case", encoding: "latin1", body: "caf\xe9 \xfc", want: "café ü"},
+		{name: "ascii", encoding: "US-ASCII", body: "cafe", want: "cafe"},
+		{name: "latin-1, strict", encoding: "ISO-8859-1", strict: true, wantErr: true},
+		{name: "unsupported", encoding: "Shift_JIS", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.StrictUTF8 = tt.strict
+
+			openStream := func(features string) error {
+				return s.Sendf("<?xml version='1.0' encoding='%s'?>"+
+					"<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' id='%s' from='%s' version='1.0'>"+
+					"<stream:features>%s</stream:features>",
+					tt.encoding, s.StreamID, s.Domain, features)
+			}
+			go func() {
+				err := func() error {
+					if _, err := s.ReadStreamHeader(); err != nil {
+						return err
+					}
+					openStream(mechanisms)
+					if auth, err := s.NextElement(); err != nil || auth.XMLName.Local != "auth" {
+						return fmt.Errorf("expected <auth>, got %v, %v", auth.XMLName, err)
+					}
+					s.Send("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+					if _, err := s.RestartStream(); err != nil {
+						return err
+					}
+					openStream(bind)
+					iq, err := s.NextElement()
+					if err != nil {
+						return err
+					}
+					return s.Sendf("<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>alice@example.com/xmpptest</jid></bind></iq>"+
+						"<message from='bob@example.com/phone' type='chat'><body>%s</body></message>",
+						iq.Attribute("id"), tt.body)
+				}()
+				if err != nil {
+					// The client rejected the stream.
+					s.Conn.Close()
+				}
+			}()
+
+			errs := c.Dial()
+			if tt.wantErr {
+				if len(errs) == 0 {
+					t.Fatalf("accepted a stream encoded in %s", tt.encoding)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			stanza, err := c.NextStanza()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, ok := stanza.(*core.Message)
+			if !ok {
+				t.Fatalf("got %T, want *core.Message", stanza)
+			}
+			if msg.Body != tt.want {
+				t.Errorf("got body %q, want %q", msg.Body, tt.want)
+			}
+		})
+	}
+}
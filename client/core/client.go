@@ -11,16 +11,23 @@ import (
 	shared "honnef.co/go/xmpp/shared/core"
 
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/base64"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var _ Client = &Conn{}
@@ -34,13 +41,88 @@ const (
 	nsClient  = "jabber:client"
 )
 
+// ErrClosed is returned by functions that were waiting for a reply
+// when the connection got closed.
+var ErrClosed = errors.New("xmpp: connection closed")
+
+var ErrNoAddresses = errors.New("xmpp: no addresses to connect to")
+
+// ErrNoAuthentication and ErrNoBinding are returned when the server
+// doesn't offer a stream feature that has to be negotiated.
+var (
+	ErrNoAuthentication = errors.New("xmpp: server doesn't offer authentication")
+	ErrNoBinding        = errors.New("xmpp: server doesn't offer resource binding")
+)
+
+// ErrResourceConflict is returned by Reconnect after another client
+// took over our resource, which the server reports with a conflict
+// stream error. DisconnectErrors caused by it match it with errors.Is.
+var ErrResourceConflict = errors.New("xmpp: resource taken over by another client")
+
+// ErrInvalidType is returned when trying to send a stanza whose type
+// isn't allowed for its kind of stanza.
+var ErrInvalidType = errors.New("xmpp: invalid stanza type")
+
+// ValidMessageType reports whether typ is a valid type for messages
+// (RFC 6121 5.2.2). The empty type is equivalent to normal.
+func ValidMessageType(typ string) bool {
+	switch typ {
+	case "", "chat", "groupchat", "headline", "normal", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidPresenceType reports whether typ is a valid type for presences
+// (RFC 6121 4.7.1). The empty type denotes availability.
+func ValidPresenceType(typ string) bool {
+	switch typ {
+	case "", "unavailable", "subscribe", "subscribed", "unsubscribe", "unsubscribed", "probe", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrInvalidShow is returned when trying to send a presence with a
+// show value other than those defined by RFC 6121.
+var ErrInvalidShow = errors.New("xmpp: invalid presence show value")
+
+// ErrInvalidPriority is returned when trying to send a presence with
+// a priority outside of the range -128 to 127.
+var ErrInvalidPriority = errors.New("xmpp: invalid presence priority")
+
+// Show is the availability sub-state of an available presence (RFC
+// 6121 4.7.2.1). The empty value means that the entity is simply
+// available and is omitted on the wire.
+type Show string
+
+const (
+	ShowAvailable Show = ""
+	ShowAway      Show = "away"
+	ShowChat      Show = "chat"
+	ShowDND       Show = "dnd"
+	ShowXA        Show = "xa"
+)
+
+// Valid reports whether s is one of the show values defined by RFC
+// 6121.
+func (s Show) Valid() bool {
+	switch s {
+	case ShowAvailable, ShowAway, ShowChat, ShowDND, ShowXA:
+		return true
+	default:
+		return false
+	}
+}
+
 type XEP interface {
 	Process(Stanza) ([]Stanza, error)
 }
 
 type XEPWrapper func(Client) (XEP, error)
 
-var SupportedMechanisms = []string{"PLAIN"}
 var errTypes = make(map[xml.Name]XMPPError)
 var xepWrappers = make(map[string]xepWrapper)
 
@@ -114,14 +196,28 @@ func RegisterXEP(name string, fn XEPWrapper, required ...string) {
 type Client interface {
 	io.Writer
 	Encode(interface{}) error
+	SendElement(v interface{}) error
+	SendRaw(s string) error
+	Flush() error
 	SendIQ(to, typ string, value interface{}) (chan *IQ, string)
+	SendIQWith(to, typ string, value interface{}, opts IQOptions) (chan *IQ, string)
 	SendIQReply(iq *IQ, typ string, value interface{})
 	SendPresence(p Presence) (cookie string, err error)
+	SendNotification(to, body string) error
+	SendPresenceTracked(p Presence, timeout time.Duration) (cookie string, errc <-chan error, err error)
 	SendError(inReplyTo Stanza, typ string, text string, errors ...XMPPError)
+	BounceMessage(orig *Message, condition string) error
 	NextStanza() (Stanza, error)
 	JID() string
+	From() string
+	NewID() string
 	Features() Features
 	Close()
+	State() State
+	Err() error
+	OnStateChange(fn func(old, new State))
+	Ready() <-chan struct{}
+	WaitReady(ctx context.Context) error
 
 	// RegisterXEP registers a XEP and all its dependencies, if
 	// required. It returns a XEP-wrapped connection and an error, if
@@ -134,41 +230,272 @@ type Client interface {
 	// MustGetXEP behaves like GetXEP but panics if the XEP hasn't
 	// been registered.
 	MustGetXEP(name string) XEP
-}
 
-func resolve(host string) ([]shared.Address, []error) {
-	return shared.ResolveFQDN(host, "xmpp-client")
+	// AddFilter adds a filter to the delivery of received stanzas.
+	AddFilter(f Filter)
+
+	// AddPresenceDecorator adds a function that modifies presences
+	// sent with SendPresence.
+	AddPresenceDecorator(d PresenceDecorator)
+
+	// HandleIQ registers a handler for IQ requests of a type and
+	// payload namespace.
+	HandleIQ(typ, space string, h IQHandler)
+
+	// DeliverIQ declares IQ requests of a type and payload namespace
+	// as answered by a XEP's Process method.
+	DeliverIQ(typ, space string)
+
+	// AddReconnectHandler adds a function that is called after the
+	// connection has been re-established with Reconnect.
+	AddReconnectHandler(h ReconnectHandler)
+
+	// AddCloseHandler adds a function that is called when the
+	// connection is closed gracefully with Close.
+	AddCloseHandler(h CloseHandler)
 }
 
-// TODO move out of client package?
-func findCompatibleMechanism(ours, theirs []string) string {
-	for _, our := range ours {
-		for _, their := range theirs {
-			if our == their {
-				return our
-			}
-		}
-	}
+// A Filter decides whether a received stanza will be delivered. If it
+// returns false, the stanza is dropped before it reaches NextStanza
+// and any XEPs. Filters are called from the goroutine reading from
+// the connection and must not block.
+type Filter func(Stanza) bool
+
+// A PresenceDecorator modifies a presence before it gets sent by
+// SendPresence, for example to attach extension elements that have
+// to be included in every presence.
+type PresenceDecorator func(*Presence)
 
-	return ""
+// A ReconnectHandler is called after the connection has been
+// re-established and bound by Reconnect. resumed reports whether the
+// stream management session has been resumed, in which case the
+// server kept our presence and room memberships. Otherwise, they
+// have to be restored.
+type ReconnectHandler func(resumed bool)
+
+// A CloseHandler is called by Close before the stream is closed, if
+// the connection is still established, so that final stanzas can be
+// sent. unavailable reports whether Close will broadcast unavailable
+// presence, in which case handlers should end presence of their own,
+// like directed presence.
+type CloseHandler func(unavailable bool)
+
+func resolve(host string) ([]shared.Address, []error) {
+	return shared.ResolveFQDN(host, "xmpp-client")
 }
 
 type Conn struct {
+	// Conn is the transport. The stream is read from it by the
+	// connection itself, and Read on Conn always fails; use Write,
+	// Encode or SendRaw to write to it, which serialize writes. Using
+	// the transport directly corrupts the stream.
 	net.Conn
+
+	// OmitFrom stops the connection from setting the 'from' attribute
+	// on stream headers and the stanzas it sends. Servers stamp the
+	// 'from' of stanzas regardless.
+	OmitFrom bool
+
+	// UserAgent identifies the client when authenticating via SASL2
+	// (XEP-0388).
+	UserAgent UserAgent
+
+	// StreamManagement enables XEP-0198 (Stream Management) if the
+	// server supports it, which allows resuming the session with
+	// Reconnect without losing stanzas.
+	StreamManagement bool
+
+	// AllowReconnect stops the connection from being closed when it
+	// is lost unexpectedly. Instead, it stays in StateDisconnected
+	// until it is re-established with Reconnect or given up on with
+	// Close.
+	AllowReconnect bool
+
+	// ReconnectOnConflict allows Reconnect after another client took
+	// over our resource. The new session is bound to a different,
+	// server-assigned resource. By default, Reconnect fails with
+	// ErrResourceConflict instead, so that clients sharing a resource
+	// don't keep taking it over from each other.
+	ReconnectOnConflict bool
+
+	// StrictUTF8 rejects streams that declare an encoding other than
+	// UTF-8, as mandated by RFC 6120. By default, a few legacy
+	// encodings are converted to UTF-8 for compatibility with
+	// non-compliant gateways.
+	StrictUTF8 bool
+
+	// MaxStanzaSize limits the size of received stanzas, in bytes. If
+	// the server sends a larger stanza, the stream is closed with a
+	// policy-violation error and ErrStanzaTooLarge. Zero means no
+	// limit.
+	MaxStanzaSize int64
+
+	// KeepRawXML makes received messages, presences and IQs carry
+	// the exact XML they were decoded from in their Raw field, for
+	// logging or forwarding them without re-encoding. It costs an
+	// additional copy of all received data.
+	KeepRawXML bool
+
+	// DeliverUnhandledIQs delivers IQ requests that no handler has
+	// been registered for via NextStanza. By default, they are
+	// answered with service-unavailable, as required by RFC 6120.
+	// XEPs register the IQs they answer with HandleIQ or, if they
+	// answer them in Process, with DeliverIQ. Applications answering
+	// IQs themselves should do the same, or set DeliverUnhandledIQs
+	// and take care of answering every request.
+	DeliverUnhandledIQs bool
+
+	// RootCAs, if not nil, replaces the system roots for verifying
+	// the server's certificate, for servers using a private CA.
+	RootCAs *x509.CertPool
+
+	// VerifyPeerCertificate, if set, is called during the TLS
+	// handshake after the server's certificate has been verified
+	// against the system roots, for additional checks like DANE. If
+	// it returns an error, the handshake fails with a
+	// CertificateError wrapping it. See also PinCertificate.
+	//
+	// If InsecureSkipTLSVerify is set, nothing has been verified and
+	// verifiedChains is nil; only rawCerts, as presented by the
+	// server, are available.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+	// InsecureSkipTLSVerify accepts any certificate the server
+	// presents, without verifying it against the system roots or
+	// matching it to the domain. It is meant for developing against
+	// servers with self-signed certificates and makes the connection
+	// vulnerable to man-in-the-middle attacks, which is why a warning
+	// is logged whenever it takes effect. Pinned certificates are
+	// still enforced, matched against the server's own certificate.
+	InsecureSkipTLSVerify bool
+
+	// OmitUnavailableOnClose stops Close from broadcasting
+	// unavailable presence before closing the stream. By default,
+	// contacts are told that we went offline right away, instead of
+	// when the server notices that the stream has been closed.
+	OmitUnavailableOnClose bool
+
+	// SendBuffer enables buffering up to that many stanzas sent while
+	// the connection isn't ready, that is while it is connecting,
+	// negotiating or lost and waiting for Reconnect. They are sent in
+	// order once the connection is bound again, and sending them
+	// reports success right away. SendBufferPolicy decides what
+	// happens when the buffer is full. Zero disables buffering, and
+	// stanzas sent while the connection isn't ready fail or break the
+	// stream, see Ready. Buffered stanzas are discarded by Close.
+	//
+	// IQ requests are never buffered: a session that couldn't be
+	// resumed fails all outstanding IQs, so their replies would never
+	// be delivered.
+	//
+	// Buffered stanzas are only sent once, but buffering doesn't make
+	// delivery more certain than it is otherwise. Stanzas written
+	// before the connection got lost are resent when stream
+	// management resumes the session, and reported by
+	// ResumeFailedError if it can't, in which case the application
+	// has to decide whether to send them again. Stanzas that aren't
+	// idempotent, like messages, may arrive twice when resent, since
+	// the server might have received them without getting to
+	// acknowledge them.
+	SendBuffer       int
+	SendBufferPolicy BufferPolicy
+
+	// Debug, if set, receives a log of the stream for
+	// troubleshooting: the raw XML that is sent and received, as
+	// well as the decoded value of every received stanza and of every
+	// value sent with Encode. Logging costs nothing if Debug is nil.
+	//
+	// Credentials are redacted: while authenticating with SASL,
+	// SASL2 or a FAST token, or performing a component handshake,
+	// the character data of all elements and the values of 'token'
+	// attributes are replaced with "[redacted]" in the raw XML, and
+	// values are logged by their type only. The rest of the stream
+	// is logged in full.
+	Debug io.Writer
+
 	extensions *extensions
 	mu         sync.Mutex
-	user       string
-	host       string
-	decoder    *xml.Decoder
-	encoder    *xml.Encoder
-	features   Features
-	password   string
-	cookie     <-chan string
-	cookieQuit chan<- struct{}
-	jid        string
-	callbacks  map[string]chan *IQ
-	closing    bool
-	stanzas    chan taggedStanza
+	// wmu serializes writes to the stream
+	wmu            sync.Mutex
+	user           string
+	host           string
+	decoder        *xml.Decoder
+	encoder        *xml.Encoder
+	features       Features
+	streamFeatures StreamFeatures
+	streamHeader   StreamHeader
+	password       string
+	cookie         <-chan string
+	cookieQuit     chan<- struct{}
+	jid            string
+	// addr, if set, is dialed instead of resolving host.
+	addr              string
+	anonymous         bool
+	fastToken         *FASTToken
+	callbacks         map[string]chan *IQ
+	bounces           map[string]chan error
+	closing           bool
+	stanzas           chan taggedStanza
+	filters           []Filter
+	decorators        []PresenceDecorator
+	handlers          map[iqRoute]IQHandler
+	reconnectHandlers []ReconnectHandler
+	closeHandlers     []CloseHandler
+	stanzaHandler     func(Stanza)
+	onDecodeError     func(DecodeError)
+	// pending holds stanzas emitted by XEPs that haven't been
+	// returned by NextStanza yet.
+	pendingMu sync.Mutex
+	pending   []taggedStanza
+	// available reports whether we broadcast available presence.
+	available bool
+	// done is closed by Close. The read loop may still be running
+	// at that point, so stanzas is never closed; sending on it has
+	// to give up once done is closed instead.
+	done chan struct{}
+	// lost holds the DisconnectError of a lost connection until
+	// NextStanza returns it. Unlike stanzas, it is buffered, so that
+	// the read loop can end without waiting for the application.
+	lost chan taggedStanza
+	// resumed reports whether the most recent setUp resumed a session.
+	resumed bool
+	// component is set for external component connections, which
+	// perform a handshake instead of negotiating stream features.
+	component bool
+	// conflict reports whether we lost the connection because
+	// another client took over our resource.
+	conflict bool
+	sm       smState
+	// readTotal is the number of bytes read from the connection,
+	// readLimit the number of bytes after which reading fails.
+	readTotal int64
+	readLimit int64
+	traffic   *traffic
+	raw       rawCapture
+	// pins are the SHA-256 hashes of pinned certificates.
+	pins [][sha256.Size]byte
+
+	// debugMu serializes writes to Debug, which happen from the
+	// read loop as well as from senders. It also protects the
+	// redaction state.
+	debugMu   sync.Mutex
+	redacting bool
+	redactors map[string]*redactor
+
+	metricsMu sync.RWMutex
+	metrics   Metrics
+
+	// sendBuffer holds the stanzas buffered for SendBuffer.
+	sendBuffer sendBuffer
+
+	stateMu       sync.Mutex
+	state         State
+	err           error
+	onStateChange func(old, new State)
+	// ready is closed once the connection is bound, changed on every
+	// state transition. Both are created on demand.
+	ready   chan struct{}
+	changed chan struct{}
 }
 
 type namedXEP struct {
@@ -273,11 +600,57 @@ func (c *Conn) MustGetXEP(name string) XEP {
 	return x
 }
 
+func (c *Conn) AddFilter(f Filter) {
+	c.mu.Lock()
+	c.filters = append(c.filters, f)
+	c.mu.Unlock()
+}
+
+func (c *Conn) AddReconnectHandler(h ReconnectHandler) {
+	c.mu.Lock()
+	c.reconnectHandlers = append(c.reconnectHandlers, h)
+	c.mu.Unlock()
+}
+
+func (c *Conn) AddCloseHandler(h CloseHandler) {
+	c.mu.Lock()
+	c.closeHandlers = append(c.closeHandlers, h)
+	c.mu.Unlock()
+}
+
+func (c *Conn) AddPresenceDecorator(d PresenceDecorator) {
+	c.mu.Lock()
+	c.decorators = append(c.decorators, d)
+	c.mu.Unlock()
+}
+
+// filter reports whether a stanza passes all filters.
+func (c *Conn) filter(s Stanza) bool {
+	c.mu.Lock()
+	filters := c.filters
+	c.mu.Unlock()
+
+	for _, f := range filters {
+		if !f(s) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func generateCookies(ch chan<- string, quit <-chan struct{}) {
+	// The random prefix makes IDs unique across connections, so that
+	// they can be used where global uniqueness is required, like
+	// origin-id (XEP-0359).
+	b := make([]byte, 8)
+	rand.Read(b)
+	prefix := hex.EncodeToString(b)
+
 	id := uint64(0)
 	for {
 		select {
-		case ch <- fmt.Sprintf("%d", id):
+		case ch <- fmt.Sprintf("%s-%d", prefix, id):
 			id++
 		case <-quit:
 			return
@@ -289,6 +662,12 @@ func (c *Conn) getCookie() string {
 	return <-c.cookie
 }
 
+// NewID returns a new unique ID, as used for stanzas sent by the
+// connection.
+func (c *Conn) NewID() string {
+	return c.getCookie()
+}
+
 // NewConn creates a new connection. After setting user name,
 // password, host and optionally more settings, Dial on the connection
 // can be used to establish a connection.
@@ -306,10 +685,35 @@ func NewConn() *Conn {
 		callbacks:  make(map[string]chan *IQ),
 		extensions: &extensions{m: make(map[string]XEP)},
 		stanzas:    make(chan taggedStanza),
+		done:       make(chan struct{}),
+		lost:       make(chan taggedStanza, 1),
+		traffic:    new(traffic),
 	}
 
 }
 
+// NewConnection creates a new connection that uses conn as its
+// transport. Dial on the returned connection will skip resolving and
+// dialing the host and directly start negotiating the stream over
+// conn. This is useful for connecting over custom transports and for
+// testing with in-memory connections such as those created by
+// net.Pipe.
+func NewConnection(conn net.Conn, user, host, password string) *Conn {
+	c := NewConn()
+	c.Conn = conn
+	c.user = user
+	c.host = host
+	c.password = password
+
+	return c
+}
+
+// SetPassword sets the password used when the connection is
+// established, for example after changing it.
+func (c *Conn) SetPassword(password string) {
+	c.password = password
+}
+
 // Dial uses the information in the connection (user name, password,
 // host) to connect to an XMPP server.
 //
@@ -320,16 +724,37 @@ func NewConn() *Conn {
 // options like the emitter, consider using the package-level function
 // Dial instead.
 func (c *Conn) Dial() []error {
+	return c.DialContext(context.Background())
+}
+
+// DialContext is like Dial but aborts once ctx is done, be it while
+// connecting or at any step of negotiating the stream. In that case,
+// the connection is torn down and ctx's error is returned.
+func (c *Conn) DialContext(ctx context.Context) []error {
 	var errors []error
+	var dialer net.Dialer
 
-	if c.Conn == nil {
+	c.setState(StateConnecting, nil)
+	if c.Conn == nil && c.addr != "" {
+		conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+		if err != nil {
+			err = ConnectError{err, "Could not connect"}
+			c.setState(StateDisconnected, err)
+			return []error{err}
+		}
+		c.Conn = conn
+	} else if c.Conn == nil {
 		var addrs []shared.Address
 		addrs, errors = resolve(c.host)
 		connected := false
 	connectLoop:
 		for _, addr := range addrs {
 			for _, ip := range addr.IPs {
-				conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: ip, Port: addr.Port})
+				if ctx.Err() != nil {
+					errors = append(errors, ctx.Err())
+					break connectLoop
+				}
+				conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)))
 				if err != nil {
 					errors = append(errors, ConnectError{err, "Could not connect"})
 					continue
@@ -342,16 +767,27 @@ func (c *Conn) Dial() []error {
 		}
 
 		if !connected {
+			var err error = ConnectError{ErrNoAddresses, "Could not connect"}
+			if len(errors) > 0 {
+				err = errors[len(errors)-1]
+			}
+			c.setState(StateDisconnected, err)
 			return errors
 		}
 	}
 
-	err := c.setUp()
+	c.countTraffic()
+	err := c.setUpContext(ctx)
+	if err, ok := err.(ResumeFailedError); ok {
+		// Not fatal, the connection has been established.
+		return []error{err}
+	}
 	if err != nil {
 		errors = append(errors, err)
 		// FIXME consider sending a </stream> to cleanly terminate the
 		// connection
 		c.Conn.Close()
+		c.setState(StateDisconnected, err)
 		return errors
 	}
 
@@ -373,9 +809,53 @@ func Dial(user, host, password string) (client Client, errors []error) {
 	return c, errors
 }
 
-func (c *Conn) initializeXMLCoders() {
-	c.decoder = xml.NewDecoder(c)
-	c.encoder = xml.NewEncoder(c)
+// DialContext is like Dial but aborts connecting once ctx is done.
+func DialContext(ctx context.Context, user, host, password string) (client Client, errors []error) {
+	c := NewConn()
+	c.host = host
+	c.user = user
+	c.password = password
+
+	errors = c.DialContext(ctx)
+	return c, errors
+}
+
+// DialDirect is like Dial but connects to host and port directly
+// instead of resolving the SRV records of domain. domain is still
+// used as the JID's domain, in the stream header and for verifying
+// the TLS certificate. This is useful for development servers and
+// servers without DNS records.
+//
+// host may be an IPv6 literal, with or without brackets. If port is
+// zero, host has to include the port, as in "[::1]:5222".
+func DialDirect(user, domain, host string, port int, password string) (client Client, errors []error) {
+	c := NewConn()
+	c.host = domain
+	if port == 0 {
+		c.addr = host
+	} else {
+		c.addr = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+	}
+	c.user = user
+	c.password = password
+
+	errors = c.Dial()
+	return c, errors
+}
+
+// DialAnonymous connects to an XMPP server and authenticates using
+// SASL ANONYMOUS. The server will assign a temporary JID, which can
+// be retrieved with JID once DialAnonymous returns.
+//
+// If the server doesn't offer anonymous authentication,
+// ErrAnonymousUnsupported will be among the returned errors.
+func DialAnonymous(host string) (client Client, errors []error) {
+	c := NewConn()
+	c.host = host
+	c.anonymous = true
+
+	errors = c.Dial()
+	return c, errors
 }
 
 // TODO document that/where we return a ConnectError
@@ -388,47 +868,151 @@ func (e ConnectError) Error() string {
 	return fmt.Sprintf("%s: %s", e.label, e.UnderlyingError.Error())
 }
 
-func (c *Conn) setUp() error {
-	var err error
+func (e ConnectError) Unwrap() error {
+	return e.UnderlyingError
+}
 
-	c.initializeXMLCoders()
-	for {
-		err = c.openStream()
-		if err != nil {
-			return ConnectError{err, "Error while opening stream"}
-		}
+// setUpContext runs setUp, aborting it once ctx is done by making
+// all pending reads and writes on the connection fail.
+func (c *Conn) setUpContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		return c.setUp(ctx)
+	}
 
-		err = c.receiveStream()
-		if err != nil {
-			return ConnectError{err, "Error receiving stream"}
+	conn := c.Conn
+	stop := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// The connection will be closed by our caller.
+			conn.SetDeadline(time.Unix(1, 0))
+			aborted <- true
+		case <-stop:
+			aborted <- false
 		}
+	}()
 
-		err = c.parseFeatures()
-		if err != nil {
-			return ConnectError{err, "Error parsing stream features"}
-		}
+	err := c.setUp(ctx)
+	close(stop)
+	if <-aborted {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (c *Conn) setUp(ctx context.Context) error {
+	var err error
+	var bound bool
 
-		if c.features.Includes("starttls") {
+	c.resumed = false
+	if c.component {
+		return c.setUpComponent()
+	}
+
+	if err := c.restartStream(); err != nil {
+		return err
+	}
+
+	// Features are negotiated in the order mandated by RFC 6120:
+	// TLS, then authentication, then binding. Each step restarts the
+	// stream, so the next one is chosen based on the features offered
+	// after the restart. Features of earlier steps that are offered
+	// again are ignored. Stream compression, which may be offered
+	// after TLS, is optional and not supported. Unknown features that
+	// the server requires make us give up, while the legacy session
+	// is established after binding if it is required.
+	var secured, authenticated bool
+negotiation:
+	for {
+		sf := c.streamFeatures
+		switch {
+		case !secured && !authenticated && sf.StartTLS != nil:
 			err = c.startTLS()
 			if err != nil {
 				return ConnectError{err, "Error establishing TLS connection"}
 			}
-			continue
-		}
-
-		if c.features.Requires("sasl") {
+			secured = true
+		case !authenticated && sf.SASL2 != nil && sf.SASL2.Bind:
+			// SASL2 doesn't restart the stream, so we only use it if
+			// we can bind inline and don't depend on
+			// post-authentication features.
+			err = c.sasl2()
+			if err != nil {
+				return ConnectError{err, "Error during SASL2"}
+			}
+			c.setState(StateAuthenticated, nil)
+			bound = true
+			break negotiation
+		case !authenticated && sf.Mechanisms != nil:
 			err = c.sasl()
 			if err != nil {
 				return ConnectError{err, "Error during SASL"}
 			}
-			continue
+			c.setState(StateAuthenticated, nil)
+			authenticated = true
+		case !authenticated:
+			return ConnectError{ErrNoAuthentication, "Error during SASL"}
+		default:
+			break negotiation
+		}
+
+		if err := c.restartStream(); err != nil {
+			return err
+		}
+	}
+
+	if unsupported := c.streamFeatures.RequiredUnknown; len(unsupported) > 0 {
+		return ConnectError{UnsupportedFeatureError{unsupported[0]}, "Error negotiating stream features"}
+	}
+
+	var lost []interface{}
+	if !bound && c.resumable() && c.streamFeatures.StreamManagement {
+		resumed, unacked, err := c.resume()
+		if err != nil {
+			return ConnectError{err, "Error resuming session"}
+		}
+		if resumed {
+			c.resumed = true
+			go c.read()
+			c.setState(StateBound, nil)
+			return nil
 		}
-		break
+		lost = unacked
+	} else {
+		// TODO support resumption inline with SASL2
+		lost = c.dropSM()
+	}
+	// IQs sent in the previous session will never be answered, and
+	// the server forgot our presence.
+	c.mu.Lock()
+	c.failCallbacks()
+	c.available = false
+	c.mu.Unlock()
+
+	if !bound && !c.streamFeatures.Bind {
+		return ConnectError{ErrNoBinding, "Error binding resource"}
 	}
 
 	go c.read()
-	c.bind() // TODO handle error
+	if !bound {
+		if err := c.bind(ctx); err != nil {
+			return ConnectError{err, "Error binding resource"}
+		}
+		if sf := c.StreamFeatures(); sf.Session != nil && sf.Session.Required() {
+			if err := c.establishSession(ctx); err != nil {
+				return ConnectError{err, "Error establishing session"}
+			}
+		}
+	}
+	if c.StreamManagement && c.StreamFeatures().StreamManagement {
+		c.enableSM()
+	}
+	c.setState(StateBound, nil)
 
+	if len(lost) > 0 {
+		return ResumeFailedError{lost}
+	}
 	return nil
 }
 
@@ -461,6 +1045,9 @@ type Message struct {
 	Error   *Error `xml:"error,omitempty"`
 	Thread  string `xml:"thread,omitempty"`
 	Inner   []byte `xml:",innerxml"`
+	// Raw is the XML the message was decoded from, if KeepRawXML is
+	// set.
+	Raw []byte `xml:"-"`
 }
 
 type Text struct {
@@ -474,23 +1061,46 @@ type Presence struct {
 
 	Lang string `xml:"lang,attr,omitempty"`
 
-	Show     string `xml:"show,omitempty"`
+	Show     Show   `xml:"show,omitempty"`
 	Status   string `xml:"status,omitempty"`
 	Priority int    `xml:"priority,omitempty"`
 	Error    *Error `xml:"error,omitempty"`
 	Inner    []byte `xml:",innerxml"`
+	// Raw is the XML the presence was decoded from, if KeepRawXML is
+	// set.
+	Raw []byte `xml:"-"`
 }
 
 func (p Presence) IsError() bool {
 	return p.Error != nil
 }
 
-type sendIQ struct { // info/query
+// Validate checks the type, show value and priority of a presence
+// that is about to be sent.
+func (p Presence) Validate() error {
+	if !ValidPresenceType(p.Type) {
+		return ErrInvalidType
+	}
+	if !p.Show.Valid() {
+		return ErrInvalidShow
+	}
+	if p.Priority < -128 || p.Priority > 127 {
+		return ErrInvalidPriority
+	}
+	return nil
+}
+
+// outgoingIQ is the representation of IQs that we send. Unlike IQ,
+// which is used for decoding, it holds its payload as an arbitrary
+// value that will be marshaled as the IQ's child element. The payload
+// should have an XMLName field, otherwise it will be named Payload.
+type outgoingIQ struct { // info/query
 	XMLName xml.Name `xml:"jabber:client iq"`
 	Header
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 
-	Error *Error `xml:"error"`
-	Inner interface{}
+	Error   *Error      `xml:"error,omitempty"`
+	Payload interface{} `xml:",omitempty"`
 }
 
 type IQ struct { // info/query
@@ -500,6 +1110,8 @@ type IQ struct { // info/query
 	Error *Error   `xml:"error"`
 	Query xml.Name `xml:"query"`
 	Inner []byte   `xml:",innerxml"`
+	// Raw is the XML the IQ was decoded from, if KeepRawXML is set.
+	Raw []byte `xml:"-"`
 }
 
 func (iq IQ) IsError() bool {
@@ -527,7 +1139,10 @@ func (x *XMPPErrors) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error
 }
 
 type Error struct {
-	XMLName xml.Name   `xml:"jabber:client error"`
+	// The namespace isn't restricted, so that errors in the
+	// jabber:component:accept namespace are decoded, too. Errors are
+	// always sent as part of a stanza, whose namespace they inherit.
+	XMLName xml.Name   `xml:"error"`
 	Type    string     `xml:"type,attr"`
 	Text    string     `xml:"urn:ietf:params:xml:ns:xmpp-streams text,omitempty"` // TODO xml:lang
 	Errors  XMPPErrors `xml:",any"`
@@ -543,72 +1158,376 @@ func (err Error) Error() string {
 	return b.String()
 }
 
-// FIXME seriously reconsider the choice of making streamError a
-// stanza. It's unlike any other.
-type streamError struct {
+// StreamError is a stream error (RFC 6120 4.9) sent by the server.
+// Stream errors are unrecoverable, the server will close the stream
+// after sending one.
+type StreamError struct {
 	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
 	Any     xml.Name `xml:",any"`
-	Text    string   `xml:"text"`
+	Text    string   `xml:"urn:ietf:params:xml:ns:xmpp-streams text"`
 }
 
-func (e streamError) Error() string {
+func (e StreamError) Error() string {
 	return fmt.Sprintf("Stream error: <%s> %s", e.Any.Local, e.Text)
 }
 
+// Condition returns the defined condition of the error, such as
+// "conflict" or "system-shutdown".
+func (e StreamError) Condition() string {
+	return e.Any.Local
+}
+
+// errEndOfStream is returned by nextStartElement when the other side
+// closed the stream.
+var errEndOfStream = errors.New("xmpp: end of stream")
+
+// DisconnectError describes why we lost the connection to the server.
+type DisconnectError struct {
+	// StreamError is the stream error that the server sent before
+	// closing the stream, if any.
+	StreamError *StreamError
+	// Clean reports whether the server closed the stream, as opposed
+	// to the underlying connection breaking down.
+	Clean bool
+	// Err is the error that occured while reading from the
+	// connection, if the disconnect wasn't clean.
+	Err error
+}
+
+func (e DisconnectError) Error() string {
+	switch {
+	case e.StreamError != nil:
+		return "Server closed the stream: " + e.StreamError.Error()
+	case e.Clean:
+		return "Server closed the stream"
+	default:
+		return "Connection lost: " + e.Err.Error()
+	}
+}
+
+// Reconnect reports whether it makes sense to reconnect and whether
+// to wait before doing so. For example, a server that is shutting
+// down warrants reconnecting after a delay, while a conflict means
+// that another client took over our resource and that we must not
+// fight for it by reconnecting.
+func (e DisconnectError) Reconnect() (reconnect bool, delay bool) {
+	if e.StreamError != nil {
+		switch e.StreamError.Condition() {
+		case "system-shutdown", "reset", "connection-timeout":
+			return true, true
+		case "see-other-host", "internal-server-error", "remote-connection-failed":
+			return true, false
+		default:
+			// This includes conflict, policy violations and
+			// authentication problems, which won't go away by
+			// reconnecting.
+			return false, false
+		}
+	}
+
+	if e.Clean {
+		return true, true
+	}
+
+	return true, false
+}
+
+// Is reports whether the disconnect was caused by another client
+// taking over our resource, if target is ErrResourceConflict.
+func (e DisconnectError) Is(target error) bool {
+	return target == ErrResourceConflict && e.conflict()
+}
+
+func (e DisconnectError) conflict() bool {
+	return e.StreamError != nil && e.StreamError.Condition() == "conflict"
+}
+
 func (c *Conn) JID() string {
 	return c.jid
 }
 
 func (c *Conn) Encode(v interface{}) error {
-	return c.encoder.Encode(v)
+	if ok, err := c.buffer(v); ok {
+		return err
+	}
+	return c.encode(v)
+}
+
+// encode is Encode without buffering.
+func (c *Conn) encode(v interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.debugValue("SEND", v)
+	var err error
+	if c.component {
+		err = c.encodeComponent(v)
+	} else {
+		err = c.encoder.Encode(v)
+	}
+	if kind := stanzaKind(v); kind != "" && err == nil {
+		c.countOutbound(v)
+		c.m().StanzaSent(kind)
+	}
+	return err
+}
+
+// Flush writes any buffered data to the connection. Encode and the
+// methods built on it flush before returning, so that a stanza has
+// been handed to the connection once they return. Flush is only
+// needed after writing to the connection's encoder by other means.
+func (c *Conn) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.encoder.Flush()
+}
+
+// SendElement marshals v and sends it over the stream. v can be any
+// value that can be marshaled by encoding/xml. Unlike writing to the
+// connection directly, it is safe to call SendElement concurrently
+// with other methods that send data.
+func (c *Conn) SendElement(v interface{}) error {
+	return c.Encode(v)
+}
+
+// SendRaw sends raw XML over the stream. It is meant as an escape
+// hatch for XML that cannot be expressed with the typed API.
+//
+// s must consist of complete, well-formed elements, otherwise it will
+// be rejected instead of corrupting the stream. Namespaces have to be
+// declared explicitly, the stream's default namespace doesn't apply.
+func (c *Conn) SendRaw(s string) error {
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.InputOffset() != int64(len(s)) {
+		return errors.New("xmpp: raw XML contains trailing data")
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.encoder.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(transport{c}, s)
+	return err
+}
+
+// ErrDirectRead is returned by Read. The stream is only read by the
+// connection itself.
+var ErrDirectRead = errors.New("xmpp: reading from the connection directly is not allowed")
+
+// Read always fails with ErrDirectRead, as reading from the transport
+// would take data away from the connection's decoder. Received
+// stanzas are available via NextStanza.
+func (c *Conn) Read(b []byte) (int, error) {
+	return 0, ErrDirectRead
+}
+
+// Write writes raw data to the stream, serialized with all other
+// writes. Unlike SendRaw, it doesn't check the data, which may be
+// split across several calls, for example by an xml.Encoder, but each
+// call has to end at an element boundary, as other writes may follow.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.encoder != nil {
+		if err := c.encoder.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return transport{c}.Write(b)
+}
+
+// LocalAddr returns the local address of the transport, or nil if
+// there is none.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the server, or nil if there is
+// no transport.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ConnectionState returns the state of the TLS connection, and false
+// if the stream isn't encrypted with TLS.
+func (c *Conn) ConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
 }
 
 type notWellFormed struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-streams not-well-formed"`
 }
 
+type policyViolation struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-streams policy-violation"`
+}
+
 type invalidNamespace struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-streams invalid-namespace"`
 }
 
 func (c *Conn) sendStreamError(e interface{}) {
-	err := c.encoder.EncodeElement(e, xml.StartElement{
-		Name: xml.Name{
-			Local: "error",
-			Space: nsStream,
-		},
-	})
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// The condition has to be a child of the error element, passing
+	// it to EncodeElement would merely rename it.
+	//
+	// Errors are ignored, the stream is going away either way.
+	c.encoder.Encode(struct {
+		XMLName   xml.Name `xml:"http://etherx.jabber.org/streams error"`
+		Condition interface{}
+	}{Condition: e})
+}
+
+// disconnected handles the end of the stream, be it because the
+// server closed it or because of an error.
+func (c *Conn) disconnected(err error, streamErr *StreamError) {
+	if c.isClosing() {
+		// We initiated the close and this is the server's response
+		// (or the connection going away while waiting for it).
+		c.Close()
+		return
+	}
 
-	if err != nil {
-		panic("Internal error sending stream error: " + err.Error())
+	reason := DisconnectError{StreamError: streamErr}
+	if err == errEndOfStream {
+		reason.Clean = true
+	} else {
+		reason.Err = err
+		if err == ErrStanzaTooLarge {
+			c.sendStreamError(policyViolation{})
+		} else if err, ok := err.(*xml.SyntaxError); ok && err.Msg != "unexpected EOF" {
+			// The server sent malformed XML, as opposed to the
+			// connection breaking down mid-stream.
+			c.sendStreamError(notWellFormed{})
+		}
 	}
+
+	if reason.conflict() {
+		// The session belongs to the other client now and can't
+		// be resumed.
+		c.sm.mu.Lock()
+		c.sm.resume = false
+		c.sm.mu.Unlock()
+		c.mu.Lock()
+		c.conflict = true
+		c.mu.Unlock()
+	}
+
+	if c.AllowReconnect {
+		if !c.resumable() {
+			// Replies to IQs will only arrive if the session can
+			// be resumed.
+			c.mu.Lock()
+			c.failCallbacks()
+			c.mu.Unlock()
+		}
+
+		c.Conn.Close()
+		c.setState(StateDisconnected, reason)
+		c.reportLost(reason)
+		return
+	}
+
+	c.setState(StateDisconnected, reason)
+	c.reportLost(reason)
+	c.Close()
+}
+
+// reportLost makes NextStanza return reason once it has returned the
+// stanzas read before. It doesn't wait for NextStanza to be called:
+// applications that only watch the state mustn't keep the read loop
+// from ending. An earlier error that hasn't been returned yet is
+// replaced.
+func (c *Conn) reportLost(reason DisconnectError) {
+	if c.stanzaHandler != nil {
+		return
+	}
+	select {
+	case <-c.lost:
+	default:
+	}
+	c.lost <- taggedStanza{err: reason}
+}
+
+// failCallbacks unblocks everyone waiting for the reply to an IQ.
+// The caller must hold mu.
+func (c *Conn) failCallbacks() {
+	for _, ch := range c.callbacks {
+		close(ch)
+	}
+	c.callbacks = make(map[string]chan *IQ)
+	c.m().OutstandingIQs(0)
+	c.failBounces()
+}
+
+func (c *Conn) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
 }
 
 func (c *Conn) read() {
+	var streamErr *StreamError
 	for {
+		c.limitStanza()
 		t, err := c.nextStartElement()
 
 		if err != nil {
-			if err != io.EOF {
-				c.sendStreamError(notWellFormed{})
-				c.stanzas <- taggedStanza{err: err}
-			}
-
-			c.Close()
+			c.disconnected(err, streamErr)
 			return
 		}
 
+		if c.component && t.Name.Space == nsComponent {
+			// Our stanza types are declared in the jabber:client
+			// namespace, which is equivalent.
+			t.Name.Space = nsClient
+		}
+
 		var nv Stanza
 		switch t.Name.Space + " " + t.Name.Local {
 		case nsStream + " error":
-			streamErr := &streamError{}
-			err := c.decoder.DecodeElement(err, t)
+			// Remember the error and wait for the server to close
+			// the stream, which it has to do after sending a stream
+			// error.
+			streamErr = &StreamError{}
+			err := c.decoder.DecodeElement(streamErr, t)
 			if err != nil {
-				panic("Internal error: Could not unmarshal XML: " + err.Error())
+				c.disconnected(err, nil)
+				return
 			}
-			c.stanzas <- taggedStanza{err: streamErr}
-			c.Close()
-			return
+			continue
+		case nsStream + " features":
+			if err := c.readvertised(t); err != nil {
+				c.disconnected(err, streamErr)
+				return
+			}
+			continue
+		case nsSM + " enabled", nsSM + " failed", nsSM + " r", nsSM + " a":
+			if err := c.handleSM(t); err != nil {
+				c.disconnected(err, streamErr)
+				return
+			}
+			continue
 		case nsClient + " message":
 			nv = &Message{}
 		case nsClient + " presence":
@@ -616,14 +1535,31 @@ func (c *Conn) read() {
 		case nsClient + " iq":
 			nv = &IQ{}
 		default:
-			fmt.Println(t.Name.Local)
 			// TODO handle error
+			if err := c.decoder.Skip(); err != nil {
+				c.disconnected(err, streamErr)
+				return
+			}
+			continue
 		}
 
 		// Unmarshal into that storage.
-		err = c.decoder.DecodeElement(nv, t)
+		ok, err := c.decodeStanza(nv, t)
 		if err != nil {
-			panic("Internal error: Could not unmarshal XML: " + err.Error())
+			c.disconnected(err, streamErr)
+			return
+		}
+		// Stanzas that failed to decode still count as handled for
+		// stream management.
+		c.countInbound()
+		if !ok {
+			continue
+		}
+		c.attachRaw(nv)
+		c.debugValue("RECV", nv)
+		c.m().StanzaReceived(t.Name.Local)
+		if p, ok := nv.(*Presence); ok {
+			c.checkBounce(p)
 		}
 		// TODO what about message and presence? They can return
 		// errors, too, but they don't have any ID associated with
@@ -634,24 +1570,52 @@ func (c *Conn) read() {
 			if ch, ok := c.callbacks[nv.ID()]; ok {
 				ch <- iq
 				delete(c.callbacks, nv.ID())
+				c.m().OutstandingIQs(len(c.callbacks))
 			}
 			c.mu.Unlock()
-		} else {
-			c.stanzas <- taggedStanza{stanza: nv}
+		} else if c.filter(nv) {
+			if iq, ok := nv.(*IQ); ok && c.routeIQ(iq) {
+				continue
+			}
+			if c.stanzaHandler != nil {
+				c.handleStanza(taggedStanza{stanza: nv})
+				continue
+			}
+			c.deliver(taggedStanza{stanza: nv})
 		}
 	}
 }
 
-func (c *Conn) bind() {
+// deliver hands a stanza to NextStanza, unless the connection gets
+// closed first.
+func (c *Conn) deliver(stanza taggedStanza) {
+	select {
+	case c.stanzas <- stanza:
+	case <-c.done:
+	}
+}
+
+func (c *Conn) bind(ctx context.Context) error {
 	// TODO support binding to a user-specified resource
-	// TODO handle error cases
 
 	ch, _ := c.SendIQ("", "set", struct {
 		XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
 	}{})
-	response := <-ch
+	var response *IQ
+	select {
+	case response = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	if response == nil {
-		return
+		return ErrClosed
+	}
+	if response.IsError() {
+		err := BindError{Err: response.Error}
+		if response.Error != nil && len(response.Error.Errors) > 0 {
+			err.Condition = response.Error.Errors[0].Name().Local
+		}
+		return err
 	}
 
 	var bind struct {
@@ -660,19 +1624,88 @@ func (c *Conn) bind() {
 		JID      string   `xml:"jid"`
 	}
 
-	xml.Unmarshal(response.Inner, &bind)
+	if err := xml.Unmarshal(response.Inner, &bind); err != nil {
+		return err
+	}
+	if bind.JID == "" {
+		return errors.New("xmpp: server didn't return the bound JID")
+	}
 	c.jid = bind.JID
+	return nil
+}
+
+// establishSession establishes a session as defined by RFC 3921,
+// which servers predating RFC 6120 require after binding a resource.
+func (c *Conn) establishSession(ctx context.Context) error {
+	ch, _ := c.SendIQ(c.host, "set", struct {
+		XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	}{})
+	var response *IQ
+	select {
+	case response = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if response == nil {
+		return ErrClosed
+	}
+	if response.IsError() {
+		return response.Error
+	}
+	return nil
+}
+
+// BindError is returned when the server refuses to bind a resource
+// (RFC 6120 7.6.2). Condition is the defined condition of the error,
+// usually "bad-request", "conflict" if the resource is in use and
+// can't be replaced, or "not-allowed" if no more resources may be
+// bound.
+type BindError struct {
+	Condition string
+	Err       *Error
+}
+
+func (e BindError) Error() string {
+	return "xmpp: failed to bind resource: " + e.Condition
 }
 
 func (c *Conn) reset() {
-	c.decoder = xml.NewDecoder(c.Conn)
-	c.features = nil
+	c.decoder = c.newDecoder()
+	c.resetRaw()
+	// The new stream will be opened with a fresh encoder, so that
+	// closing it doesn't have to account for previous stream headers.
+	c.encoder = xml.NewEncoder(transport{c})
+	c.setFeatures(StreamFeatures{})
+}
+
+// restartStream opens a new stream over the current transport, as
+// required at the start of the connection and after negotiating TLS
+// or authenticating. The stream features offered by the server are
+// available in streamFeatures afterwards.
+func (c *Conn) restartStream() error {
+	c.reset()
+
+	if err := c.openStream(); err != nil {
+		return ConnectError{err, "Error while opening stream"}
+	}
+	if err := c.receiveStream(); err != nil {
+		return ConnectError{err, "Error receiving stream"}
+	}
+	if err := c.parseFeatures(); err != nil {
+		return ConnectError{err, "Error parsing stream features"}
+	}
+	return nil
 }
 
-func (c *Conn) sasl() error {
-	payload := fmt.Sprintf("\x00%s\x00%s", c.user, c.password)
-	payloadb64 := base64.StdEncoding.EncodeToString([]byte(payload))
-	_, err := fmt.Fprintf(c, "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>%s</auth>", payloadb64)
+// ErrTLSFailure is returned when the server answers our STARTTLS
+// request with <failure/>. The server closes the stream afterwards
+// (RFC 6120 5.4.2.2).
+var ErrTLSFailure = errors.New("xmpp: server failed to negotiate TLS")
+
+func (c *Conn) startTLS() error {
+	err := c.Encode(struct {
+		XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	}{})
 	if err != nil {
 		return err
 	}
@@ -680,48 +1713,65 @@ func (c *Conn) sasl() error {
 	if err != nil {
 		return err
 	}
-	if t.Name.Local == "success" {
-		c.reset()
-	} else {
-		// TODO handle the error case
+	switch {
+	case t.Name.Space == nsTLS && t.Name.Local == "failure":
+		return ErrTLSFailure
+	case t.Name.Space != nsTLS || t.Name.Local != "proceed":
+		return UnexpectedMessage{t.Name.Local}
 	}
 
-	return nil
-	// TODO actually determine which mechanism we can use, use interfaces etc to call it
-}
-
-func (c *Conn) startTLS() error {
-	fmt.Fprint(c, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
-	t, _ := c.nextStartElement() // FIXME error handling
-	if t.Name.Local != "proceed" {
-		// TODO handle this. this should be <failure>, and the server
-		// will close the connection on us.
+	// The certificate has to match the XMPP domain, not the host we
+	// connected to, which may be an IP address.
+	tlsConn := tls.Client(c.Conn, &tls.Config{
+		ServerName:            c.host,
+		RootCAs:               c.RootCAs,
+		VerifyPeerCertificate: c.verifyPeer,
+		InsecureSkipVerify:    c.InsecureSkipTLSVerify,
+	})
+	if c.InsecureSkipTLSVerify {
+		log.Printf("xmpp: not verifying the TLS certificate of %s, because InsecureSkipTLSVerify is set", c.host)
 	}
-
-	tlsConn := tls.Client(c.Conn, nil)
 	if err := tlsConn.Handshake(); err != nil {
+		if verificationFailed(err) {
+			return CertificateError{err}
+		}
 		return err
 	}
+	if c.InsecureSkipTLSVerify {
+		c.Conn = tlsConn
+		return nil
+	}
 
 	tlsState := tlsConn.ConnectionState()
 	if len(tlsState.VerifiedChains) == 0 {
-		return errors.New("xmpp: failed to verify TLS certificate") // FIXME
+		return CertificateError{errors.New("failed to verify TLS certificate")}
 	}
 
 	if err := tlsConn.VerifyHostname(c.host); err != nil {
-		return errors.New("xmpp: failed to match TLS certificate to name: " + err.Error()) // FIXME
+		return CertificateError{errors.New("failed to match TLS certificate to name: " + err.Error())}
 	}
 
 	c.Conn = tlsConn
-	c.reset()
 
 	return nil
 }
 
+// verificationFailed reports whether a TLS handshake failed because
+// the certificate couldn't be verified.
+func verificationFailed(err error) bool {
+	var (
+		unknown  x509.UnknownAuthorityError
+		hostname x509.HostnameError
+		invalid  x509.CertificateInvalidError
+	)
+	return errors.As(err, &unknown) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
 // TODO Move this outside of client. This function will be used by
 // servers, too.
 func (c *Conn) nextStartElement() (*xml.StartElement, error) {
 	for {
+		c.markRaw()
 		t, err := c.decoder.Token()
 		if err != nil {
 			return nil, err
@@ -732,7 +1782,7 @@ func (c *Conn) nextStartElement() (*xml.StartElement, error) {
 			return &t, nil
 		case xml.EndElement:
 			if t.Name.Local == "stream" && t.Name.Space == nsStream {
-				return nil, io.EOF
+				return nil, errEndOfStream
 			}
 		}
 	}
@@ -750,15 +1800,35 @@ func (e UnexpectedMessage) Error() string {
 	return e.Name
 }
 
+// From returns the value to use for the 'from' attribute of stanzas
+// we send. It is empty before resource binding and if OmitFrom is
+// set, in which case the attribute should be omitted.
+func (c *Conn) From() string {
+	if c.OmitFrom {
+		return ""
+	}
+
+	return c.jid
+}
+
 func (c *Conn) openStream() error {
-	// TODO consider not including the JID if the connection isn't encrypted yet
 	// TODO configurable xml:lang
 
-	_, err := fmt.Fprint(c, xml.Header)
+	_, err := fmt.Fprint(transport{c}, xml.Header)
 	if err != nil {
 		return err
 	}
 
+	var attrs []xml.Attr
+	// RFC 6120 4.7.1: The client should only include its JID once the
+	// stream is protected by TLS.
+	if _, secure := c.Conn.(*tls.Conn); secure && !c.OmitFrom && c.user != "" {
+		attrs = append(attrs, xml.Attr{
+			Name:  xml.Name{Local: "from"},
+			Value: c.user + "@" + c.host,
+		})
+	}
+
 	err = c.encoder.EncodeToken(xml.StartElement{
 		// Note that unlike many other implementations, we do not set
 		// xmlns to jabber:client. Instead, all tags in the
@@ -767,11 +1837,7 @@ func (c *Conn) openStream() error {
 			Local: "stream",
 			Space: nsStream,
 		},
-		Attr: []xml.Attr{
-			xml.Attr{
-				Name:  xml.Name{Local: "from"},
-				Value: c.user + "@" + c.host,
-			},
+		Attr: append(attrs,
 			xml.Attr{
 				Name:  xml.Name{Local: "to"},
 				Value: c.host,
@@ -787,10 +1853,15 @@ func (c *Conn) openStream() error {
 				},
 				Value: "en",
 			},
-		},
+		),
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	// EncodeToken doesn't flush on its own, but we need the stream
+	// header to go out before waiting for the server's.
+	return c.encoder.Flush()
 }
 
 type UnsupportedVersion struct {
@@ -801,6 +1872,23 @@ func (e UnsupportedVersion) Error() string {
 	return "Unsupported XMPP version: " + e.Version
 }
 
+// StreamHeader holds the attributes of the stream header sent by the
+// server.
+type StreamHeader struct {
+	// ID is the stream ID assigned by the server.
+	ID      string
+	From    string
+	To      string
+	Version string
+	Lang    string
+}
+
+// StreamHeader returns the attributes of the server's stream header
+// from the most recent stream restart.
+func (c *Conn) StreamHeader() StreamHeader {
+	return c.streamHeader
+}
+
 func (c *Conn) receiveStream() error {
 	t, err := c.nextStartElement() // TODO error handling
 	if err != nil {
@@ -818,15 +1906,33 @@ func (c *Conn) receiveStream() error {
 		return nil // FIXME do we need to skip over any tokens here?
 	}
 
-	var version string
+	var header StreamHeader
 	for _, attr := range t.Attr {
-		switch attr.Name.Local {
-		// TODO consider storing all attributes in a Stream struct
-		case "version":
-			version = attr.Value
+		switch attr.Name.Space {
+		case "":
+			switch attr.Name.Local {
+			case "id":
+				header.ID = attr.Value
+			case "from":
+				header.From = attr.Value
+			case "to":
+				header.To = attr.Value
+			case "version":
+				header.Version = attr.Value
+			}
+		case "xml", "http://www.w3.org/XML/1998/namespace":
+			if attr.Name.Local == "lang" {
+				header.Lang = attr.Value
+			}
 		}
 	}
+	c.streamHeader = header
+	if c.component {
+		// Component streams don't have a version.
+		return nil
+	}
 
+	version := header.Version
 	if version == "" {
 		return UnsupportedVersion{"0.9"}
 	}
@@ -839,22 +1945,41 @@ func (c *Conn) receiveStream() error {
 	return nil
 }
 
+// Close closes the stream. Everyone waiting for the reply to an IQ is
+// unblocked by closing the reply channel, and IQs sent afterwards fail
+// the same way.
 func (c *Conn) Close() {
+	c.mu.Lock()
 	if c.closing {
+		c.mu.Unlock()
 		// Terminate TCP connection
 		c.Conn.Close()
 		return
 	}
 
-	c.mu.Lock()
-	for _, ch := range c.callbacks {
-		close(ch)
-	}
+	c.failCallbacks()
+	c.closing = true
+	close(c.done)
+	handlers := c.closeHandlers
+	unavailable := c.available && !c.OmitUnavailableOnClose
+	c.available = false
 	c.mu.Unlock()
 
-	fmt.Fprint(c, "</stream:stream>")
-	c.closing = true
-	close(c.stanzas)
+	// Only say goodbye if the connection is intact, not when closing
+	// after an error.
+	if c.State() == StateBound {
+		for _, h := range handlers {
+			h(unavailable)
+		}
+		if unavailable {
+			c.Encode(Presence{Header: Header{Type: "unavailable"}})
+		}
+	}
+
+	c.dropSendBuffer()
+	c.closeStream()
+	c.setState(StateDisconnected, nil)
+	c.closed()
 	// TODO implement timeout for waiting on </stream> from other end
 
 	// TODO "to help prevent a truncation attack the party that is
@@ -863,50 +1988,150 @@ func (c *Conn) Close() {
 	// before terminating the underlying TCP connection"
 }
 
+// closeStream sends the closing tag of our stream. It goes through
+// the encoder so that it matches the stream header that has been
+// written by openStream.
+func (c *Conn) closeStream() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.component {
+		_, err := transport{c}.Write([]byte("</stream:stream>"))
+		return err
+	}
+	err := c.encoder.EncodeToken(xml.EndElement{
+		Name: xml.Name{
+			Local: "stream",
+			Space: nsStream,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.encoder.Flush()
+}
+
+// SendIQ sends an IQ request and returns the channel its reply will
+// be delivered on, as well as the IQ's ID. If the connection gets
+// closed or lost before the reply arrives, or the request couldn't be
+// sent at all, the channel is closed instead, and receiving from it
+// yields nil.
 func (c *Conn) SendIQ(to, typ string, value interface{}) (chan *IQ, string) {
+	return c.SendIQWith(to, typ, value, IQOptions{})
+}
+
+// IQOptions are the less common attributes of IQs sent with
+// SendIQWith.
+type IQOptions struct {
+	// From overrides the sender of the IQ, for connections that may
+	// send on behalf of other JIDs, like components. It defaults to
+	// our JID.
+	From string
+	// Lang is the language of human-readable text in the IQ's
+	// payload (xml:lang).
+	Lang string
+}
+
+// SendIQWith behaves like SendIQ, but allows setting the attributes
+// described by opts.
+func (c *Conn) SendIQWith(to, typ string, value interface{}, opts IQOptions) (chan *IQ, string) {
 	cookie := c.getCookie()
 	reply := make(chan *IQ, 1)
 	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		close(reply)
+		return reply, cookie
+	}
 	c.callbacks[cookie] = reply
+	c.m().OutstandingIQs(len(c.callbacks))
 	c.mu.Unlock()
 
-	iq := sendIQ{
+	from := opts.From
+	if from == "" {
+		from = c.From()
+	}
+	err := c.Encode(outgoingIQ{
 		Header: Header{
-			From: c.jid,
+			From: from,
 			Id:   cookie,
 			To:   to,
 			Type: typ,
 		},
-		Inner: value,
+		Lang:    opts.Lang,
+		Payload: value,
+	})
+	if err != nil {
+		c.mu.Lock()
+		// Unless the callbacks have been failed in the meantime.
+		if ch, ok := c.callbacks[cookie]; ok {
+			delete(c.callbacks, cookie)
+			c.m().OutstandingIQs(len(c.callbacks))
+			close(ch)
+		}
+		c.mu.Unlock()
 	}
-
-	// TODO handle error
-	c.Encode(iq)
 	return reply, cookie
 }
 
 func (c *Conn) SendIQReply(iq *IQ, typ string, value interface{}) {
-	reply := sendIQ{
-		Header: Header{
-			From: c.jid,
-			Id:   iq.Id,
-			To:   iq.From,
-			Type: typ,
-		},
-		Inner: value,
-	}
-
 	// TODO handle error
-	c.Encode(reply)
+	c.sendIQ(Header{
+		From: c.From(),
+		Id:   iq.Id,
+		To:   iq.From,
+		Type: typ,
+	}, value)
+}
+
+func (c *Conn) sendIQ(h Header, payload interface{}) error {
+	return c.Encode(outgoingIQ{Header: h, Payload: payload})
+}
+
+// SendNotification sends a message with a body to a JID, without
+// requiring any of the IM features of RFC 6121 like the roster or
+// presence. It is meant for bots that only deliver notifications.
+// The message is of type normal, which servers store for later
+// delivery if the recipient is offline, unlike headline messages.
+// The returned error only reports an invalid JID or problems writing
+// the message.
+func (c *Conn) SendNotification(to, body string) error {
+	if !validJID(to) {
+		return ErrInvalidJID
+	}
+	return c.Encode(Message{
+		Header: Header{To: to, Type: "normal", Id: c.NewID()},
+		Body:   body,
+	})
 }
 
+// SendPresence sends a presence, setting its ID. The returned error
+// only reports problems writing the presence, not errors returned by
+// the server; use SendPresenceTracked to learn about those.
 func (c *Conn) SendPresence(p Presence) (cookie string, err error) {
-	// TODO do we need to store the cookie somewhere? present the user with a channel?
-	// TODO document that we set the ID
 	p.Id = c.getCookie()
-	c.Encode(p)
-	return p.Id, nil
-	// TODO handle error (server reply)
+	return c.sendPresence(p)
+}
+
+func (c *Conn) sendPresence(p Presence) (cookie string, err error) {
+	if err := p.Validate(); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	decorators := c.decorators
+	c.mu.Unlock()
+	for _, d := range decorators {
+		d(&p)
+	}
+
+	err = c.Encode(p)
+	if err == nil && p.To == "" {
+		c.mu.Lock()
+		c.available = p.Type == ""
+		c.mu.Unlock()
+	}
+	return p.Id, err
 }
 
 // TODO reconsider name, since it conflicts with the idea of sending
@@ -925,7 +2150,7 @@ func (c *Conn) SendError(inReplyTo Stanza, typ string, text string, errors ...XM
 	}
 
 	response := errorReply(inReplyTo, error)
-	c.encoder.Encode(response) // FIXME handle error
+	c.Encode(response) // FIXME handle error
 }
 
 type taggedStanza struct {
@@ -934,36 +2159,67 @@ type taggedStanza struct {
 	sender namedXEP
 }
 
+// NextStanza returns the next received stanza, blocking until one
+// arrives. Stanzas are returned in the order they were read, each
+// followed by the stanzas XEPs emitted for it, before the next
+// stanza that has been read. XEPs process a stanza when it is
+// returned, in the calling goroutine.
+//
+// NextStanza may be called from multiple goroutines, but the order
+// in which they process the stanzas is then up to them. The read
+// loop waits for NextStanza to be called before reading further, so
+// it has to be called continuously.
 func (c *Conn) NextStanza() (Stanza, error) {
-	stanza, ok := <-c.stanzas
-	if !ok {
-		return nil, io.EOF
-	}
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
 
-	go func() {
-		xeps := c.extensions.list()
-		newStanzas := make([]taggedStanza, 0)
-		for _, xep := range xeps {
-			if stanza.sender.name == xep.name || stanza.err != nil {
-				continue
+	var stanza taggedStanza
+	if len(c.pending) > 0 {
+		stanza = c.pending[0]
+		c.pending = c.pending[1:]
+	} else {
+		select {
+		case stanza = <-c.stanzas:
+		case stanza = <-c.lost:
+		case <-c.done:
+			// The connection may have been lost right before
+			// being closed.
+			select {
+			case stanza = <-c.lost:
+			default:
+				return nil, io.EOF
 			}
+		}
+	}
 
-			stanzas, err := xep.xep.Process(stanza.stanza)
-			if len(stanzas) == 0 && err != nil {
-				stanzas = []Stanza{nil}
-			}
+	// Derived stanzas go first, so that they are delivered right
+	// after the stanza they were derived from.
+	c.pending = append(c.process(stanza), c.pending...)
+	return stanza.stanza, stanza.err
+}
 
-			for _, stanza := range stanzas {
-				ts := taggedStanza{stanza, err, xep}
-				newStanzas = append(newStanzas, ts)
+// process lets all XEPs, except for the one that emitted the stanza,
+// process a stanza and returns the stanzas they emitted.
+func (c *Conn) process(stanza taggedStanza) []taggedStanza {
+	xeps := c.extensions.list()
+	newStanzas := make([]taggedStanza, 0)
+	for _, xep := range xeps {
+		if stanza.sender.name == xep.name || stanza.err != nil {
+			continue
+		}
 
-			}
+		stanzas, err := xep.xep.Process(stanza.stanza)
+		if len(stanzas) == 0 && err != nil {
+			stanzas = []Stanza{nil}
 		}
-		for _, newStanza := range newStanzas {
-			c.stanzas <- newStanza
+
+		for _, stanza := range stanzas {
+			ts := taggedStanza{stanza, err, xep}
+			newStanzas = append(newStanzas, ts)
+
 		}
-	}()
-	return stanza.stanza, stanza.err
+	}
+	return newStanzas
 }
 
 // TODO consider adding an ErrorReply interface that is optional to
@@ -980,10 +2236,13 @@ func errorReply(stanza Stanza, error *Error) Stanza {
 
 	to := sV.FieldByName("To")
 	from := sV.FieldByName("From")
+	id := sV.FieldByName("Id")
 
 	reply := reflect.New(sV.Type())
 	reply.Elem().FieldByName("To").Set(from)
 	reply.Elem().FieldByName("From").Set(to)
+	// Replies are matched to requests by their IDs (RFC 6120 8.2.3).
+	reply.Elem().FieldByName("Id").Set(id)
 	reply.Elem().FieldByName("Type").SetString("error")
 	reply.Elem().FieldByName("Error").Set(reflect.ValueOf(error))
 
@@ -0,0 +1,223 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPendingIQsOnClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// closeFirst closes the connection before the IQ is sent.
+		closeFirst bool
+		// hangUp has the server close the connection instead of the
+		// client.
+		hangUp bool
+	}{
+		{name: "closed while waiting"},
+		{name: "sent after closing", closeFirst: true},
+		{name: "connection lost", hangUp: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Conn.Close()
+			xmpptest.Stanzas(c)
+
+			// The server never answers, it only drains the stream.
+			requests := make(chan xmpptest.Element, 1)
+			go func() {
+				for {
+					e, err := s.NextElement()
+					if err != nil {
+						return
+					}
+					if e.XMLName.Local == "iq" {
+						requests <- e
+					}
+				}
+			}()
+
+			if tt.closeFirst {
+				c.Close()
+			}
+			ch, _ := c.SendIQ("example.com", "get", version{})
+			if !tt.closeFirst {
+				select {
+				case <-requests:
+				case <-time.After(5 * time.Second):
+					t.Fatal("IQ wasn't sent")
+				}
+				if tt.hangUp {
+					s.Conn.Close()
+				} else {
+					c.Close()
+				}
+			}
+
+			select {
+			case res, ok := <-ch:
+				if ok || res != nil {
+					t.Fatalf("got reply %v, want the channel to be closed", res)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("reply channel is still open")
+			}
+			if tt.closeFirst {
+				select {
+				case e := <-requests:
+					t.Errorf("IQ %s was sent after closing", e.Attribute("id"))
+				default:
+				}
+			}
+		})
+	}
+}
+
+func TestStanzasAfterClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// stanzas are sent by the server after our closing tag,
+		// before its own.
+		stanzas []string
+	}{
+		{name: "none"},
+		{
+			name: "presence and message",
+			stanzas: []string{
+				"<presence xmlns='jabber:client' from='bob@example.com/phone' type='unavailable'/>",
+				"<message xmlns='jabber:client' from='bob@example.com/phone'><body>bye</body></message>",
+			},
+		},
+		{name: "IQ", stanzas: []string{"<iq xmlns='jabber:client' from='example.com' type='get' id='p1'><ping xmlns='urn:xmpp:ping'/></iq>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Conn.Close()
+
+			// The server answers our closing tag like servers often
+			// do, with whatever was still on its way to us.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					if _, err := s.NextElement(); err != nil {
+						break
+					}
+				}
+				for _, stanza := range tt.stanzas {
+					s.Send(stanza)
+				}
+				s.Send("</stream:stream>")
+				// Wait for the client to hang up.
+				io.Copy(io.Discard, s.Conn)
+			}()
+			c.Close()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("client didn't hang up")
+			}
+			if stanza, err := c.NextStanza(); err != io.EOF {
+				t.Errorf("got %v, %v after closing, want %v", stanza, err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestUnavailableOnClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// presences are sent before closing.
+		presences []core.Presence
+		omit      bool
+		// want are the presences the peer receives before the end of
+		// the stream, as their types and recipients.
+		want []string
+	}{
+		{name: "never available"},
+		{
+			name:      "available",
+			presences: []core.Presence{{}},
+			want:      []string{"available to everyone", "unavailable to everyone"},
+		},
+		{
+			name:      "omitted",
+			presences: []core.Presence{{}},
+			omit:      true,
+			want:      []string{"available to everyone"},
+		},
+		{
+			name:      "already unavailable",
+			presences: []core.Presence{{}, {Header: core.Header{Type: "unavailable"}}},
+			want:      []string{"available to everyone", "unavailable to everyone"},
+		},
+		{
+			// Directed presence is the business of whoever sent it.
+			name:      "directed only",
+			presences: []core.Presence{{Header: core.Header{To: "bob@example.com"}}},
+			want:      []string{"available to bob@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Conn.Close()
+			c.OmitUnavailableOnClose = tt.omit
+			xmpptest.Stanzas(c)
+
+			received := s.CollectUntilClosed()
+
+			for _, p := range tt.presences {
+				if _, err := c.SendPresence(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.Close()
+
+			select {
+			case elements := <-received:
+				if got := presences(elements); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("peer received %q, want %q", got, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream wasn't closed")
+			}
+		})
+	}
+}
+
+// presences describes presences by their types and recipients.
+func presences(elements []xmpptest.Element) []string {
+	var out []string
+	for _, e := range elements {
+		typ, to := e.Attribute("type"), e.Attribute("to")
+		if typ == "" {
+			typ = "available"
+		}
+		if to == "" {
+			to = "everyone"
+		}
+		out = append(out, typ+" to "+to)
+	}
+	return out
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const nsComponent = "jabber:component:accept"
+
+// NewComponentConnection creates a new connection that authenticates
+// as the external component name (XEP-0114) using conn as its
+// transport. It is the counterpart of NewConnection for components.
+func NewComponentConnection(conn net.Conn, name, secret string) *Conn {
+	c := NewConn()
+	c.Conn = conn
+	c.host = name
+	c.password = secret
+	c.component = true
+
+	return c
+}
+
+// DialComponent connects to the component port of an XMPP server and
+// authenticates as the external component name (XEP-0114), using the
+// secret shared with the server.
+//
+// Components aren't bound to a user's JID. Stanzas sent over the
+// connection need explicit to and from addresses, the latter of
+// which may be any JID in the component's domain. IQs sent with
+// SendIQ default to name as their sender.
+func DialComponent(name, secret, host string, port int) (client Client, errors []error) {
+	c := NewConn()
+	c.host = name
+	c.addr = net.JoinHostPort(host, strconv.Itoa(port))
+	c.password = secret
+	c.component = true
+
+	errors = c.Dial()
+	return c, errors
+}
+
+// setUpComponent opens a component stream and performs the handshake
+// in place of negotiating stream features.
+func (c *Conn) setUpComponent() error {
+	c.reset()
+
+	// The stream has to declare the component namespace as its
+	// default namespace, which the encoder can't express.
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString("<stream:stream xmlns='" + nsComponent + "' xmlns:stream='" + nsStream + "' to='")
+	xml.EscapeText(&b, []byte(c.host))
+	b.WriteString("'>")
+	if _, err := (transport{c}).Write(b.Bytes()); err != nil {
+		return ConnectError{err, "Error while opening stream"}
+	}
+	if err := c.receiveStream(); err != nil {
+		return ConnectError{err, "Error receiving stream"}
+	}
+
+	if err := c.handshake(); err != nil {
+		return ConnectError{err, "Error during handshake"}
+	}
+	c.setState(StateAuthenticated, nil)
+
+	c.jid = c.host
+	go c.read()
+	c.setState(StateBound, nil)
+	return nil
+}
+
+func (c *Conn) handshake() error {
+	c.redact(true)
+	defer c.redact(false)
+
+	sum := sha1.Sum([]byte(c.streamHeader.ID + c.password))
+	err := c.Encode(struct {
+		XMLName xml.Name `xml:"jabber:component:accept handshake"`
+		Digest  string   `xml:",chardata"`
+	}{Digest: hex.EncodeToString(sum[:])})
+	if err != nil {
+		return err
+	}
+
+	t, err := c.nextStartElement()
+	if err != nil {
+		return err
+	}
+	switch t.Name.Space + " " + t.Name.Local {
+	case nsComponent + " handshake":
+		return c.decoder.Skip()
+	case nsStream + " error":
+		// Usually not-authorized, for a wrong secret.
+		var e StreamError
+		if err := c.decoder.DecodeElement(&e, t); err != nil {
+			return err
+		}
+		return e
+	default:
+		return UnexpectedMessage{t.Name.Local}
+	}
+}
+
+// encodeComponent marshals v like the encoder would and writes it in
+// the component namespace. The caller must hold wmu.
+func (c *Conn) encodeComponent(v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = transport{c}.Write(componentNamespace(b))
+	return err
+}
+
+// componentNamespace moves a marshaled stanza from the jabber:client
+// namespace, which our stanza types are declared in, to the component
+// namespace. Payloads are left alone.
+func componentNamespace(b []byte) []byte {
+	i := bytes.IndexAny(b, " >")
+	if i < 0 {
+		return b
+	}
+	decl := []byte(fmt.Sprintf(` xmlns="%s"`, nsClient))
+	if !bytes.HasPrefix(b[i:], decl) {
+		return b
+	}
+
+	out := make([]byte, 0, len(b)+len(nsComponent)-len(nsClient))
+	out = append(out, b[:i]...)
+	out = append(out, fmt.Sprintf(` xmlns="%s"`, nsComponent)...)
+	return append(out, b[i+len(decl):]...)
+}
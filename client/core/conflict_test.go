@@ -0,0 +1,91 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"errors"
+	"testing"
+)
+
+func TestResourceConflict(t *testing.T) {
+	tests := []struct {
+		name string
+		// condition is the condition of the stream error that ends
+		// the session.
+		condition           string
+		reconnectOnConflict bool
+		wantConflict        bool
+		wantReconnect       bool
+	}{
+		{name: "conflict", condition: "conflict", wantConflict: true},
+		{name: "conflict allowed", condition: "conflict", reconnectOnConflict: true, wantConflict: true, wantReconnect: true},
+		{name: "shutdown", condition: "system-shutdown", wantReconnect: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.AllowReconnect = true
+			c.ReconnectOnConflict = tt.reconnectOnConflict
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				s.Sendf("<stream:error><%s xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>", tt.condition)
+				s.Conn.Close()
+			}()
+			_, err := c.NextStanza()
+			var disconnect core.DisconnectError
+			if !errors.As(err, &disconnect) || disconnect.StreamError == nil || disconnect.StreamError.Condition() != tt.condition {
+				t.Fatalf("got %v, want a disconnect because of %s", err, tt.condition)
+			}
+			if got := errors.Is(err, core.ErrResourceConflict); got != tt.wantConflict {
+				t.Errorf("errors.Is(%v, ErrResourceConflict) = %t, want %t", err, got, tt.wantConflict)
+			}
+			// The disconnect itself advises against fighting for the
+			// resource, whether or not Reconnect may override that.
+			if reconnect, _ := disconnect.Reconnect(); reconnect == tt.wantConflict {
+				t.Errorf("got reconnect advice %t for %s", reconnect, tt.condition)
+			}
+
+			conn2, s2 := xmpptest.Pipe()
+			defer s2.Conn.Close()
+			negotiated := make(chan error, 1)
+			if tt.wantReconnect {
+				go func() { negotiated <- s2.Negotiate() }()
+			}
+			errs := c.Reconnect(conn2)
+			if !tt.wantReconnect {
+				if len(errs) != 1 || errs[0] != core.ErrResourceConflict {
+					t.Fatalf("got errors %v, want %v", errs, core.ErrResourceConflict)
+				}
+				if c.State() != core.StateDisconnected {
+					t.Errorf("got state %v, want %v", c.State(), core.StateDisconnected)
+				}
+				// Trying again mustn't change the answer.
+				if errs := c.Reconnect(conn2); len(errs) != 1 || errs[0] != core.ErrResourceConflict {
+					t.Errorf("got errors %v on the second attempt, want %v", errs, core.ErrResourceConflict)
+				}
+				return
+			}
+			if err := <-negotiated; err != nil {
+				t.Fatal(err)
+			}
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if c.State() != core.StateBound {
+				t.Errorf("got state %v, want %v", c.State(), core.StateBound)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package core
+
+import (
+	"encoding/xml"
+	"errors"
+)
+
+// ErrFeatureUnsupported is returned when using a stream feature that
+// the server didn't advertise.
+var ErrFeatureUnsupported = errors.New("xmpp: feature not supported by the server")
+
+// SetActive tells the server that the user is actively using the
+// client (XEP-0352, Client State Indication).
+func (c *Conn) SetActive() error {
+	return c.sendCSI("active")
+}
+
+// SetInactive tells the server that the user isn't actively using the
+// client, for example because it is running in the background. The
+// server may then hold back or drop traffic that isn't urgent, like
+// presence updates, until SetActive is called.
+func (c *Conn) SetInactive() error {
+	return c.sendCSI("inactive")
+}
+
+func (c *Conn) sendCSI(state string) error {
+	if !c.StreamFeatures().CSI {
+		return ErrFeatureUnsupported
+	}
+
+	return c.Encode(struct {
+		XMLName xml.Name
+	}{xml.Name{Space: "urn:xmpp:csi:0", Local: state}})
+}
@@ -0,0 +1,63 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"testing"
+)
+
+func TestClientStateIndication(t *testing.T) {
+	tests := []struct {
+		name     string
+		features string
+		inactive bool
+		// want is the element sent, or empty if the call has to fail
+		// without sending anything.
+		want string
+	}{
+		{name: "inactive", features: "<csi xmlns='urn:xmpp:csi:0'/>", inactive: true, want: "inactive"},
+		{name: "active", features: "<csi xmlns='urn:xmpp:csi:0'/>", want: "active"},
+		{name: "unsupported", inactive: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			s.Features = tt.features
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			set := c.SetActive
+			if tt.inactive {
+				set = c.SetInactive
+			}
+			go func() { errc <- set() }()
+
+			if tt.want == "" {
+				if err := <-errc; err != core.ErrFeatureUnsupported {
+					t.Fatalf("got %v, want %v", err, core.ErrFeatureUnsupported)
+				}
+				return
+			}
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.XMLName.Space != "urn:xmpp:csi:0" || e.XMLName.Local != tt.want {
+				t.Errorf("got <%s xmlns=%q>, want <%s xmlns='urn:xmpp:csi:0'>", e.XMLName.Local, e.XMLName.Space, tt.want)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+func (c *Conn) debugf(format string, args ...interface{}) {
+	c.debugMu.Lock()
+	fmt.Fprintf(c.Debug, format, args...)
+	c.debugMu.Unlock()
+}
+
+// debugRaw logs XML as it went over the wire. dir is "SEND" or
+// "RECV".
+func (c *Conn) debugRaw(dir string, b []byte) {
+	if c.Debug == nil {
+		return
+	}
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+	if c.redacting {
+		b = c.redactors[dir].redact(b)
+	}
+	fmt.Fprintf(c.Debug, "%s %s\n", dir, b)
+}
+
+// debugValue logs the Go value of a stanza or other element.
+func (c *Conn) debugValue(dir string, v interface{}) {
+	if c.Debug == nil {
+		return
+	}
+	c.debugMu.Lock()
+	redacting := c.redacting
+	c.debugMu.Unlock()
+	if redacting {
+		c.debugf("%s %T %s\n", dir, v, redacted)
+		return
+	}
+	var b bytes.Buffer
+	dump(&b, reflect.ValueOf(v), 1)
+	c.debugf("%s %T %s\n", dir, v, b.Bytes())
+}
+
+// dump writes a readable representation of v, omitting zero values
+// and showing byte slices, like raw payloads, as text.
+func dump(b *bytes.Buffer, v reflect.Value, depth int) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			b.WriteString("nil")
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		b.WriteString("{\n")
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if t.Field(i).PkgPath != "" || f.IsZero() {
+				continue
+			}
+			fmt.Fprintf(b, "%*s%s: ", depth*2, "", t.Field(i).Name)
+			dump(b, f, depth+1)
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(b, "%*s}", (depth-1)*2, "")
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			fmt.Fprintf(b, "%q", v.Bytes())
+			return
+		}
+		b.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			dump(b, v.Index(i), depth)
+		}
+		b.WriteString("]")
+	case reflect.String:
+		fmt.Fprintf(b, "%q", v.String())
+	default:
+		fmt.Fprintf(b, "%v", v.Interface())
+	}
+}
+
+// redact turns the redaction of credentials in the debug log on or
+// off. It is on for the duration of authentication.
+func (c *Conn) redact(on bool) {
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+	c.redacting = on
+	if on {
+		c.redactors = map[string]*redactor{"SEND": {}, "RECV": {}}
+	}
+}
+
+const redacted = "[redacted]"
+
+const (
+	redactText = iota
+	redactTagStart
+	redactTag
+	redactValue
+	redactSecretValue
+	redactDeclaration
+)
+
+// redactor replaces character data and the values of 'token'
+// attributes in raw XML. It keeps its state between calls, because
+// reads and writes may split elements at any point.
+type redactor struct {
+	state  int
+	quote  byte
+	name   []byte
+	inName bool
+	// masked reports whether the placeholder has already been
+	// written for the current run of redacted data.
+	masked bool
+}
+
+func (r *redactor) redact(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	mask := func() {
+		if !r.masked {
+			out = append(out, redacted...)
+			r.masked = true
+		}
+	}
+
+	for _, ch := range b {
+		switch r.state {
+		case redactText:
+			switch {
+			case ch == '<':
+				out = append(out, ch)
+				r.state = redactTagStart
+			case isSpace(ch) && !r.masked:
+				out = append(out, ch)
+			default:
+				mask()
+			}
+		case redactTagStart:
+			r.masked = false
+			r.inName = false
+			if ch == '!' {
+				// Comments and CDATA sections.
+				r.state = redactDeclaration
+				mask()
+				continue
+			}
+			r.state = redactTag
+			fallthrough
+		case redactTag:
+			out = append(out, ch)
+			switch {
+			case ch == '>':
+				r.state = redactText
+				r.masked = false
+			case ch == '\'' || ch == '"':
+				r.quote = ch
+				r.masked = false
+				name := string(r.name)
+				if name == "token" || strings.HasSuffix(name, ":token") {
+					r.state = redactSecretValue
+				} else {
+					r.state = redactValue
+				}
+			case isSpace(ch) || ch == '=' || ch == '/':
+				r.inName = false
+			default:
+				if !r.inName {
+					r.name = r.name[:0]
+					r.inName = true
+				}
+				r.name = append(r.name, ch)
+			}
+		case redactValue, redactSecretValue:
+			switch {
+			case ch == r.quote:
+				out = append(out, ch)
+				r.state = redactTag
+				r.inName = false
+			case r.state == redactSecretValue:
+				mask()
+			default:
+				out = append(out, ch)
+			}
+		case redactDeclaration:
+			if ch == '>' {
+				out = append(out, ch)
+				r.state = redactText
+				r.masked = false
+				continue
+			}
+			mask()
+		}
+	}
+	return out
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n'
+}
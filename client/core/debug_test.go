@@ -0,0 +1,106 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer that can be written to by the read
+// loop while the test reads it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// handshake returns the digest sent in a component handshake.
+func handshake(id, secret string) string {
+	sum := sha1.Sum([]byte(id + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDebugRedactsCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		connect   func(conn net.Conn, s *xmpptest.Server) (*core.Conn, func() error)
+		secrets   []string
+		plaintext []string
+		stanzaNS  string
+	}{
+		{
+			name: "SASL",
+			connect: func(conn net.Conn, s *xmpptest.Server) (*core.Conn, func() error) {
+				return core.NewConnection(conn, "alice", s.Domain, "hunter2"), s.Negotiate
+			},
+			secrets:   []string{"hunter2", base64.StdEncoding.EncodeToString([]byte("\x00alice\x00hunter2"))},
+			plaintext: []string{`mechanism="PLAIN"`, "<jid>alice@example.com/xmpptest</jid>"},
+			stanzaNS:  "jabber:client",
+		},
+		{
+			name: "component",
+			connect: func(conn net.Conn, s *xmpptest.Server) (*core.Conn, func() error) {
+				c := core.NewComponentConnection(conn, "bot.example.com", "hunter2")
+				return c, func() error { return s.NegotiateComponent("hunter2") }
+			},
+			secrets:   []string{handshake("xmpptest", "hunter2")},
+			plaintext: []string{"<handshake"},
+			stanzaNS:  "jabber:component:accept",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			c, negotiate := tt.connect(conn, s)
+			var log syncBuffer
+			c.Debug = &log
+
+			errc := make(chan error, 1)
+			go func() { errc <- negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			// Stanzas after authentication are logged in full.
+			stanzas := xmpptest.Stanzas(c)
+			s.Send("<message xmlns='" + tt.stanzaNS + "' from='bob@example.com'><body>in the clear</body></message>")
+			<-stanzas
+
+			out := log.String()
+			for _, secret := range tt.secrets {
+				if strings.Contains(out, secret) {
+					t.Errorf("log contains %q:\n%s", secret, out)
+				}
+			}
+			for _, want := range append(tt.plaintext, "[redacted]", "in the clear") {
+				if !strings.Contains(out, want) {
+					t.Errorf("log doesn't contain %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
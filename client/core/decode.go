@@ -0,0 +1,89 @@
+package core
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// DecodeError describes a stanza that was well-formed XML but couldn't
+// be decoded, for example because of a priority that isn't a number.
+// Such stanzas are dropped without affecting the stream, unlike
+// malformed XML, which is a stream-level problem that ends the
+// connection with a not-well-formed stream error.
+type DecodeError struct {
+	// Name is the name of the stanza, "message", "presence" or "iq".
+	Name string
+	// Stanza holds whatever could be decoded, usually at least the
+	// stanza's attributes.
+	Stanza Stanza
+	Err    error
+}
+
+func (e DecodeError) Error() string {
+	return "xmpp: couldn't decode " + e.Name + ": " + e.Err.Error()
+}
+
+// OnDecodeError sets a function that is called with stanzas that
+// couldn't be decoded. fn is called from the read loop and must not
+// block. Only one function can be set at a time.
+func (c *Conn) OnDecodeError(fn func(DecodeError)) {
+	c.mu.Lock()
+	c.onDecodeError = fn
+	c.mu.Unlock()
+}
+
+// stanzaDecoder decodes a stanza in a way that allows reading to
+// continue after the stanza failed to decode.
+type stanzaDecoder struct {
+	v   Stanza
+	err error
+}
+
+func (s *stanzaDecoder) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	err := d.DecodeElement(s.v, &start)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*xml.SyntaxError); ok {
+		return err
+	}
+
+	s.err = err
+	// The decoder is somewhere inside the stanza. Within
+	// UnmarshalXML, Token returns io.EOF once the end of the stanza
+	// has been consumed, which puts us back between stanzas.
+	for {
+		if _, err := d.Token(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// decodeStanza decodes the stanza started by start into v. Errors
+// that leave the stream intact are handled and reported by returning
+// false; other errors are returned.
+func (c *Conn) decodeStanza(v Stanza, start *xml.StartElement) (bool, error) {
+	s := stanzaDecoder{v: v}
+	if err := c.decoder.DecodeElement(&s, start); err != nil {
+		return false, err
+	}
+	if s.err == nil {
+		return true, nil
+	}
+
+	if iq, ok := v.(*IQ); ok && (iq.Type == "get" || iq.Type == "set") {
+		// The sender is waiting for a reply.
+		c.SendError(iq, "modify", "", ErrBadRequest{})
+	}
+
+	c.mu.Lock()
+	fn := c.onDecodeError
+	c.mu.Unlock()
+	if fn != nil {
+		fn(DecodeError{Name: start.Name.Local, Stanza: v, Err: s.err})
+	}
+	return false, nil
+}
@@ -0,0 +1,94 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		name   string
+		stanza string
+		// fatal reports whether the stanza ends the stream, as
+		// opposed to being skipped.
+		fatal bool
+	}{
+		{
+			name:   "bad priority",
+			stanza: "<presence xmlns='jabber:client' from='bob@example.com/phone'><priority>high</priority></presence>",
+		},
+		{
+			name:   "priority out of range",
+			stanza: "<presence xmlns='jabber:client' from='bob@example.com/phone'><priority>99999999999999999999</priority><status>Hi</status></presence>",
+		},
+		{
+			name:   "mismatched tag",
+			stanza: "<message xmlns='jabber:client' from='bob@example.com/phone'><body>hi</bod></message>",
+			fatal:  true,
+		},
+		{
+			name:   "invalid entity",
+			stanza: "<message xmlns='jabber:client' from='bob@example.com/phone'><body>a & b</body></message>",
+			fatal:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Conn.Close()
+			decodeErrs := make(chan core.DecodeError, 1)
+			c.OnDecodeError(func(err core.DecodeError) { decodeErrs <- err })
+
+			go s.Send(tt.stanza + "<message xmlns='jabber:client' from='example.com' id='sentinel'/>")
+			if tt.fatal {
+				e, err := s.NextElement()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.XMLName.Local != "error" || !strings.Contains(string(e.Inner), "not-well-formed") {
+					t.Errorf("got <%s>%s, want a not-well-formed stream error", e.XMLName.Local, e.Inner)
+				}
+				_, err = c.NextStanza()
+				var disconnect core.DisconnectError
+				var syntaxErr *xml.SyntaxError
+				if !errors.As(err, &disconnect) || !errors.As(disconnect.Err, &syntaxErr) {
+					t.Fatalf("got %v, want a disconnect because of a syntax error", err)
+				}
+				select {
+				case err := <-decodeErrs:
+					t.Errorf("malformed XML was reported as %v", err)
+				default:
+				}
+				return
+			}
+
+			// The stanza is skipped and the stream stays intact.
+			stanza, err := c.NextStanza()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, ok := stanza.(*core.Message); !ok || m.Id != "sentinel" {
+				t.Fatalf("got %#v, want the sentinel", stanza)
+			}
+			select {
+			case err := <-decodeErrs:
+				p, ok := err.Stanza.(*core.Presence)
+				if err.Name != "presence" || !ok || p.From != "bob@example.com/phone" || err.Err == nil {
+					t.Errorf("got %v for %#v, want the presence from bob@example.com/phone", err, err.Stanza)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("decode error wasn't reported")
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	nsSASL = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsTLS  = "urn:ietf:params:xml:ns:xmpp-tls"
+)
+
+func TestStartTLSRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		wantErr func(error) bool
+	}{
+		{
+			name:    "failure",
+			reply:   "<failure xmlns='" + nsTLS + "'/>",
+			wantErr: func(err error) bool { return errors.Is(err, core.ErrTLSFailure) },
+		},
+		{
+			name:  "wrong namespace",
+			reply: "<proceed xmlns='" + nsSASL + "'/>",
+			wantErr: func(err error) bool {
+				var unexpected core.UnexpectedMessage
+				return errors.As(err, &unexpected) && unexpected.Name == "proceed"
+			},
+		},
+		{
+			name:    "stream closed",
+			reply:   "</stream:stream>",
+			wantErr: func(err error) bool { return err != nil },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+
+			go func() {
+				s.ReadStreamHeader()
+				s.OpenStream("<starttls xmlns='" + nsTLS + "'><required/></starttls>")
+				if e, err := s.NextElement(); err != nil || e.XMLName.Local != "starttls" {
+					t.Errorf("got %v, %v, want a STARTTLS request", e.XMLName, err)
+				}
+				s.Send(tt.reply)
+			}()
+
+			errs := c.Dial()
+			if len(errs) != 1 || !tt.wantErr(errs[0]) {
+				t.Fatalf("got errors %v", errs)
+			}
+			if c.State() != core.StateDisconnected {
+				t.Errorf("got state %v, want %v", c.State(), core.StateDisconnected)
+			}
+		})
+	}
+}
+
+func TestDialContextCancel(t *testing.T) {
+	tests := []struct {
+		name  string
+		stall func(s *xmpptest.Server)
+	}{
+		{
+			name: "stream header",
+			stall: func(s *xmpptest.Server) {
+				s.ReadStreamHeader()
+			},
+		},
+		{
+			name: "SASL",
+			stall: func(s *xmpptest.Server) {
+				s.ReadStreamHeader()
+				s.OpenStream("<mechanisms xmlns='" + nsSASL + "'><mechanism>PLAIN</mechanism></mechanisms>")
+				s.NextElement()
+			},
+		},
+		{
+			name: "bind",
+			stall: func(s *xmpptest.Server) {
+				s.ReadStreamHeader()
+				s.OpenStream("<mechanisms xmlns='" + nsSASL + "'><mechanism>PLAIN</mechanism></mechanisms>")
+				s.NextElement()
+				s.Send("<success xmlns='" + nsSASL + "'/>")
+				s.RestartStream()
+				s.OpenStream("<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>")
+				s.NextElement()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stalled := make(chan struct{})
+			go func() {
+				tt.stall(s)
+				close(stalled)
+			}()
+
+			errc := make(chan []error, 1)
+			go func() { errc <- c.DialContext(ctx) }()
+			<-stalled
+			cancel()
+
+			select {
+			case errs := <-errc:
+				if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+					t.Fatalf("got errors %v, want %v", errs, context.Canceled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("DialContext didn't return after cancelling its context")
+			}
+		})
+	}
+}
+
+func TestDialDirectIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 isn't available:", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	cert := mustCertificate(t, "example.com")
+
+	tests := []struct {
+		name string
+		host string
+		port int
+	}{
+		{name: "literal", host: "::1", port: port},
+		{name: "bracketed", host: "[::1]", port: port},
+		{name: "with port", host: "[::1]:" + strconv.Itoa(port)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type hello struct {
+				to         string
+				serverName string
+			}
+			hellos := make(chan hello, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					close(hellos)
+					return
+				}
+				defer conn.Close()
+				s := xmpptest.NewServer(conn)
+				header, err := s.ReadStreamHeader()
+				if err != nil {
+					close(hellos)
+					return
+				}
+				var h hello
+				for _, attr := range header.Attr {
+					if attr.Name.Local == "to" {
+						h.to = attr.Value
+					}
+				}
+				s.OpenStream("<starttls xmlns='" + nsTLS + "'><required/></starttls>")
+				s.NextElement()
+				s.Send("<proceed xmlns='" + nsTLS + "'/>")
+				tls.Server(conn, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+						h.serverName = info.ServerName
+						return nil, nil
+					},
+				}).Handshake()
+				hellos <- h
+			}()
+
+			_, errs := core.DialDirect("alice", "example.com", tt.host, tt.port, "secret")
+			h, ok := <-hellos
+			if !ok {
+				t.Fatalf("no connection, errors %v", errs)
+			}
+			// The names have to be those of the XMPP domain, not of
+			// the address.
+			if h.to != "example.com" || h.serverName != "example.com" {
+				t.Errorf("got stream to %q and TLS server name %q, want example.com", h.to, h.serverName)
+			}
+			// The self-signed certificate isn't trusted, but it must
+			// have been verified against the domain.
+			var unknown x509.UnknownAuthorityError
+			if len(errs) != 1 || !errors.As(errs[0], &unknown) {
+				t.Fatalf("got errors %v, want an unknown authority", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"testing"
+)
+
+func TestEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// want is what the server decodes; characters that can't be
+		// represented in XML are replaced.
+		want string
+	}{
+		{name: "markup", in: `<a href="x">&'`, want: `<a href="x">&'`},
+		{name: "newline", in: "bob\n@example.com", want: "bob\n@example.com"},
+		{name: "tab and carriage return", in: "a\tb\rc", want: "a\tb\rc"},
+		{name: "control character", in: "a\x01b", want: "a\uFFFDb"},
+		{name: "invalid UTF-8", in: "a\xffb", want: "a\uFFFDb"},
+		{name: "closing tag", in: "</stream:stream>", want: "</stream:stream>"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			go func() {
+				errc <- c.Encode(core.Message{Header: core.Header{To: tt.in, Id: tt.in}, Body: tt.in})
+			}()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatalf("stream broken: %v", err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if got := e.Attribute("to"); got != tt.want {
+				t.Errorf("got to %q, want %q", got, tt.want)
+			}
+			if got := e.Attribute("id"); got != tt.want {
+				t.Errorf("got id %q, want %q", got, tt.want)
+			}
+			var body struct {
+				Body string `xml:"body"`
+			}
+			if err := xml.Unmarshal([]byte("<message>"+string(e.Inner)+"</message>"), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Body != tt.want {
+				t.Errorf("got body %q, want %q", body.Body, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package core
 
 import (
 	"encoding/xml"
+	"fmt"
+	"strings"
 )
 
 type Feature interface {
@@ -22,15 +24,42 @@ func (f StartTLS) Required() bool {
 }
 
 type UnsupportedFeature struct {
-	name string
+	name     string
+	required bool
 }
 
 func (f UnsupportedFeature) Name() string {
 	return f.name
 }
 
-func (UnsupportedFeature) Required() bool {
-	// TODO reconsider the decision to return false
+// Required reports whether the server marked the feature as
+// mandatory-to-negotiate, in which case we can't establish a session.
+func (f UnsupportedFeature) Required() bool {
+	return f.required
+}
+
+// UnsupportedFeatureError is returned when the server requires the
+// negotiation of a stream feature that we don't support.
+type UnsupportedFeatureError struct {
+	Feature xml.Name
+}
+
+func (e UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("xmpp: server requires unsupported stream feature <%s xmlns='%s'>", e.Feature.Local, e.Feature.Space)
+}
+
+// OptionalFeature is a feature that we know about but that doesn't
+// have to be negotiated, like stream management or roster
+// versioning.
+type OptionalFeature struct {
+	name string
+}
+
+func (f OptionalFeature) Name() string {
+	return f.name
+}
+
+func (OptionalFeature) Required() bool {
 	return false
 }
 
@@ -55,6 +84,52 @@ func (SASL) Name() string {
 	return "sasl"
 }
 
+// SASL2 is the feature advertising XEP-0388 (Extensible SASL
+// Profile).
+type SASL2 struct {
+	Mechanisms []string
+	// Bind reports whether resource binding (XEP-0386) can be
+	// performed inline.
+	Bind bool
+	// FAST lists the mechanisms offered for XEP-0484 (Fast
+	// Authentication Streamlining Tokens).
+	FAST []string
+}
+
+func (SASL2) Required() bool {
+	return true
+}
+
+func (SASL2) Name() string {
+	return "sasl2"
+}
+
+// Session is the legacy session establishment feature of RFC 3921.
+// Modern servers mark it as optional.
+type Session struct {
+	Optional bool
+}
+
+func (Session) Name() string {
+	return "session"
+}
+
+func (f Session) Required() bool {
+	return !f.Optional
+}
+
+// Compression lists the methods offered for XEP-0138 (Stream
+// Compression).
+type Compression []string
+
+func (Compression) Name() string {
+	return "compression"
+}
+
+func (Compression) Required() bool {
+	return false
+}
+
 type Features map[string]Feature
 
 func (fs Features) Requires(name string) bool {
@@ -78,64 +153,227 @@ func (fs Features) RequiresTLS() bool {
 	return false
 }
 
-func (c *Conn) parseFeatures() error {
+// StreamFeatures is the typed representation of the features
+// advertised by the server in <stream:features>. Pointer and slice
+// fields are nil if the feature hasn't been advertised.
+type StreamFeatures struct {
+	StartTLS *StartTLS
+	// Mechanisms are the offered SASL mechanisms.
+	Mechanisms  SASL
+	SASL2       *SASL2
+	Bind        bool
+	Session     *Session
+	Compression Compression
+	// Register reports support for in-band registration (XEP-0077).
+	Register bool
+	// StreamManagement reports support for XEP-0198.
+	StreamManagement bool
+	// RosterVersioning reports support for roster versioning (RFC
+	// 6121 2.6).
+	RosterVersioning bool
+	// PreApproval reports support for subscription pre-approval (RFC
+	// 6121 3.4).
+	PreApproval bool
+	// CSI reports support for client state indication (XEP-0352).
+	CSI bool
+	// Unknown lists the names of all features we don't know about.
+	Unknown []xml.Name
+	// RequiredUnknown lists the names of the unknown features that
+	// are mandatory-to-negotiate.
+	RequiredUnknown []xml.Name
+}
+
+type rawFeatures struct {
+	StartTLS *struct {
+		Required *struct{} `xml:"required"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms *struct {
+		Mechanisms []string `xml:"mechanism"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
+	Authentication *struct {
+		Mechanisms []string `xml:"mechanism"`
+		Inline     struct {
+			Bind *struct{} `xml:"urn:xmpp:bind:0 bind"`
+			FAST *struct {
+				Mechanisms []string `xml:"mechanism"`
+			} `xml:"urn:xmpp:fast:0 fast"`
+		} `xml:"inline"`
+	} `xml:"urn:xmpp:sasl:2 authentication"`
+	Bind    *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Session *struct {
+		Optional *struct{} `xml:"optional"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	Compression *struct {
+		Methods []string `xml:"method"`
+	} `xml:"http://jabber.org/features/compress compression"`
+	Register    *struct{} `xml:"http://jabber.org/features/iq-register register"`
+	SM          *struct{} `xml:"urn:xmpp:sm:3 sm"`
+	Ver         *struct{} `xml:"urn:xmpp:features:rosterver ver"`
+	PreApproval *struct{} `xml:"urn:xmpp:features:pre-approval sub"`
+	CSI         *struct{} `xml:"urn:xmpp:csi:0 csi"`
+	Unknown     []struct {
+		XMLName  xml.Name
+		Required *struct{} `xml:"required"`
+	} `xml:",any"`
+}
+
+func trimAll(in []string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = strings.TrimSpace(s)
+	}
+	return out
+}
+
+// ParseStreamFeatures decodes the <stream:features> element start,
+// whose start tag has already been read from d.
+func ParseStreamFeatures(d *xml.Decoder, start *xml.StartElement) (StreamFeatures, error) {
+	var raw rawFeatures
+	if err := d.DecodeElement(&raw, start); err != nil {
+		return StreamFeatures{}, err
+	}
+
+	var sf StreamFeatures
+	if raw.StartTLS != nil {
+		sf.StartTLS = &StartTLS{raw.StartTLS.Required != nil}
+	}
+	if raw.Mechanisms != nil {
+		sf.Mechanisms = SASL(trimAll(raw.Mechanisms.Mechanisms))
+	}
+	if a := raw.Authentication; a != nil {
+		sf.SASL2 = &SASL2{
+			Mechanisms: trimAll(a.Mechanisms),
+			Bind:       a.Inline.Bind != nil,
+		}
+		if a.Inline.FAST != nil {
+			sf.SASL2.FAST = trimAll(a.Inline.FAST.Mechanisms)
+		}
+	}
+	sf.Bind = raw.Bind != nil
+	if raw.Session != nil {
+		sf.Session = &Session{raw.Session.Optional != nil}
+	}
+	if raw.Compression != nil {
+		sf.Compression = Compression(trimAll(raw.Compression.Methods))
+	}
+	sf.Register = raw.Register != nil
+	sf.StreamManagement = raw.SM != nil
+	sf.RosterVersioning = raw.Ver != nil
+	sf.PreApproval = raw.PreApproval != nil
+	sf.CSI = raw.CSI != nil
+	for _, u := range raw.Unknown {
+		sf.Unknown = append(sf.Unknown, u.XMLName)
+		if u.Required != nil {
+			sf.RequiredUnknown = append(sf.RequiredUnknown, u.XMLName)
+		}
+	}
+
+	return sf, nil
+}
+
+// Features returns the features as a map, keyed by feature name.
+func (sf StreamFeatures) Features() Features {
 	features := make(Features)
+	if sf.StartTLS != nil {
+		features["starttls"] = *sf.StartTLS
+	}
+	if sf.Mechanisms != nil {
+		features["sasl"] = sf.Mechanisms
+	}
+	if sf.SASL2 != nil {
+		features["sasl2"] = *sf.SASL2
+	}
+	if sf.Bind {
+		features["bind"] = Bind{}
+	}
+	if sf.Session != nil {
+		features["session"] = *sf.Session
+	}
+	if sf.Compression != nil {
+		features["compression"] = sf.Compression
+	}
+	if sf.Register {
+		features["register"] = OptionalFeature{"register"}
+	}
+	if sf.StreamManagement {
+		features["sm"] = OptionalFeature{"sm"}
+	}
+	if sf.RosterVersioning {
+		features["ver"] = OptionalFeature{"ver"}
+	}
+	if sf.PreApproval {
+		features["sub"] = OptionalFeature{"sub"}
+	}
+	if sf.CSI {
+		features["csi"] = OptionalFeature{"csi"}
+	}
+	for _, name := range sf.Unknown {
+		features[name.Local] = UnsupportedFeature{name: name.Local}
+	}
+	for _, name := range sf.RequiredUnknown {
+		features[name.Local] = UnsupportedFeature{name: name.Local, required: true}
+	}
+
+	return features
+}
 
-	_, err := c.nextStartElement() // FIXME flow. this skips over the stream
+func (c *Conn) parseFeatures() error {
+	t, err := c.nextStartElement()
 	if err != nil {
 		return err
 	}
+	if t.Name.Space != nsStream || t.Name.Local != "features" {
+		return UnexpectedMessage{t.Name.Local}
+	}
 
-	for {
-		// TODO handle not getting to the end of the features (connection timeout?)
-		t, err := c.nextToken()
-		if err != nil {
-			return err
-		}
-		if t, ok := t.(xml.StartElement); ok {
-			// FIXME namespace
-			switch t.Name.Local {
-			case "starttls":
-				var f struct {
-					Required xml.Name `xml:"required"`
-				}
-				err = c.decoder.DecodeElement(&f, &t)
-				if err != nil {
-					return err
-				}
-				features["starttls"] = StartTLS{f.Required.Local != ""}
-			case "bind":
-				features["bind"] = Bind{}
-				c.decoder.Skip()
-			case "mechanisms":
-				var f struct {
-					Mechanisms []struct {
-						Name string `xml:",chardata"`
-					} `xml:"mechanism"`
-				}
-				err = c.decoder.DecodeElement(&f, &t)
-				if err != nil {
-					return err
-				}
-				mechanisms := make(SASL, len(f.Mechanisms))
-				for i, m := range f.Mechanisms {
-					mechanisms[i] = m.Name
-				}
-				features["sasl"] = mechanisms
-			default:
-				features[t.Name.Local] = UnsupportedFeature{t.Name.Local}
-				c.decoder.Skip()
-
-			}
-		} else {
-			break
-		}
+	sf, err := ParseStreamFeatures(c.decoder, t)
+	if err != nil {
+		return err
 	}
 
-	c.features = features
+	c.setFeatures(sf)
 	return nil
 }
 
+// setFeatures records the features advertised by the server.
+func (c *Conn) setFeatures(sf StreamFeatures) {
+	c.mu.Lock()
+	c.streamFeatures = sf
+	c.features = sf.Features()
+	c.mu.Unlock()
+}
+
 func (c *Conn) Features() Features {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.features
 }
+
+// StreamFeatures returns the features advertised by the server after
+// the most recent stream restart, or re-advertised by it later on.
+func (c *Conn) StreamFeatures() StreamFeatures {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streamFeatures
+}
+
+// readvertised handles features the server sent after the stream has
+// been negotiated. Some servers advertise features that only become
+// available later on, like stream management.
+func (c *Conn) readvertised(t *xml.StartElement) error {
+	sf, err := ParseStreamFeatures(c.decoder, t)
+	if err != nil {
+		return err
+	}
+	c.setFeatures(sf)
+
+	if c.StreamManagement && sf.StreamManagement && c.State() == StateBound {
+		c.sm.mu.Lock()
+		enabled := c.sm.outbound
+		c.sm.mu.Unlock()
+		if !enabled {
+			return c.enableSM()
+		}
+	}
+	return nil
+}
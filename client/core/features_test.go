@@ -0,0 +1,236 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStreamFeatures(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want core.StreamFeatures
+		// startTLS is whether STARTTLS is offered, and tlsRequired
+		// whether it is mandatory.
+		startTLS, tlsRequired bool
+		// required are the names of the features that must be
+		// negotiated.
+		required []string
+	}{
+		{
+			name: "Prosody before authentication",
+			in: `<stream:features xmlns:stream="http://etherx.jabber.org/streams" xmlns="jabber:client">
+  <starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"><required/></starttls>
+</stream:features>`,
+			startTLS:    true,
+			tlsRequired: true,
+			required:    []string{"starttls"},
+		},
+		{
+			name: "Prosody after STARTTLS",
+			in: `<stream:features xmlns:stream="http://etherx.jabber.org/streams" xmlns="jabber:client">
+  <mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl">
+    <mechanism>SCRAM-SHA-1-PLUS</mechanism>
+    <mechanism>SCRAM-SHA-1</mechanism>
+    <mechanism>PLAIN</mechanism>
+  </mechanisms>
+  <register xmlns="http://jabber.org/features/iq-register"/>
+</stream:features>`,
+			want: core.StreamFeatures{
+				Mechanisms: core.SASL{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1", "PLAIN"},
+				Register:   true,
+			},
+			required: []string{"sasl"},
+		},
+		{
+			name: "Prosody after authentication",
+			in: `<stream:features xmlns:stream="http://etherx.jabber.org/streams" xmlns="jabber:client">
+  <bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><required/></bind>
+  <session xmlns="urn:ietf:params:xml:ns:xmpp-session"><optional/></session>
+  <c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="http://prosody.im" ver="5vKzT7JqHx0CSpkqOTT8bZ2ZFiI="/>
+  <ver xmlns="urn:xmpp:features:rosterver"/>
+  <sm xmlns="urn:xmpp:sm:2"><optional/></sm>
+  <sm xmlns="urn:xmpp:sm:3"><optional/></sm>
+  <csi xmlns="urn:xmpp:csi:0"/>
+</stream:features>`,
+			want: core.StreamFeatures{
+				Bind:             true,
+				Session:          &core.Session{Optional: true},
+				StreamManagement: true,
+				RosterVersioning: true,
+				CSI:              true,
+				Unknown: []xml.Name{
+					{Space: "http://jabber.org/protocol/caps", Local: "c"},
+					{Space: "urn:xmpp:sm:2", Local: "sm"},
+				},
+			},
+			required: []string{"bind"},
+		},
+		{
+			name: "ejabberd before authentication",
+			in: `<stream:features xmlns:stream='http://etherx.jabber.org/streams' xmlns='jabber:client'>
+  <c xmlns='http://jabber.org/protocol/caps' hash='sha-1' node='http://www.process-one.net/en/ejabberd/' ver='x'/>
+  <register xmlns='http://jabber.org/features/iq-register'/>
+  <mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism><mechanism>SCRAM-SHA-256</mechanism><mechanism>X-OAUTH2</mechanism></mechanisms>
+  <compression xmlns='http://jabber.org/features/compress'><method>zlib</method></compression>
+  <authentication xmlns='urn:xmpp:sasl:2'><mechanism>SCRAM-SHA-256</mechanism><inline><bind xmlns='urn:xmpp:bind:0'/><fast xmlns='urn:xmpp:fast:0'><mechanism>HT-SHA-256-NONE</mechanism></fast></inline></authentication>
+</stream:features>`,
+			want: core.StreamFeatures{
+				Mechanisms:  core.SASL{"PLAIN", "SCRAM-SHA-256", "X-OAUTH2"},
+				SASL2:       &core.SASL2{Mechanisms: []string{"SCRAM-SHA-256"}, Bind: true, FAST: []string{"HT-SHA-256-NONE"}},
+				Compression: core.Compression{"zlib"},
+				Register:    true,
+				Unknown:     []xml.Name{{Space: "http://jabber.org/protocol/caps", Local: "c"}},
+			},
+			required: []string{"sasl", "sasl2"},
+		},
+		{
+			name: "ejabberd after authentication",
+			in: `<stream:features xmlns:stream='http://etherx.jabber.org/streams' xmlns='jabber:client'>
+  <bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>
+  <session xmlns='urn:ietf:params:xml:ns:xmpp-session'><optional/></session>
+  <sub xmlns='urn:xmpp:features:pre-approval'/>
+  <ver xmlns='urn:xmpp:features:rosterver'/>
+  <sm xmlns='urn:xmpp:sm:3'/>
+  <csi xmlns='urn:xmpp:csi:0'/>
+</stream:features>`,
+			want: core.StreamFeatures{
+				Bind:             true,
+				Session:          &core.Session{Optional: true},
+				StreamManagement: true,
+				RosterVersioning: true,
+				PreApproval:      true,
+				CSI:              true,
+			},
+			required: []string{"bind"},
+		},
+		{
+			name: "required unknown feature",
+			in:   `<stream:features xmlns:stream="http://etherx.jabber.org/streams"><exotic xmlns="urn:example:exotic"><required/></exotic></stream:features>`,
+			want: core.StreamFeatures{
+				Unknown:         []xml.Name{{Space: "urn:example:exotic", Local: "exotic"}},
+				RequiredUnknown: []xml.Name{{Space: "urn:example:exotic", Local: "exotic"}},
+			},
+			required: []string{"exotic"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := xml.NewDecoder(strings.NewReader(tt.in))
+			tok, err := d.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := tok.(xml.StartElement)
+			got, err := core.ParseStreamFeatures(d, &start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got.StartTLS != nil) != tt.startTLS || (got.StartTLS != nil && got.StartTLS.Required() != tt.tlsRequired) {
+				t.Errorf("got STARTTLS %+v, want offered %t and required %t", got.StartTLS, tt.startTLS, tt.tlsRequired)
+			}
+
+			features := got.Features()
+			got.StartTLS = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			var required []string
+			for name := range features {
+				if features.Requires(name) {
+					required = append(required, name)
+				}
+			}
+			sort.Strings(required)
+			if !reflect.DeepEqual(required, tt.required) {
+				t.Errorf("got required features %v, want %v", required, tt.required)
+			}
+		})
+	}
+}
+
+func TestReadvertisedFeatures(t *testing.T) {
+	const csi = "<csi xmlns='urn:xmpp:csi:0'/>"
+	tests := []struct {
+		name     string
+		enableSM bool
+		features string
+		// wantEnable is whether the client has to enable stream
+		// management in response.
+		wantEnable bool
+		wantSM     bool
+		wantCSI    bool
+	}{
+		{name: "stream management", enableSM: true, features: sm, wantEnable: true, wantSM: true},
+		{name: "stream management not wanted", features: sm, wantSM: true},
+		{name: "client state indication", enableSM: true, features: csi, wantCSI: true},
+		{name: "both", enableSM: true, features: csi + sm, wantEnable: true, wantSM: true, wantCSI: true},
+		{name: "empty", enableSM: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.StreamManagement = tt.enableSM
+
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if c.StreamFeatures().StreamManagement {
+				t.Fatal("stream management advertised during negotiation")
+			}
+			stanzas := xmpptest.Stanzas(c)
+
+			go s.Send("<stream:features>" + tt.features + "</stream:features>" +
+				"<message xmlns='jabber:client' from='bob@example.com'><body>after</body></message>")
+			if tt.wantEnable {
+				e, err := s.NextElement()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.XMLName.Space != "urn:xmpp:sm:3" || e.XMLName.Local != "enable" {
+					t.Fatalf("got %v, want a request to enable stream management", e.XMLName)
+				}
+				go s.Send("<enabled xmlns='urn:xmpp:sm:3'/>")
+			}
+
+			// The features aren't delivered as a stanza, and the
+			// stream continues after them.
+			select {
+			case stanza := <-stanzas:
+				if msg, ok := stanza.(*core.Message); !ok || msg.Body != "after" {
+					t.Fatalf("got %#v, want the message following the features", stanza)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no stanza delivered after the features")
+			}
+
+			sf := c.StreamFeatures()
+			if sf.StreamManagement != tt.wantSM || sf.CSI != tt.wantCSI {
+				t.Errorf("got features %+v", sf)
+			}
+			if got := c.Features().Includes("csi"); got != tt.wantCSI {
+				t.Errorf("Features().Includes(\"csi\") = %t, want %t", got, tt.wantCSI)
+			}
+			if c.State() != core.StateBound {
+				t.Errorf("got state %v, want %v", c.State(), core.StateBound)
+			}
+		})
+	}
+}
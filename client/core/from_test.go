@@ -0,0 +1,76 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"testing"
+)
+
+func TestFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		omitFrom bool
+		want     string
+	}{
+		{name: "default", want: "alice@example.com/xmpptest"},
+		{name: "omitted", omitFrom: true, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.OmitFrom = tt.omitFrom
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- func() error {
+					header, err := s.ReadStreamHeader()
+					if err != nil {
+						return err
+					}
+					for _, attr := range header.Attr {
+						if attr.Name.Local == "from" {
+							t.Errorf("stream header has from %q without TLS", attr.Value)
+						}
+					}
+					s.OpenStream("<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms>")
+					s.NextElement()
+					s.Send("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+					s.RestartStream()
+					s.OpenStream("<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>")
+
+					bind, err := s.NextElement()
+					if err != nil {
+						return err
+					}
+					if from := bind.Attribute("from"); from != "" {
+						t.Errorf("bind IQ has from %q", from)
+					}
+					return s.Sendf("<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>alice@example.com/xmpptest</jid></bind></iq>",
+						bind.Attribute("id"))
+				}()
+			}()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if got := c.From(); got != tt.want {
+				t.Errorf("got From() = %q, want %q", got, tt.want)
+			}
+			go c.SendIQ("example.com", "get", version{})
+			iq, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := iq.Attribute("from"); got != tt.want {
+				t.Errorf("got IQ from %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package core
+
+// SetStanzaHandler makes the connection deliver received stanzas by
+// calling h from the read loop, instead of queueing them for
+// NextStanza. This avoids a channel handoff and a goroutine per
+// stanza, which matters for clients processing large volumes of
+// stanzas. It has to be called before connecting, and NextStanza must
+// not be used afterwards.
+//
+// XEPs process stanzas on the read loop as well, and h is called with
+// the stanzas they emit after the original one. Neither h nor the
+// XEPs may block; in particular, they must not wait for the reply to
+// an IQ, which would be read by the very loop they're blocking.
+// Errors returned by XEPs are dropped, and the loss of the connection
+// is only reported via OnStateChange and Err.
+func (c *Conn) SetStanzaHandler(h func(Stanza)) {
+	c.stanzaHandler = h
+}
+
+// handleStanza delivers a stanza and the stanzas derived from it to
+// the stanza handler.
+func (c *Conn) handleStanza(stanza taggedStanza) {
+	if stanza.stanza != nil {
+		c.stanzaHandler(stanza.stanza)
+	}
+	for _, derived := range c.process(stanza) {
+		c.handleStanza(derived)
+	}
+}
@@ -0,0 +1,61 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"strings"
+	"testing"
+)
+
+// benchConn connects a client configured by setup to a Server.
+func benchConn(b *testing.B, setup func(c *core.Conn)) (*core.Conn, *xmpptest.Server) {
+	b.Helper()
+	conn, s := xmpptest.Pipe()
+	b.Cleanup(func() { s.Conn.Close() })
+	c := core.NewConnection(conn, "alice", s.Domain, "secret")
+	setup(c)
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Negotiate() }()
+	if errs := c.Dial(); len(errs) > 0 {
+		b.Fatal(errs)
+	}
+	if err := <-errc; err != nil {
+		b.Fatal(err)
+	}
+	return c, s
+}
+
+func BenchmarkStanzaDelivery(b *testing.B) {
+	const msg = "<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'><body>hi</body></message>"
+
+	b.Run("channel", func(b *testing.B) {
+		c, s := benchConn(b, func(c *core.Conn) {})
+		b.ReportAllocs()
+		b.ResetTimer()
+		go s.Send(strings.Repeat(msg, b.N))
+		for i := 0; i < b.N; i++ {
+			if _, err := c.NextStanza(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("handler", func(b *testing.B) {
+		n := 0
+		done := make(chan struct{})
+		_, s := benchConn(b, func(c *core.Conn) {
+			c.SetStanzaHandler(func(core.Stanza) {
+				n++
+				if n == b.N {
+					close(done)
+				}
+			})
+		})
+		b.ReportAllocs()
+		b.ResetTimer()
+		go s.Send(strings.Repeat(msg, b.N))
+		<-done
+	})
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidJID is returned when a JID is malformed.
+var ErrInvalidJID = errors.New("xmpp: invalid JID")
+
+// validJID checks the structure of a JID (RFC 7622): an optional
+// localpart, a mandatory domainpart and an optional resourcepart, each
+// at most 1023 bytes long. Parts aren't normalized, it is up to the
+// server to reject JIDs that are invalid otherwise.
+func validJID(jid string) bool {
+	if !utf8.ValidString(jid) {
+		return false
+	}
+
+	rest := jid
+	if i := strings.Index(rest, "/"); i >= 0 {
+		if resource := rest[i+1:]; resource == "" || len(resource) > 1023 {
+			return false
+		}
+		rest = rest[:i]
+	}
+	if i := strings.Index(rest, "@"); i >= 0 {
+		local := rest[:i]
+		if local == "" || len(local) > 1023 || strings.ContainsAny(local, "\"&':<>@ \t") {
+			return false
+		}
+		rest = rest[i+1:]
+	}
+	domain := strings.TrimSuffix(rest, ".")
+	return domain != "" && len(domain) <= 1023 && !strings.ContainsAny(domain, " \t@")
+}
+
+// JID is a Jabber ID (RFC 7622) of the form localpart@domainpart/
+// resourcepart, where only the domainpart is mandatory.
+//
+// The methods comparing JIDs normalize them first: localparts and
+// domainparts are compared case-insensitively and the trailing dot of
+// a fully qualified domainpart is ignored, while resourceparts are
+// compared as they are. Other normalization required by PRECIS, like
+// Unicode normalization, is left to the server, which delivers
+// normalized JIDs.
+type JID string
+
+func (j JID) split() (local, domain, resource string) {
+	rest := string(j)
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, resource = rest[:i], rest[i+1:]
+	}
+	if i := strings.Index(rest, "@"); i >= 0 {
+		local, rest = rest[:i], rest[i+1:]
+	}
+	return local, rest, resource
+}
+
+// Local returns the localpart of the JID, if any.
+func (j JID) Local() string {
+	local, _, _ := j.split()
+	return local
+}
+
+// Domain returns the domainpart of the JID.
+func (j JID) Domain() string {
+	_, domain, _ := j.split()
+	return domain
+}
+
+// Resource returns the resourcepart of the JID, if any.
+func (j JID) Resource() string {
+	_, _, resource := j.split()
+	return resource
+}
+
+// Bare returns the JID without its resourcepart.
+func (j JID) Bare() JID {
+	if i := strings.Index(string(j), "/"); i >= 0 {
+		return j[:i]
+	}
+	return j
+}
+
+// IsBare reports whether the JID has no resourcepart.
+func (j JID) IsBare() bool {
+	return !strings.Contains(string(j), "/")
+}
+
+// normalizedBare returns the normalized bare JID.
+func (j JID) normalizedBare() string {
+	local, domain, _ := j.split()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if local == "" {
+		return domain
+	}
+	return strings.ToLower(local) + "@" + domain
+}
+
+// normalized returns the normalized JID.
+func (j JID) normalized() string {
+	if j.IsBare() {
+		return j.normalizedBare()
+	}
+	return j.normalizedBare() + "/" + j.Resource()
+}
+
+// EqualBare reports whether both JIDs have the same bare JID,
+// regardless of their resourceparts.
+func (j JID) EqualBare(other JID) bool {
+	return j.normalizedBare() == other.normalizedBare()
+}
+
+// EqualFull reports whether both JIDs are the same, including their
+// resourceparts.
+func (j JID) EqualFull(other JID) bool {
+	return j.normalized() == other.normalized()
+}
+
+// MatchesBare reports whether the JID is addressed by bare, that is
+// whether it is bare itself or one of its resources. If bare has a
+// resourcepart, the JIDs have to be equal.
+func (j JID) MatchesBare(bare JID) bool {
+	if !bare.IsBare() {
+		return j.EqualFull(bare)
+	}
+	return j.EqualBare(bare)
+}
+
+// JIDSet is a set of JIDs, for example of blocked or muted entities.
+// A bare JID in the set contains all of its resources, a full JID
+// only itself. The zero value is an empty set. A JIDSet must not be
+// used concurrently without synchronization.
+type JIDSet struct {
+	// m maps normalized JIDs to the JIDs as they have been added.
+	m map[string]JID
+}
+
+// Add adds a JID to the set.
+func (s *JIDSet) Add(j JID) {
+	if s.m == nil {
+		s.m = make(map[string]JID)
+	}
+	s.m[j.normalized()] = j
+}
+
+// Remove removes a JID that is equal to j from the set. Removing a
+// bare JID doesn't remove its resources that have been added
+// separately.
+func (s *JIDSet) Remove(j JID) {
+	delete(s.m, j.normalized())
+}
+
+// Contains reports whether j or its bare JID has been added.
+func (s *JIDSet) Contains(j JID) bool {
+	if _, ok := s.m[j.normalized()]; ok {
+		return true
+	}
+	_, ok := s.m[j.normalizedBare()]
+	return ok
+}
+
+// Len returns the number of JIDs in the set.
+func (s *JIDSet) Len() int {
+	return len(s.m)
+}
+
+// JIDs returns the JIDs in the set, as they have been added, in no
+// particular order.
+func (s *JIDSet) JIDs() []JID {
+	out := make([]JID, 0, len(s.m))
+	for _, j := range s.m {
+		out = append(out, j)
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"sort"
+	"testing"
+)
+
+func TestJIDParts(t *testing.T) {
+	tests := []struct {
+		jid                     core.JID
+		local, domain, resource string
+		bare                    core.JID
+	}{
+		{jid: "juliet@example.com/balcony", local: "juliet", domain: "example.com", resource: "balcony", bare: "juliet@example.com"},
+		{jid: "juliet@example.com", local: "juliet", domain: "example.com", bare: "juliet@example.com"},
+		{jid: "example.com/service", domain: "example.com", resource: "service", bare: "example.com"},
+		{jid: "example.com", domain: "example.com", bare: "example.com"},
+		// Only the first slash separates the resourcepart, which
+		// may contain slashes and at signs of its own.
+		{jid: "juliet@example.com/a/b@c", local: "juliet", domain: "example.com", resource: "a/b@c", bare: "juliet@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.jid), func(t *testing.T) {
+			if got := tt.jid.Local(); got != tt.local {
+				t.Errorf("Local() = %q, want %q", got, tt.local)
+			}
+			if got := tt.jid.Domain(); got != tt.domain {
+				t.Errorf("Domain() = %q, want %q", got, tt.domain)
+			}
+			if got := tt.jid.Resource(); got != tt.resource {
+				t.Errorf("Resource() = %q, want %q", got, tt.resource)
+			}
+			if got := tt.jid.Bare(); got != tt.bare {
+				t.Errorf("Bare() = %q, want %q", got, tt.bare)
+			}
+			if got := tt.jid.IsBare(); got != (tt.resource == "") {
+				t.Errorf("IsBare() = %t", got)
+			}
+		})
+	}
+}
+
+func TestJIDComparison(t *testing.T) {
+	tests := []struct {
+		a, b                       core.JID
+		equalBare, equalFull, bare bool
+	}{
+		{a: "juliet@example.com/balcony", b: "juliet@example.com/balcony", equalBare: true, equalFull: true, bare: true},
+		{a: "Juliet@Example.COM/balcony", b: "juliet@example.com/balcony", equalBare: true, equalFull: true, bare: true},
+		{a: "juliet@example.com./balcony", b: "juliet@example.com/balcony", equalBare: true, equalFull: true, bare: true},
+		// Resourceparts are case-sensitive.
+		{a: "juliet@example.com/balcony", b: "juliet@example.com/Balcony", equalBare: true},
+		{a: "juliet@example.com/balcony", b: "juliet@example.com/garden", equalBare: true},
+		{a: "juliet@example.com/balcony", b: "JULIET@example.com", equalBare: true, bare: true},
+		{a: "juliet@example.com", b: "juliet@example.com", equalBare: true, equalFull: true, bare: true},
+		{a: "juliet@example.com", b: "juliet@example.com/balcony", equalBare: true},
+		{a: "juliet@example.com/balcony", b: "romeo@example.com"},
+		{a: "juliet@example.com/balcony", b: "juliet@example.net"},
+		// A domain isn't the bare JID of its users.
+		{a: "juliet@example.com", b: "example.com"},
+		{a: "example.com/service", b: "EXAMPLE.com", equalBare: true, bare: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.a)+" "+string(tt.b), func(t *testing.T) {
+			if got := tt.a.EqualBare(tt.b); got != tt.equalBare {
+				t.Errorf("EqualBare = %t, want %t", got, tt.equalBare)
+			}
+			if got := tt.b.EqualBare(tt.a); got != tt.equalBare {
+				t.Errorf("EqualBare isn't symmetric")
+			}
+			if got := tt.a.EqualFull(tt.b); got != tt.equalFull {
+				t.Errorf("EqualFull = %t, want %t", got, tt.equalFull)
+			}
+			if got := tt.a.MatchesBare(tt.b); got != tt.bare {
+				t.Errorf("MatchesBare = %t, want %t", got, tt.bare)
+			}
+		})
+	}
+}
+
+func TestJIDSet(t *testing.T) {
+	var set core.JIDSet
+	if set.Contains("juliet@example.com") || set.Len() != 0 {
+		t.Fatal("zero value isn't empty")
+	}
+	set.Add("Romeo@Example.com")
+	set.Add("nurse@example.com/Kitchen")
+	set.Add("romeo@example.com")
+
+	tests := []struct {
+		jid  core.JID
+		want bool
+	}{
+		{jid: "romeo@example.com", want: true},
+		{jid: "ROMEO@example.com/phone", want: true},
+		{jid: "nurse@example.com/Kitchen", want: true},
+		{jid: "nurse@EXAMPLE.com./Kitchen", want: true},
+		{jid: "nurse@example.com/kitchen"},
+		{jid: "nurse@example.com"},
+		{jid: "example.com"},
+	}
+	for _, tt := range tests {
+		if got := set.Contains(tt.jid); got != tt.want {
+			t.Errorf("Contains(%q) = %t, want %t", tt.jid, got, tt.want)
+		}
+	}
+
+	// Adding an equal JID replaces the earlier one.
+	jids := set.JIDs()
+	sort.Slice(jids, func(i, j int) bool { return jids[i] < jids[j] })
+	if len(jids) != 2 || jids[0] != "nurse@example.com/Kitchen" || jids[1] != "romeo@example.com" {
+		t.Errorf("got JIDs %q", jids)
+	}
+
+	// Removing a bare JID leaves resources added on their own.
+	set.Add("nurse@example.com")
+	set.Remove("NURSE@example.com")
+	if !set.Contains("nurse@example.com/Kitchen") || set.Contains("nurse@example.com/bedroom") {
+		t.Error("removing the bare JID affected the full one")
+	}
+	set.Remove("romeo@example.com/phone")
+	if !set.Contains("romeo@example.com") || set.Len() != 2 {
+		t.Errorf("removing a resource affected its bare JID, %d JIDs left", set.Len())
+	}
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrNotTCP is returned when setting TCP options on a connection that
+// doesn't use TCP, like an in-memory pipe.
+var ErrNotTCP = errors.New("xmpp: connection doesn't use TCP")
+
+// SetTCPKeepAlive enables TCP keep-alive probes with the given period
+// on the TCP connection underlying the stream, looking through TLS if
+// necessary. A period of zero disables them. The setting applies to
+// the current connection only and has to be repeated after
+// reconnecting.
+func (c *Conn) SetTCPKeepAlive(period time.Duration) error {
+	tcp, ok := tcpConn(c.Conn)
+	if !ok {
+		return ErrNotTCP
+	}
+
+	if period <= 0 {
+		return tcp.SetKeepAlive(false)
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcp.SetKeepAlivePeriod(period)
+}
+
+// tcpConn returns the TCP connection conn is based on.
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case *tls.Conn:
+			conn = c.NetConn()
+		case countingConn:
+			conn = c.Conn
+		default:
+			return nil, false
+		}
+	}
+}
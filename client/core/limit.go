@@ -0,0 +1,16 @@
+package core
+
+import "errors"
+
+var ErrStanzaTooLarge = errors.New("xmpp: stanza exceeds the maximum size")
+
+// limitStanza allows reading MaxStanzaSize bytes past the end of the
+// last element that has been decoded. It must only be called from the
+// goroutine reading from the connection.
+func (c *Conn) limitStanza() {
+	if c.MaxStanzaSize <= 0 {
+		c.readLimit = 0
+		return
+	}
+	c.readLimit = c.decoder.InputOffset() + c.MaxStanzaSize
+}
@@ -0,0 +1,87 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"strings"
+	"testing"
+)
+
+func TestMaxStanzaSize(t *testing.T) {
+	const limit = 1024
+	message := func(size int) string {
+		return "<message xmlns='jabber:client' from='bob@example.com'><body>" + strings.Repeat("a", size) + "</body></message>"
+	}
+	many := make([]string, 20)
+	for i := range many {
+		many[i] = message(100)
+	}
+
+	tests := []struct {
+		name    string
+		stanzas []string
+		// want is the number of stanzas received before the stream
+		// is closed, if it is closed.
+		want     int
+		tooLarge bool
+	}{
+		{name: "small", stanzas: []string{message(10)}, want: 1},
+		// The limit applies to each stanza, not to the stream.
+		{name: "many small", stanzas: many, want: len(many)},
+		{name: "message", stanzas: []string{message(10), message(100000)}, want: 1, tooLarge: true},
+		{
+			name: "iq payload",
+			stanzas: []string{"<iq xmlns='jabber:client' type='set' id='big' from='example.com'><query xmlns='urn:example:big'>" +
+				strings.Repeat("<item/>", 10000) + "</query></iq>"},
+			tooLarge: true,
+		},
+		{
+			name:     "unterminated",
+			stanzas:  []string{"<message xmlns='jabber:client'><body>" + strings.Repeat("a", 10*limit)},
+			tooLarge: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.MaxStanzaSize = limit
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			// The client stops reading in the middle of an oversized
+			// stanza, which blocks the write until the connection is
+			// closed.
+			go s.Send(strings.Join(tt.stanzas, ""))
+			for i := 0; i < tt.want; i++ {
+				if _, err := c.NextStanza(); err != nil {
+					t.Fatalf("stanza %d: %v", i, err)
+				}
+			}
+			if !tt.tooLarge {
+				return
+			}
+
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.XMLName.Local != "error" || !strings.Contains(string(e.Inner), "policy-violation") {
+				t.Errorf("got <%s>%s, want a policy-violation stream error", e.XMLName.Local, e.Inner)
+			}
+			_, err = c.NextStanza()
+			if derr, ok := err.(core.DisconnectError); !ok || derr.Err != core.ErrStanzaTooLarge {
+				t.Fatalf("got %v, want a disconnect because of %v", err, core.ErrStanzaTooLarge)
+			}
+		})
+	}
+}
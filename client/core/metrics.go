@@ -0,0 +1,143 @@
+package core
+
+import (
+	"expvar"
+)
+
+// Metrics receives measurements about a connection. Its methods are
+// called from the goroutines reading from and writing to the
+// connection and must not block.
+type Metrics interface {
+	// StanzaSent is called for every sent stanza. kind is one of
+	// "message", "presence" and "iq".
+	StanzaSent(kind string)
+	// StanzaReceived is called for every received stanza.
+	StanzaReceived(kind string)
+	// BytesSent and BytesReceived are called with the number of
+	// bytes written to and read from the connection.
+	BytesSent(n int)
+	BytesReceived(n int)
+	// OutstandingIQs is called with the number of IQs that are
+	// waiting for a reply whenever that number changes.
+	OutstandingIQs(n int)
+	// StateChanged is called after every state transition.
+	StateChanged(state State)
+	// Reconnecting is called whenever the connection attempts to
+	// reconnect.
+	Reconnecting()
+}
+
+type noMetrics struct{}
+
+func (noMetrics) StanzaSent(string)     {}
+func (noMetrics) StanzaReceived(string) {}
+func (noMetrics) BytesSent(int)         {}
+func (noMetrics) BytesReceived(int)     {}
+func (noMetrics) OutstandingIQs(int)    {}
+func (noMetrics) StateChanged(State)    {}
+func (noMetrics) Reconnecting()         {}
+
+// SetMetrics sets the receiver of measurements about the connection.
+// It is immediately informed of the current state. Passing nil
+// disables measuring.
+func (c *Conn) SetMetrics(m Metrics) {
+	c.metricsMu.Lock()
+	c.metrics = m
+	c.metricsMu.Unlock()
+
+	if m != nil {
+		m.StateChanged(c.State())
+	}
+}
+
+func (c *Conn) m() Metrics {
+	c.metricsMu.RLock()
+	defer c.metricsMu.RUnlock()
+	if c.metrics == nil {
+		return noMetrics{}
+	}
+	return c.metrics
+}
+
+// transport is the connection as used by the decoder and encoder,
+// which are the only ones that may read from and write to it.
+type transport struct {
+	c *Conn
+}
+
+func (t transport) Read(b []byte) (int, error) {
+	c := t.c
+	if c.readLimit > 0 {
+		remaining := c.readLimit - c.readTotal
+		if remaining <= 0 {
+			return 0, ErrStanzaTooLarge
+		}
+		if int64(len(b)) > remaining {
+			b = b[:remaining]
+		}
+	}
+
+	n, err := c.Conn.Read(b)
+	c.readTotal += int64(n)
+	if n > 0 {
+		c.m().BytesReceived(n)
+		c.debugRaw("RECV", b[:n])
+		c.captureRaw(b[:n])
+	}
+	return n, err
+}
+
+func (t transport) Write(b []byte) (int, error) {
+	c := t.c
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.m().BytesSent(n)
+		c.debugRaw("SEND", b[:n])
+	}
+	return n, err
+}
+
+// stanzaKind returns the kind of stanza v is, or the empty string if
+// it isn't a stanza.
+func stanzaKind(v interface{}) string {
+	switch v.(type) {
+	case Message, *Message:
+		return "message"
+	case Presence, *Presence:
+		return "presence"
+	case IQ, *IQ, outgoingIQ, *outgoingIQ:
+		return "iq"
+	default:
+		return ""
+	}
+}
+
+// ExpvarMetrics collects metrics in an expvar.Map, which can be
+// published with expvar.Publish or served by expvar's HTTP handler.
+//
+// The map contains the counters "sent.<kind>", "received.<kind>",
+// "bytes.sent", "bytes.received" and "reconnects", and the gauges
+// "iqs.outstanding" and "state".
+type ExpvarMetrics struct {
+	*expvar.Map
+	iqs   expvar.Int
+	state expvar.String
+}
+
+// NewExpvarMetrics returns metrics backed by a new, unpublished
+// expvar.Map.
+func NewExpvarMetrics() *ExpvarMetrics {
+	m := &ExpvarMetrics{Map: new(expvar.Map).Init()}
+	m.state.Set(StateDisconnected.String())
+	m.Set("iqs.outstanding", &m.iqs)
+	m.Set("state", &m.state)
+	return m
+}
+
+func (m *ExpvarMetrics) StanzaSent(kind string)     { m.Add("sent."+kind, 1) }
+func (m *ExpvarMetrics) StanzaReceived(kind string) { m.Add("received."+kind, 1) }
+func (m *ExpvarMetrics) BytesSent(n int)            { m.Add("bytes.sent", int64(n)) }
+func (m *ExpvarMetrics) BytesReceived(n int)        { m.Add("bytes.received", int64(n)) }
+func (m *ExpvarMetrics) OutstandingIQs(n int)       { m.iqs.Set(int64(n)) }
+func (m *ExpvarMetrics) StateChanged(state State)   { m.state.Set(state.String()) }
+func (m *ExpvarMetrics) Reconnecting()              { m.Add("reconnects", 1) }
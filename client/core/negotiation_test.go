@@ -0,0 +1,171 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+const (
+	mechanisms = "<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms>"
+	bind       = "<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>"
+	compress   = "<compression xmlns='http://jabber.org/features/compress'><method>zlib</method></compression>"
+	register   = "<register xmlns='http://jabber.org/features/iq-register'/>"
+	sm         = "<sm xmlns='urn:xmpp:sm:3'/>"
+	session    = "<session xmlns='urn:ietf:params:xml:ns:xmpp-session'/>"
+	optSession = "<session xmlns='urn:ietf:params:xml:ns:xmpp-session'><optional/></session>"
+	ver        = "<ver xmlns='urn:xmpp:features:rosterver'/>"
+)
+
+// negotiate is the server side of a negotiation offering the given
+// features before and after authentication. It answers the bind
+// request and, if session is true, the session request.
+func negotiate(s *xmpptest.Server, before, after string, session bool) error {
+	if _, err := s.ReadStreamHeader(); err != nil {
+		return err
+	}
+	s.OpenStream(before)
+	if auth, err := s.NextElement(); err != nil || auth.XMLName.Local != "auth" {
+		return fmt.Errorf("expected <auth>, got %v, %v", auth.XMLName, err)
+	}
+	s.Send("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+	if _, err := s.RestartStream(); err != nil {
+		return err
+	}
+	s.OpenStream(after)
+
+	iq, err := s.NextElement()
+	if err != nil {
+		return err
+	}
+	s.Sendf("<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>alice@example.com/xmpptest</jid></bind></iq>",
+		iq.Attribute("id"))
+	if !session {
+		return nil
+	}
+
+	iq, err = s.NextElement()
+	if err != nil {
+		return err
+	}
+	if string(iq.Inner) != "<session xmlns=\"urn:ietf:params:xml:ns:xmpp-session\"></session>" || iq.Attribute("to") != s.Domain {
+		return fmt.Errorf("expected a session request, got %s", iq.Inner)
+	}
+	return s.Sendf("<iq type='result' id='%s' from='%s'/>", iq.Attribute("id"), s.Domain)
+}
+
+func TestNegotiationOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  string
+		after   string
+		session bool
+	}{
+		{name: "minimal", before: mechanisms, after: bind},
+		{name: "compression first", before: compress + mechanisms, after: bind},
+		{name: "compression last", before: mechanisms + compress + register, after: bind},
+		{name: "bind last", before: mechanisms, after: sm + ver + bind},
+		{name: "optional session", before: mechanisms, after: optSession + bind},
+		{name: "required session", before: mechanisms, after: bind + session, session: true},
+		{name: "required session first", before: mechanisms, after: session + sm + bind, session: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+
+			errc := make(chan error, 1)
+			go func() { errc <- negotiate(s, tt.before, tt.after, tt.session) }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if c.State() != core.StateBound || c.JID() != "alice@example.com/xmpptest" {
+				t.Errorf("got state %v and JID %q", c.State(), c.JID())
+			}
+		})
+	}
+}
+
+func TestRequiredUnsupportedFeature(t *testing.T) {
+	exotic := xml.Name{Space: "urn:example:exotic", Local: "exotic"}
+	tests := []struct {
+		name    string
+		before  string
+		after   string
+		wantErr bool
+	}{
+		{name: "optional before authentication", before: "<exotic xmlns='urn:example:exotic'/>" + mechanisms, after: bind},
+		{name: "optional after authentication", before: mechanisms, after: bind + "<exotic xmlns='urn:example:exotic'/>"},
+		{name: "required after authentication", before: mechanisms, after: bind + "<exotic xmlns='urn:example:exotic'><required/></exotic>", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+
+			go negotiate(s, tt.before, tt.after, false)
+			errs := c.Dial()
+			if !tt.wantErr {
+				if len(errs) > 0 {
+					t.Fatal(errs)
+				}
+				return
+			}
+
+			var unsupported core.UnsupportedFeatureError
+			if len(errs) != 1 || !errors.As(errs[0], &unsupported) || unsupported.Feature != exotic {
+				t.Fatalf("got errors %v, want an UnsupportedFeatureError for %v", errs, exotic)
+			}
+			if !c.Features().Requires("exotic") {
+				t.Error("feature isn't reported as required")
+			}
+		})
+	}
+}
+
+func TestStreamHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		streamID string
+		domain   string
+	}{
+		{name: "default", streamID: "xmpptest", domain: "example.com"},
+		{name: "random ID", streamID: "8bd5c3b1-26b5-4a6a-9c9a-0e0d3b7f2f1a", domain: "example.com"},
+		{name: "other domain", streamID: "++TR84Sm6A3hnt3Q065SnAbbk3Y=", domain: "chat.example.org"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			s.StreamID = tt.streamID
+			s.Domain = tt.domain
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			want := core.StreamHeader{ID: tt.streamID, From: tt.domain, Version: "1.0", Lang: "en"}
+			if got := c.StreamHeader(); got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// derived is a stanza emitted by a deriving XEP.
+type derived struct {
+	label string
+}
+
+func (d derived) ID() string    { return d.label }
+func (d derived) IsError() bool { return false }
+
+// deriving is an XEP that emits a stanza for every message, and for
+// every stanza derived by the XEP named by from.
+type deriving struct {
+	core.Client
+	name string
+	from string
+}
+
+func (x deriving) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	switch stanza := stanza.(type) {
+	case *core.Message:
+		return []core.Stanza{derived{x.name + "(" + stanza.Id + ")"}}, nil
+	case derived:
+		if x.from != "" && strings.HasPrefix(stanza.label, x.from+"(") {
+			return []core.Stanza{derived{x.name + "(" + stanza.label + ")"}}, nil
+		}
+	}
+	return nil, nil
+}
+
+func init() {
+	core.RegisterXEP("test-derive-a", func(c core.Client) (core.XEP, error) {
+		return deriving{Client: c, name: "a"}, nil
+	})
+	core.RegisterXEP("test-derive-b", func(c core.Client) (core.XEP, error) {
+		return deriving{Client: c, name: "b", from: "a"}, nil
+	})
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		xeps []string
+		want []string
+	}{
+		{name: "no XEPs", want: []string{"m1", "m2", "m3"}},
+		{name: "one XEP", xeps: []string{"test-derive-a"}, want: []string{"m1", "a(m1)", "m2", "a(m2)", "m3", "a(m3)"}},
+		{
+			// Stanzas derived from derived stanzas come right after
+			// the stanza they were derived from.
+			name: "chained",
+			xeps: []string{"test-derive-a", "test-derive-b"},
+			want: []string{
+				"m1", "a(m1)", "b(a(m1))", "b(m1)",
+				"m2", "a(m2)", "b(a(m2))", "b(m2)",
+				"m3", "a(m3)", "b(a(m3))", "b(m3)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for _, name := range tt.xeps {
+				if _, err := c.RegisterXEP(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// All messages arrive at once, so that the read loop is
+			// ahead of the stanzas derived from them.
+			go s.Send("<message xmlns='jabber:client' from='bob@example.com/phone' id='m1'/>" +
+				"<message xmlns='jabber:client' from='bob@example.com/phone' id='m2'/>" +
+				"<message xmlns='jabber:client' from='bob@example.com/phone' id='m3'/>")
+
+			var got []string
+			for range tt.want {
+				stanza, err := c.NextStanza()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, stanza.ID())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// DecodePayload looks for a child element with the given namespace
+// and local name in inner, which is the inner XML of a stanza, and
+// decodes it into v. It reports whether such an element was found.
+func DecodePayload(inner []byte, space, local string, v interface{}) (bool, error) {
+	d := xml.NewDecoder(bytes.NewReader(inner))
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Space == space && start.Name.Local == local {
+			return true, d.DecodeElement(v, &start)
+		}
+		if err := d.Skip(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// PayloadNames returns the names of all child elements in inner,
+// which is the inner XML of a stanza.
+func PayloadNames(inner []byte) []xml.Name {
+	var names []xml.Name
+	d := xml.NewDecoder(bytes.NewReader(inner))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return names
+		}
+
+		if start, ok := t.(xml.StartElement); ok {
+			names = append(names, start.Name)
+			if d.Skip() != nil {
+				return names
+			}
+		}
+	}
+}
+
+// HasPayload reports whether inner, the inner XML of a stanza,
+// contains a child element with the given namespace and local name.
+func HasPayload(inner []byte, space, local string) bool {
+	for _, name := range PayloadNames(inner) {
+		if name.Space == space && name.Local == local {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AppendPayload marshals v and appends it to inner, which is the
+// inner XML of a stanza that is about to be sent. This is how
+// extension elements are attached to messages and presences.
+func AppendPayload(inner []byte, v interface{}) ([]byte, error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return inner, err
+	}
+
+	return append(inner, b...), nil
+}
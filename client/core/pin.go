@@ -0,0 +1,88 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+)
+
+// ErrCertificateNotPinned is wrapped by the CertificateError returned
+// when none of the server's certificates has been pinned.
+var ErrCertificateNotPinned = errors.New("certificate doesn't match any pin")
+
+// CertificateError is returned when the server's TLS certificate is
+// rejected, either because it couldn't be verified or by
+// PinCertificate and VerifyPeerCertificate.
+type CertificateError struct {
+	Err error
+}
+
+func (e CertificateError) Error() string {
+	return "xmpp: TLS certificate rejected: " + e.Err.Error()
+}
+
+func (e CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// PinCertificate pins a certificate by the SHA-256 hash of its DER
+// encoding. Once a certificate has been pinned, connections are only
+// established if the server's verified certificate chain contains a
+// pinned certificate, which may be the server's own certificate or an
+// intermediate or root one. Pinning happens in addition to the usual
+// verification. Pins must be added before connecting.
+func (c *Conn) PinCertificate(sum [sha256.Size]byte) {
+	c.mu.Lock()
+	c.pins = append(c.pins, sum)
+	c.mu.Unlock()
+}
+
+// verifyPeer is called by the TLS handshake after the certificate
+// chain has been verified.
+func (c *Conn) verifyPeer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	c.mu.Lock()
+	pins := c.pins
+	c.mu.Unlock()
+
+	// Pins are only checked against the verified chains. The
+	// certificates presented by the server may include any
+	// certificate, in particular intermediate ones that don't belong
+	// to the chain. Without verification, only the server's own
+	// certificate can be trusted to belong to it, as the handshake
+	// proves that the server holds its key.
+	candidates := verifiedChains
+	if c.InsecureSkipTLSVerify {
+		candidates = nil
+		if len(rawCerts) > 0 {
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return CertificateError{err}
+			}
+			candidates = [][]*x509.Certificate{{cert}}
+		}
+	}
+	if len(pins) > 0 && !pinned(pins, candidates) {
+		return CertificateError{ErrCertificateNotPinned}
+	}
+
+	if c.VerifyPeerCertificate != nil {
+		if err := c.VerifyPeerCertificate(rawCerts, verifiedChains); err != nil {
+			return CertificateError{err}
+		}
+	}
+	return nil
+}
+
+func pinned(pins [][sha256.Size]byte, chains [][]*x509.Certificate) bool {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.Raw)
+			for _, pin := range pins {
+				if sum == pin {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
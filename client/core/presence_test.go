@@ -0,0 +1,129 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"testing"
+)
+
+func TestSendPresence(t *testing.T) {
+	// wire records which of the optional elements were sent.
+	type wire struct {
+		Show     *string `xml:"show"`
+		Status   *string `xml:"status"`
+		Priority *string `xml:"priority"`
+	}
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		presence core.Presence
+		want     wire
+		wantErr  error
+	}{
+		// None of the optional elements may be sent empty.
+		{name: "available", presence: core.Presence{}},
+		{
+			name:     "dnd",
+			presence: core.Presence{Show: core.ShowDND, Status: "In a meeting", Priority: 5},
+			want:     wire{Show: str("dnd"), Status: str("In a meeting"), Priority: str("5")},
+		},
+		{name: "negative priority", presence: core.Presence{Priority: -1}, want: wire{Priority: str("-1")}},
+		{name: "invalid show", presence: core.Presence{Show: "busy"}, wantErr: core.ErrInvalidShow},
+		{name: "priority too high", presence: core.Presence{Priority: 128}, wantErr: core.ErrInvalidPriority},
+		{name: "priority too low", presence: core.Presence{Priority: -129}, wantErr: core.ErrInvalidPriority},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			xmpptest.Stanzas(c)
+
+			errc := make(chan error, 1)
+			go func() {
+				_, err := c.SendPresence(tt.presence)
+				errc <- err
+			}()
+			if tt.wantErr != nil {
+				if err := <-errc; err != tt.wantErr {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			var got wire
+			if err := xml.Unmarshal([]byte("<presence>"+string(e.Inner)+"</presence>"), &got); err != nil {
+				t.Fatal(err)
+			}
+			check := func(name string, got, want *string) {
+				switch {
+				case got == nil && want != nil:
+					t.Errorf("<%s> is missing", name)
+				case got != nil && want == nil:
+					t.Errorf("sent <%s>%s</%s>", name, *got, name)
+				case got != nil && *got != *want:
+					t.Errorf("got <%s>%s</%s>, want %s", name, *got, name, *want)
+				}
+			}
+			check("show", got.Show, tt.want.Show)
+			check("status", got.Status, tt.want.Status)
+			check("priority", got.Priority, tt.want.Priority)
+		})
+	}
+}
+
+func TestReceivePresence(t *testing.T) {
+	tests := []struct {
+		name         string
+		inner        string
+		wantShow     core.Show
+		wantStatus   string
+		wantPriority int
+	}{
+		{name: "available", wantShow: core.ShowAvailable},
+		{name: "dnd", inner: "<show>dnd</show><status>In a meeting</status><priority>-1</priority>", wantShow: core.ShowDND, wantStatus: "In a meeting", wantPriority: -1},
+		{name: "chat", inner: "<show>chat</show>", wantShow: core.ShowChat},
+		{name: "away", inner: "<show>away</show>", wantShow: core.ShowAway},
+		{name: "xa", inner: "<show>xa</show>", wantShow: core.ShowXA},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			go s.Sendf("<presence xmlns='jabber:client' from='bob@example.com/phone'>%s</presence>", tt.inner)
+			stanza, err := c.NextStanza()
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := stanza.(*core.Presence)
+			if !ok {
+				t.Fatalf("got %T, want *core.Presence", stanza)
+			}
+			if p.Show != tt.wantShow || p.Status != tt.wantStatus || p.Priority != tt.wantPriority {
+				t.Errorf("got show %q, status %q and priority %d, want %q, %q and %d",
+					p.Show, p.Status, p.Priority, tt.wantShow, tt.wantStatus, tt.wantPriority)
+			}
+			if !p.Show.Valid() {
+				t.Errorf("show %q isn't valid", p.Show)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package core
+
+// rawCapture holds the bytes read from the connection that might
+// still belong to a stanza, for KeepRawXML.
+type rawCapture struct {
+	buf []byte
+	// base is the decoder's input offset of buf[0], start the offset
+	// at which the current element starts.
+	base  int64
+	start int64
+}
+
+// captureRaw records data read from the connection.
+func (c *Conn) captureRaw(b []byte) {
+	if c.KeepRawXML {
+		c.raw.buf = append(c.raw.buf, b...)
+	}
+}
+
+// resetRaw drops all captured data, for when a new decoder starts
+// reading at offset zero.
+func (c *Conn) resetRaw() {
+	c.raw = rawCapture{}
+}
+
+// markRaw records that the next token read by the decoder might start
+// an element, dropping the data before it.
+func (c *Conn) markRaw() {
+	if !c.KeepRawXML {
+		return
+	}
+	offset := c.decoder.InputOffset()
+	if n := int(offset - c.raw.base); n > 0 && n <= len(c.raw.buf) {
+		c.raw.buf = append(c.raw.buf[:0], c.raw.buf[n:]...)
+		c.raw.base = offset
+	}
+	c.raw.start = offset
+}
+
+// rawElement returns a copy of the element that has been decoded
+// since the last call to markRaw.
+func (c *Conn) rawElement() []byte {
+	start, end := int(c.raw.start-c.raw.base), int(c.decoder.InputOffset()-c.raw.base)
+	if start < 0 || end > len(c.raw.buf) || start > end {
+		return nil
+	}
+	return append([]byte(nil), c.raw.buf[start:end]...)
+}
+
+// attachRaw stores the XML a stanza has been decoded from in the
+// stanza, if KeepRawXML is set.
+func (c *Conn) attachRaw(s Stanza) {
+	if !c.KeepRawXML {
+		return
+	}
+	switch s := s.(type) {
+	case *Message:
+		s.Raw = c.rawElement()
+	case *Presence:
+		s.Raw = c.rawElement()
+	case *IQ:
+		s.Raw = c.rawElement()
+	}
+}
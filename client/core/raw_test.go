@@ -0,0 +1,114 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"testing"
+)
+
+func TestKeepRawXML(t *testing.T) {
+	tests := []struct {
+		name string
+		// chunks are sent one after the other, with the stanza split
+		// across them.
+		chunks []string
+		// want is the raw XML of the stanza, or empty if none may be
+		// kept.
+		want string
+		// disabled doesn't set KeepRawXML.
+		disabled bool
+	}{
+		{
+			name:   "message",
+			chunks: []string{"<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'><body>caf&#xE9; &amp; cake</body></message>"},
+			want:   "<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'><body>caf&#xE9; &amp; cake</body></message>",
+		},
+		{
+			name:   "presence with prefixes",
+			chunks: []string{"<presence xmlns='jabber:client' from='bob@example.com/phone'>\n  <c:c xmlns:c='http://jabber.org/protocol/caps' hash='sha-1' node='n' ver='v'/>\n</presence>"},
+			want:   "<presence xmlns='jabber:client' from='bob@example.com/phone'>\n  <c:c xmlns:c='http://jabber.org/protocol/caps' hash='sha-1' node='n' ver='v'/>\n</presence>",
+		},
+		{
+			name:   "iq",
+			chunks: []string{`<iq xmlns="jabber:client" type="get" id="v1" from="bob@example.com/phone"><query xmlns="jabber:iq:version"/></iq>`},
+			want:   `<iq xmlns="jabber:client" type="get" id="v1" from="bob@example.com/phone"><query xmlns="jabber:iq:version"/></iq>`,
+		},
+		{
+			name:   "split and surrounded by whitespace",
+			chunks: []string{"\n\n  <message xmlns='jabber:client' from='bob@example.com/ph", "one'><body>hi</bo", "dy></message>\n "},
+			want:   "<message xmlns='jabber:client' from='bob@example.com/phone'><body>hi</body></message>",
+		},
+		{
+			name:     "disabled",
+			chunks:   []string{"<message xmlns='jabber:client' from='bob@example.com/phone'><body>hi</body></message>"},
+			disabled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.KeepRawXML = !tt.disabled
+			// The IQ has to reach NextStanza instead of being
+			// rejected.
+			c.DeliverUnhandledIQs = true
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			// A message before and after the stanza makes sure that
+			// neighbouring data isn't captured.
+			go func() {
+				s.Send("<message xmlns='jabber:client' from='example.com' id='before'/>")
+				for _, chunk := range tt.chunks {
+					s.Send(chunk)
+				}
+				s.Send("<message xmlns='jabber:client' from='example.com' id='after'/>")
+			}()
+
+			var raws [][]byte
+			for i := 0; i < 3; i++ {
+				stanza, err := c.NextStanza()
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch stanza := stanza.(type) {
+				case *core.Message:
+					raws = append(raws, stanza.Raw)
+				case *core.Presence:
+					raws = append(raws, stanza.Raw)
+				case *core.IQ:
+					raws = append(raws, stanza.Raw)
+				default:
+					t.Fatalf("got unexpected %T", stanza)
+				}
+			}
+
+			if tt.disabled {
+				for _, raw := range raws {
+					if raw != nil {
+						t.Errorf("got raw XML %q without KeepRawXML", raw)
+					}
+				}
+				return
+			}
+			if got := string(raws[1]); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if got, want := string(raws[0]), "<message xmlns='jabber:client' from='example.com' id='before'/>"; got != want {
+				t.Errorf("got %q before the stanza, want %q", got, want)
+			}
+			if got, want := string(raws[2]), "<message xmlns='jabber:client' from='example.com' id='after'/>"; got != want {
+				t.Errorf("got %q after the stanza, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "auth",
+			in:   "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>AGFsaWNlAHNlY3JldA==</auth>",
+			want: "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>[redacted]</auth>",
+		},
+		{
+			name: "nested",
+			in:   "<authenticate xmlns='urn:xmpp:sasl:2' mechanism='HT-SHA-256-NONE'>\n  <initial-response>c2VjcmV0</initial-response>\n</authenticate>",
+			want: "<authenticate xmlns='urn:xmpp:sasl:2' mechanism='HT-SHA-256-NONE'>\n  <initial-response>[redacted]</initial-response>\n</authenticate>",
+		},
+		{
+			name: "token attribute",
+			in:   `<token xmlns="urn:xmpp:fast:0" expiry="2026-10-16T12:00:00Z" token = "s3cr3t"/>`,
+			want: `<token xmlns="urn:xmpp:fast:0" expiry="2026-10-16T12:00:00Z" token = "[redacted]"/>`,
+		},
+		{
+			name: "empty elements",
+			in:   "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>",
+			want: "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>",
+		},
+		{
+			name: "CDATA",
+			in:   "<response><![CDATA[c2VjcmV0]]></response>",
+			want: "<response><[redacted]></response>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Splitting the input anywhere must not leak anything.
+			for i := 0; i <= len(tt.in); i++ {
+				var r redactor
+				got := string(r.redact([]byte(tt.in[:i]))) + string(r.redact([]byte(tt.in[i:])))
+				if i == 0 || i == len(tt.in) {
+					if got != tt.want {
+						t.Fatalf("got %q, want %q", got, tt.want)
+					}
+					continue
+				}
+				if stripped := removePlaceholders(got); stripped != removePlaceholders(tt.want) {
+					t.Fatalf("split at %d: got %q, want %q", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// removePlaceholders removes all placeholders, which are repeated
+// where the input has been split.
+func removePlaceholders(s string) string {
+	return strings.ReplaceAll(s, redacted, "")
+}
@@ -0,0 +1,101 @@
+package core
+
+// An IQHandler answers an IQ request. The returned value is sent as
+// the payload of the result, nil for an empty result. If an error is
+// returned, an error reply is sent instead: *Error and Error are sent
+// as they are, all other errors as internal-server-error.
+//
+// Handlers are called in their own goroutine, so they may block, for
+// example to send IQs of their own.
+type IQHandler func(iq *IQ) (interface{}, error)
+
+type iqRoute struct {
+	typ   string
+	space string
+}
+
+// HandleIQ registers a handler for IQs of type typ ("get" or "set")
+// whose payload is in the namespace space. IQs that have been handled
+// aren't delivered by NextStanza. Registering a nil handler removes
+// the route.
+func (c *Conn) HandleIQ(typ, space string, h IQHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[iqRoute]IQHandler)
+	}
+	if h == nil {
+		delete(c.handlers, iqRoute{typ, space})
+		return
+	}
+	c.handlers[iqRoute{typ, space}] = h
+}
+
+// DeliverIQ declares that IQs of type typ whose payload is in the
+// namespace space are answered by a XEP's Process method instead of a
+// handler, usually because the XEP emits them as synthetic stanzas.
+// They are delivered by NextStanza instead of being rejected as
+// unhandled.
+func (c *Conn) DeliverIQ(typ, space string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[iqRoute]IQHandler)
+	}
+	c.handlers[iqRoute{typ, space}] = nil
+}
+
+// routeIQ dispatches an IQ request to its handler. It reports whether
+// the IQ has been taken care of, either by a handler or by rejecting
+// it. Requests arriving after we closed the stream are dropped.
+//
+// Requests must contain exactly one payload (RFC 6120 8.2.3), others
+// are answered with bad-request.
+func (c *Conn) routeIQ(iq *IQ) bool {
+	if iq.Type != "get" && iq.Type != "set" {
+		return false
+	}
+	if c.isClosing() {
+		// Nothing may be sent after our closing tag (RFC 6120 4.4),
+		// so requests can't be answered anymore.
+		return true
+	}
+	payload := PayloadNames(iq.Inner)
+	if len(payload) != 1 {
+		c.SendError(iq, "modify", "", ErrBadRequest{})
+		return true
+	}
+
+	c.mu.Lock()
+	h, ok := c.handlers[iqRoute{iq.Type, payload[0].Space}]
+	c.mu.Unlock()
+
+	if !ok {
+		if c.DeliverUnhandledIQs {
+			return false
+		}
+		c.SendError(iq, "cancel", "", ErrServiceUnavailable{})
+		return true
+	}
+	if h == nil {
+		// Registered with DeliverIQ.
+		return false
+	}
+
+	go c.serveIQ(h, iq)
+	return true
+}
+
+func (c *Conn) serveIQ(h IQHandler, iq *IQ) {
+	v, err := h(iq)
+	switch err := err.(type) {
+	case nil:
+		c.SendIQReply(iq, "result", v)
+	case *Error:
+		c.Encode(errorReply(iq, err))
+	case Error:
+		c.Encode(errorReply(iq, &err))
+	default:
+		c.SendError(iq, "cancel", "", ErrInternalServerError{})
+	}
+}
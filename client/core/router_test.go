@@ -0,0 +1,133 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+type version struct {
+	XMLName xml.Name `xml:"jabber:iq:version query"`
+	Name    string   `xml:"name"`
+}
+
+func TestRouteIQ(t *testing.T) {
+	tests := []struct {
+		name    string
+		deliver bool
+		setup   func(c *core.Conn)
+		payload string
+		// reply is the type and the content the reply has to
+		// contain, or empty if the IQ must be delivered by
+		// NextStanza instead.
+		reply, contains string
+	}{
+		{
+			name:     "no payload",
+			payload:  "",
+			reply:    "error",
+			contains: "bad-request",
+		},
+		{
+			name:     "two payloads",
+			payload:  "<query xmlns='jabber:iq:version'/><query xmlns='jabber:iq:last'/>",
+			reply:    "error",
+			contains: "bad-request",
+		},
+		{
+			name:     "unhandled",
+			payload:  "<query xmlns='jabber:iq:version'/>",
+			reply:    "error",
+			contains: "service-unavailable",
+		},
+		{
+			name:    "unhandled, delivered",
+			deliver: true,
+			payload: "<query xmlns='jabber:iq:version'/>",
+		},
+		{
+			name: "handled",
+			setup: func(c *core.Conn) {
+				c.HandleIQ("get", "jabber:iq:version", func(*core.IQ) (interface{}, error) {
+					return version{Name: "xmpptest"}, nil
+				})
+			},
+			payload:  "<query xmlns='jabber:iq:version'/>",
+			reply:    "result",
+			contains: "<name>xmpptest</name>",
+		},
+		{
+			name: "handler error",
+			setup: func(c *core.Conn) {
+				c.HandleIQ("get", "jabber:iq:version", func(*core.IQ) (interface{}, error) {
+					return nil, &core.Error{Type: "auth", Errors: core.XMPPErrors{core.ErrForbidden{}}}
+				})
+			},
+			payload:  "<query xmlns='jabber:iq:version'/>",
+			reply:    "error",
+			contains: "forbidden",
+		},
+		{
+			name: "removed handler",
+			setup: func(c *core.Conn) {
+				c.HandleIQ("get", "jabber:iq:version", func(*core.IQ) (interface{}, error) { return nil, nil })
+				c.HandleIQ("get", "jabber:iq:version", nil)
+			},
+			payload:  "<query xmlns='jabber:iq:version'/>",
+			reply:    "error",
+			contains: "service-unavailable",
+		},
+		{
+			name: "delivered",
+			setup: func(c *core.Conn) {
+				c.DeliverIQ("get", "jabber:iq:version")
+			},
+			payload: "<query xmlns='jabber:iq:version'/>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			c.DeliverUnhandledIQs = tt.deliver
+			if tt.setup != nil {
+				tt.setup(c)
+			}
+			stanzas := xmpptest.Stanzas(c)
+
+			s.Send("<iq xmlns='jabber:client' type='get' id='q1' from='bob@example.com/phone'>" + tt.payload + "</iq>")
+
+			if tt.reply == "" {
+				select {
+				case stanza := <-stanzas:
+					if iq, ok := stanza.(*core.IQ); !ok || iq.Id != "q1" {
+						t.Fatalf("got %#v, want the IQ", stanza)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("IQ wasn't delivered")
+				}
+				return
+			}
+
+			reply, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Attribute("id") != "q1" || reply.Attribute("to") != "bob@example.com/phone" {
+				t.Errorf("got reply %v, want a reply to q1", reply.Attr)
+			}
+			if reply.Attribute("type") != tt.reply || !strings.Contains(string(reply.Inner), tt.contains) {
+				t.Errorf("got %s reply %s, want a %s reply containing %s",
+					reply.Attribute("type"), reply.Inner, tt.reply, tt.contains)
+			}
+		})
+	}
+}
@@ -0,0 +1,517 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SupportedMechanisms lists the SASL mechanisms we support, in order
+// of preference. Mechanisms ending in -PLUS will only be used on TLS
+// connections. EXTERNAL, which authenticates with the TLS client
+// certificate, is supported but has to be added explicitly.
+var SupportedMechanisms = []string{
+	"SCRAM-SHA-256-PLUS",
+	"SCRAM-SHA-1-PLUS",
+	"SCRAM-SHA-256",
+	"SCRAM-SHA-1",
+	"PLAIN",
+}
+
+var (
+	ErrNoCompatibleMechanism = errors.New("xmpp: no compatible SASL mechanism")
+	ErrAnonymousUnsupported  = errors.New("xmpp: server doesn't support anonymous authentication")
+	// ErrServerUnverified is returned when the server signals
+	// success without having proven its identity to a mechanism
+	// that authenticates the server, too, like SCRAM.
+	ErrServerUnverified = errors.New("xmpp: server didn't prove its identity")
+)
+
+// SASLError is returned when the server rejects our authentication
+// attempt.
+type SASLError struct {
+	Condition string
+	Text      string
+}
+
+func (e SASLError) Error() string {
+	if e.Text == "" {
+		return "SASL failure: " + e.Condition
+	}
+
+	return fmt.Sprintf("SASL failure: %s (%s)", e.Condition, e.Text)
+}
+
+// A SASLMechanism implements the client side of a SASL mechanism. A
+// new instance is used for every authentication attempt.
+type SASLMechanism interface {
+	// Name returns the name of the mechanism, as advertised by the
+	// server.
+	Name() string
+	// Start returns the initial response.
+	Start() ([]byte, error)
+	// Next processes a challenge, or the additional data of a
+	// success, and returns the response.
+	Next(challenge []byte) ([]byte, error)
+}
+
+// mutualMechanism is implemented by mechanisms that authenticate the
+// server as well. Success is only accepted once the server has been
+// verified.
+type mutualMechanism interface {
+	verified() bool
+}
+
+// finishSASL passes the additional data of a success, if any, to the
+// mechanism and makes sure that the server has been verified.
+func finishSASL(mechanism SASLMechanism, data []byte) error {
+	if len(data) > 0 {
+		if _, err := mechanism.Next(data); err != nil {
+			return err
+		}
+	}
+	if m, ok := mechanism.(mutualMechanism); ok && !m.verified() {
+		return ErrServerUnverified
+	}
+	return nil
+}
+
+// A SASLMechanismFactory returns a mechanism authenticating as user
+// with password.
+type SASLMechanismFactory func(user, password string) SASLMechanism
+
+var builtinMechanisms = map[string]bool{
+	"ANONYMOUS":          true,
+	"EXTERNAL":           true,
+	"PLAIN":              true,
+	"SCRAM-SHA-1":        true,
+	"SCRAM-SHA-1-PLUS":   true,
+	"SCRAM-SHA-256":      true,
+	"SCRAM-SHA-256-PLUS": true,
+}
+
+var saslMechanisms = make(map[string]SASLMechanismFactory)
+
+// RegisterSASLMechanism makes a custom mechanism available for
+// authentication. The mechanism is added to the front of
+// SupportedMechanisms, making it the most preferred one.
+func RegisterSASLMechanism(name string, fn SASLMechanismFactory) {
+	if _, ok := saslMechanisms[name]; ok || builtinMechanisms[name] {
+		panic(fmt.Sprintf("SASL mechanism '%s' has already been registered", name))
+	}
+
+	saslMechanisms[name] = fn
+	SupportedMechanisms = append([]string{name}, SupportedMechanisms...)
+}
+
+type saslAuth struct {
+	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl auth"`
+	Mechanism string   `xml:"mechanism,attr"`
+	Data      string   `xml:",chardata"`
+}
+
+type saslResponse struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl response"`
+	Data    string   `xml:",chardata"`
+}
+
+type saslAbort struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl abort"`
+}
+
+type saslFailure struct {
+	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl failure"`
+	Condition xml.Name `xml:",any"`
+	Text      string   `xml:"text"`
+}
+
+// TODO move out of client package?
+func findCompatibleMechanism(ours, theirs []string) string {
+	for _, our := range ours {
+		for _, their := range theirs {
+			if our == their {
+				return our
+			}
+		}
+	}
+
+	return ""
+}
+
+// channelBinding returns the channel binding type and data of the
+// TLS connection, if any. For TLS 1.3, tls-exporter is used, because
+// tls-unique isn't defined for it.
+func (c *Conn) channelBinding() (string, []byte) {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return "", nil
+		}
+		return "tls-exporter", data
+	}
+
+	if len(state.TLSUnique) == 0 {
+		return "", nil
+	}
+	return "tls-unique", state.TLSUnique
+}
+
+func (c *Conn) newMechanism(name string, cbType string, cbData []byte) SASLMechanism {
+	// The GS2 channel binding flag tells the server whether we could
+	// have used channel binding. "y" means we could have, but the
+	// server didn't offer it, which allows detecting downgrades.
+	flag := "n"
+	if cbData != nil {
+		flag = "y"
+	}
+	if strings.HasSuffix(name, "-PLUS") {
+		flag = "p=" + cbType
+	} else {
+		cbData = nil
+	}
+
+	switch name {
+	case "ANONYMOUS":
+		return anonymous{}
+	case "EXTERNAL":
+		return external{}
+	case "PLAIN":
+		return plain{c.user, c.password}
+	case "SCRAM-SHA-1", "SCRAM-SHA-1-PLUS":
+		return &scram{name: name, hash: sha1.New, user: c.user, password: c.password, cbFlag: flag, cbData: cbData}
+	case "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS":
+		return &scram{name: name, hash: sha256.New, user: c.user, password: c.password, cbFlag: flag, cbData: cbData}
+	}
+
+	if fn, ok := saslMechanisms[name]; ok {
+		return fn(c.user, c.password)
+	}
+	return nil
+}
+
+func encodeSASL(data []byte) string {
+	if len(data) == 0 {
+		// RFC 6120 6.4.2: An empty response is transmitted as a
+		// single equals sign.
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func decodeSASL(data string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+	if data == "=" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// selectMechanism picks the most preferred mechanism that is
+// supported by us and the server.
+func (c *Conn) selectMechanism(theirs []string) (SASLMechanism, error) {
+	cbType, cbData := c.channelBinding()
+
+	var ours []string
+	if c.anonymous {
+		ours = []string{"ANONYMOUS"}
+	} else {
+		for _, m := range SupportedMechanisms {
+			if strings.HasSuffix(m, "-PLUS") && cbData == nil {
+				continue
+			}
+			ours = append(ours, m)
+		}
+	}
+
+	name := findCompatibleMechanism(ours, theirs)
+	if name == "" {
+		if c.anonymous {
+			return nil, ErrAnonymousUnsupported
+		}
+		return nil, ErrNoCompatibleMechanism
+	}
+
+	return c.newMechanism(name, cbType, cbData), nil
+}
+
+func (c *Conn) sasl() error {
+	c.redact(true)
+	defer c.redact(false)
+
+	mechanism, err := c.selectMechanism(c.streamFeatures.Mechanisms)
+	if err != nil {
+		return err
+	}
+
+	resp, err := mechanism.Start()
+	if err != nil {
+		return err
+	}
+	err = c.Encode(saslAuth{Mechanism: mechanism.Name(), Data: encodeSASL(resp)})
+	if err != nil {
+		return err
+	}
+
+	for {
+		t, err := c.nextStartElement()
+		if err != nil {
+			return err
+		}
+
+		switch t.Name.Local {
+		case "challenge":
+			var challenge struct {
+				Data string `xml:",chardata"`
+			}
+			if err := c.decoder.DecodeElement(&challenge, t); err != nil {
+				return err
+			}
+			data, err := decodeSASL(challenge.Data)
+			if err != nil {
+				c.Encode(saslAbort{})
+				return err
+			}
+			resp, err := mechanism.Next(data)
+			if err != nil {
+				c.Encode(saslAbort{})
+				return err
+			}
+			if err := c.Encode(saslResponse{Data: encodeSASL(resp)}); err != nil {
+				return err
+			}
+		case "success":
+			var success struct {
+				Data string `xml:",chardata"`
+			}
+			if err := c.decoder.DecodeElement(&success, t); err != nil {
+				return err
+			}
+			data, err := decodeSASL(success.Data)
+			if err != nil {
+				return err
+			}
+			return finishSASL(mechanism, data)
+		case "failure":
+			var failure saslFailure
+			if err := c.decoder.DecodeElement(&failure, t); err != nil {
+				return err
+			}
+			return SASLError{failure.Condition.Local, failure.Text}
+		default:
+			return UnexpectedMessage{t.Name.Local}
+		}
+	}
+}
+
+type plain struct {
+	user     string
+	password string
+}
+
+func (plain) Name() string {
+	return "PLAIN"
+}
+
+func (m plain) Start() ([]byte, error) {
+	return []byte("\x00" + m.user + "\x00" + m.password), nil
+}
+
+func (plain) Next([]byte) ([]byte, error) {
+	return nil, errors.New("xmpp: unexpected challenge for PLAIN")
+}
+
+// anonymous implements SASL ANONYMOUS (RFC 4505). We don't send any
+// trace information.
+type anonymous struct{}
+
+func (anonymous) Name() string {
+	return "ANONYMOUS"
+}
+
+func (anonymous) Start() ([]byte, error) {
+	return nil, nil
+}
+
+func (anonymous) Next([]byte) ([]byte, error) {
+	return nil, nil
+}
+
+// external implements SASL EXTERNAL (RFC 4422 Appendix A), which
+// relies on the TLS client certificate. We don't request an
+// authorization identity, letting the server derive it from the
+// certificate.
+type external struct{}
+
+func (external) Name() string {
+	return "EXTERNAL"
+}
+
+func (external) Start() ([]byte, error) {
+	return nil, nil
+}
+
+func (external) Next([]byte) ([]byte, error) {
+	return nil, errors.New("xmpp: unexpected challenge for EXTERNAL")
+}
+
+// scram implements the SCRAM family of mechanisms (RFC 5802, RFC
+// 7677), with and without channel binding.
+type scram struct {
+	name     string
+	hash     func() hash.Hash
+	user     string
+	password string
+	cbFlag   string
+	cbData   []byte
+
+	step            int
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	serverVerified  bool
+}
+
+func (m *scram) gs2Header() string {
+	return m.cbFlag + ",,"
+}
+
+func (m *scram) Name() string {
+	return m.name
+}
+
+func (m *scram) Start() ([]byte, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	m.nonce = base64.RawStdEncoding.EncodeToString(b)
+
+	// TODO SASLprep the user name and password
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(m.user)
+	m.clientFirstBare = "n=" + user + ",r=" + m.nonce
+	return []byte(m.gs2Header() + m.clientFirstBare), nil
+}
+
+func (m *scram) Next(challenge []byte) ([]byte, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		return m.clientFinal(challenge)
+	case 2:
+		return nil, m.verify(challenge)
+	default:
+		return nil, errors.New("xmpp: unexpected SCRAM challenge")
+	}
+}
+
+func parseSCRAM(msg []byte) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, field := range strings.Split(string(msg), ",") {
+		if len(field) < 2 || field[1] != '=' {
+			continue
+		}
+		attrs[field[0]] = field[2:]
+	}
+
+	return attrs
+}
+
+func (m *scram) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs := parseSCRAM(serverFirst)
+	if _, ok := attrs['m']; ok {
+		return nil, errors.New("xmpp: unsupported SCRAM extension")
+	}
+
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, m.nonce) || len(nonce) == len(m.nonce) {
+		return nil, errors.New("xmpp: invalid SCRAM nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return nil, err
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("xmpp: invalid SCRAM iteration count")
+	}
+
+	salted := pbkdf2(m.hash, []byte(m.password), salt, iterations)
+	clientKey := m.hmac(salted, []byte("Client Key"))
+	h := m.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	cb := base64.StdEncoding.EncodeToString(append([]byte(m.gs2Header()), m.cbData...))
+	withoutProof := "c=" + cb + ",r=" + nonce
+	authMessage := []byte(m.clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+
+	proof := m.hmac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	m.serverSignature = m.hmac(m.hmac(salted, []byte("Server Key")), authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (m *scram) verify(serverFinal []byte) error {
+	attrs := parseSCRAM(serverFinal)
+	if e, ok := attrs['e']; ok {
+		return SASLError{Condition: e}
+	}
+
+	v, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || !hmac.Equal(v, m.serverSignature) {
+		return errors.New("xmpp: invalid SCRAM server signature")
+	}
+
+	m.serverVerified = true
+	return nil
+}
+
+func (m *scram) verified() bool {
+	return m.serverVerified
+}
+
+func (m *scram) hmac(key, data []byte) []byte {
+	mac := hmac.New(m.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 implements PBKDF2 (RFC 2898) with HMAC, deriving a key as
+// long as the hash's output.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The FAST mechanisms we support, in order of preference.
+var supportedFASTMechanisms = []string{"HT-SHA-256-NONE"}
+
+var ErrSASL2Tasks = errors.New("xmpp: server requested unsupported SASL2 tasks")
+
+// UserAgent identifies the client during XEP-0388 authentication. An
+// ID is required for FAST tokens and should be a UUID that stays the
+// same for an installation of the client.
+type UserAgent struct {
+	ID       string `xml:"id,attr,omitempty"`
+	Software string `xml:"software,omitempty"`
+	Device   string `xml:"device,omitempty"`
+}
+
+// FASTToken is a token for XEP-0484 (Fast Authentication
+// Streamlining Tokens). It can be persisted and handed to a future
+// connection with SetFASTToken to speed up authentication. Tokens
+// must be stored as securely as passwords.
+type FASTToken struct {
+	Mechanism string
+	Token     string
+	Expiry    time.Time
+}
+
+// Expired reports whether the token has expired. Expired tokens are
+// discarded instead of being used for authentication.
+func (t FASTToken) Expired() bool {
+	return !t.Expiry.IsZero() && !clock.Now().Before(t.Expiry)
+}
+
+// FASTToken returns the most recent FAST token issued by the server.
+func (c *Conn) FASTToken() (FASTToken, bool) {
+	if c.fastToken == nil {
+		return FASTToken{}, false
+	}
+
+	return *c.fastToken, true
+}
+
+// SetFASTToken sets the token that will be used for authentication,
+// if the server supports it. It has to be called before Dial.
+func (c *Conn) SetFASTToken(t FASTToken) {
+	c.fastToken = &t
+}
+
+type sasl2Authenticate struct {
+	XMLName         xml.Name          `xml:"urn:xmpp:sasl:2 authenticate"`
+	Mechanism       string            `xml:"mechanism,attr"`
+	InitialResponse string            `xml:"initial-response"`
+	UserAgent       *UserAgent        `xml:"user-agent,omitempty"`
+	Bind            bind2             `xml:"urn:xmpp:bind:0 bind"`
+	RequestToken    *fastRequest      `xml:"urn:xmpp:fast:0 request-token,omitempty"`
+	FAST            *fastAuthenticate `xml:"urn:xmpp:fast:0 fast,omitempty"`
+}
+
+type bind2 struct {
+	Tag string `xml:"tag,omitempty"`
+}
+
+type fastRequest struct {
+	Mechanism string `xml:"mechanism,attr"`
+}
+
+type fastAuthenticate struct{}
+
+type sasl2Response struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 response"`
+	Data    string   `xml:",chardata"`
+}
+
+type sasl2Abort struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 abort"`
+}
+
+type sasl2Success struct {
+	AdditionalData          string `xml:"additional-data"`
+	AuthorizationIdentifier string `xml:"authorization-identifier"`
+	Token                   *struct {
+		Expiry string `xml:"expiry,attr"`
+		Token  string `xml:"token,attr"`
+	} `xml:"urn:xmpp:fast:0 token"`
+}
+
+// sasl2 authenticates and binds a resource using XEP-0388 and
+// XEP-0386. Unlike with SASL, the stream isn't restarted after
+// authentication.
+func (c *Conn) sasl2() error {
+	c.redact(true)
+	defer c.redact(false)
+
+	feature := c.streamFeatures.SASL2
+
+	var (
+		mechanism SASLMechanism
+		err       error
+	)
+	auth := sasl2Authenticate{Bind: bind2{Tag: c.UserAgent.Software}}
+	if c.UserAgent.ID != "" {
+		ua := c.UserAgent
+		auth.UserAgent = &ua
+	}
+
+	if c.fastToken != nil && c.fastToken.Expired() {
+		c.fastToken = nil
+	}
+	fast := c.fastToken != nil && !c.anonymous &&
+		findCompatibleMechanism([]string{c.fastToken.Mechanism}, feature.FAST) != ""
+	if fast {
+		mechanism = fastMechanism{c.fastToken.Mechanism, c.user, c.fastToken.Token}
+		auth.FAST = &fastAuthenticate{}
+	} else {
+		mechanism, err = c.selectMechanism(feature.Mechanisms)
+		if err != nil {
+			return err
+		}
+	}
+
+	if auth.UserAgent != nil && !c.anonymous {
+		// Request a new token, which also rotates the one we used.
+		if m := findCompatibleMechanism(supportedFASTMechanisms, feature.FAST); m != "" {
+			auth.RequestToken = &fastRequest{m}
+		}
+	}
+
+	resp, err := mechanism.Start()
+	if err != nil {
+		return err
+	}
+	auth.Mechanism = mechanism.Name()
+	auth.InitialResponse = encodeSASL(resp)
+	if err := c.Encode(auth); err != nil {
+		return err
+	}
+
+	for {
+		t, err := c.nextStartElement()
+		if err != nil {
+			return err
+		}
+
+		switch t.Name.Local {
+		case "challenge":
+			var challenge struct {
+				Data string `xml:",chardata"`
+			}
+			if err := c.decoder.DecodeElement(&challenge, t); err != nil {
+				return err
+			}
+			data, err := decodeSASL(challenge.Data)
+			if err != nil {
+				c.Encode(sasl2Abort{})
+				return err
+			}
+			resp, err := mechanism.Next(data)
+			if err != nil {
+				c.Encode(sasl2Abort{})
+				return err
+			}
+			if err := c.Encode(sasl2Response{Data: encodeSASL(resp)}); err != nil {
+				return err
+			}
+		case "success":
+			var success sasl2Success
+			if err := c.decoder.DecodeElement(&success, t); err != nil {
+				return err
+			}
+			var data []byte
+			if success.AdditionalData != "" {
+				data, err = decodeSASL(success.AdditionalData)
+				if err != nil {
+					return err
+				}
+			}
+			if err := finishSASL(mechanism, data); err != nil {
+				return err
+			}
+			if success.Token != nil {
+				tokenMechanism := mechanism.Name()
+				if auth.RequestToken != nil {
+					tokenMechanism = auth.RequestToken.Mechanism
+				}
+				expiry, err := xmpptime.ParseDateTime(success.Token.Expiry)
+				if err != nil {
+					return fmt.Errorf("xmpp: invalid expiry of FAST token: %w", err)
+				}
+				c.fastToken = &FASTToken{
+					Mechanism: tokenMechanism,
+					Token:     success.Token.Token,
+					Expiry:    expiry,
+				}
+			}
+			c.jid = strings.TrimSpace(success.AuthorizationIdentifier)
+			return nil
+		case "failure":
+			var failure struct {
+				Condition xml.Name `xml:",any"`
+				Text      string   `xml:"text"`
+			}
+			if err := c.decoder.DecodeElement(&failure, t); err != nil {
+				return err
+			}
+			if fast {
+				// The token has been rejected, don't try it again.
+				c.fastToken = nil
+			}
+			return SASLError{failure.Condition.Local, failure.Text}
+		case "continue":
+			c.Encode(sasl2Abort{})
+			return ErrSASL2Tasks
+		default:
+			return UnexpectedMessage{t.Name.Local}
+		}
+	}
+}
+
+// fastMechanism implements the HT-SHA-256-NONE mechanism of XEP-0484.
+type fastMechanism struct {
+	name  string
+	user  string
+	token string
+}
+
+func (m fastMechanism) Name() string {
+	return m.name
+}
+
+func (m fastMechanism) Start() ([]byte, error) {
+	mac := hmac.New(sha256.New, []byte(m.token))
+	mac.Write([]byte("Initiator"))
+	return append([]byte(m.user+"\x00"), mac.Sum(nil)...), nil
+}
+
+func (fastMechanism) Next([]byte) ([]byte, error) {
+	// The server doesn't send its proof in the NONE variant.
+	return nil, nil
+}
@@ -0,0 +1,121 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sasl2Features = "<authentication xmlns='urn:xmpp:sasl:2'><mechanism>PLAIN</mechanism>" +
+	"<inline><bind xmlns='urn:xmpp:bind:0'/><fast xmlns='urn:xmpp:fast:0'><mechanism>HT-SHA-256-NONE</mechanism></fast></inline>" +
+	"</authentication>"
+
+type sasl2Auth struct {
+	Mechanism       string    `xml:"mechanism,attr"`
+	InitialResponse string    `xml:"initial-response"`
+	FAST            *struct{} `xml:"urn:xmpp:fast:0 fast"`
+	RequestToken    *struct {
+		Mechanism string `xml:"mechanism,attr"`
+	} `xml:"urn:xmpp:fast:0 request-token"`
+}
+
+func TestFAST(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	valid := &core.FASTToken{Mechanism: "HT-SHA-256-NONE", Token: "stored-token", Expiry: now.Add(time.Hour)}
+	expired := &core.FASTToken{Mechanism: "HT-SHA-256-NONE", Token: "stored-token", Expiry: now.Add(-time.Hour)}
+
+	tests := []struct {
+		name     string
+		stored   *core.FASTToken
+		expiry   string
+		wantMech string
+		wantErr  error
+	}{
+		{name: "no token", expiry: xmpptime.FormatDateTime(now.Add(24 * time.Hour)), wantMech: "PLAIN"},
+		{name: "valid token", stored: valid, expiry: xmpptime.FormatDateTime(now.Add(24 * time.Hour)), wantMech: "HT-SHA-256-NONE"},
+		{name: "expired token", stored: expired, expiry: xmpptime.FormatDateTime(now.Add(24 * time.Hour)), wantMech: "PLAIN"},
+		{name: "invalid expiry", expiry: "tomorrow", wantMech: "PLAIN", wantErr: xmpptime.ErrInvalidFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.UserAgent = core.UserAgent{ID: "d4565fa7-4d72-4749-b3d3-740edbf87770", Software: "xmpptest"}
+			if tt.stored != nil {
+				c.SetFASTToken(*tt.stored)
+			}
+			var log syncBuffer
+			c.Debug = &log
+
+			authc := make(chan sasl2Auth, 1)
+			go func() {
+				s.ReadStreamHeader()
+				s.OpenStream(sasl2Features)
+				e, err := s.NextElement()
+				if err != nil {
+					close(authc)
+					return
+				}
+				auth := sasl2Auth{Mechanism: e.Attribute("mechanism")}
+				xml.Unmarshal([]byte("<authenticate>"+string(e.Inner)+"</authenticate>"), &auth)
+				authc <- auth
+				s.Send("<success xmlns='urn:xmpp:sasl:2'><authorization-identifier>alice@example.com/xmpptest</authorization-identifier>" +
+					"<token xmlns='urn:xmpp:fast:0' expiry='" + tt.expiry + "' token='issued-token'/></success>")
+			}()
+
+			errs := c.Dial()
+			auth, ok := <-authc
+			if !ok {
+				t.Fatal("no authentication request")
+			}
+
+			if auth.Mechanism != tt.wantMech {
+				t.Errorf("authenticated with %s, want %s", auth.Mechanism, tt.wantMech)
+			}
+			if auth.RequestToken == nil || auth.RequestToken.Mechanism != "HT-SHA-256-NONE" {
+				t.Error("no token requested")
+			}
+			if tt.wantMech == "HT-SHA-256-NONE" {
+				if auth.FAST == nil {
+					t.Error("authenticated with a token without <fast/>")
+				}
+				mac := hmac.New(sha256.New, []byte(tt.stored.Token))
+				mac.Write([]byte("Initiator"))
+				want := base64.StdEncoding.EncodeToString(append([]byte("alice\x00"), mac.Sum(nil)...))
+				if auth.InitialResponse != want {
+					t.Errorf("got initial response %q, want %q", auth.InitialResponse, want)
+				}
+			}
+			for _, secret := range []string{"stored-token", "issued-token", auth.InitialResponse} {
+				if strings.Contains(log.String(), secret) {
+					t.Errorf("debug log contains %q", secret)
+				}
+			}
+
+			if tt.wantErr != nil {
+				if len(errs) != 1 || !errors.Is(errs[0], tt.wantErr) {
+					t.Fatalf("got errors %v, want %v", errs, tt.wantErr)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			token, ok := c.FASTToken()
+			if !ok || token.Token != "issued-token" || !token.Expiry.Equal(now.Add(24*time.Hour)) {
+				t.Errorf("got token %+v, want the issued one", token)
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// scramServer is the server side of a SCRAM exchange.
+type scramServer struct {
+	password string
+	// cbData is the channel binding data of the server's end of the
+	// connection, for tls-exporter.
+	cbData []byte
+	// final is how the server signature is delivered: "success" in
+	// the additional data of the success, "challenge" in a final
+	// challenge, "forged" as a wrong signature, "missing" not at
+	// all, and "error" replaced by a server error.
+	final string
+
+	// mechanism and gs2 are the mechanism and GS2 header chosen by
+	// the client.
+	mechanism string
+	gs2       string
+}
+
+func (srv *scramServer) send(s *xmpptest.Server, name, data string) error {
+	return s.Send("<" + name + " xmlns='" + nsSASL + "'>" + base64.StdEncoding.EncodeToString([]byte(data)) + "</" + name + ">")
+}
+
+func (srv *scramServer) next(s *xmpptest.Server, name string) (string, error) {
+	e, err := s.NextElement()
+	if err != nil {
+		return "", err
+	}
+	if e.XMLName.Space != nsSASL || e.XMLName.Local != name {
+		return "", fmt.Errorf("expected <%s>, got <%s>", name, e.XMLName.Local)
+	}
+	if name == "auth" {
+		srv.mechanism = e.Attribute("mechanism")
+	}
+	inner := strings.TrimSpace(string(e.Inner))
+	if inner == "=" {
+		// An empty response.
+		return "", nil
+	}
+	data, err := base64.StdEncoding.DecodeString(inner)
+	return string(data), err
+}
+
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// authenticate runs the exchange, from the client's <auth> to the
+// outcome. It returns an error if the client misbehaved.
+func (srv *scramServer) authenticate(s *xmpptest.Server) error {
+	clientFirst, err := srv.next(s, "auth")
+	if err != nil {
+		return err
+	}
+	// The GS2 header consists of the channel binding flag and an
+	// empty authorization identity.
+	i := strings.Index(clientFirst, ",,")
+	if i < 0 {
+		return fmt.Errorf("malformed client-first-message %q", clientFirst)
+	}
+	srv.gs2, clientFirst = clientFirst[:i+2], clientFirst[i+2:]
+	h := sha1.New
+	if strings.HasPrefix(srv.mechanism, "SCRAM-SHA-256") {
+		h = sha256.New
+	}
+
+	salt := []byte("NaCl")
+	serverFirst := "r=" + scramAttrs(clientFirst)["r"] + "server-nonce,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+	if err := srv.send(s, "challenge", serverFirst); err != nil {
+		return err
+	}
+	clientFinal, err := srv.next(s, "response")
+	if err != nil {
+		return err
+	}
+	attrs := scramAttrs(clientFinal)
+
+	cb := []byte(srv.gs2)
+	if strings.HasPrefix(srv.gs2, "p=") {
+		cb = append(cb, srv.cbData...)
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString(cb) {
+		return fmt.Errorf("got channel binding %q, want %q", attrs["c"], base64.StdEncoding.EncodeToString(cb))
+	}
+	withoutProof := clientFinal[:strings.Index(clientFinal, ",p=")]
+	authMessage := []byte(clientFirst + "," + serverFirst + "," + withoutProof)
+
+	mac := func(key []byte, data string) []byte {
+		m := hmac.New(h, key)
+		m.Write([]byte(data))
+		return m.Sum(nil)
+	}
+	// Hi() of RFC 5802, PBKDF2 for a single block.
+	u := mac([]byte(srv.password), string(salt)+"\x00\x00\x00\x01")
+	salted := append([]byte(nil), u...)
+	for i := 1; i < 4096; i++ {
+		u = mac([]byte(srv.password), string(u))
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+	sum := h()
+	sum.Write(mac(salted, "Client Key"))
+	storedKey := sum.Sum(nil)
+	proof, err := base64.StdEncoding.DecodeString(attrs["p"])
+	if err != nil {
+		return err
+	}
+	// The proof is the client key masked with the client signature.
+	clientKey := mac(storedKey, string(authMessage))
+	if len(proof) != len(clientKey) {
+		return fmt.Errorf("got a proof of %d bytes", len(proof))
+	}
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	sum = h()
+	sum.Write(clientKey)
+	if !hmac.Equal(sum.Sum(nil), storedKey) {
+		return s.Send("<failure xmlns='" + nsSASL + "'><not-authorized/></failure>")
+	}
+
+	v := "v=" + base64.StdEncoding.EncodeToString(mac(mac(salted, "Server Key"), string(authMessage)))
+	switch srv.final {
+	case "success":
+		return srv.send(s, "success", v)
+	case "challenge":
+		if err := srv.send(s, "challenge", v); err != nil {
+			return err
+		}
+		if resp, err := srv.next(s, "response"); err != nil || resp != "" {
+			return fmt.Errorf("expected an empty response, got %q, %v", resp, err)
+		}
+		return s.Send("<success xmlns='" + nsSASL + "'/>")
+	case "forged":
+		return srv.send(s, "success", "v="+base64.StdEncoding.EncodeToString(make([]byte, h().Size())))
+	case "missing":
+		return s.Send("<success xmlns='" + nsSASL + "'/>")
+	case "error":
+		return srv.send(s, "success", "e=other-error")
+	}
+	return fmt.Errorf("unknown final %q", srv.final)
+}
+
+// dialSCRAM connects a client to a server offering mechanisms and
+// authenticating with srv, optionally negotiating TLS first.
+func dialSCRAM(t *testing.T, mechanisms []string, useTLS bool, password string, srv *scramServer) []error {
+	t.Helper()
+	var c *core.Conn
+	var s *xmpptest.Server
+	if useTLS {
+		conn, server, err := xmpptest.TCPPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, s = core.NewConnection(conn, "user", server.Domain, password), server
+		c.InsecureSkipTLSVerify = true
+	} else {
+		conn, server := xmpptest.Pipe()
+		c, s = core.NewConnection(conn, "user", server.Domain, password), server
+	}
+	t.Cleanup(func() { s.Conn.Close() })
+	cert := mustCertificate(t, s.Domain)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- func() error {
+			if useTLS {
+				if err := s.StartTLS(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+					return err
+				}
+				state := s.Conn.(*tls.Conn).ConnectionState()
+				srv.cbData, _ = state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+				if _, err := s.RestartStream(); err != nil {
+					return err
+				}
+			} else if _, err := s.ReadStreamHeader(); err != nil {
+				return err
+			}
+
+			var features strings.Builder
+			features.WriteString("<mechanisms xmlns='" + nsSASL + "'>")
+			for _, m := range mechanisms {
+				features.WriteString("<mechanism>" + m + "</mechanism>")
+			}
+			features.WriteString("</mechanisms>")
+			s.OpenStream(features.String())
+			if err := srv.authenticate(s); err != nil {
+				s.Conn.Close()
+				return err
+			}
+			return nil
+		}()
+		// The client either gives up or restarts the stream, either
+		// way the test is done with the server.
+		s.RestartStream()
+		s.OpenStream(bind)
+		if iq, err := s.NextElement(); err == nil {
+			s.Sendf("<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>user@example.com/xmpptest</jid></bind></iq>",
+				iq.Attribute("id"))
+		}
+	}()
+
+	errs := c.Dial()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return errs
+}
+
+func TestSCRAM(t *testing.T) {
+	tests := []struct {
+		name       string
+		mechanisms []string
+		tls        bool
+		password   string
+		wantMech   string
+		wantGS2    string
+		wantErr    bool
+	}{
+		{name: "SCRAM-SHA-1", mechanisms: []string{"SCRAM-SHA-1", "PLAIN"}, wantMech: "SCRAM-SHA-1", wantGS2: "n,,"},
+		{name: "SCRAM-SHA-256 preferred", mechanisms: []string{"PLAIN", "SCRAM-SHA-1", "SCRAM-SHA-256"}, wantMech: "SCRAM-SHA-256", wantGS2: "n,,"},
+		{name: "PLUS without TLS", mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"}, wantMech: "SCRAM-SHA-256", wantGS2: "n,,"},
+		{name: "SCRAM-SHA-256-PLUS", mechanisms: []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}, tls: true, wantMech: "SCRAM-SHA-256-PLUS", wantGS2: "p=tls-exporter,,"},
+		{name: "SCRAM-SHA-1-PLUS", mechanisms: []string{"SCRAM-SHA-1", "SCRAM-SHA-1-PLUS"}, tls: true, wantMech: "SCRAM-SHA-1-PLUS", wantGS2: "p=tls-exporter,,"},
+		// The client could have used channel binding, which lets the
+		// server detect that PLUS has been stripped from the offer.
+		{name: "PLUS not offered", mechanisms: []string{"SCRAM-SHA-256"}, tls: true, wantMech: "SCRAM-SHA-256", wantGS2: "y,,"},
+		{name: "wrong password", mechanisms: []string{"SCRAM-SHA-256"}, password: "wrong", wantMech: "SCRAM-SHA-256", wantGS2: "n,,", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password := tt.password
+			if password == "" {
+				password = "pencil"
+			}
+			srv := &scramServer{password: "pencil", final: "success"}
+			errs := dialSCRAM(t, tt.mechanisms, tt.tls, password, srv)
+
+			if srv.mechanism != tt.wantMech || srv.gs2 != tt.wantGS2 {
+				t.Errorf("authenticated with %s and GS2 header %q, want %s and %q", srv.mechanism, srv.gs2, tt.wantMech, tt.wantGS2)
+			}
+			if tt.wantErr {
+				var saslErr core.SASLError
+				if len(errs) != 1 || !errors.As(errs[0], &saslErr) || saslErr.Condition != "not-authorized" {
+					t.Fatalf("got errors %v, want not-authorized", errs)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+		})
+	}
+}
+
+func TestSCRAMServerSignature(t *testing.T) {
+	tests := []struct {
+		final   string
+		wantErr func(error) bool
+	}{
+		{final: "success"},
+		{final: "challenge"},
+		{final: "forged", wantErr: func(err error) bool {
+			return err != nil && strings.Contains(err.Error(), "server signature")
+		}},
+		{final: "missing", wantErr: func(err error) bool { return errors.Is(err, core.ErrServerUnverified) }},
+		{final: "error", wantErr: func(err error) bool {
+			var saslErr core.SASLError
+			return errors.As(err, &saslErr) && saslErr.Condition == "other-error"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.final, func(t *testing.T) {
+			srv := &scramServer{password: "pencil", final: tt.final}
+			errs := dialSCRAM(t, []string{"SCRAM-SHA-256"}, false, "pencil", srv)
+
+			if tt.wantErr == nil {
+				if len(errs) > 0 {
+					t.Fatal(errs)
+				}
+				return
+			}
+			// The server's success doesn't count if it couldn't
+			// prove that it knows the password.
+			if len(errs) != 1 || !tt.wantErr(errs[0]) {
+				t.Fatalf("got errors %v", errs)
+			}
+		})
+	}
+}
+
+// echoMechanism is a custom mechanism that answers challenges with
+// their upper case version and refuses the challenge "fail".
+type echoMechanism struct {
+	user string
+}
+
+var errEcho = errors.New("X-ECHO: refused challenge")
+
+func init() {
+	core.RegisterSASLMechanism("X-ECHO", func(user, password string) core.SASLMechanism {
+		return echoMechanism{user}
+	})
+}
+
+func (echoMechanism) Name() string {
+	return "X-ECHO"
+}
+
+func (m echoMechanism) Start() ([]byte, error) {
+	return []byte(m.user), nil
+}
+
+func (echoMechanism) Next(challenge []byte) ([]byte, error) {
+	if string(challenge) == "fail" {
+		return nil, errEcho
+	}
+	return []byte(strings.ToUpper(string(challenge))), nil
+}
+
+func TestCustomMechanism(t *testing.T) {
+	tests := []struct {
+		name       string
+		mechanisms []string
+		challenges []string
+		// success is the additional data sent with the success.
+		success  string
+		wantMech string
+		// wantErr is the error of the mechanism, if it rejects the
+		// exchange.
+		wantErr error
+	}{
+		{name: "initial response only", mechanisms: []string{"PLAIN", "X-ECHO"}, wantMech: "X-ECHO"},
+		{name: "multiple steps", mechanisms: []string{"PLAIN", "X-ECHO"}, challenges: []string{"one", "two", "three"}, wantMech: "X-ECHO"},
+		{name: "additional data", mechanisms: []string{"X-ECHO"}, challenges: []string{"one"}, success: "done", wantMech: "X-ECHO"},
+		{name: "rejected challenge", mechanisms: []string{"X-ECHO"}, challenges: []string{"one", "fail"}, wantMech: "X-ECHO", wantErr: errEcho},
+		{name: "rejected additional data", mechanisms: []string{"X-ECHO"}, success: "fail", wantMech: "X-ECHO", wantErr: errEcho},
+		{name: "not offered", mechanisms: []string{"PLAIN"}, wantMech: "PLAIN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- func() error {
+					if _, err := s.ReadStreamHeader(); err != nil {
+						return err
+					}
+					var features strings.Builder
+					features.WriteString("<mechanisms xmlns='" + nsSASL + "'>")
+					for _, m := range tt.mechanisms {
+						features.WriteString("<mechanism>" + m + "</mechanism>")
+					}
+					features.WriteString("</mechanisms>")
+					s.OpenStream(features.String())
+
+					srv := &scramServer{}
+					initial, err := srv.next(s, "auth")
+					if err != nil {
+						return err
+					}
+					if srv.mechanism != tt.wantMech {
+						return fmt.Errorf("authenticated with %s, want %s", srv.mechanism, tt.wantMech)
+					}
+					if tt.wantMech == "X-ECHO" && initial != "alice" {
+						return fmt.Errorf("got initial response %q, want %q", initial, "alice")
+					}
+
+					for _, challenge := range tt.challenges {
+						srv.send(s, "challenge", challenge)
+						if challenge == "fail" {
+							if e, err := s.NextElement(); err != nil || e.XMLName.Local != "abort" {
+								return fmt.Errorf("expected <abort/>, got %v, %v", e.XMLName, err)
+							}
+							return nil
+						}
+						resp, err := srv.next(s, "response")
+						if err != nil {
+							return err
+						}
+						if resp != strings.ToUpper(challenge) {
+							return fmt.Errorf("got response %q to %q", resp, challenge)
+						}
+					}
+					srv.send(s, "success", tt.success)
+					if tt.wantErr != nil {
+						return nil
+					}
+
+					if _, err := s.RestartStream(); err != nil {
+						return err
+					}
+					s.OpenStream(bind)
+					iq, err := s.NextElement()
+					if err != nil {
+						return err
+					}
+					return s.Sendf("<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>alice@example.com/xmpptest</jid></bind></iq>",
+						iq.Attribute("id"))
+				}()
+			}()
+
+			errs := c.Dial()
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != nil {
+				if len(errs) != 1 || !errors.Is(errs[0], tt.wantErr) {
+					t.Fatalf("got errors %v, want %v", errs, tt.wantErr)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package core
+
+import (
+	"honnef.co/go/xmpp/client/internal/clock"
+
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const nsSM = "urn:xmpp:sm:3"
+
+var ErrNotDisconnected = errors.New("xmpp: connection hasn't been lost")
+
+// ResumeFailedError is returned by Reconnect if the stream management
+// session couldn't be resumed. The connection has been re-established
+// and bound nonetheless, but the server might not have received some
+// of the stanzas sent before the connection was lost.
+type ResumeFailedError struct {
+	// Unacked are the stanzas whose receipt hasn't been acknowledged
+	// by the server, in the order they were sent. They are the values
+	// that have been passed to Encode, SendIQ and similar methods.
+	Unacked []interface{}
+}
+
+func (e ResumeFailedError) Error() string {
+	return fmt.Sprintf("xmpp: could not resume session, %d stanzas might have been lost", len(e.Unacked))
+}
+
+// smState is the state of a XEP-0198 (Stream Management) session.
+type smState struct {
+	mu sync.Mutex
+	// outbound is true once we sent <enable/>, from which point on
+	// the server counts our stanzas.
+	outbound bool
+	// inbound is true once we received <enabled/>, from which point
+	// on we count the server's stanzas.
+	inbound bool
+	id      string
+	resume  bool
+	// max is how long the server keeps the session around for
+	// resumption, zero if it didn't say. location is its preferred
+	// address for resuming.
+	max      time.Duration
+	location string
+	// expires is when an imported session can't be resumed anymore.
+	expires time.Time
+	// h is the number of stanzas we received.
+	h uint32
+	// acked is the last h the server reported.
+	acked uint32
+	// unacked holds the stanzas sent since acked.
+	unacked []interface{}
+}
+
+type smEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enable"`
+	Resume  bool     `xml:"resume,attr,omitempty"`
+}
+
+type smEnabled struct {
+	ID       string `xml:"id,attr"`
+	Resume   bool   `xml:"resume,attr"`
+	Max      uint32 `xml:"max,attr"`
+	Location string `xml:"location,attr"`
+}
+
+type smAck struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       uint32   `xml:"h,attr"`
+}
+
+type smRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+type smResume struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resume"`
+	H       uint32   `xml:"h,attr"`
+	PrevID  string   `xml:"previd,attr"`
+}
+
+type smResult struct {
+	H *uint32 `xml:"h,attr"`
+}
+
+// enableSM asks the server to enable stream management. The answer
+// is handled by the read loop.
+func (c *Conn) enableSM() error {
+	c.sm.mu.Lock()
+	c.sm.outbound = true
+	c.sm.inbound = false
+	c.sm.h = 0
+	c.sm.acked = 0
+	c.sm.unacked = nil
+	c.sm.mu.Unlock()
+
+	return c.Encode(smEnable{Resume: true})
+}
+
+// countOutbound records a sent stanza. The caller must hold wmu, so
+// that the order of the queue matches the order on the wire.
+func (c *Conn) countOutbound(v interface{}) {
+	c.sm.mu.Lock()
+	if c.sm.outbound {
+		c.sm.unacked = append(c.sm.unacked, v)
+	}
+	c.sm.mu.Unlock()
+}
+
+func (c *Conn) countInbound() {
+	c.sm.mu.Lock()
+	if c.sm.inbound {
+		c.sm.h++
+	}
+	c.sm.mu.Unlock()
+}
+
+// ack drops all stanzas up to h from the queue of unacknowledged
+// stanzas.
+func (c *Conn) ack(h uint32) {
+	c.sm.mu.Lock()
+	defer c.sm.mu.Unlock()
+
+	// h wraps around at 2^32, the subtraction does so, too.
+	n := int(h - c.sm.acked)
+	if n > len(c.sm.unacked) {
+		n = len(c.sm.unacked)
+	}
+	c.sm.unacked = c.sm.unacked[n:]
+	c.sm.acked = h
+}
+
+// handleSM handles stream management elements received by the read
+// loop.
+func (c *Conn) handleSM(t *xml.StartElement) error {
+	switch t.Name.Local {
+	case "enabled":
+		var v smEnabled
+		if err := c.decoder.DecodeElement(&v, t); err != nil {
+			return err
+		}
+		c.sm.mu.Lock()
+		c.sm.inbound = true
+		c.sm.id = v.ID
+		c.sm.resume = v.Resume && v.ID != ""
+		c.sm.max = time.Duration(v.Max) * time.Second
+		c.sm.location = v.Location
+		c.sm.expires = time.Time{}
+		c.sm.mu.Unlock()
+		return nil
+	case "failed":
+		c.sm.mu.Lock()
+		c.sm.outbound = false
+		c.sm.unacked = nil
+		c.sm.mu.Unlock()
+		return c.decoder.Skip()
+	case "r":
+		c.sm.mu.Lock()
+		h := c.sm.h
+		c.sm.mu.Unlock()
+		if err := c.decoder.Skip(); err != nil {
+			return err
+		}
+		return c.Encode(smAck{H: h})
+	case "a":
+		var v smAck
+		if err := c.decoder.DecodeElement(&v, t); err != nil {
+			return err
+		}
+		c.ack(v.H)
+		return nil
+	default:
+		return c.decoder.Skip()
+	}
+}
+
+// RequestAck asks the server to acknowledge the stanzas it received.
+// It has no effect if stream management isn't enabled.
+func (c *Conn) RequestAck() error {
+	c.sm.mu.Lock()
+	enabled := c.sm.outbound
+	c.sm.mu.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	return c.Encode(smRequest{})
+}
+
+// Unacked returns the stanzas whose receipt hasn't been acknowledged
+// by the server yet.
+func (c *Conn) Unacked() []interface{} {
+	c.sm.mu.Lock()
+	defer c.sm.mu.Unlock()
+	return append([]interface{}(nil), c.sm.unacked...)
+}
+
+// dropSM ends the stream management session and returns the
+// stanzas that the server didn't acknowledge.
+func (c *Conn) dropSM() []interface{} {
+	c.sm.mu.Lock()
+	defer c.sm.mu.Unlock()
+	unacked := c.sm.unacked
+	c.sm.outbound = false
+	c.sm.inbound = false
+	c.sm.unacked = nil
+	return unacked
+}
+
+func (c *Conn) resumable() bool {
+	c.sm.mu.Lock()
+	defer c.sm.mu.Unlock()
+	if !c.sm.expires.IsZero() && clock.Now().After(c.sm.expires) {
+		return false
+	}
+	return c.sm.outbound && c.sm.resume
+}
+
+// ErrSMStateExpired is returned by ImportSMState if the server has
+// discarded the session already.
+var ErrSMStateExpired = errors.New("xmpp: stream management session has expired")
+
+// SMState is the state of a stream management session, which allows
+// resuming it from a different process, for example after a mobile
+// app has been killed. It can be stored in any format, like JSON.
+//
+// The state includes the session's resume ID. Resuming still
+// requires authenticating as the same user, but the resume ID is
+// what ties a new stream to the session, including the stanzas the
+// server holds for it, and should be stored as securely as
+// credentials and deleted once it has been used.
+type SMState struct {
+	// ID is the session's resume ID.
+	ID string
+	// JID is the full JID the session was bound to.
+	JID string
+	// H is the number of stanzas we received, Acked the number of
+	// our stanzas the server acknowledged.
+	H     uint32
+	Acked uint32
+	// Max is how long the server keeps the session after the
+	// connection has been lost, zero if it didn't say.
+	Max time.Duration
+	// Location is the server's preferred address for resuming, if
+	// any.
+	Location string
+	// Time is when the state has been exported.
+	Time time.Time
+}
+
+// ExportSMState returns the state of the current stream management
+// session, and false if there is no session that can be resumed. The
+// state should be exported as late as possible, ideally after the
+// connection has been lost or right before the process exits, as
+// the counters keep changing while the connection is in use.
+//
+// Stanzas the server hasn't acknowledged are not part of the state;
+// see Unacked.
+func (c *Conn) ExportSMState() (SMState, bool) {
+	if !c.resumable() {
+		return SMState{}, false
+	}
+
+	c.sm.mu.Lock()
+	defer c.sm.mu.Unlock()
+	return SMState{
+		ID:       c.sm.id,
+		JID:      c.JID(),
+		H:        c.sm.h,
+		Acked:    c.sm.acked,
+		Max:      c.sm.max,
+		Location: c.sm.location,
+		Time:     clock.Now(),
+	}, true
+}
+
+// ImportSMState makes Dial try to resume a session exported by
+// ExportSMState, usually in a different process. It has to be called
+// before Dial. If resuming fails, Dial binds a new session instead.
+//
+// If the server announced how long it keeps sessions, and that time
+// has passed since the state has been exported, ErrSMStateExpired is
+// returned and no resumption will be attempted.
+func (c *Conn) ImportSMState(state SMState) error {
+	var expires time.Time
+	if state.Max > 0 {
+		expires = state.Time.Add(state.Max)
+		if clock.Now().After(expires) {
+			return ErrSMStateExpired
+		}
+	}
+
+	c.sm.mu.Lock()
+	c.sm.outbound = true
+	c.sm.inbound = true
+	c.sm.resume = true
+	c.sm.id = state.ID
+	c.sm.h = state.H
+	c.sm.acked = state.Acked
+	c.sm.unacked = nil
+	c.sm.max = state.Max
+	c.sm.location = state.Location
+	c.sm.expires = expires
+	c.sm.mu.Unlock()
+	c.jid = state.JID
+	return nil
+}
+
+// resume tries to resume the previous session. It reports whether
+// the session has been resumed. If it hasn't, the stanzas that might
+// have been lost are returned.
+func (c *Conn) resume() (bool, []interface{}, error) {
+	c.sm.mu.Lock()
+	req := smResume{H: c.sm.h, PrevID: c.sm.id}
+	c.sm.mu.Unlock()
+
+	if err := c.Encode(req); err != nil {
+		return false, nil, err
+	}
+
+	t, err := c.nextStartElement()
+	if err != nil {
+		return false, nil, err
+	}
+	if t.Name.Space != nsSM || (t.Name.Local != "resumed" && t.Name.Local != "failed") {
+		return false, nil, UnexpectedMessage{t.Name.Local}
+	}
+
+	var v smResult
+	if err := c.decoder.DecodeElement(&v, t); err != nil {
+		return false, nil, err
+	}
+	if v.H != nil {
+		c.ack(*v.H)
+	}
+
+	c.sm.mu.Lock()
+	unacked := c.sm.unacked
+	c.sm.unacked = nil
+	if t.Name.Local == "failed" {
+		c.sm.outbound = false
+		c.sm.inbound = false
+		c.sm.mu.Unlock()
+		return false, unacked, nil
+	}
+	c.sm.mu.Unlock()
+
+	// Resend everything the server didn't get. Encode queues the
+	// stanzas again, until the server acknowledges them.
+	for _, v := range unacked {
+		if err := c.encode(v); err != nil {
+			return true, nil, err
+		}
+	}
+
+	return true, nil, nil
+}
+
+// Reconnect re-establishes a connection that has been lost. It can
+// only be used if AllowReconnect is set. conn is used as the new
+// transport, if it is nil, the host will be resolved and dialed
+// again.
+//
+// If stream management (XEP-0198) was enabled and the server allowed
+// resumption, the session will be resumed and stanzas that the server
+// hadn't acknowledged will be resent. If resumption fails, a new
+// session will be bound and a ResumeFailedError listing the stanzas
+// that might have been lost will be among the returned errors.
+//
+// If another client took over our resource, Reconnect returns
+// ErrResourceConflict unless ReconnectOnConflict is set.
+//
+// Once the connection has been bound, the handlers added with
+// AddReconnectHandler are called before Reconnect returns.
+func (c *Conn) Reconnect(conn net.Conn) []error {
+	if c.isClosing() || c.State() != StateDisconnected {
+		return []error{ErrNotDisconnected}
+	}
+	c.mu.Lock()
+	refuse := c.conflict && !c.ReconnectOnConflict
+	if !refuse {
+		c.conflict = false
+	}
+	c.mu.Unlock()
+	if refuse {
+		return []error{ErrResourceConflict}
+	}
+
+	c.setState(StateReconnecting, nil)
+	c.Conn = conn
+	errs := c.Dial()
+	if c.State() != StateBound {
+		return errs
+	}
+
+	c.mu.Lock()
+	handlers := c.reconnectHandlers
+	c.mu.Unlock()
+	for _, h := range handlers {
+		h(c.resumed)
+	}
+	return errs
+}
@@ -0,0 +1,247 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// smSession connects a client with stream management enabled and
+// resumable, which has received one stanza and sent the messages m1
+// and m2.
+func smSession(t *testing.T) (*core.Conn, *xmpptest.Server, <-chan core.State) {
+	t.Helper()
+	conn, s := xmpptest.Pipe()
+	t.Cleanup(func() { s.Conn.Close() })
+	s.Features = sm
+	c := core.NewConnection(conn, "alice", s.Domain, "secret")
+	c.StreamManagement = true
+	c.AllowReconnect = true
+	states := make(chan core.State, 16)
+	c.OnStateChange(func(old, new core.State) { states <- new })
+
+	errc := make(chan error, 1)
+	go func() {
+		if err := s.Negotiate(); err != nil {
+			errc <- err
+			return
+		}
+		if e, err := s.NextElement(); err != nil || e.XMLName.Local != "enable" || e.Attribute("resume") != "true" {
+			errc <- fmt.Errorf("expected <enable resume='true'/>, got %v, %v", e.XMLName, err)
+			return
+		}
+		s.Send("<enabled xmlns='urn:xmpp:sm:3' id='sess' resume='true'/>")
+		errc <- s.Send("<message xmlns='jabber:client' from='bob@example.com'><body>hi</body></message>")
+	}()
+	if errs := c.Dial(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.NextStanza(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"m1", "m2"} {
+		go c.Encode(core.Message{Header: core.Header{To: "bob@example.com", Id: id}, Body: id})
+		if e, err := s.NextElement(); err != nil || e.Attribute("id") != id {
+			t.Fatalf("expected message %s, got %v, %v", id, e.Attr, err)
+		}
+	}
+	return c, s, states
+}
+
+// ids returns the IDs of stanzas returned by Unacked.
+func ids(stanzas []interface{}) []string {
+	var out []string
+	for _, v := range stanzas {
+		out = append(out, v.(core.Message).Id)
+	}
+	return out
+}
+
+func TestStreamManagementAck(t *testing.T) {
+	c, s, _ := smSession(t)
+
+	// The server requests an acknowledgement for the stanza it sent
+	// and acknowledges the first of ours.
+	go s.Send("<r xmlns='urn:xmpp:sm:3'/>")
+	a, err := s.NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.XMLName.Local != "a" || a.Attribute("h") != "1" {
+		t.Fatalf("got <%s h=%q>, want <a h=\"1\">", a.XMLName.Local, a.Attribute("h"))
+	}
+	s.Send("<a xmlns='urn:xmpp:sm:3' h='1'/>")
+	// Another request makes sure that the ack has been handled.
+	go s.Send("<r xmlns='urn:xmpp:sm:3'/>")
+	s.NextElement()
+
+	if got := ids(c.Unacked()); !reflect.DeepEqual(got, []string{"m2"}) {
+		t.Errorf("got unacked stanzas %v, want [m2]", got)
+	}
+}
+
+func TestStreamManagementResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// ack is sent before the connection is lost.
+		ack string
+		// answer is the answer to <resume/>.
+		answer string
+		// wantResent are the stanzas resent after resuming, wantLost
+		// the ones reported as lost if resuming failed.
+		wantResent []string
+		wantLost   []string
+	}{
+		{
+			name:       "resumed",
+			ack:        "<a xmlns='urn:xmpp:sm:3' h='1'/>",
+			answer:     "<resumed xmlns='urn:xmpp:sm:3' previd='sess' h='1'/>",
+			wantResent: []string{"m2"},
+		},
+		{
+			name:       "resumed, acknowledged while resuming",
+			answer:     "<resumed xmlns='urn:xmpp:sm:3' previd='sess' h='1'/>",
+			wantResent: []string{"m2"},
+		},
+		{
+			name:       "resumed, nothing acknowledged",
+			answer:     "<resumed xmlns='urn:xmpp:sm:3' previd='sess' h='0'/>",
+			wantResent: []string{"m1", "m2"},
+		},
+		{
+			name:   "resumed, everything acknowledged",
+			ack:    "<a xmlns='urn:xmpp:sm:3' h='1'/>",
+			answer: "<resumed xmlns='urn:xmpp:sm:3' previd='sess' h='2'/>",
+		},
+		{
+			name:     "failed",
+			answer:   "<failed xmlns='urn:xmpp:sm:3' h='1'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></failed>",
+			wantLost: []string{"m2"},
+		},
+		{
+			name:     "failed without count",
+			ack:      "<a xmlns='urn:xmpp:sm:3' h='1'/>",
+			answer:   "<failed xmlns='urn:xmpp:sm:3'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></failed>",
+			wantLost: []string{"m2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, states := smSession(t)
+			if tt.ack != "" {
+				s.Send(tt.ack)
+			}
+			s.Conn.Close()
+			for state := range states {
+				if state == core.StateDisconnected {
+					break
+				}
+			}
+
+			conn, s2 := xmpptest.Pipe()
+			defer s2.Close()
+			resent := make(chan []string, 1)
+			errc := make(chan error, 1)
+			go func() {
+				if _, err := s2.ReadStreamHeader(); err != nil {
+					errc <- err
+					return
+				}
+				s2.OpenStream(mechanisms)
+				s2.NextElement()
+				s2.Send("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+				s2.RestartStream()
+				s2.OpenStream(bind + sm)
+
+				r, err := s2.NextElement()
+				if err != nil {
+					errc <- err
+					return
+				}
+				if r.XMLName.Local != "resume" || r.Attribute("previd") != "sess" || r.Attribute("h") != "1" {
+					errc <- fmt.Errorf("expected <resume previd='sess' h='1'/>, got <%s> %v", r.XMLName.Local, r.Attr)
+					return
+				}
+				s2.Send(tt.answer)
+
+				if tt.wantLost == nil {
+					var got []string
+					for range tt.wantResent {
+						e, err := s2.NextElement()
+						if err != nil {
+							errc <- err
+							return
+						}
+						got = append(got, e.Attribute("id"))
+					}
+					resent <- got
+					errc <- nil
+					return
+				}
+
+				// A new session is bound and stream management
+				// enabled again.
+				iq, err := s2.NextElement()
+				if err != nil {
+					errc <- err
+					return
+				}
+				s2.Sendf("<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>alice@example.com/xmpptest</jid></bind></iq>",
+					iq.Attribute("id"))
+				if e, err := s2.NextElement(); err != nil || e.XMLName.Local != "enable" {
+					errc <- fmt.Errorf("expected <enable/>, got %v, %v", e.XMLName, err)
+					return
+				}
+				errc <- nil
+			}()
+
+			errs := c.Reconnect(conn)
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if c.State() != core.StateBound {
+				t.Fatalf("got state %v, want %v", c.State(), core.StateBound)
+			}
+
+			if tt.wantLost != nil {
+				var failed core.ResumeFailedError
+				if len(errs) != 1 || !errors.As(errs[0], &failed) {
+					t.Fatalf("got errors %v, want a ResumeFailedError", errs)
+				}
+				if got := ids(failed.Unacked); !reflect.DeepEqual(got, tt.wantLost) {
+					t.Errorf("got lost stanzas %v, want %v", got, tt.wantLost)
+				}
+				if len(c.Unacked()) != 0 {
+					t.Errorf("lost stanzas %v are still queued", ids(c.Unacked()))
+				}
+				return
+			}
+
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			select {
+			case got := <-resent:
+				if !reflect.DeepEqual(got, tt.wantResent) {
+					t.Errorf("got resent stanzas %v, want %v", got, tt.wantResent)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("stanzas weren't resent")
+			}
+			// Resent stanzas stay queued until they are acknowledged.
+			if got := ids(c.Unacked()); !reflect.DeepEqual(got, tt.wantResent) {
+				t.Errorf("got unacked stanzas %v, want %v", got, tt.wantResent)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package core
+
+import "context"
+
+// State is the state of a connection.
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateAuthenticated
+	StateBound
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateAuthenticated:
+		return "authenticated"
+	case StateBound:
+		return "bound"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the current state of the connection.
+func (c *Conn) State() State {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// Err returns the reason for the most recent transition to
+// StateDisconnected. It is nil if the connection has been closed
+// deliberately or is still alive.
+func (c *Conn) Err() error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.err
+}
+
+// OnStateChange sets a function that will be called after every state
+// transition. When transitioning to StateDisconnected, the reason can
+// be retrieved with Err. fn is called from the goroutine causing the
+// transition, which might be the one reading from the connection, and
+// must not block. Only one function can be set at a time.
+func (c *Conn) OnStateChange(fn func(old, new State)) {
+	c.stateMu.Lock()
+	c.onStateChange = fn
+	c.stateMu.Unlock()
+}
+
+func (c *Conn) setState(state State, err error) {
+	c.stateMu.Lock()
+	old := c.state
+	if old == state {
+		c.stateMu.Unlock()
+		return
+	}
+	c.state = state
+	if state == StateDisconnected {
+		c.err = err
+	}
+	if state == StateBound {
+		close(c.readyChan())
+	} else if old == StateBound {
+		c.ready = nil
+	}
+	c.notifyChanged()
+	fn := c.onStateChange
+	c.stateMu.Unlock()
+
+	m := c.m()
+	m.StateChanged(state)
+	if state == StateReconnecting {
+		m.Reconnecting()
+	}
+	if state == StateBound {
+		c.flushSendBuffer()
+	}
+
+	if fn != nil {
+		fn(old, state)
+	}
+}
+
+// notifyChanged wakes everyone in WaitReady. The caller must hold
+// stateMu.
+func (c *Conn) notifyChanged() {
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// closed wakes everyone in WaitReady once the connection has been
+// closed for good, which needn't change its state: it may already be
+// disconnected.
+func (c *Conn) closed() {
+	c.stateMu.Lock()
+	c.notifyChanged()
+	c.stateMu.Unlock()
+}
+
+// readyChan returns the channel that is closed once the connection is
+// bound. The caller must hold stateMu.
+func (c *Conn) readyChan() chan struct{} {
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	return c.ready
+}
+
+// Ready returns a channel that is closed once the stream has been
+// negotiated and a resource bound, that is when the connection enters
+// StateBound. If the connection is lost, later calls return a new
+// channel that is closed once it has been re-established with
+// Reconnect.
+//
+// Stanzas should only be sent once the connection is ready, unless
+// SendBuffer is set. Sent during negotiation, they end up in the
+// middle of it and break the stream. Sent while disconnected, they
+// fail.
+func (c *Conn) Ready() <-chan struct{} {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.readyChan()
+}
+
+// WaitReady blocks until the connection is ready, as described for
+// Ready. It returns ErrClosed if the connection gets closed for good
+// instead, and ctx's error if ctx is done first. Failed attempts at
+// connecting don't end the wait, so that it spans retries.
+func (c *Conn) WaitReady(ctx context.Context) error {
+	for {
+		c.stateMu.Lock()
+		state := c.state
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.stateMu.Unlock()
+
+		if state == StateBound {
+			return nil
+		}
+		if c.isClosing() {
+			return ErrClosed
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
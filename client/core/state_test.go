@@ -0,0 +1,194 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// closed reports whether ch has been closed.
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	tests := []struct {
+		name string
+		// end ends the wait after the connection has been lost.
+		end     func(t *testing.T, c *core.Conn, cancel context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name: "reconnected",
+			end: func(t *testing.T, c *core.Conn, cancel context.CancelFunc) {
+				conn, s := xmpptest.Pipe()
+				t.Cleanup(func() { s.Conn.Close() })
+				errc := make(chan error, 1)
+				go func() { errc <- s.Negotiate() }()
+				if errs := c.Reconnect(conn); len(errs) > 0 {
+					t.Fatal(errs)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:    "closed",
+			end:     func(t *testing.T, c *core.Conn, cancel context.CancelFunc) { c.Close() },
+			wantErr: core.ErrClosed,
+		},
+		{
+			name:    "canceled",
+			end:     func(t *testing.T, c *core.Conn, cancel context.CancelFunc) { cancel() },
+			wantErr: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.AllowReconnect = true
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			first := c.Ready()
+			if closed(first) {
+				t.Fatal("ready before dialing")
+			}
+			waited := make(chan error, 1)
+			go func() { waited <- c.WaitReady(ctx) }()
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-waited:
+				if err != nil {
+					t.Fatalf("got %v while dialing, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WaitReady didn't return once bound")
+			}
+			if !closed(first) || !closed(c.Ready()) {
+				t.Fatal("not ready once bound")
+			}
+
+			// Lose the connection.
+			go func() {
+				s.Send("<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>")
+				s.Conn.Close()
+			}()
+			if _, err := c.NextStanza(); err == nil {
+				t.Fatal("connection wasn't lost")
+			}
+			second := c.Ready()
+			if closed(second) {
+				t.Fatal("still ready after losing the connection")
+			}
+			if !closed(first) {
+				t.Error("channel of the first connection was reopened")
+			}
+
+			go func() { waited <- c.WaitReady(ctx) }()
+			select {
+			case err := <-waited:
+				t.Fatalf("WaitReady returned %v while disconnected", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			tt.end(t, c, cancel)
+			select {
+			case err := <-waited:
+				if err != tt.wantErr {
+					t.Errorf("got %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WaitReady didn't return")
+			}
+			if got := closed(second); got != (tt.wantErr == nil) {
+				t.Errorf("got ready %t, want %t", got, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestLostWithoutReader(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowReconnect bool
+	}{
+		{name: "reconnect allowed", allowReconnect: true},
+		{name: "reconnect disallowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.AllowReconnect = tt.allowReconnect
+			states := make(chan core.State, 16)
+			c.OnStateChange(func(old, new core.State) { states <- new })
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			// Nobody calls NextStanza while the connection is lost,
+			// the application only watches the state.
+			go func() {
+				s.Send("<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>")
+				io.Copy(io.Discard, s.Conn)
+			}()
+		wait:
+			for {
+				select {
+				case state := <-states:
+					if state == core.StateDisconnected {
+						break wait
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("got state %v, want %v", c.State(), core.StateDisconnected)
+				}
+			}
+			if !tt.allowReconnect {
+				if err := c.WaitReady(context.Background()); err != core.ErrClosed {
+					t.Errorf("WaitReady returned %v, want %v", err, core.ErrClosed)
+				}
+			}
+
+			// The error is still reported to whoever reads later.
+			_, err := c.NextStanza()
+			var disconnect core.DisconnectError
+			if !errors.As(err, &disconnect) || disconnect.StreamError == nil || disconnect.StreamError.Condition() != "system-shutdown" {
+				t.Fatalf("got %v, want a disconnect because of system-shutdown", err)
+			}
+			if !tt.allowReconnect {
+				if _, err := c.NextStanza(); err != io.EOF {
+					t.Errorf("got %v after the disconnect, want %v", err, io.EOF)
+				}
+			}
+		})
+	}
+}
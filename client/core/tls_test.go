@@ -0,0 +1,175 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+// dialTLS connects a client configured by setup to a server
+// presenting cert.
+func dialTLS(t *testing.T, cert tls.Certificate, setup func(c *core.Conn)) (*core.Conn, error) {
+	t.Helper()
+	conn, s, err := xmpptest.TCPPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Conn.Close() })
+
+	c := core.NewConnection(conn, "alice", s.Domain, "secret")
+	setup(c)
+	go func() {
+		if err := s.StartTLS(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+			s.Conn.Close()
+			return
+		}
+		s.Negotiate()
+	}()
+
+	if errs := c.Dial(); len(errs) > 0 {
+		return c, errs[0]
+	}
+	return c, nil
+}
+
+func mustCertificate(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+	cert, err := xmpptest.Certificate(names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestInsecureSkipTLSVerify(t *testing.T) {
+	cert := mustCertificate(t, "example.com")
+	other := mustCertificate(t, "example.com")
+
+	tests := []struct {
+		name     string
+		cert     tls.Certificate
+		insecure bool
+		pin      *tls.Certificate
+		wantErr  func(error) bool
+	}{
+		{name: "verified", cert: cert, wantErr: func(err error) bool {
+			var unknown x509.UnknownAuthorityError
+			return errors.As(err, &unknown)
+		}},
+		{name: "self-signed", cert: cert, insecure: true},
+		{name: "wrong name", cert: mustCertificate(t, "example.net"), insecure: true},
+		{name: "pinned", cert: cert, insecure: true, pin: &cert},
+		{name: "not pinned", cert: cert, insecure: true, pin: &other, wantErr: func(err error) bool {
+			return errors.Is(err, core.ErrCertificateNotPinned)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hookRaw [][]byte
+			var hookChains [][]*x509.Certificate
+			c, err := dialTLS(t, tt.cert, func(c *core.Conn) {
+				c.InsecureSkipTLSVerify = tt.insecure
+				if tt.pin != nil {
+					c.PinCertificate(sha256.Sum256(tt.pin.Certificate[0]))
+				}
+				c.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					hookRaw, hookChains = rawCerts, verifiedChains
+					return nil
+				}
+			})
+
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("got unexpected error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.State() != core.StateBound {
+				t.Errorf("got state %v, want %v", c.State(), core.StateBound)
+			}
+			// The hook must not mistake unverified certificates for
+			// verified ones.
+			if hookChains != nil {
+				t.Errorf("got verified chains %v without verification", hookChains)
+			}
+			if len(hookRaw) != 1 {
+				t.Errorf("got %d raw certificates, want 1", len(hookRaw))
+			}
+		})
+	}
+}
+
+// errUnverified stands for any error of the certificate verification
+// done by crypto/tls.
+var errUnverified = errors.New("unverified")
+
+func TestPinCertificate(t *testing.T) {
+	cert := mustCertificate(t, "example.com")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	other := mustCertificate(t, "example.com")
+	errHook := errors.New("rejected by DANE")
+
+	tests := []struct {
+		name    string
+		cert    tls.Certificate
+		roots   *x509.CertPool
+		pins    []tls.Certificate
+		hookErr error
+		wantErr error
+	}{
+		{name: "unknown authority", cert: cert, wantErr: errUnverified},
+		{name: "verified", cert: cert, roots: roots},
+		{name: "wrong name", cert: mustCertificate(t, "example.net"), roots: roots, wantErr: errUnverified},
+		{name: "pinned", cert: cert, roots: roots, pins: []tls.Certificate{cert}},
+		{name: "one of several pins", cert: cert, roots: roots, pins: []tls.Certificate{other, cert}},
+		{name: "unexpected certificate", cert: cert, roots: roots, pins: []tls.Certificate{other}, wantErr: core.ErrCertificateNotPinned},
+		{name: "hook", cert: cert, roots: roots, hookErr: errHook, wantErr: errHook},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hookChains [][]*x509.Certificate
+			_, err := dialTLS(t, tt.cert, func(c *core.Conn) {
+				c.RootCAs = tt.roots
+				for _, pin := range tt.pins {
+					c.PinCertificate(sha256.Sum256(pin.Certificate[0]))
+				}
+				c.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					hookChains = verifiedChains
+					return tt.hookErr
+				}
+			})
+
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(hookChains) == 0 || !hookChains[0][0].Equal(leaf) {
+					t.Errorf("hook got verified chains %v", hookChains)
+				}
+				return
+			}
+			var certErr core.CertificateError
+			if !errors.As(err, &certErr) {
+				t.Fatalf("got %v, want a CertificateError", err)
+			}
+			if tt.wantErr != errUnverified && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// traffic counts the bytes transferred over the transport. It is
+// allocated separately from Conn so that its fields are 64-bit
+// aligned, as required by the atomic operations.
+type traffic struct {
+	read    uint64
+	written uint64
+}
+
+// countingConn counts the bytes transferred over the transport, below
+// TLS and compression, so that the counters reflect what actually
+// goes over the wire.
+type countingConn struct {
+	net.Conn
+	t *traffic
+}
+
+func (cc countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	atomic.AddUint64(&cc.t.read, uint64(n))
+	return n, err
+}
+
+func (cc countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	atomic.AddUint64(&cc.t.written, uint64(n))
+	return n, err
+}
+
+// countTraffic wraps the transport in a countingConn. It has to be
+// called whenever the transport is replaced, before any layers like
+// TLS are added on top.
+func (c *Conn) countTraffic() {
+	if _, ok := c.Conn.(countingConn); ok {
+		return
+	}
+	c.Conn = countingConn{c.Conn, c.traffic}
+}
+
+// BytesRead returns the number of bytes read from the transport,
+// including TLS and compression overhead.
+func (c *Conn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.traffic.read)
+}
+
+// BytesWritten returns the number of bytes written to the transport,
+// including TLS and compression overhead.
+func (c *Conn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.traffic.written)
+}
+
+// ResetTraffic resets the counters returned by BytesRead and
+// BytesWritten. The counters aren't reset when reconnecting.
+func (c *Conn) ResetTraffic() {
+	atomic.StoreUint64(&c.traffic.read, 0)
+	atomic.StoreUint64(&c.traffic.written, 0)
+}
@@ -0,0 +1,114 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// countedConn counts the bytes the client transfers, independently of
+// the client's own counters.
+type countedConn struct {
+	read    uint64
+	written uint64
+	net.Conn
+}
+
+func (cc *countedConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	atomic.AddUint64(&cc.read, uint64(n))
+	return n, err
+}
+
+func (cc *countedConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	atomic.AddUint64(&cc.written, uint64(n))
+	return n, err
+}
+
+func TestTraffic(t *testing.T) {
+	const msg = "<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'><body>Wherefore art thou?</body></message>"
+
+	tests := []struct {
+		name string
+		tls  bool
+	}{
+		{name: "plain"},
+		// The counters are maintained below TLS, so they have to
+		// survive the upgrade and include its overhead.
+		{name: "tls", tls: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conn net.Conn
+			var s *xmpptest.Server
+			if tt.tls {
+				var err error
+				conn, s, err = xmpptest.TCPPipe()
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				conn, s = xmpptest.Pipe()
+			}
+			defer s.Conn.Close()
+			counted := &countedConn{Conn: conn}
+			c := core.NewConnection(counted, "alice", s.Domain, "secret")
+			c.InsecureSkipTLSVerify = true
+			cert := mustCertificate(t, s.Domain)
+
+			errc := make(chan error, 1)
+			go func() {
+				if tt.tls {
+					if err := s.StartTLS(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+						s.Conn.Close()
+						errc <- err
+						return
+					}
+				}
+				errc <- s.Negotiate()
+			}()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(step string) {
+				t.Helper()
+				if got, want := c.BytesRead(), atomic.LoadUint64(&counted.read); got != want {
+					t.Errorf("%s: BytesRead() = %d, want %d", step, got, want)
+				}
+				if got, want := c.BytesWritten(), atomic.LoadUint64(&counted.written); got != want {
+					t.Errorf("%s: BytesWritten() = %d, want %d", step, got, want)
+				}
+			}
+			check("negotiation")
+
+			before := c.BytesRead()
+			go s.Send(msg)
+			if _, err := c.NextStanza(); err != nil {
+				t.Fatal(err)
+			}
+			check("message")
+			n := c.BytesRead() - before
+			if !tt.tls && n != uint64(len(msg)) {
+				t.Errorf("read %d bytes for a message of %d bytes", n, len(msg))
+			}
+			if tt.tls && n <= uint64(len(msg)) {
+				t.Errorf("read %d bytes for a message of %d bytes, which doesn't account for TLS", n, len(msg))
+			}
+
+			c.ResetTraffic()
+			if c.BytesRead() != 0 || c.BytesWritten() != 0 {
+				t.Errorf("got %d bytes read and %d written after resetting", c.BytesRead(), c.BytesWritten())
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package im
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+
+	"sync"
+	"time"
+)
+
+// AutoAway changes our presence to away and later to extended away
+// (xa) when the user has been idle for a while, and restores it once
+// the user becomes active again. Activity has to be reported with
+// Touch.
+//
+// AutoAway observes the presences broadcast with SendPresence, so
+// that it restores the status the user set last. It doesn't change a
+// status that the user explicitly set to away, xa or dnd.
+type AutoAway struct {
+	c    *Conn
+	away time.Duration
+	xa   time.Duration
+
+	mu    sync.Mutex
+	timer clock.Timer
+	last  time.Time
+	// user is the last presence that has been broadcast by the
+	// user, as opposed to by us.
+	user core.Presence
+	// show is the show value we set, or the empty string if we
+	// didn't change the user's presence.
+	show    core.Show
+	sending bool
+	stopped bool
+}
+
+// NewAutoAway starts changing our presence to away after being idle
+// for away, and to xa after being idle for xa. Either duration may be
+// zero to disable the respective state.
+func (c *Conn) NewAutoAway(away, xa time.Duration) *AutoAway {
+	a := &AutoAway{
+		c:    c,
+		away: away,
+		xa:   xa,
+		last: clock.Now(),
+	}
+	c.AddPresenceDecorator(a.observe)
+
+	a.mu.Lock()
+	a.timer = clock.AfterFunc(a.nextCheck(), a.check)
+	a.mu.Unlock()
+
+	return a
+}
+
+func (a *AutoAway) observe(p *core.Presence) {
+	if p.To != "" || p.Type != "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sending {
+		return
+	}
+	a.user = *p
+	a.user.Id = ""
+	a.user.Inner = nil
+	// The user overrode whatever we set.
+	a.show = ""
+}
+
+// manual reports whether the user explicitly set a status that we
+// must not clobber. The caller must hold the lock.
+func (a *AutoAway) manual() bool {
+	switch a.user.Show {
+	case core.ShowAway, core.ShowXA, core.ShowDND:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextCheck returns the duration until the next state change is due.
+// The caller must hold the lock.
+func (a *AutoAway) nextCheck() time.Duration {
+	idle := clock.Since(a.last)
+	switch {
+	case a.show == "" && a.away > 0:
+		return a.away - idle
+	case a.show != core.ShowXA && a.xa > 0:
+		return a.xa - idle
+	default:
+		// Nothing left to do until the next Touch.
+		return -1
+	}
+}
+
+func (a *AutoAway) check() {
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		return
+	}
+
+	idle := clock.Since(a.last)
+	var show core.Show
+	switch {
+	case a.xa > 0 && idle >= a.xa && a.show != core.ShowXA:
+		show = core.ShowXA
+	case a.away > 0 && idle >= a.away && a.show == "":
+		show = core.ShowAway
+	}
+	if show != "" && !a.manual() {
+		a.send(show)
+	}
+
+	if d := a.nextCheck(); d >= 0 {
+		a.timer.Reset(d)
+	}
+	a.mu.Unlock()
+}
+
+// send broadcasts the user's presence with the given show value. The
+// caller must hold the lock.
+func (a *AutoAway) send(show core.Show) {
+	p := a.user
+	p.Show = show
+	a.show = show
+
+	a.sending = true
+	a.mu.Unlock()
+	a.c.SendPresence(p)
+	a.mu.Lock()
+	a.sending = false
+}
+
+// Touch reports user activity. If our presence has been changed to
+// away or xa, the user's presence will be restored.
+func (a *AutoAway) Touch() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		return
+	}
+
+	a.last = clock.Now()
+	if a.show != "" {
+		a.send(a.user.Show)
+		a.show = ""
+	}
+	if d := a.nextCheck(); d >= 0 {
+		a.timer.Reset(d)
+	}
+}
+
+// Idle returns the show value set due to inactivity, or the empty
+// string if the user is considered active.
+func (a *AutoAway) Idle() core.Show {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.show
+}
+
+// Stop stops changing our presence. It doesn't restore the user's
+// presence.
+func (a *AutoAway) Stop() {
+	a.mu.Lock()
+	a.stopped = true
+	a.timer.Stop()
+	a.mu.Unlock()
+}
@@ -1,16 +1,27 @@
 package im
 
-// TODO implement roster versioning
-// TODO handle a roster, that keeps track of presence, the contacts
-// who are in it, etc
-
 import (
 	"encoding/xml"
+	"errors"
 	"honnef.co/go/xmpp/client/core"
+	"strings"
+	"time"
 )
 
 var _ Client = &Conn{}
 
+// ErrNotBroadcast is returned by GoOnlineWith if the presence isn't
+// an available presence meant for all our contacts.
+var ErrNotBroadcast = errors.New("xmpp: initial presence must be an available presence without a recipient")
+
+// ErrInvalidChatState is returned by SendMessageWith if the chat
+// state isn't one of those defined by XEP-0085.
+var ErrInvalidChatState = errors.New("xmpp: invalid chat state")
+
+// ErrInvalidHint is returned by SendMessageWith if a hint isn't one of
+// those defined by XEP-0334.
+var ErrInvalidHint = errors.New("xmpp: invalid message processing hint")
+
 type Client interface {
 	core.Client
 	GetRoster() Roster
@@ -22,8 +33,13 @@ type Client interface {
 	DenySubscription(auth *AuthorizationRequest)
 	BecomeAvailable()
 	BecomeUnavailable()
-	SendMessage(typ, to string, message core.Message)
-	Reply(orig *core.Message, reply string)
+	GoOnline() (Roster, error)
+	GoOnlineWith(p core.Presence) (Roster, error)
+	SendDirectedPresence(to string, p core.Presence) (cookie string, err error)
+	Probe(jid string) error
+	SendMessage(typ, to string, message core.Message) error
+	SendMessageWith(opts MessageOptions) (id string, err error)
+	Reply(orig *core.Message, reply string) error
 }
 
 func init() {
@@ -32,15 +48,55 @@ func init() {
 
 type Conn struct {
 	core.Client
+
+	// Restore is called before our last presence is broadcast again
+	// after the connection has been re-established. It may modify
+	// the presence, or return false to stay offline. If it is nil,
+	// the presence is restored unchanged.
+	Restore func(p *core.Presence) bool
+
+	// RestoreDelay is how long the connection has to be up again
+	// before our presence is restored, which keeps a flapping
+	// connection from spamming contacts with presence changes. It
+	// only applies if the session couldn't be resumed: resumed
+	// sessions, which require stream management and a reconnect
+	// within the server's resumption timeout, keep their presence
+	// anyway. Zero restores the presence right away. A few seconds
+	// are a good choice for mobile clients.
+	RestoreDelay time.Duration
+
+	// Nick is our nickname (XEP-0172). If set, it is included in
+	// subscription requests.
+	Nick string
+
+	roster    *RosterCache
+	muted     *muteList
+	directed  *directedList
+	broadcast broadcast
 }
 
 func wrap(c core.Client) (core.XEP, error) {
 	conn := &Conn{
-		Client: c,
+		Client:   c,
+		roster:   newRosterCache(),
+		muted:    newMuteList(),
+		directed: newDirectedList(),
 	}
+	c.AddFilter(conn.muteFilter)
+	c.AddPresenceDecorator(conn.observeBroadcast)
+	c.AddPresenceDecorator(conn.attachNick)
+	c.AddReconnectHandler(conn.restorePresence)
+	c.AddCloseHandler(conn.closing)
+	c.HandleIQ("set", "jabber:iq:roster", conn.handleRosterPush)
 	return conn, nil
 }
 
+// Roster returns the cache of the roster and the presence of its
+// contacts.
+func (c *Conn) Roster() *RosterCache {
+	return c.roster
+}
+
 func Wrap(c core.Client) *Conn {
 	xep, _ := c.RegisterXEP("im")
 	return xep.(*Conn)
@@ -48,20 +104,25 @@ func Wrap(c core.Client) *Conn {
 
 type AuthorizationRequest core.Presence
 
+// Headline is emitted for headline messages, which are notifications
+// like service announcements or news rather than part of a
+// conversation, and shouldn't be displayed as chats. Many are sent by
+// publish-subscribe services, whose notifications the pubsub package
+// decodes.
+type Headline core.Message
+
 func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
 	// TODO way to subscribe to roster events (roster push, subscription requests, ...)
 	switch t := stanza.(type) {
-	case *core.IQ:
-		if t.Query.Space == "jabber:iq:roster" && t.Type == "set" {
-			// TODO check 'from' ("Security Warning:
-			// Traditionally, a roster push included no 'from'
-			// address")
-			c.SendIQReply(t, "result", nil)
-		}
 	case *core.Presence:
+		c.roster.presence(t)
 		if t.Type == "subscribe" {
 			return []core.Stanza{(*AuthorizationRequest)(t)}, nil
 		}
+	case *core.Message:
+		if t.Type == "headline" {
+			return []core.Stanza{(*Headline)(t)}, nil
+		}
 	default:
 		// TODO track JID etc
 	}
@@ -69,33 +130,125 @@ func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
 	return nil, nil
 }
 
+var errServiceUnavailable = &core.Error{
+	Type:   "cancel",
+	Errors: core.XMPPErrors{core.ErrServiceUnavailable{}},
+}
+
+var errBadRequest = &core.Error{
+	Type:   "modify",
+	Errors: core.XMPPErrors{core.ErrBadRequest{}},
+}
+
+// handleRosterPush applies a roster push to the roster cache.
+func (c *Conn) handleRosterPush(iq *core.IQ) (interface{}, error) {
+	if !c.fromServer(iq.From) {
+		return nil, errServiceUnavailable
+	}
+	var push rosterResult
+	if err := xml.Unmarshal(iq.Inner, &push); err != nil {
+		return nil, errBadRequest
+	}
+	for _, item := range push.Items {
+		c.roster.update(item)
+	}
+	if push.Ver != "" {
+		c.roster.setVersion(push.Ver)
+	}
+	return nil, nil
+}
+
+// fromServer reports whether a roster push has been sent by our
+// server on behalf of our account. Pushes from anyone else must be
+// ignored (RFC 6121 2.1.6), or any entity could rewrite our roster.
+func (c *Conn) fromServer(from string) bool {
+	return from == "" || core.JID(from).EqualFull(core.JID(c.JID()).Bare())
+}
+
 type Roster []RosterItem
 
 type RosterItem struct {
-	JID  string `xml:"jid,attr"`
-	Name string `xml:"name,attr,omitempty"`
-	// Groups []string // TODO
+	JID          string `xml:"jid,attr"`
+	Name         string `xml:"name,attr,omitempty"`
 	Subscription string `xml:"subscription,attr,omitempty"`
+	// Ask is "subscribe" if we sent a subscription request that is
+	// still pending. It is set by the server only.
+	Ask    string   `xml:"ask,attr,omitempty"`
+	Groups []string `xml:"group"`
+}
+
+// PendingOut reports whether we asked to subscribe to the contact's
+// presence and the contact hasn't answered yet. Together with
+// Subscription, it distinguishes the states of RFC 6121 Appendix A
+// that are stored in the roster: a subscription of "none" or "from"
+// is either requested and awaiting approval, or not requested at all.
+func (item RosterItem) PendingOut() bool {
+	return item.Ask == "subscribe" && item.Subscription != "to" && item.Subscription != "both"
 }
 
 type rosterQuery struct {
-	XMLName xml.Name    `xml:"jabber:iq:roster query"`
-	Item    *RosterItem `xml:"item,omitempty"`
+	XMLName xml.Name `xml:"jabber:iq:roster query"`
+	// Ver is the version of our cached roster. An empty version
+	// asks for the whole roster, but has to be sent nonetheless if
+	// the server supports roster versioning.
+	Ver  *string     `xml:"ver,attr,omitempty"`
+	Item *RosterItem `xml:"item,omitempty"`
+}
+
+type rosterResult struct {
+	XMLName xml.Name     `xml:"jabber:iq:roster query"`
+	Ver     string       `xml:"ver,attr"`
+	Items   []RosterItem `xml:"item"`
 }
 
+// GetRoster fetches the roster from the server and stores it in the
+// roster cache.
+//
+// If the server supports roster versioning (RFC 6121 2.6), the
+// version of the cached roster is sent along. The server then either
+// sends the whole roster, or nothing if the cached roster is current,
+// followed by roster pushes for the items that changed since. In the
+// latter case, the cached roster is returned; the pushes are applied
+// to the cache as they arrive.
 func (c *Conn) GetRoster() Roster {
-	// TODO implement
+	roster, _ := c.getRoster()
+	return roster
+}
 
-	ch, _ := c.SendIQ("", "get", rosterQuery{})
-	<-ch
+func (c *Conn) getRoster() (Roster, error) {
+	var q rosterQuery
+	if c.Features().Includes("ver") {
+		ver := c.roster.Version()
+		q.Ver = &ver
+	}
+	ch, _ := c.SendIQ("", "get", q)
+	res := <-ch
+	if res == nil {
+		return nil, core.ErrClosed
+	}
+	if res.IsError() {
+		return nil, res.Error
+	}
 
-	return nil
+	if q.Ver != nil && strings.TrimSpace(string(res.Inner)) == "" {
+		// Our version is current, changes arrive as pushes.
+		return c.roster.Roster(), nil
+	}
+	var result rosterResult
+	if err := xml.Unmarshal(res.Inner, &result); err != nil {
+		return nil, err
+	}
+	roster := Roster(result.Items)
+	c.roster.set(roster, result.Ver)
+
+	return roster, nil
 }
 
 // AddToRoster adds an item to the roster. If no item with the
 // specified JID exists yet, a new one will be created. Otherwise an
 // existing one will be updated.
 func (c *Conn) AddToRoster(item RosterItem) error {
+	item.Ask = ""
 	ch, _ := c.SendIQ("", "set", rosterQuery{Item: &item})
 	// TODO implement error handling
 	<-ch
@@ -176,6 +329,43 @@ func (c *Conn) RevokeSubscription(jid string) {
 	})
 }
 
+// GoOnline fetches the roster and then broadcasts initial available
+// presence, returning the roster. This is the order recommended by
+// RFC 6121 (2.2): presence of our contacts, which the server sends in
+// response to initial presence, can only be matched to roster items
+// once we know the roster. GoOnline returns once the presence has
+// been written to the connection. Like GetRoster, it only fetches
+// the changes to the cached roster if the server supports roster
+// versioning.
+//
+// If the roster can't be fetched, no presence is sent and the error
+// is returned. If sending the presence fails, the roster is returned
+// along with the error.
+func (c *Conn) GoOnline() (Roster, error) {
+	return c.GoOnlineWith(core.Presence{})
+}
+
+// GoOnlineWith behaves like GoOnline, but broadcasts p as our initial
+// presence, so that contacts see our show value, status and priority
+// right away. p must be an available presence without a recipient. It
+// is validated before fetching the roster, and restored after
+// reconnecting like any other broadcast presence.
+func (c *Conn) GoOnlineWith(p core.Presence) (Roster, error) {
+	if p.Type != "" || p.To != "" {
+		return nil, ErrNotBroadcast
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	roster, err := c.getRoster()
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.SendPresence(p)
+	return roster, err
+}
+
 func (c *Conn) BecomeAvailable() {
 	// TODO document SendPresence (rfc6120) for more specific needs
 	c.SendPresence(core.Presence{})
@@ -183,31 +373,201 @@ func (c *Conn) BecomeAvailable() {
 
 func (c *Conn) BecomeUnavailable() {
 	// TODO document SendPresence (rfc6120) for more specific needs
-	c.Encode(core.Presence{Header: core.Header{Type: "unavailable"}})
+	c.SendPresence(core.Presence{Header: core.Header{Type: "unavailable"}})
+	c.broadcast.mu.Lock()
+	c.broadcast.presence = nil
+	c.broadcast.mu.Unlock()
+	c.endDirectedPresence()
 }
 
-func (c *Conn) SendMessage(typ, to string, message core.Message) {
-	// TODO support extended items in the mssage
+// closing ends directed presence when the connection is closed, along
+// with the unavailable presence broadcast by Close.
+func (c *Conn) closing(unavailable bool) {
+	if unavailable {
+		c.endDirectedPresence()
+	}
+}
+
+// endDirectedPresence sends unavailable presence to everyone we sent
+// directed presence to. The server only informs subscribers, entities
+// that we sent directed presence to have to be told by us.
+func (c *Conn) endDirectedPresence() {
+	c.directed.mu.Lock()
+	defer c.directed.mu.Unlock()
+	for jid := range c.directed.set {
+		if resource(jid) != "" {
+			if _, ok := c.directed.set[bare(jid)]; ok {
+				// Covered by the unavailable presence to the
+				// bare JID.
+				continue
+			}
+		}
+		c.Encode(core.Presence{Header: core.Header{To: jid, Type: "unavailable"}})
+	}
+	c.directed.set = make(map[string]struct{})
+}
+
+// SendMessage sends a message. It returns once the message has been
+// written to the connection, or with the error that prevented it.
+// typ must be a valid message type, the empty type defaults to
+// normal.
+func (c *Conn) SendMessage(typ, to string, message core.Message) error {
+	_, err := c.sendMessage(typ, to, message)
+	return err
+}
+
+// MessageOptions describes a message sent with SendMessageWith. The
+// zero value of every option leaves the respective feature unused.
+type MessageOptions struct {
+	// To is the recipient of the message.
+	To string
+	// Type is the type of the message. It defaults to normal.
+	Type string
+	// ID is the ID of the message. If empty, a new ID is generated.
+	ID      string
+	Body    string
+	Subject string
+	Thread  string
+	// RequestReceipt requests a delivery receipt (XEP-0184).
+	RequestReceipt bool
+	// Markable allows the recipient to send chat markers for the
+	// message (XEP-0333).
+	Markable bool
+	// ChatState is the chat state (XEP-0085) to attach: one of
+	// "active", "composing", "paused", "inactive" and "gone".
+	ChatState string
+	// Private keeps the message from being carbon-copied to our
+	// other resources (XEP-0280).
+	Private bool
+	// Hints are message processing hints (XEP-0334) to attach: any
+	// of "no-permanent-store", "no-store", "no-copy" and "store".
+	Hints []string
+	// Extensions are additional payloads, which are marshalled as
+	// XML.
+	Extensions []interface{}
+}
+
+func validChatState(state string) bool {
+	switch state {
+	case "", "active", "composing", "paused", "inactive", "gone":
+		return true
+	default:
+		return false
+	}
+}
+
+func validHint(hint string) bool {
+	switch hint {
+	case "no-permanent-store", "no-store", "no-copy", "store":
+		return true
+	default:
+		return false
+	}
+}
+
+// SendMessageWith sends a message described by opts. It returns the
+// message's ID, which receipts, markers and errors will refer to.
+// Invalid chat states and hints are rejected with ErrInvalidChatState
+// and ErrInvalidHint, without sending anything.
+func (c *Conn) SendMessageWith(opts MessageOptions) (id string, err error) {
+	if !validChatState(opts.ChatState) {
+		return "", ErrInvalidChatState
+	}
+	for _, hint := range opts.Hints {
+		if !validHint(hint) {
+			return "", ErrInvalidHint
+		}
+	}
+
+	message := core.Message{
+		Header:  core.Header{Id: opts.ID},
+		Body:    opts.Body,
+		Subject: opts.Subject,
+		Thread:  opts.Thread,
+	}
+
+	if opts.RequestReceipt {
+		message.Inner = append(message.Inner, "<request xmlns='urn:xmpp:receipts'/>"...)
+	}
+	if opts.Markable {
+		message.Inner = append(message.Inner, "<markable xmlns='urn:xmpp:chat-markers:0'/>"...)
+	}
+	if opts.Private {
+		message.Inner = append(message.Inner, "<private xmlns='urn:xmpp:carbons:2'/><no-copy xmlns='urn:xmpp:hints'/>"...)
+	}
+	if opts.ChatState != "" {
+		message.Inner, err = core.AppendPayload(message.Inner, struct {
+			XMLName xml.Name
+		}{xml.Name{Space: "http://jabber.org/protocol/chatstates", Local: opts.ChatState}})
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, hint := range opts.Hints {
+		if core.HasPayload(message.Inner, "urn:xmpp:hints", hint) {
+			// Private includes no-copy.
+			continue
+		}
+		message.Inner, err = core.AppendPayload(message.Inner, struct {
+			XMLName xml.Name
+		}{xml.Name{Space: "urn:xmpp:hints", Local: hint}})
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, ext := range opts.Extensions {
+		message.Inner, err = core.AppendPayload(message.Inner, ext)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return c.sendMessage(opts.Type, opts.To, message)
+}
+
+func (c *Conn) sendMessage(typ, to string, message core.Message) (id string, err error) {
+	if !core.ValidMessageType(typ) {
+		return "", core.ErrInvalidType
+	}
+	if typ == "" {
+		typ = "normal"
+	}
+
 	// TODO if `to` is a bare JID, see if we know about a full JID to
 	// use instead. if it's a full jid, check if it's outdated.
 	// Probably make these two things explicit by providing a function
 	// on the roster that the user has to call, that translates a jid
 	// into a better one. replying should probably automatically use
 	// it.
+	id = message.Id
+	if id == "" {
+		id = c.NewID()
+	}
 	message.Header = core.Header{
-		From: c.JID(),
+		From: c.From(),
+		Id:   id,
 		To:   to,
 		Type: typ,
 	}
 
-	c.Encode(message)
+	return id, c.Encode(message)
 }
 
-func (c *Conn) Reply(orig *core.Message, reply string) {
+func (c *Conn) Reply(orig *core.Message, reply string) error {
 	// TODO use bare JID if full JID isn't up to date anymore
 	// TODO support subject
 	// TODO support extended items
-	c.SendMessage(orig.Type, orig.From, core.Message{Body: reply, Thread: orig.Thread})
+	return c.SendMessage(orig.Type, orig.From, core.Message{Body: reply, Thread: orig.Thread})
+}
+
+// MeAction reports whether a message body is a /me command (XEP-0245)
+// and returns the action, which is the body without the leading
+// "/me ". Clients usually display it prefixed with the sender's name.
+func MeAction(body string) (action string, ok bool) {
+	if !strings.HasPrefix(body, "/me ") {
+		return "", false
+	}
+	return body[len("/me "):], true
 }
 
 // The user's client SHOULD address the initial message in a chat
@@ -0,0 +1,47 @@
+package im
+
+import (
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/last"
+
+	"time"
+)
+
+// LastSeen returns when a contact was last seen online. If the
+// contact is online right now, the current time is returned.
+//
+// There are two sources for this information: Observed values are
+// recorded when the contact's last available resource goes offline
+// while we are connected. They are precise, but only cover the time
+// since we logged in. Queried values are retrieved from the server
+// with QueryLastSeen (XEP-0012) and are available for contacts that
+// were already offline when we logged in; their precision depends on
+// the server. Contact.LastSeenObserved tells the two apart.
+func (c *Conn) LastSeen(jid string) (time.Time, bool) {
+	contact, ok := c.roster.Contact(jid)
+	if !ok {
+		return time.Time{}, false
+	}
+	if contact.Online() {
+		return clock.Now(), true
+	}
+	if contact.LastSeen.IsZero() {
+		return time.Time{}, false
+	}
+	return contact.LastSeen, true
+}
+
+// QueryLastSeen asks the server when an offline contact was last
+// online and records the answer in the roster cache, unless a more
+// recent time has already been observed. Querying requires a presence
+// subscription to the contact.
+func (c *Conn) QueryLastSeen(jid string) (time.Time, error) {
+	seconds, _, err := last.Query(c, bare(jid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t := clock.Now().Add(-time.Duration(seconds) * time.Second)
+	c.roster.queried(jid, t)
+	return t, nil
+}
@@ -0,0 +1,184 @@
+package im_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestSendMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      string
+		omitFrom bool
+		wantType string
+		wantFrom string
+	}{
+		{name: "chat", typ: "chat", wantType: "chat", wantFrom: "alice@example.com/xmpptest"},
+		{name: "default type", typ: "", wantType: "normal", wantFrom: "alice@example.com/xmpptest"},
+		{name: "omitted from", typ: "chat", omitFrom: true, wantType: "chat", wantFrom: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			c.OmitFrom = tt.omitFrom
+			conn := im.Wrap(c)
+
+			errc := make(chan error, 1)
+			go func() { errc <- conn.SendMessage(tt.typ, "bob@example.com", core.Message{Body: "hi"}) }()
+			msg, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if got := msg.Attribute("from"); got != tt.wantFrom {
+				t.Errorf("got from %q, want %q", got, tt.wantFrom)
+			}
+			if got := msg.Attribute("type"); got != tt.wantType {
+				t.Errorf("got type %q, want %q", got, tt.wantType)
+			}
+			if got := msg.Attribute("to"); got != "bob@example.com" {
+				t.Errorf("got to %q, want bob@example.com", got)
+			}
+		})
+	}
+}
+
+func TestSendMessageWithHints(t *testing.T) {
+	tests := []struct {
+		name    string
+		hints   []string
+		private bool
+		want    []string
+	}{
+		{name: "none"},
+		{name: "no-store", hints: []string{"no-store"}, want: []string{"no-store"}},
+		{name: "several", hints: []string{"no-permanent-store", "no-copy"}, want: []string{"no-permanent-store", "no-copy"}},
+		// Private messages carry a no-copy hint of their own.
+		{name: "private", hints: []string{"no-copy", "no-store"}, private: true, want: []string{"no-copy", "no-store"}},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn := im.Wrap(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			go func() {
+				_, err := conn.SendMessageWith(im.MessageOptions{To: "bob@example.com", Type: "chat", Body: "hi", Hints: tt.hints, Private: tt.private})
+				errc <- err
+			}()
+			msg, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, name := range core.PayloadNames(msg.Inner) {
+				if name.Space == "urn:xmpp:hints" {
+					got = append(got, name.Local)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got hints %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMessageWithValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		chatState string
+		hints     []string
+		// wantErr is the error returned, in which case nothing may
+		// be sent.
+		wantErr error
+	}{
+		{name: "valid", chatState: "composing", hints: []string{"store"}},
+		{name: "no chat state"},
+		{name: "unknown chat state", chatState: "typing", wantErr: im.ErrInvalidChatState},
+		{name: "unknown hint", hints: []string{"no-store", "no-forward"}, wantErr: im.ErrInvalidHint},
+		{name: "empty hint", hints: []string{""}, wantErr: im.ErrInvalidHint},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn := im.Wrap(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			go func() {
+				_, err := conn.SendMessageWith(im.MessageOptions{To: "bob@example.com", Type: "chat", Body: "hi", ChatState: tt.chatState, Hints: tt.hints})
+				errc <- err
+				// A marker message proves that nothing else has
+				// been sent.
+				c.Encode(core.Message{Header: core.Header{Id: "marker"}})
+			}()
+			var sent []xmpptest.Element
+			for {
+				e, err := s.NextElement()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Attribute("id") == "marker" {
+					break
+				}
+				sent = append(sent, e)
+			}
+			if err := <-errc; err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				if len(sent) != 0 {
+					t.Errorf("sent %d stanzas, want none", len(sent))
+				}
+				return
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %d stanzas, want one", len(sent))
+			}
+			msg := sent[0]
+			var got []xml.Name
+			for _, name := range core.PayloadNames(msg.Inner) {
+				if name.Space == "http://jabber.org/protocol/chatstates" || name.Space == "urn:xmpp:hints" {
+					got = append(got, name)
+				}
+			}
+			var want []xml.Name
+			if tt.chatState != "" {
+				want = append(want, xml.Name{Space: "http://jabber.org/protocol/chatstates", Local: tt.chatState})
+			}
+			for _, hint := range tt.hints {
+				want = append(want, xml.Name{Space: "urn:xmpp:hints", Local: hint})
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got payloads %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package im
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"sync"
+)
+
+// Muting is purely local: The server still delivers stanzas from
+// muted entities, they are merely dropped by us before they reach the
+// application. Use blocking (XEP-0191) if the server supports it and
+// the entity shouldn't be able to reach us at all.
+type muteList struct {
+	mu  sync.RWMutex
+	set core.JIDSet
+}
+
+func newMuteList() *muteList {
+	return &muteList{}
+}
+
+// Mute drops all messages and presences from jid. A bare JID mutes
+// all of its resources, a full JID only mutes that resource. Muting
+// is local-only and doesn't stop the server from delivering stanzas.
+func (c *Conn) Mute(jid string) {
+	c.muted.mu.Lock()
+	c.muted.set.Add(core.JID(jid))
+	c.muted.mu.Unlock()
+}
+
+// Unmute undoes the effect of Mute. jid has to be equal to the JID
+// that has been passed to Mute.
+func (c *Conn) Unmute(jid string) {
+	c.muted.mu.Lock()
+	c.muted.set.Remove(core.JID(jid))
+	c.muted.mu.Unlock()
+}
+
+// IsMuted reports whether stanzas from jid are being dropped, either
+// because jid or its bare JID has been muted.
+func (c *Conn) IsMuted(jid string) bool {
+	c.muted.mu.RLock()
+	defer c.muted.mu.RUnlock()
+	return c.muted.set.Contains(core.JID(jid))
+}
+
+// Muted returns all muted JIDs.
+func (c *Conn) Muted() []string {
+	c.muted.mu.RLock()
+	defer c.muted.mu.RUnlock()
+	out := make([]string, 0, c.muted.set.Len())
+	for _, jid := range c.muted.set.JIDs() {
+		out = append(out, string(jid))
+	}
+	return out
+}
+
+func (c *Conn) muteFilter(s core.Stanza) bool {
+	switch t := s.(type) {
+	case *core.Message:
+		return !c.IsMuted(t.From)
+	case *core.Presence:
+		return !c.IsMuted(t.From)
+	}
+
+	return true
+}
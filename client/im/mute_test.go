@@ -0,0 +1,67 @@
+package im_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"testing"
+	"time"
+)
+
+func TestMute(t *testing.T) {
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn := im.Wrap(c)
+	conn.Mute("Romeo@Example.com")
+	conn.Mute("nurse@example.com/Kitchen")
+	stanzas := xmpptest.Stanzas(c)
+
+	tests := []struct {
+		from      string
+		delivered bool
+	}{
+		{from: "romeo@example.com/phone"},
+		{from: "ROMEO@example.com."},
+		{from: "nurse@example.com/Kitchen"},
+		{from: "nurse@example.com/kitchen", delivered: true},
+		{from: "nurse@example.com/bedroom", delivered: true},
+		{from: "juliet@example.com/balcony", delivered: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			s.Sendf("<message xmlns='jabber:client' from='%s'><body>muted?</body></message>", tt.from)
+			s.Send("<presence xmlns='jabber:client' from='sentinel@example.com'/>")
+
+			// The sentinel shows that the message has been dropped,
+			// rather than not having arrived yet.
+			var got []string
+			timeout := time.After(5 * time.Second)
+			for len(got) == 0 || got[len(got)-1] != "sentinel@example.com" {
+				select {
+				case stanza := <-stanzas:
+					switch stanza := stanza.(type) {
+					case *core.Message:
+						got = append(got, stanza.From)
+					case *core.Presence:
+						got = append(got, stanza.From)
+					}
+				case <-timeout:
+					t.Fatal("sentinel not delivered")
+				}
+			}
+			if delivered := len(got) == 2 && got[0] == tt.from; delivered != tt.delivered {
+				t.Errorf("got stanzas from %q, want the message delivered: %t", got, tt.delivered)
+			}
+		})
+	}
+
+	conn.Unmute("romeo@example.com")
+	if conn.IsMuted("romeo@example.com/phone") || !conn.IsMuted("nurse@example.com/Kitchen") {
+		t.Errorf("got muted JIDs %q after unmuting", conn.Muted())
+	}
+}
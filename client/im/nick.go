@@ -0,0 +1,45 @@
+package im
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"encoding/xml"
+)
+
+const nsNick = "http://jabber.org/protocol/nick"
+
+type nick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Name    string   `xml:",chardata"`
+}
+
+// AttachNick adds a nickname (XEP-0172) to the payload of an outgoing
+// message or presence and returns the new payload.
+func AttachNick(inner []byte, name string) []byte {
+	inner, _ = core.AppendPayload(inner, nick{Name: name})
+	return inner
+}
+
+// Nick returns the nickname included in the payload of a message or
+// presence, or the empty string if there is none.
+func Nick(inner []byte) string {
+	var v nick
+	if found, err := core.DecodePayload(inner, nsNick, "nick", &v); err != nil || !found {
+		return ""
+	}
+	return v.Name
+}
+
+// Nick returns the nickname the contact included in the request, or
+// the empty string if there is none.
+func (a *AuthorizationRequest) Nick() string {
+	return Nick(a.Inner)
+}
+
+// attachNick includes our nickname in subscription requests.
+func (c *Conn) attachNick(p *core.Presence) {
+	if c.Nick == "" || p.Type != "subscribe" || core.HasPayload(p.Inner, nsNick, "nick") {
+		return
+	}
+	p.Inner = AttachNick(p.Inner, c.Nick)
+}
@@ -0,0 +1,266 @@
+package im_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGoOnline(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply answers the roster request, the IQ's id is passed
+		// as the argument.
+		reply string
+		// hangUp closes the connection after sending the reply.
+		hangUp   bool
+		wantErr  func(error) bool
+		wantJIDs []string
+	}{
+		{
+			name:     "roster",
+			reply:    "<iq xmlns='jabber:client' type='result' id='%s'><query xmlns='jabber:iq:roster'><item jid='bob@example.com' subscription='both'/><item jid='carol@example.com' subscription='to'/></query></iq>",
+			wantJIDs: []string{"bob@example.com", "carol@example.com"},
+		},
+		{
+			name:  "empty roster",
+			reply: "<iq xmlns='jabber:client' type='result' id='%s'><query xmlns='jabber:iq:roster'/></iq>",
+		},
+		{
+			name:  "error",
+			reply: "<iq xmlns='jabber:client' type='error' id='%s'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr) && stanzaErr.Type == "cancel"
+			},
+		},
+		{
+			name:    "closed",
+			reply:   "</stream:stream>",
+			hangUp:  true,
+			wantErr: func(err error) bool { return err == core.ErrClosed },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			conn := im.Wrap(c)
+			xmpptest.Stanzas(c)
+
+			type result struct {
+				roster im.Roster
+				err    error
+			}
+			done := make(chan result, 1)
+			go func() {
+				roster, err := conn.GoOnline()
+				done <- result{roster, err}
+			}()
+
+			req, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.XMLName.Local != "iq" || req.Attribute("type") != "get" {
+				t.Fatalf("got <%s>, want the roster request first", req.XMLName.Local)
+			}
+			s.Sendf(tt.reply, req.Attribute("id"))
+			if tt.hangUp {
+				s.Conn.Close()
+			}
+
+			if tt.wantErr != nil {
+				res := <-done
+				if !tt.wantErr(res.err) {
+					t.Fatalf("got error %v", res.err)
+				}
+				if res.roster != nil {
+					t.Errorf("got roster %v along with an error", res.roster)
+				}
+				return
+			}
+
+			presence, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if presence.XMLName.Local != "presence" || presence.Attribute("type") != "" || presence.Attribute("to") != "" {
+				t.Errorf("got <%s> %v, want initial available presence", presence.XMLName.Local, presence.Attr)
+			}
+			res := <-done
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			if len(res.roster) != len(tt.wantJIDs) {
+				t.Fatalf("got roster %v, want %v", res.roster, tt.wantJIDs)
+			}
+			for i, item := range res.roster {
+				if item.JID != tt.wantJIDs[i] {
+					t.Errorf("got item %q, want %q", item.JID, tt.wantJIDs[i])
+				}
+				if _, ok := conn.Roster().Contact(item.JID); !ok {
+					t.Errorf("%s isn't in the roster cache", item.JID)
+				}
+			}
+		})
+	}
+}
+
+func TestGoOnlineVersioned(t *testing.T) {
+	const rosterver = "<ver xmlns='urn:xmpp:features:rosterver'/>"
+	tests := []struct {
+		name     string
+		features string
+		// stored is the version of the seeded roster, which only
+		// contains bob.
+		stored string
+		// versioned is set if the request has to carry wantVer.
+		versioned bool
+		wantVer   string
+		// reply is the payload of the roster result.
+		reply string
+		// push is the payload of a roster push sent after going
+		// online, if not empty.
+		push       string
+		wantJIDs   []string
+		wantCached []string
+		wantStored string
+	}{
+		{
+			name:       "unsupported",
+			stored:     "v1",
+			reply:      "<query xmlns='jabber:iq:roster'><item jid='carol@example.com'/></query>",
+			wantJIDs:   []string{"carol@example.com"},
+			wantCached: []string{"carol@example.com"},
+		},
+		{
+			name:       "first fetch",
+			features:   rosterver,
+			versioned:  true,
+			reply:      "<query xmlns='jabber:iq:roster' ver='v2'><item jid='carol@example.com'/></query>",
+			wantJIDs:   []string{"carol@example.com"},
+			wantCached: []string{"carol@example.com"},
+			wantStored: "v2",
+		},
+		{
+			name:       "outdated",
+			features:   rosterver,
+			stored:     "v1",
+			versioned:  true,
+			wantVer:    "v1",
+			reply:      "<query xmlns='jabber:iq:roster' ver='v2'><item jid='carol@example.com'/></query>",
+			wantJIDs:   []string{"carol@example.com"},
+			wantCached: []string{"carol@example.com"},
+			wantStored: "v2",
+		},
+		{
+			name:       "current",
+			features:   rosterver,
+			stored:     "v1",
+			versioned:  true,
+			wantVer:    "v1",
+			wantJIDs:   []string{"bob@example.com"},
+			wantCached: []string{"bob@example.com"},
+			wantStored: "v1",
+		},
+		{
+			name:       "current with changes",
+			features:   rosterver,
+			stored:     "v1",
+			versioned:  true,
+			wantVer:    "v1",
+			push:       "<query xmlns='jabber:iq:roster' ver='v2'><item jid='carol@example.com'/></query>",
+			wantJIDs:   []string{"bob@example.com"},
+			wantCached: []string{"bob@example.com", "carol@example.com"},
+			wantStored: "v2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipe, s := xmpptest.Pipe()
+			defer s.Close()
+			s.Features = tt.features
+			c := core.NewConnection(pipe, "alice", s.Domain, "secret")
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			conn := im.Wrap(c)
+			conn.Roster().SeedVersion(im.Roster{{JID: "bob@example.com", Subscription: "both"}}, tt.stored)
+			xmpptest.Stanzas(c)
+
+			type result struct {
+				roster im.Roster
+				err    error
+			}
+			done := make(chan result, 1)
+			go func() {
+				roster, err := conn.GoOnline()
+				done <- result{roster, err}
+			}()
+
+			req, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var q struct {
+				Ver *string `xml:"ver,attr"`
+			}
+			xml.Unmarshal(req.Inner, &q)
+			if (q.Ver != nil) != tt.versioned || (q.Ver != nil && *q.Ver != tt.wantVer) {
+				t.Fatalf("got request %s, want version %q sent: %t", req.Inner, tt.wantVer, tt.versioned)
+			}
+			s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'>%s</iq>", req.Attribute("id"), tt.reply)
+
+			if _, err := s.NextElement(); err != nil {
+				t.Fatal(err)
+			}
+			res := <-done
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			if got := jids(res.roster); !reflect.DeepEqual(got, tt.wantJIDs) {
+				t.Errorf("got roster %v, want %v", got, tt.wantJIDs)
+			}
+
+			if tt.push != "" {
+				s.Sendf("<iq xmlns='jabber:client' type='set' id='push1'>%s</iq>", tt.push)
+				if _, err := s.NextElement(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := jids(conn.Roster().Roster()); !reflect.DeepEqual(got, tt.wantCached) {
+				t.Errorf("got cached roster %v, want %v", got, tt.wantCached)
+			}
+			if got := conn.Roster().Version(); got != tt.wantStored {
+				t.Errorf("got version %q, want %q", got, tt.wantStored)
+			}
+		})
+	}
+}
+
+// jids returns the sorted JIDs of a roster.
+func jids(roster im.Roster) []string {
+	var out []string
+	for _, item := range roster {
+		out = append(out, item.JID)
+	}
+	sort.Strings(out)
+	return out
+}
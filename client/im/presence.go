@@ -0,0 +1,94 @@
+package im
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"sync"
+)
+
+// directedList tracks the entities we sent directed presence to, so
+// that they can be told when we go offline (RFC 6121 4.6.3).
+type directedList struct {
+	mu  sync.Mutex
+	set map[string]struct{}
+}
+
+func newDirectedList() *directedList {
+	return &directedList{set: make(map[string]struct{})}
+}
+
+// SendDirectedPresence sends presence to a single entity instead of
+// broadcasting it to all subscribers. This is useful for sharing
+// presence with entities that aren't subscribed to it, like the peer
+// of a chat session or a room. p.To and p.Type are overwritten.
+//
+// Presence directed at a bare JID is delivered to all of its
+// resources. The entity is remembered and will be sent unavailable
+// presence by BecomeUnavailable or EndDirectedPresence.
+func (c *Conn) SendDirectedPresence(to string, p core.Presence) (cookie string, err error) {
+	p.To = to
+	p.Type = ""
+
+	c.directed.mu.Lock()
+	c.directed.set[to] = struct{}{}
+	c.directed.mu.Unlock()
+
+	return c.SendPresence(p)
+}
+
+// EndDirectedPresence sends directed unavailable presence to an
+// entity that we previously sent directed presence to, for example
+// when a chat session is over.
+func (c *Conn) EndDirectedPresence(to string) error {
+	c.directed.mu.Lock()
+	c.forgetDirected(to)
+	c.directed.mu.Unlock()
+
+	return c.Encode(core.Presence{
+		Header: core.Header{
+			To:   to,
+			Type: "unavailable",
+		},
+	})
+}
+
+// forgetDirected removes to from the list of directed presence
+// recipients. Unavailable presence sent to a bare JID reaches all of
+// its resources, so those are forgotten, too. The caller must hold
+// the lock.
+func (c *Conn) forgetDirected(to string) {
+	delete(c.directed.set, to)
+	if resource(to) != "" {
+		return
+	}
+	for jid := range c.directed.set {
+		if bare(jid) == to {
+			delete(c.directed.set, jid)
+		}
+	}
+}
+
+// DirectedPresence returns the entities that we sent directed
+// presence to and that haven't been sent unavailable presence since.
+func (c *Conn) DirectedPresence() []string {
+	c.directed.mu.Lock()
+	defer c.directed.mu.Unlock()
+
+	out := make([]string, 0, len(c.directed.set))
+	for jid := range c.directed.set {
+		out = append(out, jid)
+	}
+	return out
+}
+
+// Probe asks the server for the current presence of jid. The answer
+// will arrive as a regular presence stanza. Probing only works for
+// contacts whose presence we're subscribed to.
+func (c *Conn) Probe(jid string) error {
+	return c.Encode(core.Presence{
+		Header: core.Header{
+			To:   jid,
+			Type: "probe",
+		},
+	})
+}
@@ -0,0 +1,77 @@
+package im_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCloseEndsDirectedPresence(t *testing.T) {
+	tests := []struct {
+		name      string
+		available bool
+		omit      bool
+		// want are the presences the peer receives after the
+		// directed presence, as their types and recipients.
+		want []string
+	}{
+		{
+			name:      "available",
+			available: true,
+			want:      []string{"unavailable to bob@example.com/phone", "unavailable to everyone"},
+		},
+		{name: "omitted", available: true, omit: true},
+		{name: "never available"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Conn.Close()
+			c.OmitUnavailableOnClose = tt.omit
+			conn := im.Wrap(c)
+			xmpptest.Stanzas(c)
+
+			received := s.CollectUntilClosed()
+
+			want := []string{"available to bob@example.com/phone"}
+			if tt.available {
+				if _, err := c.SendPresence(core.Presence{}); err != nil {
+					t.Fatal(err)
+				}
+				want = append([]string{"available to everyone"}, want...)
+			}
+			if _, err := conn.SendDirectedPresence("bob@example.com/phone", core.Presence{}); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+
+			select {
+			case elements := <-received:
+				var got []string
+				for _, e := range elements {
+					typ, to := e.Attribute("type"), e.Attribute("to")
+					if typ == "" {
+						typ = "available"
+					}
+					if to == "" {
+						to = "everyone"
+					}
+					got = append(got, typ+" to "+to)
+				}
+				if want := append(want, tt.want...); !reflect.DeepEqual(got, want) {
+					t.Errorf("peer received %q, want %q", got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream wasn't closed")
+			}
+		})
+	}
+}
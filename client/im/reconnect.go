@@ -0,0 +1,88 @@
+package im
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+
+	"sync"
+)
+
+// broadcast remembers the last presence we broadcast, so that it can
+// be restored after reconnecting.
+type broadcast struct {
+	mu       sync.Mutex
+	presence *core.Presence
+	// generation changes with every reconnect and every presence we
+	// broadcast, invalidating delayed restores.
+	generation uint64
+}
+
+func (c *Conn) observeBroadcast(p *core.Presence) {
+	if p.To != "" {
+		return
+	}
+
+	c.broadcast.mu.Lock()
+	defer c.broadcast.mu.Unlock()
+	c.broadcast.generation++
+	if p.Type != "" {
+		c.broadcast.presence = nil
+		return
+	}
+	stored := *p
+	stored.Id = ""
+	// Payloads are attached by decorators, which will attach them
+	// again when the presence is restored.
+	stored.Inner = nil
+	c.broadcast.presence = &stored
+}
+
+// LastPresence returns the presence we last broadcast, and false if
+// we aren't available.
+func (c *Conn) LastPresence() (core.Presence, bool) {
+	c.broadcast.mu.Lock()
+	defer c.broadcast.mu.Unlock()
+	if c.broadcast.presence == nil {
+		return core.Presence{}, false
+	}
+	return *c.broadcast.presence, true
+}
+
+// restorePresence broadcasts our last presence again after the
+// connection has been re-established, unless the session has been
+// resumed and the server still knows it.
+func (c *Conn) restorePresence(resumed bool) {
+	if resumed {
+		return
+	}
+	if c.RestoreDelay <= 0 {
+		c.restore()
+		return
+	}
+
+	c.broadcast.mu.Lock()
+	c.broadcast.generation++
+	gen := c.broadcast.generation
+	c.broadcast.mu.Unlock()
+	clock.AfterFunc(c.RestoreDelay, func() {
+		c.broadcast.mu.Lock()
+		current := c.broadcast.generation == gen
+		c.broadcast.mu.Unlock()
+		// If the connection dropped again in the meantime, the
+		// next reconnect takes care of it.
+		if current && c.State() == core.StateBound {
+			c.restore()
+		}
+	})
+}
+
+func (c *Conn) restore() {
+	p, ok := c.LastPresence()
+	if !ok {
+		return
+	}
+	if c.Restore != nil && !c.Restore(&p) {
+		return
+	}
+	c.SendPresence(p)
+}
@@ -0,0 +1,306 @@
+package im
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+
+	"strings"
+	"sync"
+	"time"
+)
+
+// Contact is a roster item together with the presences of its
+// available resources.
+type Contact struct {
+	RosterItem
+	// Presences maps resources to their most recent available
+	// presence.
+	Presences map[string]core.Presence
+	// LastSeen is the time the contact went offline, or the zero
+	// time if it is unknown. See (*Conn).LastSeen for details.
+	LastSeen time.Time
+	// LastSeenObserved reports whether LastSeen has been observed by
+	// us, as opposed to having been queried from the server.
+	LastSeenObserved bool
+}
+
+// Online reports whether at least one resource of the contact is
+// available.
+func (c Contact) Online() bool {
+	return len(c.Presences) > 0
+}
+
+// RosterCache keeps track of the roster and the presence of the
+// contacts in it. It is updated from the initial roster fetch, roster
+// pushes and presence stanzas as they are processed. It is safe for
+// concurrent use.
+//
+// A program printing the contacts that are currently online could
+// look like this:
+//
+//	conn := im.Wrap(client)
+//	if _, err := conn.GoOnline(); err != nil {
+//	    log.Fatal(err)
+//	}
+//	for _, contact := range conn.Roster().Online() {
+//	    fmt.Println(contact.JID)
+//	}
+type RosterCache struct {
+	mu       sync.RWMutex
+	contacts map[string]*Contact
+	ver      string
+	changes  chan string
+}
+
+func newRosterCache() *RosterCache {
+	return &RosterCache{
+		contacts: make(map[string]*Contact),
+		changes:  make(chan string, 64),
+	}
+}
+
+// Changes returns a channel that receives the bare JID of every
+// contact whose roster item or presence changed. The notification
+// doesn't carry the new state, which can be retrieved with Contact.
+// If the channel isn't drained, further notifications will be
+// dropped instead of blocking the processing of stanzas.
+func (r *RosterCache) Changes() <-chan string {
+	return r.changes
+}
+
+func (r *RosterCache) notify(jid string) {
+	select {
+	case r.changes <- jid:
+	default:
+	}
+}
+
+func copyContact(c *Contact) Contact {
+	out := *c
+	out.Presences = make(map[string]core.Presence, len(c.Presences))
+	out.Groups = append([]string(nil), c.Groups...)
+	for res, p := range c.Presences {
+		out.Presences[res] = p
+	}
+	return out
+}
+
+// Contact returns the contact with the given bare JID.
+func (r *RosterCache) Contact(jid string) (Contact, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.contacts[bare(jid)]
+	if !ok {
+		return Contact{}, false
+	}
+	return copyContact(c), true
+}
+
+// Contacts returns all contacts in the roster.
+func (r *RosterCache) Contacts() []Contact {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]Contact, 0, len(r.contacts))
+	for _, c := range r.contacts {
+		out = append(out, copyContact(c))
+	}
+	return out
+}
+
+// Online returns all contacts that have at least one available
+// resource.
+func (r *RosterCache) Online() []Contact {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []Contact
+	for _, c := range r.contacts {
+		if c.Online() {
+			out = append(out, copyContact(c))
+		}
+	}
+	return out
+}
+
+// Version returns the version of the cached roster, as assigned by a
+// server that supports roster versioning. It is empty if the version
+// is unknown.
+func (r *RosterCache) Version() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ver
+}
+
+func (r *RosterCache) setVersion(ver string) {
+	r.mu.Lock()
+	r.ver = ver
+	r.mu.Unlock()
+}
+
+// set replaces the whole roster, keeping known presences of
+// contacts that are still in it.
+func (r *RosterCache) set(roster Roster, ver string) {
+	r.mu.Lock()
+	r.ver = ver
+	old := r.contacts
+	r.contacts = make(map[string]*Contact, len(roster))
+	for _, item := range roster {
+		jid := bare(item.JID)
+		c := &Contact{RosterItem: item, Presences: make(map[string]core.Presence)}
+		if prev, ok := old[jid]; ok {
+			c.Presences = prev.Presences
+		}
+		r.contacts[jid] = c
+	}
+	r.mu.Unlock()
+
+	for jid := range old {
+		if _, ok := roster.get(jid); !ok {
+			r.notify(jid)
+		}
+	}
+	for _, item := range roster {
+		r.notify(bare(item.JID))
+	}
+}
+
+// update applies a roster push.
+func (r *RosterCache) update(item RosterItem) {
+	jid := bare(item.JID)
+	r.mu.Lock()
+	if item.Subscription == "remove" {
+		delete(r.contacts, jid)
+	} else if c, ok := r.contacts[jid]; ok {
+		c.RosterItem = item
+	} else {
+		r.contacts[jid] = &Contact{RosterItem: item, Presences: make(map[string]core.Presence)}
+	}
+	r.mu.Unlock()
+
+	r.notify(jid)
+}
+
+// presence applies an available or unavailable presence. Presences
+// from entities that aren't in the roster are ignored.
+func (r *RosterCache) presence(p *core.Presence) {
+	if p.Type != "" && p.Type != "unavailable" {
+		return
+	}
+
+	jid := bare(p.From)
+	r.mu.Lock()
+	c, ok := r.contacts[jid]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	res := resource(p.From)
+	if p.Type == "unavailable" {
+		if res == "" {
+			c.Presences = make(map[string]core.Presence)
+		} else {
+			delete(c.Presences, res)
+		}
+		if len(c.Presences) == 0 {
+			c.LastSeen = clock.Now()
+			c.LastSeenObserved = true
+		}
+	} else {
+		c.Presences[res] = *p
+	}
+	r.mu.Unlock()
+
+	r.notify(jid)
+}
+
+// queried records a last seen time retrieved from the server, unless
+// we observed a more recent one ourselves.
+func (r *RosterCache) queried(jid string, t time.Time) {
+	r.mu.Lock()
+	c, ok := r.contacts[bare(jid)]
+	if !ok || (c.LastSeenObserved && c.LastSeen.After(t)) {
+		r.mu.Unlock()
+		return
+	}
+	c.LastSeen = t
+	c.LastSeenObserved = false
+	r.mu.Unlock()
+
+	r.notify(bare(jid))
+}
+
+func (r Roster) get(jid string) (RosterItem, bool) {
+	for _, item := range r {
+		if bare(item.JID) == jid {
+			return item, true
+		}
+	}
+	return RosterItem{}, false
+}
+
+// RosterDiff compares two snapshots of the roster, as returned by
+// GetRoster, by JID. It returns the items that are only in new, the
+// items that are only in old, and the items whose name, subscription,
+// pending request or groups changed, as they are in new. The order of
+// groups doesn't matter.
+func RosterDiff(old, new Roster) (added, removed, changed []RosterItem) {
+	before := make(map[string]RosterItem, len(old))
+	for _, item := range old {
+		before[item.JID] = item
+	}
+	after := make(map[string]bool, len(new))
+
+	for _, item := range new {
+		after[item.JID] = true
+		prev, ok := before[item.JID]
+		switch {
+		case !ok:
+			added = append(added, item)
+		case prev.Name != item.Name ||
+			prev.Subscription != item.Subscription ||
+			prev.Ask != item.Ask ||
+			!sameGroups(prev.Groups, item.Groups):
+			changed = append(changed, item)
+		}
+	}
+
+	for _, item := range old {
+		if !after[item.JID] {
+			removed = append(removed, item)
+		}
+	}
+
+	return added, removed, changed
+}
+
+func sameGroups(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int, len(a))
+	for _, g := range a {
+		count[g]++
+	}
+	for _, g := range b {
+		if count[g] == 0 {
+			return false
+		}
+		count[g]--
+	}
+	return true
+}
+
+// bare returns the bare JID of jid.
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	return jid
+}
+
+// resource returns the resource part of jid.
+func resource(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,223 @@
+package im_test
+
+import (
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRosterPush(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		applied bool
+	}{
+		{name: "no from", from: "", applied: true},
+		{name: "own bare JID", from: "alice@example.com", applied: true},
+		{name: "own bare JID, different case", from: "Alice@Example.com", applied: true},
+		{name: "own full JID", from: "alice@example.com/xmpptest", applied: false},
+		{name: "server", from: "example.com", applied: false},
+		{name: "contact", from: "mallory@example.net", applied: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			conn := im.Wrap(c)
+			xmpptest.Stanzas(c)
+
+			from := ""
+			if tt.from != "" {
+				from = " from='" + tt.from + "'"
+			}
+			s.Send("<iq xmlns='jabber:client' type='set' id='push1'" + from + ">" +
+				"<query xmlns='jabber:iq:roster'><item jid='bob@example.com' subscription='both'/></query></iq>")
+
+			reply, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Attribute("id") != "push1" {
+				t.Fatalf("got reply with id %q, want push1", reply.Attribute("id"))
+			}
+
+			_, ok := conn.Roster().Contact("bob@example.com")
+			if tt.applied {
+				if reply.Attribute("type") != "result" {
+					t.Errorf("got reply of type %q, want result", reply.Attribute("type"))
+				}
+				if !ok {
+					t.Error("push wasn't applied to the roster cache")
+				}
+				return
+			}
+			if reply.Attribute("type") != "error" || !strings.Contains(string(reply.Inner), "service-unavailable") {
+				t.Errorf("got reply %s, want a service-unavailable error", reply.Inner)
+			}
+			if ok {
+				t.Error("push from a foreign entity was applied to the roster cache")
+			}
+		})
+	}
+}
+
+func TestRosterDiff(t *testing.T) {
+	bob := im.RosterItem{JID: "bob@example.com", Name: "Bob", Subscription: "both", Groups: []string{"Friends", "Work"}}
+	carol := im.RosterItem{JID: "carol@example.com", Subscription: "to"}
+
+	tests := []struct {
+		name        string
+		old, new    im.Roster
+		wantAdded   []im.RosterItem
+		wantRemoved []im.RosterItem
+		wantChanged []im.RosterItem
+	}{
+		{name: "empty"},
+		{name: "unchanged", old: im.Roster{bob, carol}, new: im.Roster{carol, bob}},
+		{
+			name: "group order",
+			old:  im.Roster{bob},
+			new:  im.Roster{{JID: bob.JID, Name: bob.Name, Subscription: bob.Subscription, Groups: []string{"Work", "Friends"}}},
+		},
+		{name: "added", old: im.Roster{bob}, new: im.Roster{bob, carol}, wantAdded: []im.RosterItem{carol}},
+		{name: "removed", old: im.Roster{bob, carol}, new: im.Roster{carol}, wantRemoved: []im.RosterItem{bob}},
+		{
+			name:        "groups and subscription",
+			old:         im.Roster{bob, carol},
+			new:         im.Roster{{JID: bob.JID, Name: bob.Name, Subscription: "from", Groups: []string{"Work", "Family"}}, carol},
+			wantChanged: []im.RosterItem{{JID: bob.JID, Name: bob.Name, Subscription: "from", Groups: []string{"Work", "Family"}}},
+		},
+		{
+			name:        "renamed",
+			old:         im.Roster{carol},
+			new:         im.Roster{{JID: carol.JID, Name: "Carol", Subscription: carol.Subscription}},
+			wantChanged: []im.RosterItem{{JID: carol.JID, Name: "Carol", Subscription: carol.Subscription}},
+		},
+		{
+			name:        "duplicate group",
+			old:         im.Roster{{JID: bob.JID, Groups: []string{"Friends", "Friends"}}},
+			new:         im.Roster{{JID: bob.JID, Groups: []string{"Friends", "Work"}}},
+			wantChanged: []im.RosterItem{{JID: bob.JID, Groups: []string{"Friends", "Work"}}},
+		},
+		{
+			name:        "pending request",
+			old:         im.Roster{carol},
+			new:         im.Roster{{JID: carol.JID, Subscription: carol.Subscription, Ask: "subscribe"}},
+			wantChanged: []im.RosterItem{{JID: carol.JID, Subscription: carol.Subscription, Ask: "subscribe"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed, changed := im.RosterDiff(tt.old, tt.new)
+			if !reflect.DeepEqual(added, tt.wantAdded) {
+				t.Errorf("got added %v, want %v", added, tt.wantAdded)
+			}
+			if !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("got removed %v, want %v", removed, tt.wantRemoved)
+			}
+			if !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("got changed %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestPendingSubscription(t *testing.T) {
+	tests := []struct {
+		name string
+		// attrs are the item's attributes besides the JID.
+		attrs       string
+		wantAsk     string
+		wantPending bool
+	}{
+		{name: "none", attrs: "subscription='none'"},
+		{name: "requested", attrs: "subscription='none' ask='subscribe'", wantAsk: "subscribe", wantPending: true},
+		{name: "requested, subscribed to us", attrs: "subscription='from' ask='subscribe'", wantAsk: "subscribe", wantPending: true},
+		{name: "subscribed to us", attrs: "subscription='from'"},
+		{name: "approved", attrs: "subscription='to'"},
+		// Servers shouldn't keep the flag once the request has
+		// been approved.
+		{name: "stale ask", attrs: "subscription='both' ask='subscribe'", wantAsk: "subscribe"},
+	}
+
+	for _, tt := range tests {
+		for _, push := range []bool{false, true} {
+			name := tt.name + "/result"
+			if push {
+				name = tt.name + "/push"
+			}
+			t.Run(name, func(t *testing.T) {
+				c, s, err := xmpptest.Connect("alice", "secret")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				conn := im.Wrap(c)
+				xmpptest.Stanzas(c)
+
+				item := fmt.Sprintf("<item jid='bob@example.com' name='Bob' %s><group>Friends</group></item>", tt.attrs)
+				if push {
+					s.Send("<iq xmlns='jabber:client' type='set' id='push1'><query xmlns='jabber:iq:roster'>" + item + "</query></iq>")
+					if _, err := s.NextElement(); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					done := make(chan im.Roster, 1)
+					go func() { done <- conn.GetRoster() }()
+					iq, err := s.NextElement()
+					if err != nil {
+						t.Fatal(err)
+					}
+					s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'><query xmlns='jabber:iq:roster'>%s</query></iq>", iq.Attribute("id"), item)
+					roster := <-done
+					if len(roster) != 1 || roster[0].Ask != tt.wantAsk {
+						t.Errorf("got roster %+v, want bob with ask %q", roster, tt.wantAsk)
+					}
+				}
+
+				contact, ok := conn.Roster().Contact("bob@example.com")
+				if !ok {
+					t.Fatal("bob isn't in the roster cache")
+				}
+				if contact.Ask != tt.wantAsk || contact.PendingOut() != tt.wantPending {
+					t.Errorf("got ask %q, pending %t, want %q, %t", contact.Ask, contact.PendingOut(), tt.wantAsk, tt.wantPending)
+				}
+
+				// Updating the item must not echo the server's flag.
+				contact.Name = "Robert"
+				errc := make(chan error, 1)
+				go func() { errc <- conn.AddToRoster(contact.RosterItem) }()
+				iq, err := s.NextElement()
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'/>", iq.Attribute("id"))
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				var sent struct {
+					Item struct {
+						Name string  `xml:"name,attr"`
+						Ask  *string `xml:"ask,attr"`
+					} `xml:"item"`
+				}
+				if err := xml.Unmarshal(iq.Inner, &sent); err != nil {
+					t.Fatal(err)
+				}
+				if sent.Item.Name != "Robert" || sent.Item.Ask != nil {
+					t.Errorf("got update %s, want the new name without ask", iq.Inner)
+				}
+			})
+		}
+	}
+}
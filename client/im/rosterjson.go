@@ -0,0 +1,68 @@
+package im
+
+import (
+	"encoding/json"
+)
+
+// jsonRosterItem is the serialized form of a roster item. It is
+// independent of the XMPP wire format, so that stored rosters stay
+// readable if RosterItem changes.
+type jsonRosterItem struct {
+	JID          string   `json:"jid"`
+	Name         string   `json:"name,omitempty"`
+	Subscription string   `json:"subscription,omitempty"`
+	Ask          string   `json:"ask,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+}
+
+// MarshalJSON encodes the roster as JSON, for storing it between
+// sessions.
+func (r Roster) MarshalJSON() ([]byte, error) {
+	items := make([]jsonRosterItem, len(r))
+	for i, item := range r {
+		items[i] = jsonRosterItem(item)
+	}
+	return json.Marshal(items)
+}
+
+// UnmarshalJSON decodes a roster encoded with MarshalJSON.
+func (r *Roster) UnmarshalJSON(b []byte) error {
+	var items []jsonRosterItem
+	if err := json.Unmarshal(b, &items); err != nil {
+		return err
+	}
+
+	*r = make(Roster, len(items))
+	for i, item := range items {
+		(*r)[i] = RosterItem(item)
+	}
+	return nil
+}
+
+// Roster returns the roster items of all contacts, for example for
+// storing them with MarshalJSON.
+func (r *RosterCache) Roster() Roster {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(Roster, 0, len(r.contacts))
+	for _, c := range r.contacts {
+		item := c.RosterItem
+		item.Groups = append([]string(nil), item.Groups...)
+		out = append(out, item)
+	}
+	return out
+}
+
+// Seed fills the cache with a stored roster, so that contacts are
+// known before the roster has been fetched from the server. The
+// stored roster is replaced once GetRoster is called.
+func (r *RosterCache) Seed(roster Roster) {
+	r.set(roster, "")
+}
+
+// SeedVersion is like Seed, for a roster stored together with its
+// Version. If the server supports roster versioning, GetRoster then
+// only fetches the changes made since the roster was stored.
+func (r *RosterCache) SeedVersion(roster Roster, ver string) {
+	r.set(roster, ver)
+}
@@ -0,0 +1,85 @@
+package im_test
+
+import (
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRosterJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		// items are the roster items sent by the server.
+		items    string
+		wantJSON string
+	}{
+		{name: "empty", wantJSON: `[]`},
+		{
+			name:     "minimal",
+			items:    "<item jid='bob@example.com'/>",
+			wantJSON: `[{"jid":"bob@example.com"}]`,
+		},
+		{
+			name: "full",
+			items: "<item jid='bob@example.com' name='Bob' subscription='both'><group>Friends</group><group>Work</group></item>" +
+				"<item jid='carol@example.com' subscription='none' ask='subscribe'/>",
+			wantJSON: `[{"jid":"bob@example.com","name":"Bob","subscription":"both","groups":["Friends","Work"]},` +
+				`{"jid":"carol@example.com","subscription":"none","ask":"subscribe"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			conn := im.Wrap(c)
+			xmpptest.Stanzas(c)
+
+			done := make(chan im.Roster, 1)
+			go func() { done <- conn.GetRoster() }()
+			req, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'><query xmlns='jabber:iq:roster'>%s</query></iq>",
+				req.Attribute("id"), tt.items)
+			roster := <-done
+
+			b, err := json.Marshal(roster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.wantJSON {
+				t.Errorf("got %s, want %s", b, tt.wantJSON)
+			}
+
+			var decoded im.Roster
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(roster) || (len(roster) > 0 && !reflect.DeepEqual(decoded, roster)) {
+				t.Fatalf("got %+v after a round trip, want %+v", decoded, roster)
+			}
+
+			// A stored roster seeds the cache of the next session.
+			c2, s2, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s2.Close()
+			cache := im.Wrap(c2).Roster()
+			cache.Seed(decoded)
+			for _, item := range roster {
+				if got, ok := cache.Contact(item.JID); !ok || !reflect.DeepEqual(got.RosterItem, item) {
+					t.Errorf("seeded cache has %+v, want %+v", got, item)
+				}
+			}
+		})
+	}
+}
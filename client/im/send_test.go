@@ -0,0 +1,80 @@
+package im_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSendBeforeClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// tcp connects over the loopback interface, where writes
+		// don't wait for the peer to read them.
+		tcp bool
+		// available sends initial presence, which makes Close
+		// announce that we went offline.
+		available bool
+		want      []string
+	}{
+		{name: "pipe", want: []string{"message"}},
+		{name: "tcp", tcp: true, want: []string{"message"}},
+		{name: "available", available: true, want: []string{"message", "presence"}},
+		{name: "available over tcp", tcp: true, available: true, want: []string{"message", "presence"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conn net.Conn
+			var s *xmpptest.Server
+			if tt.tcp {
+				var err error
+				conn, s, err = xmpptest.TCPPipe()
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				conn, s = xmpptest.Pipe()
+			}
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			received := s.CollectUntilClosed()
+
+			if tt.available {
+				if _, err := c.SendPresence(core.Presence{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := im.Wrap(c).SendMessage("chat", "bob@example.com", core.Message{Body: "bye"}); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+
+			var got []string
+			for _, e := range <-received {
+				got = append(got, e.XMLName.Local)
+			}
+			if tt.available {
+				// Drop the initial presence.
+				got = got[1:]
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("peer received %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
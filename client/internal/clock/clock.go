@@ -0,0 +1,93 @@
+// Package clock abstracts the passing of time, so that time-based
+// features like timeouts, keepalives and idle detection can be tested
+// deterministically with a Mock instead of real sleeps.
+//
+// All time-based code uses the package-level functions, which
+// delegate to the clock installed with Set, the real clock by
+// default. Deadlines on network connections keep using real time.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls f in its own goroutine after d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the equivalent of time.Timer. C returns nil for timers
+// created with AfterFunc.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the equivalent of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var (
+	mu      sync.RWMutex
+	current Clock = Real{}
+)
+
+// Set installs a clock and returns a function that restores the
+// previous one.
+func Set(c Clock) (restore func()) {
+	mu.Lock()
+	prev := current
+	current = c
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		current = prev
+		mu.Unlock()
+	}
+}
+
+func get() Clock {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+func Now() time.Time                            { return get().Now() }
+func Since(t time.Time) time.Duration           { return get().Now().Sub(t) }
+func NewTimer(d time.Duration) Timer            { return get().NewTimer(d) }
+func NewTicker(d time.Duration) Ticker          { return get().NewTicker(d) }
+func AfterFunc(d time.Duration, f func()) Timer { return get().AfterFunc(d, f) }
+func After(d time.Duration) <-chan time.Time    { return NewTimer(d).C() }
+
+// Real is the clock of the time package.
+type Real struct{}
+
+func (Real) Now() time.Time { return time.Now() }
+
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
@@ -0,0 +1,165 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mock is a clock that only moves when told to. Timers fire while
+// Advance moves the clock past their time.
+type Mock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+// NewMock returns a mock clock set to now.
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+type mockTimer struct {
+	m *Mock
+	c chan time.Time
+	f func()
+	// when is the time the timer fires next, period the interval of
+	// tickers.
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+func (m *Mock) NewTimer(d time.Duration) Timer {
+	return m.add(&mockTimer{c: make(chan time.Time, 1)}, d)
+}
+
+func (m *Mock) NewTicker(d time.Duration) Ticker {
+	return mockTicker{m.add(&mockTimer{c: make(chan time.Time, 1), period: d}, d)}
+}
+
+func (m *Mock) AfterFunc(d time.Duration, f func()) Timer {
+	return m.add(&mockTimer{f: f}, d)
+}
+
+func (m *Mock) add(t *mockTimer, d time.Duration) *mockTimer {
+	t.m = m
+	m.mu.Lock()
+	t.when = m.now.Add(d)
+	t.active = true
+	m.timers = append(m.timers, t)
+	m.mu.Unlock()
+	return t
+}
+
+// Timers returns the number of timers that haven't fired or been
+// stopped yet, which allows waiting for code under test to start a
+// timer before advancing the clock.
+func (m *Mock) Timers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, t := range m.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+// Advance moves the clock forward by d, firing all timers that are
+// due on the way, in order.
+func (m *Mock) Advance(d time.Duration) {
+	m.mu.Lock()
+	end := m.now.Add(d)
+	for {
+		var due []*mockTimer
+		for _, t := range m.timers {
+			if t.active && !t.when.After(end) {
+				due = append(due, t)
+			}
+		}
+		if len(due) == 0 {
+			break
+		}
+		sort.Slice(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+		t := due[0]
+		if t.when.After(m.now) {
+			m.now = t.when
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+		} else {
+			t.active = false
+		}
+		m.fire(t)
+	}
+	m.now = end
+	m.prune()
+	m.mu.Unlock()
+}
+
+// fire delivers a timer's tick. The caller must hold the lock.
+func (m *Mock) fire(t *mockTimer) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.c <- m.now:
+	default:
+		// Like real tickers, drop ticks nobody has received.
+	}
+}
+
+// prune drops inactive timers. The caller must hold the lock.
+func (m *Mock) prune() {
+	active := m.timers[:0]
+	for _, t := range m.timers {
+		if t.active {
+			active = append(active, t)
+		}
+	}
+	m.timers = active
+}
+
+type mockTicker struct{ t *mockTimer }
+
+func (t mockTicker) C() <-chan time.Time { return t.t.c }
+func (t mockTicker) Stop()               { t.t.Stop() }
+
+func (t *mockTimer) C() <-chan time.Time {
+	if t.f != nil {
+		return nil
+	}
+	return t.c
+}
+
+func (t *mockTimer) Stop() bool {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	was := t.active
+	t.when = t.m.now.Add(d)
+	t.active = true
+	for _, other := range t.m.timers {
+		if other == t {
+			return was
+		}
+	}
+	t.m.timers = append(t.m.timers, t)
+	return was
+}
@@ -0,0 +1,205 @@
+// Package amp implements XEP-0079 (Advanced Message Processing).
+//
+// AMP rules tell the server how to handle a message depending on
+// conditions such as whether it can be delivered immediately or when
+// it expires. Rules are attached to outgoing messages with Attach.
+// Notifications and errors sent by the server in response to rules
+// are delivered as synthetic Event stanzas.
+package amp
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+
+	"encoding/xml"
+	"time"
+)
+
+const ns = "http://jabber.org/protocol/amp"
+
+// Conditions defined by XEP-0079.
+const (
+	ConditionDeliver       = "deliver"
+	ConditionExpireAt      = "expire-at"
+	ConditionMatchResource = "match-resource"
+)
+
+// Actions defined by XEP-0079.
+const (
+	ActionAlert  = "alert"
+	ActionDrop   = "drop"
+	ActionError  = "error"
+	ActionNotify = "notify"
+)
+
+// Rule is a single AMP rule: if Condition has the value Value, the
+// server takes Action.
+type Rule struct {
+	Condition string `xml:"condition,attr"`
+	Value     string `xml:"value,attr"`
+	Action    string `xml:"action,attr"`
+}
+
+// Deliver returns a rule that triggers action if the message would be
+// delivered in the given way, one of "direct", "forward", "gateway",
+// "none" and "stored".
+func Deliver(method, action string) Rule {
+	return Rule{ConditionDeliver, method, action}
+}
+
+// ExpireAt returns a rule that triggers action if the message hasn't
+// been delivered by t.
+func ExpireAt(t time.Time, action string) Rule {
+	return Rule{ConditionExpireAt, xmpptime.FormatDateTime(t), action}
+}
+
+type amp struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/amp amp"`
+	Status  string   `xml:"status,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	From    string   `xml:"from,attr,omitempty"`
+	PerHop  bool     `xml:"per-hop,attr,omitempty"`
+	Rules   []Rule   `xml:"rule"`
+}
+
+type rules struct {
+	Rules []Rule `xml:"rule"`
+}
+
+type ampError struct {
+	FailedRules           *rules `xml:"http://jabber.org/protocol/amp failed-rules"`
+	UnsupportedActions    *rules `xml:"http://jabber.org/protocol/amp unsupported-actions"`
+	UnsupportedConditions *rules `xml:"http://jabber.org/protocol/amp unsupported-conditions"`
+}
+
+// Event is emitted when the server notifies us about a rule having
+// been triggered, or rejects a message because of its rules.
+type Event struct {
+	*core.Message
+	// Status is the action that has been taken, or ActionError if
+	// the message has been rejected.
+	Status string
+	// OriginalTo and OriginalFrom are the addressing of the
+	// original message.
+	OriginalTo   string
+	OriginalFrom string
+	// Rules are the rules that have been triggered.
+	Rules []Rule
+	// Unsupported are rules that have been rejected because the
+	// server doesn't support their actions or conditions.
+	Unsupported []Rule
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("amp", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+// Attach attaches rules to an outgoing message. Rules are evaluated
+// in order by the server, the first one that matches is applied.
+func Attach(m *core.Message, r ...Rule) {
+	m.Inner, _ = core.AppendPayload(m.Inner, amp{Rules: r})
+}
+
+func (c *Conn) serverInfo() (disco.Info, error) {
+	server := core.JID(c.JID()).Domain()
+	return c.MustGetXEP("disco").(*disco.Conn).GetInfo(server)
+}
+
+// Supported reports whether the server supports AMP.
+func (c *Conn) Supported() (bool, error) {
+	info, err := c.serverInfo()
+	if err != nil {
+		return false, err
+	}
+	for _, f := range info.Features {
+		if f.Var == ns {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SupportsRule reports whether the server supports the condition and
+// action of a rule.
+func (c *Conn) SupportsRule(r Rule) (bool, error) {
+	info, err := c.serverInfo()
+	if err != nil {
+		return false, err
+	}
+
+	condition, action := false, false
+	for _, f := range info.Features {
+		switch f.Var {
+		case ns + "?condition=" + r.Condition:
+			condition = true
+		case ns + "?action=" + r.Action:
+			action = true
+		}
+	}
+	return condition && action, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok {
+		return nil, nil
+	}
+
+	var v amp
+	found, err := core.DecodePayload(msg.Inner, ns, "amp", &v)
+	if err != nil || !found {
+		return nil, err
+	}
+	if v.Status == "" && msg.Type != "error" {
+		// A message with rules meant for the server, not a response.
+		return nil, nil
+	}
+
+	ev := &Event{
+		Message:      msg,
+		Status:       v.Status,
+		OriginalTo:   v.To,
+		OriginalFrom: v.From,
+		Rules:        v.Rules,
+	}
+
+	if msg.Type == "error" {
+		ev.Status = ActionError
+
+		var e ampError
+		found, err := core.DecodePayload(msg.Inner, "", "error", &e)
+		if err == nil && !found {
+			_, err = core.DecodePayload(msg.Inner, "jabber:client", "error", &e)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.FailedRules != nil {
+			ev.Rules = e.FailedRules.Rules
+		}
+		if e.UnsupportedActions != nil {
+			ev.Unsupported = append(ev.Unsupported, e.UnsupportedActions.Rules...)
+		}
+		if e.UnsupportedConditions != nil {
+			ev.Unsupported = append(ev.Unsupported, e.UnsupportedConditions.Rules...)
+		}
+	}
+
+	return []core.Stanza{ev}, nil
+}
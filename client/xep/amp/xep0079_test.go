@@ -0,0 +1,237 @@
+package amp_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/amp"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	stored  = "<rule condition='deliver' value='stored' action='error'/>"
+	forward = "<rule condition='deliver' value='forward' action='alert'/>"
+)
+
+var (
+	storedRule  = amp.Rule{Condition: amp.ConditionDeliver, Value: "stored", Action: amp.ActionError}
+	forwardRule = amp.Rule{Condition: amp.ConditionDeliver, Value: "forward", Action: amp.ActionAlert}
+)
+
+func TestEvent(t *testing.T) {
+	// ampError returns an error message rejecting the rules stored
+	// and forward, with the error element in the given namespace
+	// containing the element reason.
+	ampError := func(space, reason string) string {
+		xmlns := ""
+		if space != "" {
+			xmlns = " xmlns='" + space + "'"
+		}
+		return fmt.Sprintf("<message xmlns='jabber:client' from='example.com' type='error' id='m1'>"+
+			"<amp xmlns='http://jabber.org/protocol/amp'>%[1]s%[2]s</amp>"+
+			"<error%[3]s type='modify' code='500'><undefined-condition xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>"+
+			"<%[4]s xmlns='http://jabber.org/protocol/amp'>%[1]s</%[4]s></error></message>",
+			stored, forward, xmlns, reason)
+	}
+
+	tests := []struct {
+		name    string
+		message string
+		// want is the event emitted, without its message, or nil if
+		// none may be emitted.
+		want *amp.Event
+	}{
+		{
+			name: "notification",
+			message: "<message xmlns='jabber:client' from='example.com' id='m1'>" +
+				"<amp xmlns='http://jabber.org/protocol/amp' status='alert' to='bob@example.com' from='alice@example.com/xmpptest'>" + forward + "</amp></message>",
+			want: &amp.Event{Status: amp.ActionAlert, OriginalTo: "bob@example.com", OriginalFrom: "alice@example.com/xmpptest", Rules: []amp.Rule{forwardRule}},
+		},
+		{
+			// Rules without a status are meant for the server.
+			name:    "rules",
+			message: "<message xmlns='jabber:client' from='bob@example.com/phone' id='m1'><amp xmlns='http://jabber.org/protocol/amp'>" + stored + "</amp></message>",
+		},
+		{
+			name:    "no rules",
+			message: "<message xmlns='jabber:client' from='bob@example.com/phone' id='m1'><body>hi</body></message>",
+		},
+		{
+			name:    "failed rules",
+			message: ampError("", "failed-rules"),
+			want:    &amp.Event{Status: amp.ActionError, Rules: []amp.Rule{storedRule}},
+		},
+		{
+			name:    "failed rules, jabber:client",
+			message: ampError("jabber:client", "failed-rules"),
+			want:    &amp.Event{Status: amp.ActionError, Rules: []amp.Rule{storedRule}},
+		},
+		{
+			name:    "unsupported actions",
+			message: ampError("", "unsupported-actions"),
+			want:    &amp.Event{Status: amp.ActionError, Rules: []amp.Rule{storedRule, forwardRule}, Unsupported: []amp.Rule{storedRule}},
+		},
+		{
+			name:    "unsupported actions, jabber:client",
+			message: ampError("jabber:client", "unsupported-actions"),
+			want:    &amp.Event{Status: amp.ActionError, Rules: []amp.Rule{storedRule, forwardRule}, Unsupported: []amp.Rule{storedRule}},
+		},
+		{
+			name:    "unsupported conditions",
+			message: ampError("", "unsupported-conditions"),
+			want:    &amp.Event{Status: amp.ActionError, Rules: []amp.Rule{storedRule, forwardRule}, Unsupported: []amp.Rule{storedRule}},
+		},
+		{
+			name:    "unsupported conditions, jabber:client",
+			message: ampError("jabber:client", "unsupported-conditions"),
+			want:    &amp.Event{Status: amp.ActionError, Rules: []amp.Rule{storedRule, forwardRule}, Unsupported: []amp.Rule{storedRule}},
+		},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := c.RegisterXEP("amp"); err != nil {
+		t.Fatal(err)
+	}
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Send(tt.message)
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *amp.Event
+			for _, stanza := range emitted {
+				if stanza, ok := stanza.(*amp.Event); ok {
+					got = stanza
+				}
+			}
+
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("got event %+v, want none", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("no event emitted")
+			}
+			if got.Message == nil || got.Id != "m1" {
+				t.Errorf("got event for %+v, want the message m1", got.Message)
+			}
+			got.Message = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSupportsRule(t *testing.T) {
+	const (
+		feature   = "<feature var='http://jabber.org/protocol/amp'/>"
+		deliver   = "<feature var='http://jabber.org/protocol/amp?condition=deliver'/>"
+		expireAt  = "<feature var='http://jabber.org/protocol/amp?condition=expire-at'/>"
+		errAction = "<feature var='http://jabber.org/protocol/amp?action=error'/>"
+		drop      = "<feature var='http://jabber.org/protocol/amp?action=drop'/>"
+	)
+	tests := []struct {
+		name     string
+		features string
+		// fail answers the query with an error.
+		fail          bool
+		wantSupported bool
+		want          bool
+	}{
+		{name: "supported", features: feature + deliver + errAction, wantSupported: true, want: true},
+		{name: "unsupported condition", features: feature + expireAt + errAction, wantSupported: true},
+		{name: "unsupported action", features: feature + deliver + drop, wantSupported: true},
+		// Rules are checked independently of AMP itself.
+		{name: "without AMP", features: deliver + errAction, want: true},
+		{name: "error", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("amp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := x.(*amp.Conn)
+			xmpptest.Stanzas(c)
+
+			// answer answers the next disco#info query, which has to
+			// be sent to our server.
+			answer := func() error {
+				iq, err := s.NextElement()
+				if err != nil {
+					return err
+				}
+				if iq.Attribute("to") != "example.com" || !strings.Contains(string(iq.Inner), "http://jabber.org/protocol/disco#info") {
+					return fmt.Errorf("got %v %s, want a disco#info query to example.com", iq.Attr, iq.Inner)
+				}
+				if tt.fail {
+					return s.Sendf("<iq xmlns='jabber:client' type='error' id='%s' from='example.com'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+						iq.Attribute("id"))
+				}
+				return s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='example.com'><query xmlns='http://jabber.org/protocol/disco#info'>"+
+					"<identity category='server' type='im'/>%s</query></iq>", iq.Attribute("id"), tt.features)
+			}
+
+			type result struct {
+				ok  bool
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				ok, err := conn.Supported()
+				done <- result{ok, err}
+			}()
+			if err := answer(); err != nil {
+				t.Fatal(err)
+			}
+			res := <-done
+			if tt.fail {
+				var stanzaErr *core.Error
+				if !errors.As(res.err, &stanzaErr) {
+					t.Errorf("Supported: got %v, want a stanza error", res.err)
+				}
+			} else if res.err != nil || res.ok != tt.wantSupported {
+				t.Errorf("Supported: got %t, %v, want %t", res.ok, res.err, tt.wantSupported)
+			}
+
+			go func() {
+				ok, err := conn.SupportsRule(storedRule)
+				done <- result{ok, err}
+			}()
+			if err := answer(); err != nil {
+				t.Fatal(err)
+			}
+			res = <-done
+			if tt.fail {
+				var stanzaErr *core.Error
+				if !errors.As(res.err, &stanzaErr) {
+					t.Errorf("SupportsRule: got %v, want a stanza error", res.err)
+				}
+				return
+			}
+			if res.err != nil || res.ok != tt.want {
+				t.Errorf("SupportsRule: got %t, %v, want %t", res.ok, res.err, tt.want)
+			}
+		})
+	}
+}
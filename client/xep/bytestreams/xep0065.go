@@ -0,0 +1,455 @@
+// Package bytestreams implements XEP-0065 (SOCKS5 Bytestreams).
+//
+// A bytestream is a direct TCP connection between two entities, or
+// one relayed by a proxy, that is negotiated via XMPP and established
+// via SOCKS5. Higher level protocols, like file transfer, use
+// bytestreams to transfer data outside of the XMPP stream.
+//
+// The initiator opens a bytestream with Open, the target accepts it
+// with Accept. Both have to agree on the session ID beforehand, for
+// example via stream initiation (XEP-0095). Offers for session IDs
+// that nobody is waiting for are delivered as synthetic Request
+// stanzas.
+package bytestreams
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ns = "http://jabber.org/protocol/bytestreams"
+
+var (
+	ErrNoStreamHosts = errors.New("xmpp: could not connect to any stream host")
+	ErrSOCKS5        = errors.New("xmpp: SOCKS5 negotiation failed")
+)
+
+// DialTimeout limits how long connecting to a single stream host may
+// take before the next one is tried.
+var DialTimeout = 10 * time.Second
+
+// StreamHost is a host that can be connected to via SOCKS5, either
+// the initiator itself or a proxy.
+type StreamHost struct {
+	JID  string `xml:"jid,attr"`
+	Host string `xml:"host,attr"`
+	Port int    `xml:"port,attr"`
+}
+
+type query struct {
+	XMLName     xml.Name     `xml:"http://jabber.org/protocol/bytestreams query"`
+	SID         string       `xml:"sid,attr,omitempty"`
+	Mode        string       `xml:"mode,attr,omitempty"`
+	StreamHosts []StreamHost `xml:"streamhost"`
+	Used        *struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"streamhost-used"`
+	Activate string `xml:"activate,omitempty"`
+}
+
+// Request is emitted when a bytestream has been offered that nobody
+// is waiting for. It can be accepted with AcceptRequest.
+type Request struct {
+	*core.IQ
+	SID         string
+	StreamHosts []StreamHost
+}
+
+type Conn struct {
+	core.Client
+
+	// Proxies are offered as stream hosts when opening bytestreams.
+	// They can be found with DiscoverProxies.
+	Proxies []StreamHost
+	// Listener, if set, is used to accept direct connections from
+	// targets. Its address is offered as a stream host before any
+	// proxies.
+	Listener net.Listener
+	// Host is the host offered for direct connections to Listener,
+	// for example our public IP address. If it is empty, the host
+	// Listener is bound to is offered, unless that is an unspecified
+	// address like 0.0.0.0, which targets can't connect to. No direct
+	// connection is offered then.
+	Host string
+
+	mu       sync.Mutex
+	waiting  map[string]chan *Request
+	incoming map[string]chan net.Conn
+	serving  bool
+}
+
+func init() {
+	core.RegisterXEP("bytestreams", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client:   c,
+		waiting:  make(map[string]chan *Request),
+		incoming: make(map[string]chan net.Conn),
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+	// Process hands requests to expected transfers or emits them.
+	c.DeliverIQ("set", ns)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	iq, ok := stanza.(*core.IQ)
+	if !ok || iq.Type != "set" || iq.Query.Space != ns {
+		return nil, nil
+	}
+
+	var q query
+	if err := xml.Unmarshal(iq.Inner, &q); err != nil {
+		return nil, err
+	}
+	req := &Request{iq, q.SID, q.StreamHosts}
+
+	c.mu.Lock()
+	ch, ok := c.waiting[q.SID]
+	delete(c.waiting, q.SID)
+	c.mu.Unlock()
+	if ok {
+		ch <- req
+		return nil, nil
+	}
+
+	return []core.Stanza{req}, nil
+}
+
+// Hash computes the SOCKS5 destination address of a bytestream.
+func Hash(sid, initiator, target string) string {
+	sum := sha1.Sum([]byte(sid + initiator + target))
+	return hex.EncodeToString(sum[:])
+}
+
+// DiscoverProxies looks for bytestream proxies among the items of
+// the server and stores them in Proxies.
+func (c *Conn) DiscoverProxies(server string) ([]StreamHost, error) {
+	discovery := c.MustGetXEP("disco").(*disco.Conn)
+	items, err := discovery.GetItems(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxies []StreamHost
+	for _, item := range items {
+		info, err := discovery.GetInfo(item.JID)
+		if err != nil {
+			continue
+		}
+		isProxy := false
+		for _, id := range info.Identities {
+			if id.Category == "proxy" && id.Type == "bytestreams" {
+				isProxy = true
+			}
+		}
+		if !isProxy {
+			continue
+		}
+
+		ch, _ := c.SendIQ(item.JID, "get", query{})
+		res := <-ch
+		if res == nil {
+			return proxies, core.ErrClosed
+		}
+		if res.IsError() {
+			continue
+		}
+		var q query
+		if xml.Unmarshal(res.Inner, &q) == nil {
+			proxies = append(proxies, q.StreamHosts...)
+		}
+	}
+
+	c.Proxies = proxies
+	return proxies, nil
+}
+
+// Open opens a bytestream with the session ID sid to target, offering
+// a direct connection if Listener is set and the proxies in Proxies.
+func (c *Conn) Open(target, sid string) (net.Conn, error) {
+	hash := Hash(sid, c.JID(), target)
+
+	var hosts []StreamHost
+	var direct chan net.Conn
+	if host, ok := c.directHost(); ok {
+		hosts = append(hosts, host)
+		direct = c.expect(hash)
+		defer c.unexpect(hash)
+	}
+	hosts = append(hosts, c.Proxies...)
+	if len(hosts) == 0 {
+		return nil, ErrNoStreamHosts
+	}
+
+	ch, _ := c.SendIQ(target, "set", query{SID: sid, Mode: "tcp", StreamHosts: hosts})
+	res := <-ch
+	if res == nil {
+		return nil, core.ErrClosed
+	}
+	if res.IsError() {
+		return nil, res.Error
+	}
+
+	var q query
+	if err := xml.Unmarshal(res.Inner, &q); err != nil {
+		return nil, err
+	}
+	if q.Used == nil {
+		return nil, ErrNoStreamHosts
+	}
+
+	if q.Used.JID == c.JID() && direct != nil {
+		select {
+		case conn := <-direct:
+			return conn, nil
+		case <-clock.After(DialTimeout):
+			return nil, ErrNoStreamHosts
+		}
+	}
+
+	for _, host := range c.Proxies {
+		if host.JID != q.Used.JID {
+			continue
+		}
+		conn, err := connect(host, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		// The proxy only starts relaying once we activate the
+		// bytestream.
+		ch, _ := c.SendIQ(host.JID, "set", query{SID: sid, Activate: target})
+		res := <-ch
+		if res == nil {
+			conn.Close()
+			return nil, core.ErrClosed
+		}
+		if res.IsError() {
+			conn.Close()
+			return nil, res.Error
+		}
+		return conn, nil
+	}
+
+	return nil, ErrNoStreamHosts
+}
+
+// directHost returns the stream host for direct connections to
+// Listener, if it can be offered.
+func (c *Conn) directHost() (StreamHost, bool) {
+	if c.Listener == nil {
+		return StreamHost{}, false
+	}
+	host, port, err := net.SplitHostPort(c.Listener.Addr().String())
+	if err != nil {
+		return StreamHost{}, false
+	}
+	if c.Host != "" {
+		host = c.Host
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return StreamHost{}, false
+	}
+	p, _ := strconv.Atoi(port)
+	return StreamHost{JID: c.JID(), Host: host, Port: p}, true
+}
+
+// Expect returns a channel on which the offer of a bytestream with
+// the session ID sid will be delivered. It should be called before
+// the initiator can possibly send the offer, for example before
+// accepting a stream initiation request.
+func (c *Conn) Expect(sid string) <-chan *Request {
+	ch := make(chan *Request, 1)
+	c.mu.Lock()
+	c.waiting[sid] = ch
+	c.mu.Unlock()
+	return ch
+}
+
+// Accept waits for the initiator to offer a bytestream with the
+// session ID sid and connects to it.
+func (c *Conn) Accept(sid string) (net.Conn, error) {
+	return c.AcceptExpected(sid, c.Expect(sid))
+}
+
+// AcceptExpected is like Accept, for offers that have been announced
+// with Expect.
+func (c *Conn) AcceptExpected(sid string, ch <-chan *Request) (net.Conn, error) {
+	select {
+	case req := <-ch:
+		return c.AcceptRequest(req)
+	case <-clock.After(time.Minute):
+		c.mu.Lock()
+		delete(c.waiting, sid)
+		c.mu.Unlock()
+		return nil, ErrNoStreamHosts
+	}
+}
+
+// AcceptRequest connects to one of the stream hosts offered by a
+// request. Stream hosts are tried in the order they have been
+// offered, which usually means that direct connections are tried
+// before falling back to proxies.
+func (c *Conn) AcceptRequest(req *Request) (net.Conn, error) {
+	hash := Hash(req.SID, req.From, c.JID())
+	for _, host := range req.StreamHosts {
+		conn, err := connect(host, hash)
+		if err != nil {
+			continue
+		}
+
+		c.SendIQReply(req.IQ, "result", query{
+			SID: req.SID,
+			Used: &struct {
+				JID string `xml:"jid,attr"`
+			}{host.JID},
+		})
+		return conn, nil
+	}
+
+	c.SendError(req.IQ, "cancel", "", core.ErrItemNotFound{})
+	return nil, ErrNoStreamHosts
+}
+
+// connect connects to a stream host and performs the SOCKS5
+// handshake.
+func connect(host StreamHost, hash string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host.Host, strconv.Itoa(host.Port)), DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handshake(conn, hash); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func handshake(conn net.Conn, hash string) error {
+	// Version 5, one method: no authentication
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != 0 {
+		return ErrSOCKS5
+	}
+
+	// CONNECT to the domain name hash, port 0
+	req := append([]byte{5, 1, 0, 3, byte(len(hash))}, hash...)
+	req = append(req, 0, 0)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return ErrSOCKS5
+	}
+	// Skip the bound address, which is the hash again, and the port.
+	rest := make([]byte, int(reply[4])+2)
+	_, err := io.ReadFull(conn, rest)
+	return err
+}
+
+func (c *Conn) expect(hash string) chan net.Conn {
+	ch := make(chan net.Conn, 1)
+	c.mu.Lock()
+	c.incoming[hash] = ch
+	if !c.serving {
+		c.serving = true
+		go c.serve(c.Listener)
+	}
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *Conn) unexpect(hash string) {
+	c.mu.Lock()
+	delete(c.incoming, hash)
+	c.mu.Unlock()
+}
+
+// serve accepts direct connections from targets. It acts as a
+// minimal SOCKS5 server that only accepts destinations that are
+// expected bytestreams.
+func (c *Conn) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			c.mu.Lock()
+			c.serving = false
+			c.mu.Unlock()
+			return
+		}
+		go c.serveConn(conn)
+	}
+}
+
+func (c *Conn) serveConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil || hdr[0] != 5 {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0})
+
+	req := make([]byte, 5)
+	if _, err := io.ReadFull(conn, req); err != nil || req[0] != 5 || req[1] != 1 || req[3] != 3 {
+		conn.Close()
+		return
+	}
+	addr := make([]byte, int(req[4])+2)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		conn.Close()
+		return
+	}
+	hash := string(addr[:len(addr)-2])
+
+	c.mu.Lock()
+	ch, ok := c.incoming[hash]
+	delete(c.incoming, hash)
+	c.mu.Unlock()
+	if !ok {
+		// Host unreachable
+		conn.Write([]byte{5, 4, 0, 3, 0, 0, 0})
+		conn.Close()
+		return
+	}
+
+	reply := append([]byte{5, 0, 0, 3, byte(len(hash))}, hash...)
+	reply = append(reply, 0, 0)
+	conn.Write(reply)
+	conn.SetDeadline(time.Time{})
+	ch <- conn
+}
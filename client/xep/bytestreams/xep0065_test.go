@@ -0,0 +1,458 @@
+package bytestreams_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/bytestreams"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const sid = "s1"
+
+type streamHosts struct {
+	SID         string                   `xml:"sid,attr"`
+	StreamHosts []bytestreams.StreamHost `xml:"streamhost"`
+	Used        *struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"streamhost-used"`
+	Activate string `xml:"activate"`
+}
+
+// connect returns a client with bytestreams registered.
+func connect(t *testing.T, user string) (*core.Conn, *bytestreams.Conn, *xmpptest.Server) {
+	t.Helper()
+	c, s, err := xmpptest.Connect(user, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	x, err := c.RegisterXEP("bytestreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, x.(*bytestreams.Conn), s
+}
+
+// listen returns a listener on the loopback interface.
+func listen(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// hostOf returns the host of a listener's address as a stream host.
+func hostOf(t *testing.T, jid string, l net.Listener) bytestreams.StreamHost {
+	t.Helper()
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return bytestreams.StreamHost{JID: jid, Host: host, Port: p}
+}
+
+// proxy starts a SOCKS5 proxy on the loopback interface that accepts
+// a single connection to hash, or refuses it if refuse is set. The
+// connection is delivered on the returned channel once the handshake
+// has succeeded.
+func proxy(t *testing.T, jid, hash string, refuse bool) (bytestreams.StreamHost, <-chan net.Conn) {
+	t.Helper()
+	l := listen(t, "127.0.0.1:0")
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		l.Close()
+
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil || !bytes.Equal(greeting, []byte{5, 1, 0}) {
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		req := make([]byte, 5+len(hash)+2)
+		if _, err := io.ReadFull(conn, req); err != nil || string(req[5:5+len(hash)]) != hash || refuse {
+			// Connection refused
+			conn.Write([]byte{5, 5, 0, 3, 0, 0, 0})
+			conn.Close()
+			return
+		}
+		req[1] = 0
+		conn.Write(req)
+		ch <- conn
+	}()
+	return hostOf(t, jid, l), ch
+}
+
+// socks5 connects to a SOCKS5 server at addr with the destination
+// hash and returns the server's reply.
+func socks5(t *testing.T, addr, hash string, version byte) (net.Conn, []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte{version, 1, 0})
+	req := append([]byte{5, 1, 0, 3, byte(len(hash))}, hash...)
+	conn.Write(append(req, 0, 0))
+	reply, _ := io.ReadAll(io.LimitReader(conn, int64(len(req)+2)))
+	return conn, reply
+}
+
+// transfers checks that data written to one end of a bytestream
+// arrives at the other one.
+func transfers(t *testing.T, from, to net.Conn) {
+	t.Helper()
+	const data = "some data"
+	go from.Write([]byte(data))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(to, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != data {
+		t.Errorf("got %q, want %q", buf, data)
+	}
+}
+
+func TestOpenDirect(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string
+		host   string
+		// wantHost is the host offered, the listener isn't offered
+		// if it is empty.
+		wantHost string
+	}{
+		{name: "loopback", listen: "127.0.0.1:0", wantHost: "127.0.0.1"},
+		{name: "unspecified IPv4", listen: "0.0.0.0:0"},
+		{name: "unspecified", listen: ":0"},
+		{name: "unspecified with host", listen: "0.0.0.0:0", host: "127.0.0.1", wantHost: "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice, initiator, s1 := connect(t, "alice")
+			bob, target, s2 := connect(t, "bob")
+			xmpptest.Stanzas(alice)
+			xmpptest.Stanzas(bob)
+			initiator.Listener = listen(t, tt.listen)
+			initiator.Host = tt.host
+
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			opened := make(chan result, 1)
+			go func() {
+				conn, err := initiator.Open(s2.JID(), sid)
+				opened <- result{conn, err}
+			}()
+
+			if tt.wantHost == "" {
+				// Without proxies, nothing is left to offer.
+				if res := <-opened; res.err != bytestreams.ErrNoStreamHosts {
+					t.Fatalf("got %v, want %v", res.err, bytestreams.ErrNoStreamHosts)
+				}
+				return
+			}
+
+			expected := target.Expect(sid)
+			accepted := make(chan result, 1)
+			go func() {
+				conn, err := target.AcceptExpected(sid, expected)
+				accepted <- result{conn, err}
+			}()
+
+			offer, err := s1.Forward(s2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var q streamHosts
+			xml.Unmarshal(offer.Inner, &q)
+			want := []bytestreams.StreamHost{hostOf(t, s1.JID(), initiator.Listener)}
+			want[0].Host = tt.wantHost
+			if !reflect.DeepEqual(q.StreamHosts, want) {
+				t.Fatalf("got stream hosts %+v, want %+v", q.StreamHosts, want)
+			}
+
+			used, err := s2.Forward(s1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q = streamHosts{}
+			xml.Unmarshal(used.Inner, &q)
+			if used.Attribute("type") != "result" || q.Used == nil || q.Used.JID != s1.JID() {
+				t.Fatalf("got %v %s, want the initiator used", used.Attr, used.Inner)
+			}
+
+			in, out := <-opened, <-accepted
+			if in.err != nil || out.err != nil {
+				t.Fatalf("got errors %v and %v", in.err, out.err)
+			}
+			defer in.conn.Close()
+			defer out.conn.Close()
+			transfers(t, in.conn, out.conn)
+			transfers(t, out.conn, in.conn)
+		})
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	_, initiator, s := connect(t, "alice")
+	xmpptest.Stanzas(initiator)
+	initiator.Listener = listen(t, "127.0.0.1:0")
+	const target = "bob@example.com/phone"
+	hash := bytestreams.Hash(sid, s.JID(), target)
+
+	opened := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := initiator.Open(target, sid)
+		opened <- conn
+	}()
+	// The listener only serves connections while a bytestream is
+	// being opened.
+	offer, err := s.NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		hash    string
+		version byte
+		// wantReply is the reply code, or -1 if the connection is
+		// closed without replying to the connection request.
+		wantReply int
+	}{
+		{name: "not SOCKS5", hash: hash, version: 4, wantReply: -1},
+		{name: "unknown destination", hash: bytestreams.Hash("other", s.JID(), target), version: 5, wantReply: 4},
+		{name: "expected", hash: hash, version: 5, wantReply: 0},
+	}
+	var conn net.Conn
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, reply := socks5(t, initiator.Listener.Addr().String(), tt.hash, tt.version)
+			if tt.wantReply != 0 {
+				defer c.Close()
+			}
+			got := -1
+			// The method selection is followed by the reply.
+			if len(reply) > 3 {
+				got = int(reply[3])
+			}
+			if got != tt.wantReply {
+				t.Fatalf("got reply %v, want code %d", reply, tt.wantReply)
+			}
+			if tt.wantReply == 0 {
+				// The reply's address is the destination.
+				if string(reply[7:7+len(hash)]) != hash {
+					t.Errorf("got reply %q, want it to contain %s", reply, hash)
+				}
+				conn = c
+			}
+		})
+	}
+
+	s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='%s'><query xmlns='http://jabber.org/protocol/bytestreams' sid='%s'><streamhost-used jid='%s'/></query></iq>",
+		offer.Attribute("id"), target, sid, s.JID())
+	in := <-opened
+	if in == nil {
+		t.Fatal("Open failed")
+	}
+	defer in.Close()
+	if conn != nil {
+		defer conn.Close()
+		transfers(t, conn, in)
+	}
+}
+
+func TestOpenProxy(t *testing.T) {
+	const (
+		target   = "bob@example.com/phone"
+		proxyJID = "proxy.example.com"
+	)
+	tests := []struct {
+		name   string
+		refuse bool
+		// activated is the reply to the activation request.
+		activated string
+		wantErr   func(error) bool
+	}{
+		{name: "activated", activated: "result"},
+		{
+			name:      "activation failed",
+			activated: "error",
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr)
+			},
+		},
+		{name: "refused", refuse: true, wantErr: func(err error) bool { return err == bytestreams.ErrSOCKS5 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, initiator, s := connect(t, "alice")
+			xmpptest.Stanzas(c)
+			host, relayed := proxy(t, proxyJID, bytestreams.Hash(sid, s.JID(), target), tt.refuse)
+			initiator.Proxies = []bytestreams.StreamHost{host}
+
+			errc := make(chan error, 1)
+			opened := make(chan net.Conn, 1)
+			go func() {
+				conn, err := initiator.Open(target, sid)
+				opened <- conn
+				errc <- err
+			}()
+
+			offer, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var q streamHosts
+			xml.Unmarshal(offer.Inner, &q)
+			if !reflect.DeepEqual(q.StreamHosts, initiator.Proxies) {
+				t.Fatalf("got stream hosts %+v, want only the proxy %+v", q.StreamHosts, initiator.Proxies)
+			}
+			s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='%s'><query xmlns='http://jabber.org/protocol/bytestreams' sid='%s'><streamhost-used jid='%s'/></query></iq>",
+				offer.Attribute("id"), target, sid, proxyJID)
+
+			if !tt.refuse {
+				activate, err := s.NextElement()
+				if err != nil {
+					t.Fatal(err)
+				}
+				q = streamHosts{}
+				xml.Unmarshal(activate.Inner, &q)
+				if activate.Attribute("to") != proxyJID || q.SID != sid || q.Activate != target {
+					t.Fatalf("got %v %s, want an activation of %s", activate.Attr, activate.Inner, target)
+				}
+				if tt.activated == "result" {
+					s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='%s'/>", activate.Attribute("id"), proxyJID)
+				} else {
+					s.Sendf("<iq xmlns='jabber:client' type='error' id='%s' from='%s'><error type='cancel'><not-allowed xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+						activate.Attribute("id"), proxyJID)
+				}
+			}
+
+			conn, err := <-opened, <-errc
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("got unexpected error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			transfers(t, conn, <-relayed)
+		})
+	}
+}
+
+func TestAcceptRequest(t *testing.T) {
+	const initiator = "alice@example.com/desktop"
+	tests := []struct {
+		name string
+		// hosts are the offered stream hosts by JID, with "dead"
+		// hosts refusing TCP connections and "refusing" ones
+		// refusing the SOCKS5 connection request.
+		hosts    []string
+		wantUsed string
+	}{
+		{name: "first", hosts: []string{"proxy1.example.com", "proxy2.example.com"}, wantUsed: "proxy1.example.com"},
+		{name: "fallback", hosts: []string{"dead.example.com", "refusing.example.com", "proxy.example.com"}, wantUsed: "proxy.example.com"},
+		{name: "none", hosts: []string{"dead.example.com", "refusing.example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, target, s := connect(t, "bob")
+			hash := bytestreams.Hash(sid, initiator, s.JID())
+
+			var offer []bytestreams.StreamHost
+			relayed := make(map[string]<-chan net.Conn)
+			for _, jid := range tt.hosts {
+				var host bytestreams.StreamHost
+				switch jid {
+				case "dead.example.com":
+					l := listen(t, "127.0.0.1:0")
+					host = hostOf(t, jid, l)
+					l.Close()
+				default:
+					host, relayed[jid] = proxy(t, jid, hash, jid == "refusing.example.com")
+				}
+				offer = append(offer, host)
+			}
+			inner, _ := xml.Marshal(struct {
+				XMLName     xml.Name                 `xml:"http://jabber.org/protocol/bytestreams query"`
+				SID         string                   `xml:"sid,attr"`
+				StreamHosts []bytestreams.StreamHost `xml:"streamhost"`
+			}{SID: sid, StreamHosts: offer})
+			s.Sendf("<iq xmlns='jabber:client' type='set' id='offer' from='%s'>%s</iq>", initiator, inner)
+
+			// Offers nobody is waiting for are emitted after the IQ.
+			var req *bytestreams.Request
+			for req == nil {
+				stanza, err := c.NextStanza()
+				if err != nil {
+					t.Fatal(err)
+				}
+				req, _ = stanza.(*bytestreams.Request)
+			}
+			if req.SID != sid || !reflect.DeepEqual(req.StreamHosts, offer) {
+				t.Fatalf("got request %s %+v, want %s %+v", req.SID, req.StreamHosts, sid, offer)
+			}
+
+			errc := make(chan error, 1)
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := target.AcceptRequest(req)
+				accepted <- conn
+				errc <- err
+			}()
+			reply, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := <-accepted, <-errc
+
+			if tt.wantUsed == "" {
+				if err != bytestreams.ErrNoStreamHosts {
+					t.Errorf("got %v, want %v", err, bytestreams.ErrNoStreamHosts)
+				}
+				if reply.Attribute("type") != "error" || !bytes.Contains(reply.Inner, []byte("item-not-found")) {
+					t.Errorf("got %v %s, want an item-not-found error", reply.Attr, reply.Inner)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			var q streamHosts
+			xml.Unmarshal(reply.Inner, &q)
+			if reply.Attribute("type") != "result" || reply.Attribute("id") != "offer" || q.Used == nil || q.Used.JID != tt.wantUsed {
+				t.Fatalf("got %v %s, want %s used", reply.Attr, reply.Inner, tt.wantUsed)
+			}
+			transfers(t, <-relayed[tt.wantUsed], conn)
+		})
+	}
+}
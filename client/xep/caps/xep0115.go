@@ -0,0 +1,220 @@
+// Package caps implements XEP-0115 (Entity Capabilities).
+//
+// Once registered, every presence sent with SendPresence advertises a
+// hash of our identities and features, and the capabilities of
+// contacts are learned from their presences. A contact's features are
+// only queried with disco#info if its hash hasn't been seen before, so
+// that contacts running the same software don't cost a round trip
+// each.
+package caps
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"sort"
+	"sync"
+)
+
+const ns = "http://jabber.org/protocol/caps"
+
+// DefaultNode identifies the software sending our capabilities.
+var DefaultNode = "https://honnef.co/go/xmpp"
+
+type Conn struct {
+	core.Client
+	disco *disco.Conn
+
+	// Node is the node advertised in our capabilities. It defaults to
+	// DefaultNode.
+	Node string
+
+	mu sync.RWMutex
+	// verified maps hashes to the features they describe.
+	verified map[string][]string
+	// jids maps JIDs to the hashes they advertised.
+	jids map[string]string
+	// pending holds the hashes currently being queried.
+	pending map[string]bool
+}
+
+type caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+func init() {
+	core.RegisterXEP("caps", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client:   c,
+		disco:    c.MustGetXEP("disco").(*disco.Conn),
+		Node:     DefaultNode,
+		verified: make(map[string][]string),
+		jids:     make(map[string]string),
+		pending:  make(map[string]bool),
+	}
+
+	conn.disco.AddFeature(ns)
+	c.AddPresenceDecorator(conn.decorate)
+
+	return conn, nil
+}
+
+// Ver computes the verification string of a set of identities and
+// features, as described in XEP-0115 5.1. Extended information
+// (XEP-0128) isn't supported.
+func Ver(identities []disco.Identity, features []disco.Feature) string {
+	ids := make([]string, len(identities))
+	for i, id := range identities {
+		// We don't support xml:lang on identities, so the language
+		// is always empty.
+		ids[i] = id.Category + "/" + id.Type + "//" + id.Name
+	}
+	sort.Strings(ids)
+
+	vars := make([]string, len(features))
+	for i, f := range features {
+		vars[i] = f.Var
+	}
+	sort.Strings(vars)
+
+	var s string
+	for _, id := range ids {
+		s += id + "<"
+	}
+	for _, v := range vars {
+		s += v + "<"
+	}
+
+	sum := sha1.Sum([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// OwnVer returns the verification string for our own identities and
+// features. It changes when XEPs are registered.
+func (c *Conn) OwnVer() string {
+	return Ver(c.disco.AdvertisedIdentities(), c.disco.AdvertisedFeatures())
+}
+
+func (c *Conn) decorate(p *core.Presence) {
+	if p.Type != "" {
+		return
+	}
+	if core.HasPayload(p.Inner, ns, "c") {
+		return
+	}
+
+	ver := c.OwnVer()
+	// Contacts query the node we advertise to learn our features.
+	c.disco.AddRootNode(c.Node + "#" + ver)
+	p.Inner, _ = core.AppendPayload(p.Inner, caps{
+		Hash: "sha-1",
+		Node: c.Node,
+		Ver:  ver,
+	})
+}
+
+// FeaturesOf returns the features of jid, as learned from its
+// presence. The second return value is false if jid didn't advertise
+// its capabilities or if they haven't been retrieved yet.
+func (c *Conn) FeaturesOf(jid string) ([]string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ver, ok := c.jids[jid]
+	if !ok {
+		return nil, false
+	}
+	features, ok := c.verified[ver]
+	if !ok {
+		return nil, false
+	}
+	return append([]string(nil), features...), true
+}
+
+// Supports reports whether jid is known to support a feature.
+func (c *Conn) Supports(jid, feature string) bool {
+	features, _ := c.FeaturesOf(jid)
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	p, ok := stanza.(*core.Presence)
+	if !ok || p.From == "" {
+		return nil, nil
+	}
+
+	switch p.Type {
+	case "":
+	case "unavailable":
+		c.mu.Lock()
+		delete(c.jids, p.From)
+		c.mu.Unlock()
+		return nil, nil
+	default:
+		return nil, nil
+	}
+
+	var v caps
+	found, err := core.DecodePayload(p.Inner, ns, "c", &v)
+	if err != nil || !found {
+		return nil, err
+	}
+	if v.Hash != "sha-1" {
+		// TODO support other hash functions
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	c.jids[p.From] = v.Ver
+	_, known := c.verified[v.Ver]
+	if known || c.pending[v.Ver] {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.pending[v.Ver] = true
+	c.mu.Unlock()
+
+	// Don't hold up the processing of other stanzas while waiting
+	// for the reply.
+	go c.query(p.From, v)
+
+	return nil, nil
+}
+
+// query retrieves the features behind an unknown hash and caches
+// them if they match the hash.
+func (c *Conn) query(jid string, v caps) {
+	info, err := c.disco.GetInfoFromNode(jid, v.Node+"#"+v.Ver)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, v.Ver)
+	if err != nil {
+		return
+	}
+	if Ver(info.Identities, info.Features) != v.Ver {
+		// Either the entity is misbehaving or somebody is trying
+		// to poison our cache. Don't trust the hash.
+		return
+	}
+
+	features := make([]string, len(info.Features))
+	for i, f := range info.Features {
+		features[i] = f.Var
+	}
+	c.verified[v.Ver] = features
+}
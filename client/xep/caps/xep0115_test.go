@@ -0,0 +1,209 @@
+package caps_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/caps"
+	"honnef.co/go/xmpp/client/xep/disco"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const node = "https://example.org/client"
+
+var (
+	identities = []disco.Identity{{Category: "client", Type: "phone", Name: "Phone"}}
+	features   = []disco.Feature{{Var: "http://jabber.org/protocol/caps"}, {Var: "urn:xmpp:receipts"}}
+)
+
+// advertise sends a presence from jid with capabilities.
+func advertise(s *xmpptest.Server, jid, hash, ver string) {
+	s.Sendf("<presence xmlns='jabber:client' from='%s'><c xmlns='http://jabber.org/protocol/caps' hash='%s' node='%s' ver='%s'/></presence>",
+		jid, hash, node, ver)
+}
+
+// answer reads a disco#info query for the node of ver sent to jid and
+// answers it with the given features.
+func answer(s *xmpptest.Server, jid, ver string, features []disco.Feature) error {
+	iq, err := s.NextElement()
+	if err != nil {
+		return err
+	}
+	var query struct {
+		XMLName xml.Name
+		Node    string `xml:"node,attr"`
+	}
+	xml.Unmarshal(iq.Inner, &query)
+	if iq.Attribute("type") != "get" || iq.Attribute("to") != jid ||
+		query.XMLName.Space != "http://jabber.org/protocol/disco#info" || query.Node != node+"#"+ver {
+		return fmt.Errorf("got %v %s, want a disco#info query for %s#%s to %s", iq.Attr, iq.Inner, node, ver, jid)
+	}
+
+	res := struct {
+		XMLName    xml.Name         `xml:"http://jabber.org/protocol/disco#info query"`
+		Node       string           `xml:"node,attr"`
+		Identities []disco.Identity `xml:"identity"`
+		Features   []disco.Feature  `xml:"feature"`
+	}{Node: query.Node, Identities: identities, Features: features}
+	inner, _ := xml.Marshal(res)
+	return s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='%s'>%s</iq>", iq.Attribute("id"), jid, inner)
+}
+
+// nothingSent checks that the client didn't send anything, by having
+// it send a marker and checking that it arrives first.
+func nothingSent(t *testing.T, c *core.Conn, s *xmpptest.Server) {
+	t.Helper()
+	go c.Encode(core.Message{Header: core.Header{Id: "marker"}})
+	e, err := s.NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Attribute("id") != "marker" {
+		t.Errorf("got <%s> %v %s, want no query", e.XMLName.Local, e.Attr, e.Inner)
+	}
+}
+
+// learned waits for the features of jid to be known.
+func learned(c *caps.Conn, jid string) ([]string, bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		if features, ok := c.FeaturesOf(jid); ok {
+			return features, true
+		}
+		select {
+		case <-timeout:
+			return nil, false
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ver := caps.Ver(identities, features)
+	want := []string{"http://jabber.org/protocol/caps", "urn:xmpp:receipts"}
+
+	tests := []struct {
+		name string
+		// hash is the hash function advertised, sha-1 if empty.
+		hash string
+		// poisoned has the contact answer with features that don't
+		// match the hash.
+		poisoned bool
+		// wantQuery reports whether the first contact gets queried.
+		wantQuery bool
+	}{
+		{name: "uncached, then cached", wantQuery: true},
+		{name: "poisoned", poisoned: true, wantQuery: true},
+		{name: "unsupported hash", hash: "sha-256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("caps")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := x.(*caps.Conn)
+			stanzas := xmpptest.Stanzas(c)
+			hash := tt.hash
+			if hash == "" {
+				hash = "sha-1"
+			}
+
+			advertise(s, "bob@example.com/phone", hash, ver)
+			if !tt.wantQuery {
+				if _, err := s.EmittedUntilSentinel(stanzas); err != nil {
+					t.Fatal(err)
+				}
+				nothingSent(t, c, s)
+				if _, ok := conn.FeaturesOf("bob@example.com/phone"); ok {
+					t.Error("features of an unsupported hash are known")
+				}
+				return
+			}
+
+			answered := features
+			if tt.poisoned {
+				answered = []disco.Feature{{Var: "urn:xmpp:receipts"}, {Var: "urn:xmpp:jingle:1"}}
+			}
+			if err := answer(s, "bob@example.com/phone", ver, answered); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.poisoned {
+				// The hash stays unknown, so the next contact using it
+				// is queried again. Until the reply has been processed,
+				// the first query is still considered pending.
+				timeout := time.After(5 * time.Second)
+				for {
+					advertise(s, "carol@example.com/phone", hash, ver)
+					if _, err := s.EmittedUntilSentinel(stanzas); err != nil {
+						t.Fatal(err)
+					}
+					if _, ok := conn.FeaturesOf("bob@example.com/phone"); ok {
+						t.Fatal("poisoned features have been cached")
+					}
+					errc := make(chan error, 1)
+					go func() { errc <- c.Encode(core.Message{Header: core.Header{Id: "marker"}}) }()
+					e, err := s.NextElement()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if e.XMLName.Local == "iq" {
+						// Let the marker through before giving up on
+						// the query.
+						s.NextElement()
+						<-errc
+						return
+					}
+					<-errc
+					select {
+					case <-timeout:
+						t.Fatal("the hash wasn't queried again")
+					default:
+					}
+				}
+			}
+
+			got, ok := learned(conn, "bob@example.com/phone")
+			if !ok || !reflect.DeepEqual(got, want) {
+				t.Fatalf("got features %v, %t, want %v", got, ok, want)
+			}
+			if !conn.Supports("bob@example.com/phone", "urn:xmpp:receipts") || conn.Supports("bob@example.com/phone", "urn:xmpp:jingle:1") {
+				t.Error("Supports disagrees with FeaturesOf")
+			}
+
+			// Another contact with the same software is answered from
+			// the cache.
+			advertise(s, "carol@example.com/laptop", hash, ver)
+			if _, err := s.EmittedUntilSentinel(stanzas); err != nil {
+				t.Fatal(err)
+			}
+			nothingSent(t, c, s)
+			if got, ok := conn.FeaturesOf("carol@example.com/laptop"); !ok || !reflect.DeepEqual(got, want) {
+				t.Errorf("got features %v, %t for the cached hash, want %v", got, ok, want)
+			}
+
+			// Going offline forgets the contact, but not the hash.
+			s.Send("<presence xmlns='jabber:client' from='bob@example.com/phone' type='unavailable'/>")
+			if _, err := s.EmittedUntilSentinel(stanzas); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := conn.FeaturesOf("bob@example.com/phone"); ok {
+				t.Error("features of an offline contact are still known")
+			}
+			if _, ok := conn.FeaturesOf("carol@example.com/laptop"); !ok {
+				t.Error("cached hash was forgotten")
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Package carbons implements XEP-0280 (Message Carbons).
+//
+// With carbons enabled, the server copies messages sent and received
+// by our other resources to us. Copies are delivered as synthetic
+// Carbon stanzas. Groupchat messages are never carbon-copied, and
+// copies of them are ignored, as are copies of messages that were
+// marked as private or carry a no-copy hint (XEP-0334).
+//
+// Messages that must not be copied to other resources, for example
+// because they are encrypted for a single device like OTR-encrypted
+// messages, can be marked with Private or sent with SendPrivate.
+package carbons
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+	"strings"
+	"sync"
+)
+
+const (
+	ns        = "urn:xmpp:carbons:2"
+	nsForward = "urn:xmpp:forward:0"
+	nsHints   = "urn:xmpp:hints"
+)
+
+// Directions of a carbon copy.
+const (
+	// Received is a copy of a message received by another resource.
+	Received = "received"
+	// Sent is a copy of a message sent by another resource.
+	Sent = "sent"
+)
+
+type enable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 enable"`
+}
+
+type disable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 disable"`
+}
+
+type private struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 private"`
+}
+
+type noCopy struct {
+	XMLName xml.Name `xml:"urn:xmpp:hints no-copy"`
+}
+
+type wrapper struct {
+	Forwarded struct {
+		Message *core.Message `xml:"jabber:client message"`
+	} `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// Carbon is emitted for carbon copies. The embedded message is the
+// copied message, not the one it was wrapped in.
+type Carbon struct {
+	*core.Message
+	// Direction is either Received or Sent.
+	Direction string
+}
+
+type Conn struct {
+	core.Client
+
+	mu      sync.Mutex
+	enabled bool
+}
+
+func init() {
+	core.RegisterXEP("carbons", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	c.AddReconnectHandler(conn.reconnected)
+
+	return conn, nil
+}
+
+// Enable asks the server to send us carbon copies. Carbons stay
+// enabled after reconnecting.
+func (c *Conn) Enable() error {
+	if err := c.set(enable{}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.enabled = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Disable stops the server from sending us carbon copies.
+func (c *Conn) Disable() error {
+	if err := c.set(disable{}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.enabled = false
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) set(v interface{}) error {
+	ch, _ := c.SendIQ("", "set", v)
+	res := <-ch
+	if res == nil {
+		return core.ErrClosed
+	}
+	if res.IsError() {
+		return res.Error
+	}
+	return nil
+}
+
+func (c *Conn) reconnected(resumed bool) {
+	if resumed {
+		return
+	}
+
+	c.mu.Lock()
+	enabled := c.enabled
+	c.mu.Unlock()
+	if enabled {
+		go c.set(enable{})
+	}
+}
+
+// Private marks an outgoing message as private, which keeps the
+// server from copying it to our other resources, and adds a hint
+// (XEP-0334) against copying it anywhere else.
+func Private(m *core.Message) {
+	if !IsPrivate(m) {
+		m.Inner, _ = core.AppendPayload(m.Inner, private{})
+	}
+	if !core.HasPayload(m.Inner, nsHints, "no-copy") {
+		m.Inner, _ = core.AppendPayload(m.Inner, noCopy{})
+	}
+}
+
+// IsPrivate reports whether a message has been marked as private.
+func IsPrivate(m *core.Message) bool {
+	return core.HasPayload(m.Inner, ns, "private")
+}
+
+// SendPrivate marks a message as private and sends it.
+func (c *Conn) SendPrivate(m core.Message) error {
+	Private(&m)
+	return c.Encode(m)
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok {
+		return nil, nil
+	}
+
+	carbon, ok := Unwrap(msg, c.JID())
+	if !ok {
+		return nil, nil
+	}
+	return []core.Stanza{carbon}, nil
+}
+
+// Unwrap returns the carbon copy carried by msg, received on the
+// connection of own, our JID. It reports false if msg isn't a carbon
+// or is a copy of a message that shouldn't have been copied, which are
+// ignored.
+func Unwrap(msg *core.Message, own string) (*Carbon, bool) {
+	if msg.Type == "groupchat" {
+		return nil, false
+	}
+
+	// Only our own server may send us carbons, anything else is an
+	// attempt at impersonating other entities.
+	if msg.From != "" && msg.From != bare(own) {
+		return nil, false
+	}
+
+	for _, dir := range []string{Received, Sent} {
+		var v wrapper
+		found, err := core.DecodePayload(msg.Inner, ns, dir, &v)
+		if err != nil || !found {
+			continue
+		}
+		fwd := v.Forwarded.Message
+		if fwd == nil || fwd.Type == "groupchat" {
+			return nil, false
+		}
+		if IsPrivate(fwd) || core.HasPayload(fwd.Inner, nsHints, "no-copy") {
+			// Shouldn't have been copied.
+			return nil, false
+		}
+		return &Carbon{fwd, dir}, true
+	}
+	return nil, false
+}
+
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	return jid
+}
@@ -0,0 +1,172 @@
+package carbons_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/carbons"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"testing"
+)
+
+func TestSendPrivate(t *testing.T) {
+	tests := []struct {
+		name       string
+		inner      string
+		wantActive bool
+	}{
+		{name: "plain"},
+		{name: "with payload", inner: "<active xmlns='http://jabber.org/protocol/chatstates'/>", wantActive: true},
+		// Markers that are already present mustn't be duplicated.
+		{name: "already private", inner: "<private xmlns='urn:xmpp:carbons:2'/>"},
+		{name: "already no-copy", inner: "<no-copy xmlns='urn:xmpp:hints'/>"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	x, err := c.RegisterXEP("carbons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := x.(*carbons.Conn)
+	xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := core.Message{
+				Header: core.Header{To: "bob@example.com", Type: "chat"},
+				Body:   "?OTR:AAMDJ+MVmSfjFZcAAAAAAQAAAAIAAADA",
+				Inner:  []byte(tt.inner),
+			}
+			errc := make(chan error, 1)
+			go func() { errc <- conn.SendPrivate(msg) }()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if e.XMLName.Local != "message" || e.Attribute("to") != "bob@example.com" {
+				t.Fatalf("got <%s> %v, want a message to bob@example.com", e.XMLName.Local, e.Attr)
+			}
+			var got struct {
+				Private []struct{} `xml:"urn:xmpp:carbons:2 private"`
+				NoCopy  []struct{} `xml:"urn:xmpp:hints no-copy"`
+				Active  *struct{}  `xml:"http://jabber.org/protocol/chatstates active"`
+			}
+			if err := xml.Unmarshal([]byte("<message>"+string(e.Inner)+"</message>"), &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Private) != 1 || len(got.NoCopy) != 1 {
+				t.Errorf("got %s with %d private markers and %d no-copy hints, want one each", e.Inner, len(got.Private), len(got.NoCopy))
+			}
+			if tt.wantActive && got.Active == nil {
+				t.Errorf("got %s, want the chat state kept", e.Inner)
+			}
+			// The message passed in is sent as a copy.
+			if string(msg.Inner) != tt.inner {
+				t.Error("SendPrivate modified the caller's message")
+			}
+		})
+	}
+}
+
+func TestCarbon(t *testing.T) {
+	const forwarded = "<%s xmlns='urn:xmpp:carbons:2'><forwarded xmlns='urn:xmpp:forward:0'>" +
+		"<message xmlns='jabber:client' from='%s' to='%s' type='%s'><body>hi</body>%s</message></forwarded></%s>"
+
+	tests := []struct {
+		name string
+		// from and typ are those of the wrapping message.
+		from string
+		typ  string
+		// dir, copyType, copyFrom, copyTo and copyInner describe the
+		// copy.
+		dir       string
+		copyFrom  string
+		copyTo    string
+		copyType  string
+		copyInner string
+		want      bool
+	}{
+		{
+			name: "received", from: "alice@example.com", dir: carbons.Received,
+			copyFrom: "bob@example.com/phone", copyTo: "alice@example.com/laptop", copyType: "chat", want: true,
+		},
+		{
+			name: "sent", from: "alice@example.com", dir: carbons.Sent,
+			copyFrom: "alice@example.com/laptop", copyTo: "bob@example.com", copyType: "chat", want: true,
+		},
+		{
+			name: "groupchat copy", from: "alice@example.com", dir: carbons.Received,
+			copyFrom: "room@muc.example.com/bob", copyTo: "alice@example.com/laptop", copyType: "groupchat",
+		},
+		{
+			name: "groupchat wrapper", from: "room@muc.example.com", typ: "groupchat", dir: carbons.Received,
+			copyFrom: "bob@example.com/phone", copyTo: "alice@example.com/laptop", copyType: "chat",
+		},
+		{
+			name: "forged", from: "mallory@example.net", dir: carbons.Sent,
+			copyFrom: "alice@example.com/laptop", copyTo: "bob@example.com", copyType: "chat",
+		},
+		// Copies of messages that shouldn't have been copied are
+		// ignored.
+		{
+			name: "private", from: "alice@example.com", dir: carbons.Sent,
+			copyFrom: "alice@example.com/laptop", copyTo: "bob@example.com", copyType: "chat",
+			copyInner: "<private xmlns='urn:xmpp:carbons:2'/>",
+		},
+		{
+			name: "no-copy hint", from: "alice@example.com", dir: carbons.Received,
+			copyFrom: "bob@example.com/phone", copyTo: "alice@example.com/laptop", copyType: "chat",
+			copyInner: "<no-copy xmlns='urn:xmpp:hints'/>",
+		},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := c.RegisterXEP("carbons"); err != nil {
+		t.Fatal(err)
+	}
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Sendf("<message xmlns='jabber:client' from='%s' type='%s'>"+forwarded+"</message>",
+				tt.from, tt.typ, tt.dir, tt.copyFrom, tt.copyTo, tt.copyType, tt.copyInner, tt.dir)
+
+			var got []*carbons.Carbon
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stanza := range emitted {
+				if stanza, ok := stanza.(*carbons.Carbon); ok {
+					got = append(got, stanza)
+				}
+			}
+
+			if !tt.want {
+				if len(got) != 0 {
+					t.Fatalf("got carbon %+v, want none", got[0])
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d carbons, want 1", len(got))
+			}
+			if got[0].Direction != tt.dir || got[0].From != tt.copyFrom || got[0].To != tt.copyTo || got[0].Body != "hi" {
+				t.Errorf("got %s carbon from %s to %s with body %q, want %s from %s to %s",
+					got[0].Direction, got[0].From, got[0].To, got[0].Body, tt.dir, tt.copyFrom, tt.copyTo)
+			}
+		})
+	}
+}
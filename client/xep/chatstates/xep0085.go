@@ -0,0 +1,228 @@
+// Package chatstates implements XEP-0085 (Chat State Notifications).
+//
+// Chat states tell the other party of a conversation whether we are
+// paying attention and whether we are typing. States can be attached
+// to outgoing messages with Attach or sent on their own with Send.
+// TypingNotifier takes care of sending the right states while the
+// user is typing. Inbound states are delivered as synthetic Event
+// stanzas, and the typing status of contacts is tracked for Typing.
+package chatstates
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+	"sync"
+	"time"
+)
+
+const ns = "http://jabber.org/protocol/chatstates"
+
+type State string
+
+const (
+	Active    State = "active"
+	Composing State = "composing"
+	Paused    State = "paused"
+	Inactive  State = "inactive"
+	Gone      State = "gone"
+)
+
+var states = []State{Active, Composing, Paused, Inactive, Gone}
+
+// Event is emitted for messages that carry a chat state.
+type Event struct {
+	*core.Message
+	State State
+}
+
+type Conn struct {
+	core.Client
+
+	// PauseAfter is how long the user has to stop typing before a
+	// TypingNotifier sends the paused state.
+	PauseAfter time.Duration
+	// TypingTimeout is how long a contact is considered to be typing
+	// after having sent the composing state, unless a different state
+	// arrives first.
+	TypingTimeout time.Duration
+
+	mu     sync.Mutex
+	typing map[string]time.Time
+}
+
+func init() {
+	core.RegisterXEP("chatstates", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client:        c,
+		PauseAfter:    5 * time.Second,
+		TypingTimeout: 30 * time.Second,
+		typing:        make(map[string]time.Time),
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+// Attach adds a chat state to an outgoing message.
+func Attach(m *core.Message, s State) {
+	m.Inner, _ = core.AppendPayload(m.Inner, struct {
+		XMLName xml.Name
+	}{xml.Name{Space: ns, Local: string(s)}})
+}
+
+// Of returns the chat state of a message, or the empty string if it
+// doesn't have one.
+func Of(m *core.Message) State {
+	for _, s := range states {
+		if core.HasPayload(m.Inner, ns, string(s)) {
+			return s
+		}
+	}
+	return ""
+}
+
+// Send sends a standalone chat state notification. States should
+// only be sent to contacts that have shown support for them, either
+// by sending states themselves or via service discovery.
+func (c *Conn) Send(to string, s State) error {
+	msg := core.Message{
+		Header: core.Header{
+			To:   to,
+			Type: "chat",
+		},
+	}
+	Attach(&msg, s)
+	return c.Encode(msg)
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok || msg.Type == "error" {
+		return nil, nil
+	}
+
+	s := Of(msg)
+	c.mu.Lock()
+	if s == Composing {
+		c.typing[msg.From] = clock.Now()
+	} else if s != "" || msg.Body != "" {
+		delete(c.typing, msg.From)
+	}
+	c.mu.Unlock()
+
+	if s == "" {
+		return nil, nil
+	}
+	return []core.Stanza{&Event{msg, s}}, nil
+}
+
+// Typing reports whether jid, a full JID, is currently typing a
+// message to us. A contact stops typing when it sends a message or a
+// different state, or when TypingTimeout has passed without it
+// sending the composing state again.
+func (c *Conn) Typing(jid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.typing[jid]
+	if !ok {
+		return false
+	}
+	if clock.Since(t) >= c.TypingTimeout {
+		delete(c.typing, jid)
+		return false
+	}
+	return true
+}
+
+// TypingNotifier sends chat states for a single conversation based on
+// the user's input: composing when the user starts typing, paused
+// when the user stops typing for PauseAfter, and active once the
+// message has been sent. Each state is only sent once, no matter how
+// often the input changes.
+type TypingNotifier struct {
+	c  *Conn
+	to string
+
+	mu      sync.Mutex
+	state   State
+	timer   clock.Timer
+	stopped bool
+}
+
+// NewTypingNotifier returns a TypingNotifier for the conversation
+// with to.
+func (c *Conn) NewTypingNotifier(to string) *TypingNotifier {
+	return &TypingNotifier{c: c, to: to, state: Active}
+}
+
+// InputChanged reports that the user has changed the message being
+// composed.
+func (n *TypingNotifier) InputChanged() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+
+	if n.timer == nil {
+		n.timer = clock.AfterFunc(n.c.PauseAfter, n.pause)
+	} else {
+		n.timer.Reset(n.c.PauseAfter)
+	}
+	if n.state != Composing {
+		n.state = Composing
+		n.c.Send(n.to, Composing)
+	}
+}
+
+func (n *TypingNotifier) pause() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped || n.state != Composing {
+		return
+	}
+	n.state = Paused
+	n.c.Send(n.to, Paused)
+}
+
+// MessageSent reports that the user is sending the message they
+// composed. The active state is attached to m, which has to be sent
+// by the caller, instead of being sent separately.
+func (n *TypingNotifier) MessageSent(m *core.Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+	n.state = Active
+	Attach(m, Active)
+}
+
+// Stop stops sending states. If the user has been typing, the active
+// state is sent to end the notification.
+func (n *TypingNotifier) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+
+	n.stopped = true
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+	if n.state != Active {
+		n.state = Active
+		n.c.Send(n.to, Active)
+	}
+}
@@ -0,0 +1,200 @@
+package chatstates_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/chatstates"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+const bob = "bob@example.com/phone"
+
+// connect returns a client with chat states registered, using a mock
+// clock.
+func connect(t *testing.T) (*core.Conn, *chatstates.Conn, *xmpptest.Server, *clock.Mock) {
+	t.Helper()
+	mock := clock.NewMock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	t.Cleanup(clock.Set(mock))
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	x, err := c.RegisterXEP("chatstates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, x.(*chatstates.Conn), s, mock
+}
+
+func TestTypingNotifier(t *testing.T) {
+	const (
+		input  = "input"
+		wait   = "wait PauseAfter"
+		almost = "wait almost PauseAfter"
+		sent   = "message sent"
+		stop   = "stop"
+	)
+	type step struct {
+		action string
+		// want is the state sent because of the action, if any.
+		want chatstates.State
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "composing once", steps: []step{{input, chatstates.Composing}, {input, ""}, {input, ""}}},
+		{name: "paused", steps: []step{{input, chatstates.Composing}, {wait, chatstates.Paused}, {wait, ""}}},
+		{
+			name:  "typing delays pause",
+			steps: []step{{input, chatstates.Composing}, {almost, ""}, {input, ""}, {almost, ""}, {almost, chatstates.Paused}},
+		},
+		{name: "typing after pause", steps: []step{{input, chatstates.Composing}, {wait, chatstates.Paused}, {input, chatstates.Composing}}},
+		// The active state goes along with the message instead.
+		{name: "message sent", steps: []step{{input, chatstates.Composing}, {sent, ""}, {wait, ""}}},
+		{name: "new message", steps: []step{{input, chatstates.Composing}, {sent, ""}, {input, chatstates.Composing}}},
+		{name: "stopped while typing", steps: []step{{input, chatstates.Composing}, {stop, chatstates.Active}, {input, ""}, {wait, ""}}},
+		{name: "stopped while paused", steps: []step{{input, chatstates.Composing}, {wait, chatstates.Paused}, {stop, chatstates.Active}}},
+		{name: "stopped idle", steps: []step{{stop, ""}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, conn, s, mock := connect(t)
+			xmpptest.Stanzas(c)
+			n := conn.NewTypingNotifier(bob)
+
+			// Sending blocks until the server reads, so states are
+			// read concurrently.
+			states := make(chan chatstates.State, 16)
+			go func() {
+				for {
+					e, err := s.NextElement()
+					if err != nil {
+						close(states)
+						return
+					}
+					if e.Attribute("id") == "marker" {
+						states <- "marker"
+						continue
+					}
+					msg := core.Message{Inner: e.Inner}
+					if e.Attribute("to") != bob {
+						t.Errorf("got state sent to %q, want %s", e.Attribute("to"), bob)
+					}
+					states <- chatstates.Of(&msg)
+				}
+			}()
+
+			for _, step := range tt.steps {
+				switch step.action {
+				case input:
+					n.InputChanged()
+				case wait:
+					mock.Advance(conn.PauseAfter)
+				case almost:
+					mock.Advance(conn.PauseAfter - time.Second)
+				case sent:
+					var msg core.Message
+					n.MessageSent(&msg)
+					if got := chatstates.Of(&msg); got != chatstates.Active {
+						t.Errorf("%s: got %q attached, want %q", step.action, got, chatstates.Active)
+					}
+				case stop:
+					n.Stop()
+				}
+
+				if step.want == "" {
+					continue
+				}
+				select {
+				case got := <-states:
+					if got != step.want {
+						t.Fatalf("%s: got %q, want %q", step.action, got, step.want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%s: no state sent, want %q", step.action, step.want)
+				}
+			}
+
+			// Nothing else has been sent before the marker.
+			go c.Encode(core.Message{Header: core.Header{Id: "marker"}})
+			if got := <-states; got != "marker" {
+				t.Errorf("got unexpected state %q", got)
+			}
+		})
+	}
+}
+
+func TestTyping(t *testing.T) {
+	type step struct {
+		// state is sent by bob, along with body. If both are empty,
+		// the clock is advanced by advance instead.
+		state   chatstates.State
+		body    string
+		advance time.Duration
+		want    bool
+	}
+	const timeout = 30 * time.Second
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "composing", steps: []step{{state: chatstates.Composing, want: true}}},
+		{
+			name: "expired",
+			steps: []step{
+				{state: chatstates.Composing, want: true},
+				{advance: timeout - time.Second, want: true},
+				{advance: time.Second, want: false},
+			},
+		},
+		{
+			name: "refreshed",
+			steps: []step{
+				{state: chatstates.Composing, want: true},
+				{advance: timeout - time.Second, want: true},
+				{state: chatstates.Composing, want: true},
+				{advance: timeout - time.Second, want: true},
+			},
+		},
+		{name: "paused", steps: []step{{state: chatstates.Composing, want: true}, {state: chatstates.Paused, want: false}}},
+		{name: "message", steps: []step{{state: chatstates.Composing, want: true}, {body: "hi", want: false}}},
+		{name: "message with active", steps: []step{{state: chatstates.Composing, want: true}, {state: chatstates.Active, body: "hi", want: false}}},
+		{name: "never typed", steps: []step{{state: chatstates.Active, want: false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, conn, s, mock := connect(t)
+			conn.TypingTimeout = timeout
+			stanzas := xmpptest.Stanzas(c)
+
+			for i, step := range tt.steps {
+				if step.state == "" && step.body == "" {
+					mock.Advance(step.advance)
+				} else {
+					msg := core.Message{Header: core.Header{From: bob, Type: "chat"}, Body: step.body}
+					if step.state != "" {
+						chatstates.Attach(&msg, step.state)
+					}
+					b, _ := xml.Marshal(msg)
+					s.Send(string(b))
+					if _, err := s.EmittedUntilSentinel(stanzas); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if got := conn.Typing(bob); got != step.want {
+					t.Fatalf("step %d: got typing %t, want %t", i, got, step.want)
+				}
+			}
+		})
+	}
+}
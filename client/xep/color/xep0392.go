@@ -0,0 +1,169 @@
+// Package color implements XEP-0392 (Consistent Color Generation).
+//
+// The color of a nickname or JID is derived from a hash of it, so that
+// all clients show the same participant in the same color. Colors
+// have the same perceived lightness and saturation, and only differ
+// in hue.
+package color
+
+import (
+	"crypto/sha1"
+	"image/color"
+	"math"
+)
+
+// Corrections for color vision deficiencies, which restrict the hues
+// to those that can be told apart.
+const (
+	NoCorrection = iota
+	RedGreen
+	Blue
+)
+
+// Options adapt the generated colors to the user and the UI.
+type Options struct {
+	// Deficiency is one of NoCorrection, RedGreen and Blue.
+	Deficiency int
+	// Background, if set, is the color the generated color will be
+	// shown on. The inverted background is mixed into the color, for
+	// more contrast.
+	Background color.Color
+}
+
+// Angle returns the hue angle of an identifier, in degrees.
+func Angle(identifier string) float64 {
+	sum := sha1.Sum([]byte(identifier))
+	v := uint16(sum[0]) | uint16(sum[1])<<8
+	return float64(v) / 65536 * 360
+}
+
+// ConsistentColor returns the color of an identifier, like a
+// nickname or a bare JID.
+func ConsistentColor(identifier string) (r, g, b uint8) {
+	return ConsistentColorWith(identifier, Options{})
+}
+
+// ConsistentColorWith returns the color of an identifier, corrected
+// according to opts.
+func ConsistentColorWith(identifier string, opts Options) (r, g, b uint8) {
+	angle := Angle(identifier)
+	switch opts.Deficiency {
+	case RedGreen:
+		angle = math.Mod(angle, 180)
+	case Blue:
+		angle = math.Mod(angle-90, 180) + 90
+		if angle < 90 {
+			angle += 180
+		}
+	}
+
+	rf, gf, bf := hsluvToRGB(angle, 100, 50)
+	if opts.Background != nil {
+		br, bg, bb, _ := opts.Background.RGBA()
+		rf = 0.2*(1-float64(br)/0xffff) + 0.8*rf
+		gf = 0.2*(1-float64(bg)/0xffff) + 0.8*gf
+		bf = 0.2*(1-float64(bb)/0xffff) + 0.8*bf
+	}
+	return to8(rf), to8(gf), to8(bf)
+}
+
+func to8(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(1, v)) * 255))
+}
+
+// The following implements the conversion from HSLuv to sRGB, as
+// specified at https://www.hsluv.org/.
+
+var m = [3][3]float64{
+	{3.240969941904521, -1.537383177570093, -0.498610760293},
+	{-0.96924363628087, 1.87596750150772, 0.041555057407175},
+	{0.055630079696993, -0.20397695888897, 1.056971514242878},
+}
+
+const (
+	refU    = 0.19783000664283
+	refV    = 0.46831999493879
+	kappa   = 903.2962962
+	epsilon = 0.0088564516
+)
+
+func hsluvToRGB(h, s, l float64) (r, g, b float64) {
+	// HSLuv to LCh
+	var c float64
+	switch {
+	case l > 99.9999999:
+		l = 100
+	case l < 0.00000001:
+		l = 0
+	default:
+		c = maxChroma(l, h) / 100 * s
+	}
+
+	// LCh to Luv
+	hrad := h / 360 * 2 * math.Pi
+	u, v := c*math.Cos(hrad), c*math.Sin(hrad)
+
+	// Luv to XYZ
+	if l == 0 {
+		return 0, 0, 0
+	}
+	varU := u/(13*l) + refU
+	varV := v/(13*l) + refV
+	y := lToY(l)
+	x := -(9 * y * varU) / ((varU-4)*varV - varU*varV)
+	z := (9*y - 15*varV*y - varV*x) / (3 * varV)
+
+	// XYZ to sRGB
+	return fromLinear(m[0][0]*x + m[0][1]*y + m[0][2]*z),
+		fromLinear(m[1][0]*x + m[1][1]*y + m[1][2]*z),
+		fromLinear(m[2][0]*x + m[2][1]*y + m[2][2]*z)
+}
+
+// maxChroma returns the highest chroma that is still within sRGB for
+// a lightness and hue.
+func maxChroma(l, h float64) float64 {
+	hrad := h / 360 * 2 * math.Pi
+	min := math.MaxFloat64
+	for _, line := range bounds(l) {
+		length := line[1] / (math.Sin(hrad) - line[0]*math.Cos(hrad))
+		if length >= 0 && length < min {
+			min = length
+		}
+	}
+	return min
+}
+
+// bounds returns the lines, as slope and intercept, that delimit sRGB
+// at a lightness.
+func bounds(l float64) [][2]float64 {
+	var out [][2]float64
+	sub1 := math.Pow(l+16, 3) / 1560896
+	sub2 := sub1
+	if sub1 <= epsilon {
+		sub2 = l / kappa
+	}
+	for _, row := range m {
+		m1, m2, m3 := row[0], row[1], row[2]
+		for t := 0.0; t < 2; t++ {
+			top1 := (284517*m1 - 94839*m3) * sub2
+			top2 := (838422*m3+769860*m2+731718*m1)*l*sub2 - 769860*t*l
+			bottom := (632260*m3-126452*m2)*sub2 + 126452*t
+			out = append(out, [2]float64{top1 / bottom, top2 / bottom})
+		}
+	}
+	return out
+}
+
+func lToY(l float64) float64 {
+	if l <= 8 {
+		return l / kappa
+	}
+	return math.Pow((l+16)/116, 3)
+}
+
+func fromLinear(c float64) float64 {
+	if c <= 0.0031308 {
+		return 12.92 * c
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
@@ -0,0 +1,95 @@
+package color_test
+
+import (
+	xepcolor "honnef.co/go/xmpp/client/xep/color"
+
+	"image/color"
+	"math"
+	"testing"
+)
+
+// The test vectors of XEP-0392, with colors as fractions.
+var vectors = []struct {
+	in      string
+	angle   float64
+	r, g, b float64
+}{
+	{"Romeo", 327.255249, 0.865, 0.000, 0.686},
+	{"juliet@capulet.lit", 209.410400, 0.000, 0.515, 0.573},
+	{"\U0001F63A", 331.199341, 0.872, 0.000, 0.659},
+	{"council", 359.994507, 0.918, 0.000, 0.394},
+}
+
+// near reports whether a color component is within rounding distance
+// of a fraction.
+func near(got uint8, want float64) bool {
+	return math.Abs(float64(got)-want*255) <= 1
+}
+
+func TestConsistentColor(t *testing.T) {
+	for _, tt := range vectors {
+		t.Run(tt.in, func(t *testing.T) {
+			if angle := xepcolor.Angle(tt.in); math.Abs(angle-tt.angle) > 1e-6 {
+				t.Errorf("got angle %f, want %f", angle, tt.angle)
+			}
+			r, g, b := xepcolor.ConsistentColor(tt.in)
+			if !near(r, tt.r) || !near(g, tt.g) || !near(b, tt.b) {
+				t.Errorf("got (%d, %d, %d), want (%.3f, %.3f, %.3f)", r, g, b, tt.r, tt.g, tt.b)
+			}
+		})
+	}
+}
+
+func TestBackground(t *testing.T) {
+	tests := []struct {
+		name       string
+		background color.Color
+		// mix is the inverted background, which makes up a fifth of
+		// the color.
+		mix float64
+	}{
+		{name: "white", background: color.White, mix: 0},
+		{name: "black", background: color.Black, mix: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range vectors {
+				r, g, b := xepcolor.ConsistentColorWith(v.in, xepcolor.Options{Background: tt.background})
+				wr, wg, wb := 0.2*tt.mix+0.8*v.r, 0.2*tt.mix+0.8*v.g, 0.2*tt.mix+0.8*v.b
+				if !near(r, wr) || !near(g, wg) || !near(b, wb) {
+					t.Errorf("%s: got (%d, %d, %d), want (%.3f, %.3f, %.3f)", v.in, r, g, b, wr, wg, wb)
+				}
+			}
+		})
+	}
+}
+
+func TestDeficiency(t *testing.T) {
+	tests := []struct {
+		name       string
+		deficiency int
+		in         string
+		// unchanged reports whether the identifier's hue is already
+		// one that can be told apart.
+		unchanged bool
+	}{
+		// Red-green blindness restricts hues to [0, 180).
+		{name: "red-green, hue kept", deficiency: xepcolor.RedGreen, in: "alice", unchanged: true},
+		{name: "red-green, hue moved", deficiency: xepcolor.RedGreen, in: "Romeo"},
+		// Blue blindness restricts hues to [90, 270).
+		{name: "blue, hue kept", deficiency: xepcolor.Blue, in: "juliet@capulet.lit", unchanged: true},
+		{name: "blue, hue moved below", deficiency: xepcolor.Blue, in: "alice"},
+		{name: "blue, hue moved above", deficiency: xepcolor.Blue, in: "Romeo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, g, b := xepcolor.ConsistentColor(tt.in)
+			cr, cg, cb := xepcolor.ConsistentColorWith(tt.in, xepcolor.Options{Deficiency: tt.deficiency})
+			if unchanged := r == cr && g == cg && b == cb; unchanged != tt.unchanged {
+				t.Errorf("got (%d, %d, %d) instead of (%d, %d, %d), want unchanged: %t", cr, cg, cb, r, g, b, tt.unchanged)
+			}
+		})
+	}
+}
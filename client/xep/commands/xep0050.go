@@ -0,0 +1,211 @@
+// Package commands implements the requesting side of XEP-0050
+// (Ad-Hoc Commands).
+//
+// Commands are offered by servers, bots and other entities, and are
+// usually used for remote administration. A command is executed in
+// one or more stages: ExecuteCommand starts it, and the returned
+// CommandResult is used to advance to the next stage, usually by
+// submitting the form the entity sent, until the command has been
+// completed or canceled.
+package commands
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+	"errors"
+)
+
+const ns = "http://jabber.org/protocol/commands"
+
+// ErrFinished is returned when trying to advance a command that has
+// already been completed or canceled.
+var ErrFinished = errors.New("xmpp: ad-hoc command has already finished")
+
+// Actions defined by XEP-0050.
+const (
+	ActionExecute  = "execute"
+	ActionNext     = "next"
+	ActionPrev     = "prev"
+	ActionComplete = "complete"
+	ActionCancel   = "cancel"
+)
+
+// Statuses of a command.
+const (
+	StatusExecuting = "executing"
+	StatusCompleted = "completed"
+	StatusCanceled  = "canceled"
+)
+
+// Note is a message about the execution of a command. Type is one of
+// "info", "warn" and "error".
+type Note struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type actions struct {
+	Execute  string    `xml:"execute,attr,omitempty"`
+	Prev     *struct{} `xml:"prev"`
+	Next     *struct{} `xml:"next"`
+	Complete *struct{} `xml:"complete"`
+}
+
+type command struct {
+	XMLName   xml.Name        `xml:"http://jabber.org/protocol/commands command"`
+	Node      string          `xml:"node,attr"`
+	SessionID string          `xml:"sessionid,attr,omitempty"`
+	Action    string          `xml:"action,attr,omitempty"`
+	Status    string          `xml:"status,attr,omitempty"`
+	Actions   *actions        `xml:"actions"`
+	Notes     []Note          `xml:"note"`
+	Form      *dataforms.Form `xml:"jabber:x:data x,omitempty"`
+}
+
+// CommandResult is the outcome of a stage of a command.
+type CommandResult struct {
+	// To is the entity executing the command.
+	To        string
+	Node      string
+	SessionID string
+	Status    string
+	// Actions are the actions allowed for advancing the command.
+	// Default is the one to use if the user didn't pick one.
+	Actions []string
+	Default string
+	Notes   []Note
+	// Form is the form to fill in for the next stage, or the
+	// result of a completed command.
+	Form *dataforms.Form
+
+	c *Conn
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("commands", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	return &Conn{
+		Client: c,
+	}, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
+
+// ListCommands returns the commands offered by an entity. The node of
+// each item identifies the command.
+func (c *Conn) ListCommands(to string) ([]disco.Item, error) {
+	return c.MustGetXEP("disco").(*disco.Conn).GetItemsFromNode(to, ns)
+}
+
+// ExecuteCommand starts executing a command. form, which may be nil,
+// is submitted along with the request, for commands that complete in
+// a single stage.
+func (c *Conn) ExecuteCommand(to, node string, form *dataforms.Form) (*CommandResult, error) {
+	return c.execute(to, command{Node: node, Action: ActionExecute, Form: form})
+}
+
+func (c *Conn) execute(to string, cmd command) (*CommandResult, error) {
+	ch, _ := c.SendIQ(to, "set", cmd)
+	res := <-ch
+	if res == nil {
+		return nil, core.ErrClosed
+	}
+	if res.IsError() {
+		return nil, res.Error
+	}
+
+	var v command
+	if err := xml.Unmarshal(res.Inner, &v); err != nil {
+		return nil, err
+	}
+
+	r := &CommandResult{
+		To:        to,
+		Node:      v.Node,
+		SessionID: v.SessionID,
+		Status:    v.Status,
+		Notes:     v.Notes,
+		Form:      v.Form,
+		c:         c,
+	}
+	if r.Node == "" {
+		r.Node = cmd.Node
+	}
+	if r.SessionID == "" {
+		r.SessionID = cmd.SessionID
+	}
+	if a := v.Actions; a != nil {
+		if a.Prev != nil {
+			r.Actions = append(r.Actions, ActionPrev)
+		}
+		if a.Next != nil {
+			r.Actions = append(r.Actions, ActionNext)
+		}
+		if a.Complete != nil {
+			r.Actions = append(r.Actions, ActionComplete)
+		}
+		r.Default = a.Execute
+	}
+	if r.Default == "" && r.Status == StatusExecuting {
+		// Without actions, the only way forward is completing the
+		// command.
+		r.Default = ActionComplete
+	}
+	return r, nil
+}
+
+// Finished reports whether the command has been completed or
+// canceled.
+func (r *CommandResult) Finished() bool {
+	return r.Status != StatusExecuting
+}
+
+// Advance continues the command with an action. form, which may be
+// nil, is submitted with it. If action is empty, the default action
+// is used.
+func (r *CommandResult) Advance(action string, form *dataforms.Form) (*CommandResult, error) {
+	if r.Finished() {
+		return nil, ErrFinished
+	}
+	if action == "" {
+		action = r.Default
+	}
+	return r.c.execute(r.To, command{
+		Node:      r.Node,
+		SessionID: r.SessionID,
+		Action:    action,
+		Form:      form,
+	})
+}
+
+// Next advances the command to the next stage, submitting form.
+func (r *CommandResult) Next(form *dataforms.Form) (*CommandResult, error) {
+	return r.Advance(ActionNext, form)
+}
+
+// Prev returns to the previous stage of the command.
+func (r *CommandResult) Prev() (*CommandResult, error) {
+	return r.Advance(ActionPrev, nil)
+}
+
+// Complete finishes the command, submitting form.
+func (r *CommandResult) Complete(form *dataforms.Form) (*CommandResult, error) {
+	return r.Advance(ActionComplete, form)
+}
+
+// Cancel cancels the command.
+func (r *CommandResult) Cancel() error {
+	_, err := r.Advance(ActionCancel, nil)
+	return err
+}
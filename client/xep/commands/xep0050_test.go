@@ -0,0 +1,251 @@
+package commands_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/commands"
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const bot = "bot@example.com/bot"
+
+// request is a command request as received by the bot.
+type request struct {
+	Node      string          `xml:"node,attr"`
+	SessionID string          `xml:"sessionid,attr"`
+	Action    string          `xml:"action,attr"`
+	Form      *dataforms.Form `xml:"jabber:x:data x"`
+}
+
+// nextRequest reads the next command request and checks that it is
+// sent to the bot.
+func nextRequest(s *xmpptest.Server) (request, string, error) {
+	iq, err := s.NextElement()
+	if err != nil {
+		return request{}, "", err
+	}
+	if iq.XMLName.Local != "iq" || iq.Attribute("type") != "set" || iq.Attribute("to") != bot {
+		return request{}, "", fmt.Errorf("got <%s> %v, want an IQ set to %s", iq.XMLName.Local, iq.Attr, bot)
+	}
+	var req request
+	err = xml.Unmarshal(iq.Inner, &req)
+	return req, iq.Attribute("id"), err
+}
+
+func TestExecuteCommand(t *testing.T) {
+	const first = "<iq xmlns='jabber:client' type='result' id='%s' from='" + bot + "'>" +
+		"<command xmlns='http://jabber.org/protocol/commands' node='config' sessionid='s1' status='executing'>" +
+		"<actions execute='complete'><next/><complete/></actions>" +
+		"<x xmlns='jabber:x:data' type='form'><field var='motd' type='text-single'/></x>" +
+		"</command></iq>"
+
+	tests := []struct {
+		name string
+		// advance moves the command to its second stage.
+		advance    func(r *commands.CommandResult) (*commands.CommandResult, error)
+		wantAction string
+		wantForm   bool
+		// reply answers the second stage, the IQ's id is passed as
+		// the argument.
+		reply      string
+		wantStatus string
+		wantNotes  []commands.Note
+		wantErr    func(error) bool
+	}{
+		{
+			name: "default action",
+			advance: func(r *commands.CommandResult) (*commands.CommandResult, error) {
+				form := dataforms.NewSubmitForm("")
+				form.Set("motd", "Hello")
+				return r.Advance("", form)
+			},
+			wantAction: commands.ActionComplete,
+			wantForm:   true,
+			reply: "<iq xmlns='jabber:client' type='result' id='%s' from='" + bot + "'>" +
+				"<command xmlns='http://jabber.org/protocol/commands' node='config' sessionid='s1' status='completed'><note type='info'>Saved</note></command></iq>",
+			wantStatus: commands.StatusCompleted,
+			wantNotes:  []commands.Note{{Type: "info", Text: "Saved"}},
+		},
+		{
+			name: "next",
+			advance: func(r *commands.CommandResult) (*commands.CommandResult, error) {
+				form := dataforms.NewSubmitForm("")
+				form.Set("motd", "Hello")
+				return r.Next(form)
+			},
+			wantAction: commands.ActionNext,
+			wantForm:   true,
+			// The session ID may be omitted from later stages.
+			reply: "<iq xmlns='jabber:client' type='result' id='%s' from='" + bot + "'>" +
+				"<command xmlns='http://jabber.org/protocol/commands' node='config' status='completed'/></iq>",
+			wantStatus: commands.StatusCompleted,
+		},
+		{
+			name: "cancel",
+			advance: func(r *commands.CommandResult) (*commands.CommandResult, error) {
+				return nil, r.Cancel()
+			},
+			wantAction: commands.ActionCancel,
+			reply: "<iq xmlns='jabber:client' type='result' id='%s' from='" + bot + "'>" +
+				"<command xmlns='http://jabber.org/protocol/commands' node='config' sessionid='s1' status='canceled'/></iq>",
+		},
+		{
+			name: "expired session",
+			advance: func(r *commands.CommandResult) (*commands.CommandResult, error) {
+				return r.Complete(nil)
+			},
+			wantAction: commands.ActionComplete,
+			reply: "<iq xmlns='jabber:client' type='error' id='%s' from='" + bot + "'><error type='modify'>" +
+				"<bad-request xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/><bad-sessionid xmlns='http://jabber.org/protocol/commands'/></error></iq>",
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr) && stanzaErr.Type == "modify"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("commands")
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			errc := make(chan error, 1)
+			go func() {
+				err := func() error {
+					req, id, err := nextRequest(s)
+					if err != nil {
+						return err
+					}
+					if req.Node != "config" || req.Action != commands.ActionExecute || req.SessionID != "" || req.Form != nil {
+						return fmt.Errorf("got first stage %+v", req)
+					}
+					s.Sendf(first, id)
+
+					req, id, err = nextRequest(s)
+					if err != nil {
+						return err
+					}
+					if req.Node != "config" || req.SessionID != "s1" || req.Action != tt.wantAction {
+						return fmt.Errorf("got second stage %+v, want action %s in session s1", req, tt.wantAction)
+					}
+					if tt.wantForm && (req.Form == nil || req.Form.Type != dataforms.TypeSubmit || req.Form.Get("motd") != "Hello") {
+						return fmt.Errorf("got form %+v, want the submitted one", req.Form)
+					}
+					if !tt.wantForm && req.Form != nil {
+						return fmt.Errorf("got form %+v, want none", req.Form)
+					}
+					return s.Sendf(tt.reply, id)
+				}()
+				if err != nil {
+					// Unblock the client.
+					s.Conn.Close()
+				}
+				errc <- err
+			}()
+
+			r, err := x.(*commands.Conn).ExecuteCommand(bot, "config", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.SessionID != "s1" || r.Finished() {
+				t.Errorf("got session %q, finished %t, want s1 executing", r.SessionID, r.Finished())
+			}
+			if want := []string{commands.ActionNext, commands.ActionComplete}; !reflect.DeepEqual(r.Actions, want) || r.Default != commands.ActionComplete {
+				t.Errorf("got actions %v and default %q, want %v and %q", r.Actions, r.Default, want, commands.ActionComplete)
+			}
+			if r.Form == nil || len(r.Form.Fields) != 1 || r.Form.Fields[0].Var != "motd" {
+				t.Errorf("got form %+v, want the motd form", r.Form)
+			}
+
+			r2, err := tt.advance(r)
+			if e := <-errc; e != nil {
+				t.Fatal(e)
+			}
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("got unexpected error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r2 == nil {
+				return
+			}
+			if r2.Status != tt.wantStatus || !r2.Finished() || r2.SessionID != "s1" || !reflect.DeepEqual(r2.Notes, tt.wantNotes) {
+				t.Errorf("got %s in session %q with notes %v, want %s in s1 with %v", r2.Status, r2.SessionID, r2.Notes, tt.wantStatus, tt.wantNotes)
+			}
+			if _, err := r2.Next(nil); err != commands.ErrFinished {
+				t.Errorf("advancing a finished command returned %v, want %v", err, commands.ErrFinished)
+			}
+		})
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	x, err := c.RegisterXEP("commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmpptest.Stanzas(c)
+
+	type result struct {
+		nodes []string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		items, err := x.(*commands.Conn).ListCommands(bot)
+		var nodes []string
+		for _, item := range items {
+			nodes = append(nodes, item.Node)
+		}
+		done <- result{nodes, err}
+	}()
+
+	iq, err := s.NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query struct {
+		XMLName xml.Name
+		Node    string `xml:"node,attr"`
+	}
+	xml.Unmarshal(iq.Inner, &query)
+	if iq.Attribute("type") != "get" || iq.Attribute("to") != bot ||
+		query.XMLName.Space != "http://jabber.org/protocol/disco#items" || query.Node != "http://jabber.org/protocol/commands" {
+		t.Fatalf("got %v %s, want a disco#items request for the commands node", iq.Attr, iq.Inner)
+	}
+	s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='"+bot+"'>"+
+		"<query xmlns='http://jabber.org/protocol/disco#items' node='http://jabber.org/protocol/commands'>"+
+		"<item jid='"+bot+"' node='config' name='Configure'/><item jid='"+bot+"' node='restart' name='Restart'/>"+
+		"</query></iq>", iq.Attribute("id"))
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if want := []string{"config", "restart"}; !reflect.DeepEqual(res.nodes, want) {
+		t.Errorf("got commands %v, want %v", res.nodes, want)
+	}
+}
@@ -0,0 +1,101 @@
+// Package dataforms implements XEP-0004 (Data Forms).
+//
+// Forms are used by many other XEPs to transport structured data,
+// like configuration options. This package only provides the types;
+// it is up to the respective XEPs to send and receive forms.
+package dataforms
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+)
+
+const ns = "jabber:x:data"
+
+// Form types.
+const (
+	TypeForm   = "form"
+	TypeSubmit = "submit"
+	TypeCancel = "cancel"
+	TypeResult = "result"
+)
+
+type Form struct {
+	XMLName      xml.Name `xml:"jabber:x:data x"`
+	Type         string   `xml:"type,attr"`
+	Title        string   `xml:"title,omitempty"`
+	Instructions string   `xml:"instructions,omitempty"`
+	Fields       []Field  `xml:"field"`
+}
+
+type Field struct {
+	Var     string   `xml:"var,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Label   string   `xml:"label,attr,omitempty"`
+	Values  []string `xml:"value"`
+	Options []Option `xml:"option"`
+}
+
+type Option struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// NewSubmitForm returns a form of type submit. If formType isn't
+// empty, it is included as the hidden FORM_TYPE field that identifies
+// the purpose of the form.
+func NewSubmitForm(formType string) *Form {
+	f := &Form{Type: TypeSubmit}
+	if formType != "" {
+		f.Set("FORM_TYPE", formType)
+		f.Fields[0].Type = "hidden"
+	}
+	return f
+}
+
+// Set sets the values of a field, adding the field if necessary.
+func (f *Form) Set(name string, values ...string) {
+	for i := range f.Fields {
+		if f.Fields[i].Var == name {
+			f.Fields[i].Values = values
+			return
+		}
+	}
+	f.Fields = append(f.Fields, Field{Var: name, Values: values})
+}
+
+// Get returns the first value of a field, or the empty string if the
+// field doesn't exist.
+func (f *Form) Get(name string) string {
+	for _, field := range f.Fields {
+		if field.Var == name && len(field.Values) > 0 {
+			return field.Values[0]
+		}
+	}
+	return ""
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("dataforms", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
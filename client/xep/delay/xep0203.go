@@ -0,0 +1,180 @@
+// Package delay implements XEP-0203 (Delayed Delivery).
+//
+// Messages that weren't delivered immediately, like offline messages
+// and room history, carry the time they were originally sent. Inbound
+// delayed messages are delivered as synthetic Message stanzas.
+//
+// Offline messages are told apart from other delayed messages by a
+// heuristic: Servers deliver stored messages right after receiving
+// our initial presence. Delayed messages that arrive before our
+// initial presence or within OfflineCutoff after it are considered
+// offline messages, with the exception of groupchat messages, which
+// are room history.
+package delay
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/disco"
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+
+	"encoding/xml"
+	"sync"
+	"time"
+)
+
+const ns = "urn:xmpp:delay"
+
+// Delay describes why and since when a stanza has been delayed.
+type Delay struct {
+	// From is the entity that delayed the stanza, usually our server
+	// or a room.
+	From   string
+	Stamp  time.Time
+	Reason string
+}
+
+type delay struct {
+	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
+	From    string   `xml:"from,attr,omitempty"`
+	Stamp   string   `xml:"stamp,attr"`
+	Reason  string   `xml:",chardata"`
+}
+
+// Message is emitted for delayed messages.
+type Message struct {
+	*core.Message
+	Delay Delay
+	// Offline reports whether the message has been stored by our
+	// server while we were offline.
+	Offline bool
+}
+
+type Conn struct {
+	core.Client
+
+	// OfflineCutoff is how long after sending our initial presence
+	// delayed messages are still considered offline messages.
+	OfflineCutoff time.Duration
+
+	mu sync.Mutex
+	// available is the time we sent our initial presence on the
+	// stream with the ID stream.
+	available time.Time
+	stream    string
+}
+
+func init() {
+	core.RegisterXEP("delay", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client:        c,
+		OfflineCutoff: 10 * time.Second,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	c.AddPresenceDecorator(conn.observePresence)
+	c.AddReconnectHandler(conn.reconnected)
+
+	return conn, nil
+}
+
+// Attach marks an outgoing stanza's payload as delayed since stamp,
+// which is useful when sending messages that had been queued while
+// we were offline.
+func Attach(inner []byte, stamp time.Time, reason string) []byte {
+	inner, _ = core.AppendPayload(inner, delay{
+		Stamp:  xmpptime.FormatDateTime(stamp),
+		Reason: reason,
+	})
+	return inner
+}
+
+// Get returns the delay of a stanza, given its payload, and reports
+// whether it has been delayed.
+func Get(inner []byte) (Delay, bool) {
+	var v delay
+	found, err := core.DecodePayload(inner, ns, "delay", &v)
+	if err != nil || !found {
+		return Delay{}, false
+	}
+
+	stamp, err := xmpptime.ParseDateTime(v.Stamp)
+	if err != nil {
+		return Delay{}, false
+	}
+	return Delay{From: v.From, Stamp: stamp, Reason: v.Reason}, true
+}
+
+// streamID returns the ID of the current stream, which identifies
+// the session.
+func (c *Conn) streamID() string {
+	if s, ok := c.Client.(interface {
+		StreamHeader() core.StreamHeader
+	}); ok {
+		return s.StreamHeader().ID
+	}
+	return ""
+}
+
+func (c *Conn) observePresence(p *core.Presence) {
+	if p.To != "" || p.Type != "" {
+		return
+	}
+
+	id := c.streamID()
+	c.mu.Lock()
+	if c.available.IsZero() || c.stream != id {
+		c.available = clock.Now()
+		c.stream = id
+	}
+	c.mu.Unlock()
+}
+
+func (c *Conn) reconnected(resumed bool) {
+	if !resumed {
+		return
+	}
+
+	// The server still knows our presence and won't deliver offline
+	// messages again, so the resumed session counts as one in which
+	// we sent our initial presence long ago.
+	c.mu.Lock()
+	c.stream = c.streamID()
+	c.mu.Unlock()
+}
+
+// offline reports whether a delayed message received now is an
+// offline message.
+func (c *Conn) offline(msg *core.Message) bool {
+	if msg.Type == "groupchat" {
+		return false
+	}
+
+	id := c.streamID()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.available.IsZero() || c.stream != id {
+		// We haven't sent our initial presence yet.
+		return true
+	}
+	return clock.Since(c.available) < c.OfflineCutoff
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok {
+		return nil, nil
+	}
+
+	d, ok := Get(msg.Inner)
+	if !ok {
+		return nil, nil
+	}
+
+	return []core.Stanza{&Message{msg, d, c.offline(msg)}}, nil
+}
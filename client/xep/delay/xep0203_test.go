@@ -0,0 +1,219 @@
+package delay_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/delay"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	cutoff  = 10 * time.Second
+	delayed = "<message xmlns='jabber:client' from='%s' type='%s'><body>hi</body>" +
+		"<delay xmlns='urn:xmpp:delay' from='%s' stamp='2023-12-31T12:00:00Z'>Offline Storage</delay></message>"
+	sm = "<sm xmlns='urn:xmpp:sm:3'/>"
+)
+
+var stamp = time.Date(2023, 12, 31, 12, 0, 0, 0, time.UTC)
+
+// offline sends a delayed message of type typ and reports whether it
+// has been emitted as an offline message.
+func offline(t *testing.T, s *xmpptest.Server, stanzas <-chan core.Stanza, typ string) bool {
+	t.Helper()
+	from, by := "bob@example.com/phone", "example.com"
+	if typ == "groupchat" {
+		from, by = "room@muc.example.com/bob", "room@muc.example.com"
+	}
+	s.Sendf(delayed, from, typ, by)
+	emitted, err := s.EmittedUntilSentinel(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stanza := range emitted {
+		if msg, ok := stanza.(*delay.Message); ok {
+			want := delay.Delay{From: by, Stamp: stamp, Reason: "Offline Storage"}
+			if !msg.Delay.Stamp.Equal(want.Stamp) || msg.Delay.From != want.From || msg.Delay.Reason != want.Reason {
+				t.Errorf("got delay %+v, want %+v", msg.Delay, want)
+			}
+			return msg.Offline
+		}
+	}
+	t.Fatal("no delayed message emitted")
+	return false
+}
+
+// sendPresence sends p and waits for it to arrive.
+func sendPresence(t *testing.T, c *core.Conn, s *xmpptest.Server, p core.Presence) {
+	t.Helper()
+	go c.SendPresence(p)
+	if e, err := s.NextElement(); err != nil || e.XMLName.Local != "presence" {
+		t.Fatalf("got <%s>, %v, want a presence", e.XMLName.Local, err)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	type step struct {
+		// presence is sent, if not nil.
+		presence *core.Presence
+		advance  time.Duration
+		// message is the type of a delayed message that is sent,
+		// if not empty, and wantOffline whether it has to be
+		// considered an offline message.
+		message     string
+		wantOffline bool
+	}
+	initial := &core.Presence{}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "before initial presence", steps: []step{{message: "chat", wantOffline: true}, {message: "normal", wantOffline: true}}},
+		{name: "inside cutoff", steps: []step{{presence: initial}, {advance: cutoff - time.Second, message: "chat", wantOffline: true}}},
+		{name: "outside cutoff", steps: []step{{presence: initial}, {advance: cutoff, message: "chat"}}},
+		{
+			// Updates don't restart the cutoff.
+			name:  "presence update",
+			steps: []step{{presence: initial}, {advance: cutoff - time.Second, presence: &core.Presence{Show: "away"}}, {advance: time.Second, message: "chat"}},
+		},
+		{
+			name:  "directed presence",
+			steps: []step{{presence: &core.Presence{Header: core.Header{To: "room@muc.example.com/alice"}}}, {advance: time.Minute, message: "chat", wantOffline: true}},
+		},
+		{name: "groupchat history before initial presence", steps: []step{{message: "groupchat"}}},
+		{name: "groupchat history inside cutoff", steps: []step{{presence: initial}, {message: "groupchat"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := clock.NewMock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			defer clock.Set(mock)()
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("delay")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x.(*delay.Conn).OfflineCutoff != cutoff {
+				t.Fatalf("got cutoff %v, want %v", x.(*delay.Conn).OfflineCutoff, cutoff)
+			}
+			stanzas := xmpptest.Stanzas(c)
+
+			for i, step := range tt.steps {
+				mock.Advance(step.advance)
+				if step.presence != nil {
+					sendPresence(t, c, s, *step.presence)
+				}
+				if step.message == "" {
+					continue
+				}
+				if got := offline(t, s, stanzas, step.message); got != step.wantOffline {
+					t.Errorf("step %d: got offline %t, want %t", i, got, step.wantOffline)
+				}
+			}
+		})
+	}
+}
+
+func TestOfflineAfterReconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		// resume resumes the session instead of starting a new one.
+		resume      bool
+		wantOffline bool
+	}{
+		// Offline messages are delivered again after the next
+		// initial presence.
+		{name: "new session", wantOffline: true},
+		// The server still considers us online.
+		{name: "resumed", resume: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := clock.NewMock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			defer clock.Set(mock)()
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.AllowReconnect = true
+			states := make(chan core.State, 16)
+			c.OnStateChange(func(old, new core.State) { states <- new })
+			if tt.resume {
+				s.Features = sm
+				c.StreamManagement = true
+			}
+			errc := make(chan error, 1)
+			go func() {
+				if err := s.Negotiate(); err != nil || !tt.resume {
+					errc <- err
+					return
+				}
+				s.NextElement()
+				errc <- s.Send("<enabled xmlns='urn:xmpp:sm:3' id='sess' resume='true'/>")
+			}()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.RegisterXEP("delay"); err != nil {
+				t.Fatal(err)
+			}
+			stanzas := xmpptest.Stanzas(c)
+
+			sendPresence(t, c, s, core.Presence{})
+			mock.Advance(time.Minute)
+			if offline(t, s, stanzas, "chat") {
+				t.Fatal("got offline message long after initial presence")
+			}
+
+			s.Conn.Close()
+			for state := range states {
+				if state == core.StateDisconnected {
+					break
+				}
+			}
+			conn2, s2 := xmpptest.Pipe()
+			defer s2.Conn.Close()
+			s2.StreamID = "second"
+			go func() {
+				if !tt.resume {
+					errc <- s2.Negotiate()
+					return
+				}
+				if _, err := s2.ReadStreamHeader(); err != nil {
+					errc <- err
+					return
+				}
+				s2.OpenStream("<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms>")
+				s2.NextElement()
+				s2.Send("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+				s2.RestartStream()
+				s2.OpenStream("<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>" + sm)
+				if e, err := s2.NextElement(); err != nil || e.XMLName.Local != "resume" {
+					errc <- fmt.Errorf("got <%s>, %v, want <resume/>", e.XMLName.Local, err)
+					return
+				}
+				errc <- s2.Send("<resumed xmlns='urn:xmpp:sm:3' previd='sess' h='1'/>")
+			}()
+			if errs := c.Reconnect(conn2); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if got := offline(t, s2, stanzas, "chat"); got != tt.wantOffline {
+				t.Errorf("got offline %t after reconnecting, want %t", got, tt.wantOffline)
+			}
+		})
+	}
+}
@@ -7,11 +7,24 @@ import (
 	"sync"
 )
 
+// DefaultIdentity is advertised if no other identity has been added.
+var DefaultIdentity = Identity{Category: "client", Type: "pc"}
+
 type Conn struct {
 	core.Client
 	sync.RWMutex
 	identities []Identity
 	features   []Feature
+	items      []Item
+	// nodes holds what is advertised for nodes other than the root,
+	// rootNodes the nodes that are answered like the root.
+	nodes     map[string]*node
+	rootNodes map[string]bool
+}
+
+type node struct {
+	info  Info
+	items []Item
 }
 
 func init() {
@@ -20,10 +33,15 @@ func init() {
 
 func wrap(c core.Client) (core.XEP, error) {
 	conn := &Conn{
-		Client: c,
+		Client:    c,
+		nodes:     make(map[string]*node),
+		rootNodes: make(map[string]bool),
 	}
 
 	conn.AddFeature("http://jabber.org/protocol/disco#info")
+	conn.AddFeature("http://jabber.org/protocol/disco#items")
+	c.HandleIQ("get", "http://jabber.org/protocol/disco#info", conn.handleInfo)
+	c.HandleIQ("get", "http://jabber.org/protocol/disco#items", conn.handleItems)
 
 	return conn, nil
 }
@@ -34,31 +52,162 @@ func (c *Conn) AddIdentity(id Identity) {
 	c.Unlock()
 }
 
+// AddFeature advertises a feature. XEP implementations that answer
+// requests should add their namespaces when they get registered.
+// Adding a feature more than once has no effect.
 func (c *Conn) AddFeature(f string) {
 	c.Lock()
+	defer c.Unlock()
+	for _, feature := range c.features {
+		if feature.Var == f {
+			return
+		}
+	}
 	c.features = append(c.features, Feature{f})
+}
+
+// AddItem adds an item that will be returned for disco#items
+// queries.
+func (c *Conn) AddItem(item Item) {
+	c.Lock()
+	c.items = append(c.items, item)
+	c.Unlock()
+}
+
+// SetNodeInfo sets the identities and features advertised for a
+// node, for example the node of an ad-hoc command. Queries for nodes
+// that haven't been set are answered with item-not-found.
+func (c *Conn) SetNodeInfo(name string, info Info) {
+	c.Lock()
+	c.node(name).info = info
+	c.Unlock()
+}
+
+// SetNodeItems sets the items returned for disco#items queries for a
+// node, for example the commands listed by the ad-hoc commands node.
+func (c *Conn) SetNodeItems(name string, items []Item) {
+	c.Lock()
+	c.node(name).items = items
+	c.Unlock()
+}
+
+// node returns the node with the given name, adding it if necessary.
+// The caller must hold the lock.
+func (c *Conn) node(name string) *node {
+	n, ok := c.nodes[name]
+	if !ok {
+		n = &node{}
+		c.nodes[name] = n
+	}
+	return n
+}
+
+// RemoveNode stops advertising a node set with SetNodeInfo or
+// SetNodeItems.
+func (c *Conn) RemoveNode(name string) {
+	c.Lock()
+	delete(c.nodes, name)
 	c.Unlock()
 }
 
+// AddRootNode makes queries for a node be answered with what is
+// advertised for the root, that is without a node. This is what
+// entity capabilities (XEP-0115) rely on.
+func (c *Conn) AddRootNode(name string) {
+	c.Lock()
+	c.rootNodes[name] = true
+	c.Unlock()
+}
+
+// lookup returns the node a query is for. root reports whether the
+// query is for the root, ok whether the node exists at all.
+func (c *Conn) lookup(iq *core.IQ) (name string, n node, root, ok bool) {
+	var query struct {
+		Node string `xml:"node,attr"`
+	}
+	xml.Unmarshal(iq.Inner, &query)
+
+	c.RLock()
+	defer c.RUnlock()
+	if query.Node == "" || c.rootNodes[query.Node] {
+		return query.Node, node{}, true, true
+	}
+	if n, ok := c.nodes[query.Node]; ok {
+		return query.Node, *n, false, true
+	}
+	return query.Node, node{}, false, false
+}
+
+var errItemNotFound = &core.Error{
+	Type:   "cancel",
+	Errors: core.XMPPErrors{core.ErrItemNotFound{}},
+}
+
+// AdvertisedIdentities returns the identities that are being advertised.
+func (c *Conn) AdvertisedIdentities() []Identity {
+	c.RLock()
+	defer c.RUnlock()
+	if len(c.identities) == 0 {
+		return []Identity{DefaultIdentity}
+	}
+	return append([]Identity(nil), c.identities...)
+}
+
+// AdvertisedFeatures returns the features that are being advertised.
+func (c *Conn) AdvertisedFeatures() []Feature {
+	c.RLock()
+	defer c.RUnlock()
+	return append([]Feature(nil), c.features...)
+}
+
 func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
-	// TODO support queries for items/item nodes
-	if iq, ok := stanza.(*core.IQ); ok {
-		if iq.Query.Space == "http://jabber.org/protocol/disco#info" && iq.Type == "get" {
-			// TODO support queries targetted at nodes
-			c.RLock()
-			c.SendIQReply(iq, "result", struct {
-				XMLName    xml.Name   `xml:"http://jabber.org/protocol/disco#info query"`
-				Identities []Identity `xml:"identity"`
-				Features   []Feature  `xml:"feature"`
-			}{
-				Identities: c.identities,
-				Features:   c.features,
-			})
-			c.RUnlock()
+	return nil, nil
+}
+
+func (c *Conn) handleInfo(iq *core.IQ) (interface{}, error) {
+	name, n, root, ok := c.lookup(iq)
+	if !ok {
+		return nil, errItemNotFound
+	}
+	if root {
+		n.info = Info{
+			Identities: c.AdvertisedIdentities(),
+			Features:   c.AdvertisedFeatures(),
 		}
 	}
 
-	return nil, nil
+	// The node has to be included in the reply.
+	return struct {
+		XMLName    xml.Name   `xml:"http://jabber.org/protocol/disco#info query"`
+		Node       string     `xml:"node,attr,omitempty"`
+		Identities []Identity `xml:"identity"`
+		Features   []Feature  `xml:"feature"`
+	}{
+		Node:       name,
+		Identities: n.info.Identities,
+		Features:   n.info.Features,
+	}, nil
+}
+
+func (c *Conn) handleItems(iq *core.IQ) (interface{}, error) {
+	name, n, root, ok := c.lookup(iq)
+	if !ok {
+		return nil, errItemNotFound
+	}
+	if root {
+		c.RLock()
+		n.items = append([]Item(nil), c.items...)
+		c.RUnlock()
+	}
+
+	return struct {
+		XMLName xml.Name `xml:"http://jabber.org/protocol/disco#items query"`
+		Node    string   `xml:"node,attr,omitempty"`
+		Items   []Item   `xml:"item"`
+	}{
+		Node:  name,
+		Items: n.items,
+	}, nil
 }
 
 type Info struct {
@@ -69,7 +218,7 @@ type Info struct {
 type Identity struct {
 	Category string `xml:"category,attr"`
 	Type     string `xml:"type,attr"`
-	Name     string `xml:"name,attr"`
+	Name     string `xml:"name,attr,omitempty"`
 }
 
 type Feature struct {
@@ -82,8 +231,8 @@ type items struct {
 
 type Item struct {
 	JID  string `xml:"jid,attr"`
-	Name string `xml:"name,attr"`
-	Node string `xml:"node,attr"`
+	Name string `xml:"name,attr,omitempty"`
+	Node string `xml:"node,attr,omitempty"`
 }
 
 // FIXME return error
@@ -100,6 +249,10 @@ func (c *Conn) GetInfoFromNode(to, node string) (Info, error) {
 func parseInfo(s *core.IQ) (Info, error) {
 	var result Info
 
+	if s == nil {
+		return result, core.ErrClosed
+	}
+
 	if s.IsError() {
 		return result, s.Error
 	}
@@ -140,6 +293,10 @@ func (c *Conn) GetItemsFromNode(to, node string) ([]Item, error) {
 func parseItems(s *core.IQ) ([]Item, error) {
 	var items items
 
+	if s == nil {
+		return items.Items, core.ErrClosed
+	}
+
 	if s.IsError() {
 		return items.Items, s.Error
 	}
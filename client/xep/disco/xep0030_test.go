@@ -0,0 +1,150 @@
+package disco_test
+
+import (
+	"honnef.co/go/xmpp/client/xep/disco"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"fmt"
+	"testing"
+)
+
+const commands = "http://jabber.org/protocol/commands"
+
+// reply is the query of a disco reply.
+type reply struct {
+	Node       string           `xml:"node,attr"`
+	Identities []disco.Identity `xml:"identity"`
+	Features   []disco.Feature  `xml:"feature"`
+	Items      []disco.Item     `xml:"item"`
+}
+
+func TestNodeQueries(t *testing.T) {
+	tests := []struct {
+		name string
+		// query is "info" or "items".
+		query string
+		node  string
+		// want summarizes the reply, or names the error condition.
+		want string
+	}{
+		{name: "root info", query: "info", want: "identities [client/pc] features [disco#info disco#items]"},
+		{name: "root items", query: "items", want: "items [room@muc.example.com]"},
+		{name: "commands info", query: "info", node: commands, want: "identities [automation/command-list] features [commands]"},
+		{name: "commands items", query: "items", node: commands, want: "items [alice@example.com/xmpptest#config]"},
+		{name: "command info", query: "info", node: "config", want: "identities [automation/command-node] features [commands jabber:x:data]"},
+		{name: "command without items", query: "items", node: "config", want: "items []"},
+		// Entity capabilities point contacts at a node that stands for
+		// the root.
+		{name: "caps node", query: "info", node: "https://example.org/client#ver", want: "identities [client/pc] features [disco#info disco#items]"},
+		{name: "unknown node", query: "info", node: "secret", want: "error item-not-found"},
+		{name: "unknown node items", query: "items", node: "secret", want: "error item-not-found"},
+		{name: "removed node", query: "info", node: "restart", want: "error item-not-found"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	x, err := c.RegisterXEP("disco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := x.(*disco.Conn)
+	xmpptest.Stanzas(c)
+
+	conn.AddItem(disco.Item{JID: "room@muc.example.com"})
+	conn.SetNodeInfo(commands, disco.Info{
+		Identities: []disco.Identity{{Category: "automation", Type: "command-list"}},
+		Features:   []disco.Feature{{Var: commands}},
+	})
+	conn.SetNodeItems(commands, []disco.Item{{JID: "alice@example.com/xmpptest", Node: "config", Name: "Configure"}})
+	conn.SetNodeInfo("config", disco.Info{
+		Identities: []disco.Identity{{Category: "automation", Type: "command-node"}},
+		Features:   []disco.Feature{{Var: commands}, {Var: "jabber:x:data"}},
+	})
+	conn.SetNodeInfo("restart", disco.Info{Features: []disco.Feature{{Var: commands}}})
+	conn.RemoveNode("restart")
+	conn.AddRootNode("https://example.org/client#ver")
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := fmt.Sprintf("q%d", i)
+			node := ""
+			if tt.node != "" {
+				node = " node='" + tt.node + "'"
+			}
+			s.Sendf("<iq xmlns='jabber:client' type='get' id='%s' from='bob@example.com/phone'><query xmlns='http://jabber.org/protocol/disco#%s'%s/></iq>",
+				id, tt.query, node)
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Attribute("id") != id {
+				t.Fatalf("got reply %v, want one to %s", e.Attr, id)
+			}
+
+			if e.Attribute("type") == "error" {
+				var v struct {
+					Error struct {
+						Condition struct {
+							XMLName xml.Name
+						} `xml:",any"`
+					} `xml:"error"`
+				}
+				xml.Unmarshal([]byte("<iq>"+string(e.Inner)+"</iq>"), &v)
+				got := "error " + v.Error.Condition.XMLName.Local
+				if got != tt.want {
+					t.Errorf("got %s, want %s", got, tt.want)
+				}
+				return
+			}
+
+			var got reply
+			if err := xml.Unmarshal(e.Inner, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Node != tt.node {
+				t.Errorf("got reply for node %q, want %q", got.Node, tt.node)
+			}
+			if summary := summarize(tt.query, got); summary != tt.want {
+				t.Errorf("got %s, want %s", summary, tt.want)
+			}
+		})
+	}
+}
+
+// summarize describes a disco reply, abbreviating the disco
+// namespaces.
+func summarize(query string, r reply) string {
+	if query == "items" {
+		items := []string{}
+		for _, item := range r.Items {
+			s := item.JID
+			if item.Node != "" {
+				s += "#" + item.Node
+			}
+			items = append(items, s)
+		}
+		return fmt.Sprintf("items %v", items)
+	}
+
+	var identities, features []string
+	for _, id := range r.Identities {
+		identities = append(identities, id.Category+"/"+id.Type)
+	}
+	for _, f := range r.Features {
+		switch f.Var {
+		case "http://jabber.org/protocol/disco#info":
+			features = append(features, "disco#info")
+		case "http://jabber.org/protocol/disco#items":
+			features = append(features, "disco#items")
+		case commands:
+			features = append(features, "commands")
+		default:
+			features = append(features, f.Var)
+		}
+	}
+	return fmt.Sprintf("identities %v features %v", identities, features)
+}
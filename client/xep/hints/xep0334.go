@@ -0,0 +1,72 @@
+// Package hints implements XEP-0334 (Message Processing Hints).
+//
+// Hints tell servers and clients how to treat a message, for example
+// that it is transient and mustn't be archived. They are only
+// advisory. Outgoing hints can also be attached with the Hints option
+// of im.MessageOptions.
+package hints
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"encoding/xml"
+)
+
+const ns = "urn:xmpp:hints"
+
+// The hints.
+const (
+	// NoPermanentStore asks not to archive the message, while still
+	// allowing it to be stored for later delivery.
+	NoPermanentStore = "no-permanent-store"
+	// NoStore asks not to store the message at all, neither in
+	// archives nor for offline delivery.
+	NoStore = "no-store"
+	// NoCopy asks not to copy the message to other resources, for
+	// example with carbons (XEP-0280).
+	NoCopy = "no-copy"
+	// Store asks to store the message even if it would usually not
+	// be stored, like a message without a body.
+	Store = "store"
+)
+
+type hint struct {
+	XMLName xml.Name
+}
+
+// Add attaches hints to an outgoing message, skipping those it has
+// already.
+func Add(m *core.Message, hints ...string) {
+	for _, h := range hints {
+		if !Has(m, h) {
+			m.Inner, _ = core.AppendPayload(m.Inner, hint{xml.Name{Space: ns, Local: h}})
+		}
+	}
+}
+
+// Has reports whether a message carries a hint.
+func Has(m *core.Message, h string) bool {
+	return core.HasPayload(m.Inner, ns, h)
+}
+
+// Get returns all hints of a message.
+func Get(m *core.Message) []string {
+	var out []string
+	for _, name := range core.PayloadNames(m.Inner) {
+		if name.Space == ns {
+			out = append(out, name.Local)
+		}
+	}
+	return out
+}
+
+// Storable reports whether a received message may be stored
+// permanently, for example in a local history. Messages with a body
+// are, unless they carry NoStore or NoPermanentStore; other messages
+// only if they carry Store.
+func Storable(m *core.Message) bool {
+	if Has(m, NoStore) || Has(m, NoPermanentStore) {
+		return false
+	}
+	return m.Body != "" || Has(m, Store)
+}
@@ -0,0 +1,114 @@
+package hints_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/hints"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReceivedHints(t *testing.T) {
+	tests := []struct {
+		name         string
+		inner        string
+		want         []string
+		wantStorable bool
+	}{
+		{name: "none", inner: "<body>hi</body>", wantStorable: true},
+		{name: "no-store", inner: "<body>hi</body><no-store xmlns='urn:xmpp:hints'/>", want: []string{hints.NoStore}},
+		{name: "no-permanent-store", inner: "<body>hi</body><no-permanent-store xmlns='urn:xmpp:hints'/>", want: []string{hints.NoPermanentStore}},
+		{name: "no-copy", inner: "<body>hi</body><no-copy xmlns='urn:xmpp:hints'/>", want: []string{hints.NoCopy}, wantStorable: true},
+		{name: "store without body", inner: "<store xmlns='urn:xmpp:hints'/>", want: []string{hints.Store}, wantStorable: true},
+		{name: "without body", inner: "<active xmlns='http://jabber.org/protocol/chatstates'/>"},
+		{
+			name:  "several",
+			inner: "<body>hi</body><no-copy xmlns='urn:xmpp:hints'/><active xmlns='http://jabber.org/protocol/chatstates'/><no-store xmlns='urn:xmpp:hints'/>",
+			want:  []string{hints.NoCopy, hints.NoStore},
+		},
+		// Only elements in the hints namespace are hints.
+		{name: "other namespace", inner: "<body>hi</body><no-store xmlns='urn:example:other'/>", wantStorable: true},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Sendf("<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'>%s</message>", tt.inner)
+			var m *core.Message
+			select {
+			case stanza := <-stanzas:
+				m = stanza.(*core.Message)
+			case <-time.After(5 * time.Second):
+				t.Fatal("message wasn't delivered")
+			}
+
+			if got := hints.Get(m); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got hints %v, want %v", got, tt.want)
+			}
+			for _, h := range tt.want {
+				if !hints.Has(m, h) {
+					t.Errorf("Has(%s) = false", h)
+				}
+			}
+			if got := hints.Storable(m); got != tt.wantStorable {
+				t.Errorf("got storable %t, want %t", got, tt.wantStorable)
+			}
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		inner string
+		add   []string
+		want  []string
+	}{
+		{name: "one", add: []string{hints.NoStore}, want: []string{hints.NoStore}},
+		{name: "several", add: []string{hints.NoCopy, hints.NoPermanentStore}, want: []string{hints.NoCopy, hints.NoPermanentStore}},
+		{name: "repeated", add: []string{hints.Store, hints.Store}, want: []string{hints.Store}},
+		{
+			name:  "already present",
+			inner: "<no-copy xmlns='urn:xmpp:hints'/>",
+			add:   []string{hints.NoCopy, hints.NoStore},
+			want:  []string{hints.NoCopy, hints.NoStore},
+		},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := core.Message{Header: core.Header{To: "bob@example.com", Type: "chat"}, Body: "hi", Inner: []byte(tt.inner)}
+			hints.Add(&m, tt.add...)
+
+			// The hints have to survive being sent.
+			errc := make(chan error, 1)
+			go func() { errc <- c.Encode(m) }()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			sent := &core.Message{Inner: e.Inner}
+			if got := hints.Get(sent); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent hints %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
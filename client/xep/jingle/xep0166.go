@@ -0,0 +1,291 @@
+// Package jingle implements the signaling of XEP-0166 (Jingle).
+//
+// Jingle negotiates sessions, like calls or file transfers, between
+// two entities. This package handles session IDs, the dispatch of
+// actions and the acknowledgement of requests. Application formats
+// and transports, like RTP or SOCKS5 bytestreams, are defined by
+// other XEPs; their descriptions and transports are passed through as
+// opaque Elements.
+//
+// Every Jingle request received for a known session, or a new session
+// being initiated, is delivered as a synthetic Request stanza. The
+// request has already been acknowledged.
+package jingle
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"sync"
+)
+
+const ns = "urn:xmpp:jingle:1"
+
+// Actions defined by XEP-0166.
+const (
+	ContentAccept    = "content-accept"
+	ContentAdd       = "content-add"
+	ContentModify    = "content-modify"
+	ContentReject    = "content-reject"
+	ContentRemove    = "content-remove"
+	DescriptionInfo  = "description-info"
+	SecurityInfo     = "security-info"
+	SessionAccept    = "session-accept"
+	SessionInfo      = "session-info"
+	SessionInitiate  = "session-initiate"
+	SessionTerminate = "session-terminate"
+	TransportAccept  = "transport-accept"
+	TransportInfo    = "transport-info"
+	TransportReject  = "transport-reject"
+	TransportReplace = "transport-replace"
+)
+
+// Reasons for terminating a session.
+const (
+	ReasonBusy                    = "busy"
+	ReasonCancel                  = "cancel"
+	ReasonDecline                 = "decline"
+	ReasonGeneralError            = "general-error"
+	ReasonSuccess                 = "success"
+	ReasonTimeout                 = "timeout"
+	ReasonUnsupportedApplications = "unsupported-applications"
+	ReasonUnsupportedTransports   = "unsupported-transports"
+)
+
+// Element is an XML element whose content isn't interpreted by this
+// package, like an application description or a transport.
+type Element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+func (e *Element) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		Inner []byte `xml:",innerxml"`
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+
+	e.XMLName = start.Name
+	e.Inner = raw.Inner
+	e.Attrs = nil
+	for _, attr := range start.Attr {
+		// The default namespace is reproduced from XMLName when
+		// marshaling.
+		if attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+			continue
+		}
+		e.Attrs = append(e.Attrs, attr)
+	}
+	return nil
+}
+
+type Content struct {
+	Creator     string   `xml:"creator,attr"`
+	Name        string   `xml:"name,attr"`
+	Senders     string   `xml:"senders,attr,omitempty"`
+	Description *Element `xml:"description,omitempty"`
+	Transport   *Element `xml:"transport,omitempty"`
+}
+
+type Reason struct {
+	Condition struct {
+		XMLName xml.Name
+	} `xml:",any"`
+	Text string `xml:"text,omitempty"`
+}
+
+// Jingle is the <jingle/> element carried by every Jingle request.
+type Jingle struct {
+	XMLName   xml.Name  `xml:"urn:xmpp:jingle:1 jingle"`
+	Action    string    `xml:"action,attr"`
+	Initiator string    `xml:"initiator,attr,omitempty"`
+	Responder string    `xml:"responder,attr,omitempty"`
+	SID       string    `xml:"sid,attr"`
+	Contents  []Content `xml:"content"`
+	Reason    *Reason   `xml:"reason,omitempty"`
+}
+
+// Session is a Jingle session with a peer.
+type Session struct {
+	SID  string
+	Peer string
+	// Initiator reports whether we initiated the session.
+	Initiator bool
+	// Active reports whether the session has been accepted.
+	Active bool
+}
+
+// Request is emitted for every received Jingle request.
+type Request struct {
+	*core.IQ
+	Session *Session
+	Jingle  Jingle
+}
+
+type unknownSession struct {
+	XMLName xml.Name `xml:"urn:xmpp:jingle:errors:1 unknown-session"`
+}
+
+func (e unknownSession) Name() xml.Name { return e.XMLName }
+func (unknownSession) Text() string     { return "" }
+
+type Conn struct {
+	core.Client
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func init() {
+	core.RegisterXEP("jingle", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client:   c,
+		sessions: make(map[string]*Session),
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+	// Jingle requests are emitted as Request stanzas by Process.
+	c.DeliverIQ("set", ns)
+
+	return conn, nil
+}
+
+func newSID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Session returns the session with the given ID.
+func (c *Conn) Session(sid string) (*Session, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.sessions[sid]
+	return s, ok
+}
+
+// send sends a Jingle request and waits for it to be acknowledged.
+func (c *Conn) send(s *Session, j Jingle) error {
+	j.SID = s.SID
+	ch, _ := c.SendIQ(s.Peer, "set", j)
+	res := <-ch
+	if res == nil {
+		return core.ErrClosed
+	}
+	if res.IsError() {
+		return res.Error
+	}
+	return nil
+}
+
+// InitiateSession starts a new session with to, offering the given
+// contents. The session becomes active once the peer accepts it,
+// which will be delivered as a Request with the session-accept
+// action.
+func (c *Conn) InitiateSession(to string, contents []Content) (*Session, error) {
+	s := &Session{
+		SID:       newSID(),
+		Peer:      to,
+		Initiator: true,
+	}
+
+	c.mu.Lock()
+	c.sessions[s.SID] = s
+	c.mu.Unlock()
+
+	err := c.send(s, Jingle{
+		Action:    SessionInitiate,
+		Initiator: c.JID(),
+		Contents:  contents,
+	})
+	if err != nil {
+		c.forget(s)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// AcceptSession accepts a session initiated by the peer.
+func (c *Conn) AcceptSession(s *Session, contents []Content) error {
+	err := c.send(s, Jingle{
+		Action:    SessionAccept,
+		Responder: c.JID(),
+		Contents:  contents,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	s.Active = true
+	c.mu.Unlock()
+	return nil
+}
+
+// TerminateSession ends a session, or declines it if it hasn't been
+// accepted yet. reason should be one of the Reason constants.
+func (c *Conn) TerminateSession(s *Session, reason string) error {
+	j := Jingle{Action: SessionTerminate}
+	if reason != "" {
+		j.Reason = &Reason{}
+		j.Reason.Condition.XMLName.Local = reason
+	}
+
+	c.forget(s)
+	return c.send(s, j)
+}
+
+// Send sends an arbitrary action, like transport-info, for a session.
+func (c *Conn) Send(s *Session, action string, contents []Content) error {
+	return c.send(s, Jingle{Action: action, Contents: contents})
+}
+
+func (c *Conn) forget(s *Session) {
+	c.mu.Lock()
+	delete(c.sessions, s.SID)
+	c.mu.Unlock()
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	iq, ok := stanza.(*core.IQ)
+	if !ok || iq.Type != "set" {
+		return nil, nil
+	}
+
+	var j Jingle
+	found, err := core.DecodePayload(iq.Inner, ns, "jingle", &j)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	s, known := c.sessions[j.SID]
+	switch {
+	case j.Action == SessionInitiate && !known:
+		s = &Session{SID: j.SID, Peer: iq.From}
+		c.sessions[s.SID] = s
+	case !known || s.Peer != iq.From:
+		c.mu.Unlock()
+		c.SendError(iq, "cancel", "", core.ErrItemNotFound{}, unknownSession{})
+		return nil, nil
+	case j.Action == SessionAccept:
+		s.Active = true
+	case j.Action == SessionTerminate:
+		delete(c.sessions, s.SID)
+	}
+	c.mu.Unlock()
+
+	c.SendIQReply(iq, "result", nil)
+	return []core.Stanza{&Request{iq, s, j}}, nil
+}
@@ -0,0 +1,88 @@
+package jingle_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/jingle"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequests(t *testing.T) {
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Jingle requests must reach Process even though no handler is
+	// registered for them.
+	if _, err := c.RegisterXEP("jingle"); err != nil {
+		t.Fatal(err)
+	}
+	stanzas := xmpptest.Stanzas(c)
+
+	// The steps share a connection and build on each other.
+	steps := []struct {
+		name   string
+		from   string
+		action string
+		sid    string
+		// condition is the expected error condition, or empty if
+		// the request has to be acknowledged and emitted.
+		condition string
+	}{
+		{name: "initiate", from: "bob@example.com/phone", action: jingle.SessionInitiate, sid: "s1"},
+		{name: "info", from: "bob@example.com/phone", action: jingle.TransportInfo, sid: "s1"},
+		{name: "unknown session", from: "bob@example.com/phone", action: jingle.TransportInfo, sid: "s2", condition: "unknown-session"},
+		{name: "other peer", from: "mallory@example.com/pc", action: jingle.SessionTerminate, sid: "s1", condition: "unknown-session"},
+		{name: "terminate", from: "bob@example.com/phone", action: jingle.SessionTerminate, sid: "s1"},
+		{name: "terminated", from: "bob@example.com/phone", action: jingle.TransportInfo, sid: "s1", condition: "unknown-session"},
+	}
+
+	for i, step := range steps {
+		id := fmt.Sprintf("j%d", i)
+		s.Sendf("<iq xmlns='jabber:client' type='set' id='%s' from='%s'>"+
+			"<jingle xmlns='urn:xmpp:jingle:1' action='%s' sid='%s'/></iq>",
+			id, step.from, step.action, step.sid)
+
+		reply, err := s.NextElement()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Attribute("id") != id {
+			t.Fatalf("%s: got reply to %q, want %q", step.name, reply.Attribute("id"), id)
+		}
+		if step.condition != "" {
+			if reply.Attribute("type") != "error" || !strings.Contains(string(reply.Inner), step.condition) {
+				t.Errorf("%s: got %s, want a %s error", step.name, reply.Inner, step.condition)
+			}
+			continue
+		}
+		if reply.Attribute("type") != "result" {
+			t.Fatalf("%s: got %s reply %s", step.name, reply.Attribute("type"), reply.Inner)
+		}
+
+		req := nextRequest(t, stanzas)
+		if req.Jingle.Action != step.action || req.Session.SID != step.sid || req.Session.Peer != step.from {
+			t.Errorf("%s: got request %+v for session %+v", step.name, req.Jingle, req.Session)
+		}
+	}
+}
+
+func nextRequest(t *testing.T, stanzas <-chan core.Stanza) *jingle.Request {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case stanza := <-stanzas:
+			if req, ok := stanza.(*jingle.Request); ok {
+				return req
+			}
+		case <-timeout:
+			t.Fatal("no request emitted")
+		}
+	}
+}
@@ -34,6 +34,10 @@ func wrap(c core.Client) (core.XEP, error) {
 
 	discovery := conn.MustGetXEP("disco").(*disco.Conn)
 	discovery.AddFeature("jabber:iq:last")
+	// Queries are emitted as LastActivityRequest, for the application
+	// to answer. This replaces the handler of the standard
+	// responders, if they have been enabled before.
+	c.DeliverIQ("get", "jabber:iq:last")
 
 	return conn, nil
 }
@@ -62,11 +66,20 @@ func Reply(t *LastActivityRequest, seconds uint64) {
 // of the returned values depends on whether the entity is an account,
 // resource or service.
 func (c *Conn) Query(who string) (seconds uint64, text string, err error) {
+	return Query(c, who)
+}
+
+// Query sends a Last Activity query to an entity, without requiring
+// the XEP to be registered.
+func Query(c core.Client, who string) (seconds uint64, text string, err error) {
 	ch, _ := c.SendIQ(who, "get", struct {
 		XMLName xml.Name `xml:"jabber:iq:last query"`
 	}{})
 
 	res := <-ch
+	if res == nil {
+		return 0, "", core.ErrClosed
+	}
 	if res.IsError() {
 		return 0, "", res.Error
 	}
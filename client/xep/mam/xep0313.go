@@ -0,0 +1,335 @@
+// Package mam implements XEP-0313 (Message Archive Management).
+//
+// The archive is queried a page at a time with Query, using Result Set
+// Management (XEP-0059) for paging. GetRecentMessages covers the
+// common case of showing the latest history of a conversation.
+package mam
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ns    = "urn:xmpp:mam:2"
+	nsRSM = "http://jabber.org/protocol/rsm"
+)
+
+// Default archiving policies.
+const (
+	Always = "always"
+	Never  = "never"
+	Roster = "roster"
+)
+
+var ErrInvalidDefault = errors.New("xmpp: default archiving policy must be always, never or roster")
+
+type Conn struct {
+	core.Client
+
+	mu sync.Mutex
+	// queries maps the IDs of running queries to the messages
+	// received for them so far.
+	queries map[string][]ArchivedMessage
+}
+
+func init() {
+	core.RegisterXEP("mam", wrap, "dataforms")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client:  c,
+		queries: make(map[string][]ArchivedMessage),
+	}
+
+	c.AddFilter(conn.collect)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
+
+// Prefs are the archiving preferences stored by the server.
+type Prefs struct {
+	// Default is the policy for JIDs that aren't listed in Always
+	// or Never. It is one of Always, Never and Roster.
+	Default string
+	// Always lists JIDs whose messages are always archived.
+	Always []string
+	// Never lists JIDs whose messages are never archived.
+	Never []string
+}
+
+type jidList struct {
+	JIDs []string `xml:"jid"`
+}
+
+type prefs struct {
+	XMLName xml.Name `xml:"urn:xmpp:mam:2 prefs"`
+	Default string   `xml:"default,attr,omitempty"`
+	Always  *jidList `xml:"always"`
+	Never   *jidList `xml:"never"`
+}
+
+func parsePrefs(res *core.IQ) (Prefs, error) {
+	if res == nil {
+		return Prefs{}, core.ErrClosed
+	}
+	if res.IsError() {
+		return Prefs{}, res.Error
+	}
+
+	var p prefs
+	if err := xml.Unmarshal(res.Inner, &p); err != nil {
+		return Prefs{}, err
+	}
+
+	out := Prefs{Default: p.Default}
+	if p.Always != nil {
+		out.Always = p.Always.JIDs
+	}
+	if p.Never != nil {
+		out.Never = p.Never.JIDs
+	}
+	return out, nil
+}
+
+// GetArchivePrefs retrieves the archiving preferences.
+func (c *Conn) GetArchivePrefs() (Prefs, error) {
+	ch, _ := c.SendIQ("", "get", prefs{})
+	return parsePrefs(<-ch)
+}
+
+// SetArchivePrefs sets the archiving preferences. def is the default
+// policy and has to be one of Always, Never and Roster. always and
+// never override the default for specific JIDs. The returned
+// preferences are those stored by the server, which might differ
+// from the requested ones.
+func (c *Conn) SetArchivePrefs(def string, always, never []string) (Prefs, error) {
+	switch def {
+	case Always, Never, Roster:
+	default:
+		return Prefs{}, ErrInvalidDefault
+	}
+
+	ch, _ := c.SendIQ("", "set", prefs{
+		Default: def,
+		Always:  &jidList{always},
+		Never:   &jidList{never},
+	})
+	return parsePrefs(<-ch)
+}
+
+// ArchivedMessage is a message retrieved from the archive.
+type ArchivedMessage struct {
+	*core.Message
+	// ID is the archive's ID of the message, which identifies it when
+	// paging.
+	ID string
+	// Stamp is the time the message has been archived.
+	Stamp time.Time
+}
+
+// Query selects messages from the archive. All fields are optional.
+type Query struct {
+	// With restricts the results to a conversation with a JID.
+	With string
+	// Start and End restrict the results to a period of time.
+	Start time.Time
+	End   time.Time
+
+	// Max is the maximum number of messages to return. Servers
+	// return fewer if they limit the page size. Zero leaves the page
+	// size up to the server.
+	Max int
+	// After requests the page after the message with this archive
+	// ID.
+	After string
+	// Before requests the page before the message with this archive
+	// ID. If Backward is set and Before is empty, the last page is
+	// requested.
+	Before   string
+	Backward bool
+}
+
+// Page is a page of query results.
+type Page struct {
+	// Messages are in chronological order, whether paging forward or
+	// backward.
+	Messages []ArchivedMessage
+	// First and Last are the archive IDs of the first and last
+	// message, for requesting the adjacent pages.
+	First string
+	Last  string
+	// Complete reports whether this is the last page in the
+	// direction of paging: the oldest when paging backward, the
+	// newest otherwise.
+	Complete bool
+}
+
+type rsmSet struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rsm set"`
+	Max     *int     `xml:"max"`
+	After   *string  `xml:"after"`
+	Before  *string  `xml:"before"`
+	First   string   `xml:"first,omitempty"`
+	Last    string   `xml:"last,omitempty"`
+}
+
+type query struct {
+	XMLName xml.Name        `xml:"urn:xmpp:mam:2 query"`
+	QueryID string          `xml:"queryid,attr"`
+	Form    *dataforms.Form `xml:"x"`
+	Set     *rsmSet
+}
+
+type fin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete bool     `xml:"complete,attr"`
+	Set      rsmSet
+}
+
+type result struct {
+	QueryID   string `xml:"queryid,attr"`
+	ID        string `xml:"id,attr"`
+	Forwarded struct {
+		Delay struct {
+			Stamp string `xml:"stamp,attr"`
+		} `xml:"urn:xmpp:delay delay"`
+		Message *core.Message `xml:"jabber:client message"`
+	} `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// collect takes the results of our queries out of the stream.
+func (c *Conn) collect(stanza core.Stanza) bool {
+	msg, ok := stanza.(*core.Message)
+	if !ok {
+		return true
+	}
+	var v result
+	found, err := core.DecodePayload(msg.Inner, ns, "result", &v)
+	if err != nil || !found {
+		return true
+	}
+	// Only our own archive may answer our queries, anything else is
+	// an attempt at injecting messages.
+	if msg.From != "" && msg.From != bare(c.JID()) {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results, ok := c.queries[v.QueryID]
+	if !ok || v.Forwarded.Message == nil {
+		return true
+	}
+	stamp, _ := xmpptime.ParseDateTime(v.Forwarded.Delay.Stamp)
+	c.queries[v.QueryID] = append(results, ArchivedMessage{
+		Message: v.Forwarded.Message,
+		ID:      v.ID,
+		Stamp:   stamp,
+	})
+	return false
+}
+
+// Query retrieves a page of messages from our archive.
+func (c *Conn) Query(q Query) (Page, error) {
+	form := dataforms.NewSubmitForm(ns)
+	if q.With != "" {
+		form.Set("with", q.With)
+	}
+	if !q.Start.IsZero() {
+		form.Set("start", xmpptime.FormatDateTime(q.Start))
+	}
+	if !q.End.IsZero() {
+		form.Set("end", xmpptime.FormatDateTime(q.End))
+	}
+
+	set := &rsmSet{}
+	if q.Max > 0 {
+		set.Max = &q.Max
+	}
+	if q.After != "" {
+		set.After = &q.After
+	}
+	if q.Before != "" || q.Backward {
+		set.Before = &q.Before
+	}
+
+	id := c.NewID()
+	c.mu.Lock()
+	c.queries[id] = []ArchivedMessage{}
+	c.mu.Unlock()
+
+	ch, _ := c.SendIQ("", "set", query{QueryID: id, Form: form, Set: set})
+	res := <-ch
+
+	// The results arrive before the reply to the query.
+	c.mu.Lock()
+	messages := c.queries[id]
+	delete(c.queries, id)
+	c.mu.Unlock()
+
+	if res == nil {
+		return Page{}, core.ErrClosed
+	}
+	if res.IsError() {
+		return Page{}, res.Error
+	}
+
+	var v fin
+	if err := xml.Unmarshal(res.Inner, &v); err != nil {
+		return Page{}, err
+	}
+	return Page{
+		Messages: messages,
+		First:    v.Set.First,
+		Last:     v.Set.Last,
+		Complete: v.Complete,
+	}, nil
+}
+
+// GetRecentMessages returns up to the last n messages exchanged with
+// a JID, oldest first. Fewer messages are returned if the history is
+// shorter. If the server's page size is smaller than n, as many pages
+// as necessary are requested.
+func (c *Conn) GetRecentMessages(with string, n int) ([]ArchivedMessage, error) {
+	var messages []ArchivedMessage
+	q := Query{With: with, Backward: true}
+	for len(messages) < n {
+		q.Max = n - len(messages)
+		page, err := c.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Messages) > q.Max {
+			// Don't trust the server to honour the limit.
+			page.Messages = page.Messages[len(page.Messages)-q.Max:]
+		}
+		// Pages are in chronological order, and each is older than
+		// the ones before it.
+		messages = append(page.Messages, messages...)
+		if page.Complete || len(page.Messages) == 0 || page.First == "" {
+			break
+		}
+		q.Before = page.First
+	}
+	return messages, nil
+}
+
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	return jid
+}
@@ -0,0 +1,168 @@
+package mam_test
+
+import (
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xep/mam"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// request is a MAM query as received by the archive.
+type request struct {
+	QueryID string         `xml:"queryid,attr"`
+	Form    dataforms.Form `xml:"jabber:x:data x"`
+	Set     struct {
+		Max    *int    `xml:"max"`
+		Before *string `xml:"before"`
+	} `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+// archive answers backward queries for the conversation with bob,
+// whose messages are numbered from 1 to size.
+type archive struct {
+	size int
+	// pageSize limits the number of results per page, if non-zero.
+	pageSize int
+	// ignoreMax returns pageSize results regardless of the requested
+	// maximum.
+	ignoreMax bool
+}
+
+func (a archive) serve(s *xmpptest.Server, befores chan<- string) error {
+	for {
+		iq, err := s.NextElement()
+		if err != nil {
+			return nil
+		}
+		var req request
+		if err := xml.Unmarshal(iq.Inner, &req); err != nil {
+			return err
+		}
+		if req.Form.Get("with") != "bob@example.com" || req.Set.Before == nil || req.Set.Max == nil {
+			return fmt.Errorf("got %s, want a backward query for bob@example.com with a maximum", iq.Inner)
+		}
+		befores <- *req.Set.Before
+
+		end := a.size
+		if *req.Set.Before != "" {
+			end, _ = strconv.Atoi(*req.Set.Before)
+			end--
+		}
+		n := *req.Set.Max
+		if a.pageSize != 0 && (n > a.pageSize || a.ignoreMax) {
+			n = a.pageSize
+		}
+		start := end - n
+		if start < 0 {
+			start = 0
+		}
+
+		for i := start + 1; i <= end; i++ {
+			s.Sendf("<message xmlns='jabber:client' from='alice@example.com'><result xmlns='urn:xmpp:mam:2' queryid='%s' id='%d'>"+
+				"<forwarded xmlns='urn:xmpp:forward:0'><delay xmlns='urn:xmpp:delay' stamp='2024-01-01T00:%02d:00Z'/>"+
+				"<message xmlns='jabber:client' from='bob@example.com/phone' to='alice@example.com' type='chat'><body>%d</body></message>"+
+				"</forwarded></result></message>", req.QueryID, i, i, i)
+		}
+		set := ""
+		if end > start {
+			set = fmt.Sprintf("<first>%d</first><last>%d</last>", start+1, end)
+		}
+		s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'><fin xmlns='urn:xmpp:mam:2' complete='%t'>"+
+			"<set xmlns='http://jabber.org/protocol/rsm'>%s</set></fin></iq>", iq.Attribute("id"), start == 0, set)
+	}
+}
+
+func TestGetRecentMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive archive
+		n       int
+		want    []string
+		// wantBefores are the pages requested, by the message they
+		// precede.
+		wantBefores []string
+	}{
+		{name: "one page", archive: archive{size: 5}, n: 3, want: []string{"3", "4", "5"}, wantBefores: []string{""}},
+		{
+			name:        "server page size",
+			archive:     archive{size: 10, pageSize: 3},
+			n:           7,
+			want:        []string{"4", "5", "6", "7", "8", "9", "10"},
+			wantBefores: []string{"", "8", "5"},
+		},
+		{name: "short history", archive: archive{size: 2}, n: 5, want: []string{"1", "2"}, wantBefores: []string{""}},
+		{name: "whole history", archive: archive{size: 4, pageSize: 2}, n: 4, want: []string{"1", "2", "3", "4"}, wantBefores: []string{"", "3"}},
+		{name: "empty", archive: archive{}, n: 5, wantBefores: []string{""}},
+		{
+			name:        "maximum ignored",
+			archive:     archive{size: 10, pageSize: 5, ignoreMax: true},
+			n:           3,
+			want:        []string{"8", "9", "10"},
+			wantBefores: []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("mam")
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			befores := make(chan string, 16)
+			errc := make(chan error, 1)
+			go func() {
+				err := tt.archive.serve(s, befores)
+				if err != nil {
+					// Unblock the client.
+					s.Conn.Close()
+				}
+				errc <- err
+			}()
+
+			messages, err := x.(*mam.Conn).GetRecentMessages("bob@example.com", tt.n)
+			s.Close()
+			if e := <-errc; e != nil {
+				t.Fatal(e)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for i, m := range messages {
+				got = append(got, m.Body)
+				if m.ID != m.Body || m.From != "bob@example.com/phone" {
+					t.Errorf("message %d has ID %s and is from %s", i, m.ID, m.From)
+				}
+				n, _ := strconv.Atoi(m.Body)
+				if want := time.Date(2024, 1, 1, 0, n, 0, 0, time.UTC); !m.Stamp.Equal(want) {
+					t.Errorf("message %d has stamp %v, want %v", i, m.Stamp, want)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got messages %v, want %v", got, tt.want)
+			}
+			close(befores)
+			var gotBefores []string
+			for before := range befores {
+				gotBefores = append(gotBefores, before)
+			}
+			if !reflect.DeepEqual(gotBefores, tt.wantBefores) {
+				t.Errorf("requested pages before %q, want %q", gotBefores, tt.wantBefores)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Package markers implements XEP-0333 (Chat Markers).
+//
+// Chat markers tell the sender of a message that it has been
+// received, displayed or acknowledged by the user. Unlike delivery
+// receipts, they reflect what the user has seen.
+//
+// Marking is opt-in per message: Outgoing messages have to be made
+// markable with Markable, and markers must only be sent for messages
+// that are markable. Inbound markers are delivered as synthetic
+// MarkerEvent stanzas.
+package markers
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+const ns = "urn:xmpp:chat-markers:0"
+
+var ErrNotMarkable = errors.New("xmpp: message is not markable")
+
+type Marker string
+
+const (
+	Received     Marker = "received"
+	Displayed    Marker = "displayed"
+	Acknowledged Marker = "acknowledged"
+)
+
+type Conn struct {
+	core.Client
+}
+
+// MarkerEvent is emitted when a chat marker has been received.
+type MarkerEvent struct {
+	*core.Message
+	Marker Marker
+	// MessageID is the ID of the message that has been marked.
+	MessageID string
+}
+
+type markable struct {
+	XMLName xml.Name `xml:"urn:xmpp:chat-markers:0 markable"`
+}
+
+type marker struct {
+	XMLName xml.Name
+	ID      string `xml:"id,attr"`
+}
+
+func init() {
+	core.RegisterXEP("markers", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+// Markable makes an outgoing message markable, allowing the recipient
+// to send chat markers for it. The message needs an ID for markers to
+// be useful.
+func Markable(m *core.Message) {
+	if IsMarkable(m) {
+		return
+	}
+	m.Inner, _ = core.AppendPayload(m.Inner, markable{})
+}
+
+// IsMarkable reports whether markers may be sent for a message.
+func IsMarkable(m *core.Message) bool {
+	return core.HasPayload(m.Inner, ns, "markable")
+}
+
+// Mark sends a chat marker for a markable message.
+func (c *Conn) Mark(orig *core.Message, m Marker) error {
+	if !IsMarkable(orig) {
+		return ErrNotMarkable
+	}
+
+	to := orig.From
+	if orig.Type == "groupchat" {
+		// Markers in rooms are sent to the room, not the occupant.
+		if i := strings.Index(to, "/"); i >= 0 {
+			to = to[:i]
+		}
+	}
+
+	msg := core.Message{
+		Header: core.Header{
+			To:   to,
+			Type: orig.Type,
+		},
+		Thread: orig.Thread,
+	}
+	msg.Inner, _ = core.AppendPayload(nil, marker{
+		XMLName: xml.Name{Space: ns, Local: string(m)},
+		ID:      orig.Id,
+	})
+
+	return c.Encode(msg)
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok {
+		return nil, nil
+	}
+
+	for _, m := range []Marker{Received, Displayed, Acknowledged} {
+		var v marker
+		found, err := core.DecodePayload(msg.Inner, ns, string(m), &v)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return []core.Stanza{&MarkerEvent{msg, m, v.ID}}, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,191 @@
+package markers_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/markers"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestMarkable(t *testing.T) {
+	tests := []struct {
+		name  string
+		inner string
+	}{
+		{name: "plain"},
+		{name: "with payload", inner: "<active xmlns='http://jabber.org/protocol/chatstates'/>"},
+		{name: "already markable", inner: "<markable xmlns='urn:xmpp:chat-markers:0'/>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := core.Message{Header: core.Header{Id: "m1"}, Inner: []byte(tt.inner)}
+			markers.Markable(&msg)
+			if !markers.IsMarkable(&msg) {
+				t.Fatalf("got %s, want a markable message", msg.Inner)
+			}
+			if n := strings.Count(string(msg.Inner), "<markable"); n != 1 {
+				t.Errorf("got %s with %d markable elements, want one", msg.Inner, n)
+			}
+			if !strings.Contains(string(msg.Inner), tt.inner) {
+				t.Errorf("got %s, want %s kept", msg.Inner, tt.inner)
+			}
+		})
+	}
+}
+
+func TestMark(t *testing.T) {
+	const markable = "<markable xmlns='urn:xmpp:chat-markers:0'/>"
+	tests := []struct {
+		name   string
+		orig   core.Message
+		marker markers.Marker
+		// wantTo is the recipient of the marker, which mustn't be
+		// sent if it is empty.
+		wantTo string
+	}{
+		{
+			name:   "chat",
+			orig:   core.Message{Header: core.Header{From: "bob@example.com/phone", Id: "m1", Type: "chat"}, Inner: []byte(markable)},
+			marker: markers.Displayed,
+			wantTo: "bob@example.com/phone",
+		},
+		{
+			name:   "thread",
+			orig:   core.Message{Header: core.Header{From: "bob@example.com/phone", Id: "m1", Type: "chat"}, Thread: "t1", Inner: []byte(markable)},
+			marker: markers.Received,
+			wantTo: "bob@example.com/phone",
+		},
+		{
+			// Markers in rooms are sent to the room.
+			name:   "groupchat",
+			orig:   core.Message{Header: core.Header{From: "room@muc.example.com/bob", Id: "m1", Type: "groupchat"}, Inner: []byte(markable)},
+			marker: markers.Acknowledged,
+			wantTo: "room@muc.example.com",
+		},
+		{
+			name:   "not markable",
+			orig:   core.Message{Header: core.Header{From: "bob@example.com/phone", Id: "m1", Type: "chat"}},
+			marker: markers.Displayed,
+		},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	x, err := c.RegisterXEP("markers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := x.(*markers.Conn)
+	xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			go func() {
+				errc <- conn.Mark(&tt.orig, tt.marker)
+				// A marker message proves that nothing else has
+				// been sent.
+				c.Encode(core.Message{Header: core.Header{Id: "marker"}})
+			}()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantTo == "" {
+				if err := <-errc; err != markers.ErrNotMarkable {
+					t.Errorf("got %v, want %v", err, markers.ErrNotMarkable)
+				}
+				if e.Attribute("id") != "marker" {
+					t.Errorf("got %v %s, want nothing sent", e.Attr, e.Inner)
+				}
+				return
+			}
+
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if e.Attribute("to") != tt.wantTo || e.Attribute("type") != tt.orig.Type {
+				t.Errorf("got marker %v, want a %s message to %s", e.Attr, tt.orig.Type, tt.wantTo)
+			}
+			var got struct {
+				Thread string `xml:"thread"`
+				Marker struct {
+					XMLName xml.Name
+					ID      string `xml:"id,attr"`
+				} `xml:",any"`
+			}
+			xml.Unmarshal([]byte("<message>"+string(e.Inner)+"</message>"), &got)
+			if want := (xml.Name{Space: "urn:xmpp:chat-markers:0", Local: string(tt.marker)}); got.Marker.XMLName != want || got.Marker.ID != tt.orig.Id {
+				t.Errorf("got %s, want <%s id='%s'>", e.Inner, tt.marker, tt.orig.Id)
+			}
+			if got.Thread != tt.orig.Thread {
+				t.Errorf("got thread %q, want %q", got.Thread, tt.orig.Thread)
+			}
+			if e, err := s.NextElement(); err != nil || e.Attribute("id") != "marker" {
+				t.Errorf("got %v %s, %v, want nothing else sent", e.Attr, e.Inner, err)
+			}
+		})
+	}
+}
+
+func TestMarkerEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		inner string
+		// want is the marker emitted, if any.
+		want markers.Marker
+	}{
+		{name: "received", inner: "<received xmlns='urn:xmpp:chat-markers:0' id='m1'/>", want: markers.Received},
+		{name: "displayed", inner: "<displayed xmlns='urn:xmpp:chat-markers:0' id='m1'/>", want: markers.Displayed},
+		{name: "acknowledged", inner: "<acknowledged xmlns='urn:xmpp:chat-markers:0' id='m1'/>", want: markers.Acknowledged},
+		{name: "markable", inner: "<body>hi</body><markable xmlns='urn:xmpp:chat-markers:0'/>"},
+		{name: "other namespace", inner: "<received xmlns='urn:xmpp:receipts' id='m1'/>"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := c.RegisterXEP("markers"); err != nil {
+		t.Fatal(err)
+	}
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Sendf("<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'>%s</message>", tt.inner)
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *markers.MarkerEvent
+			for _, stanza := range emitted {
+				if stanza, ok := stanza.(*markers.MarkerEvent); ok {
+					got = stanza
+				}
+			}
+
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("got %s marker, want none", got.Marker)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("no marker emitted")
+			}
+			if got.Marker != tt.want || got.MessageID != "m1" || got.From != "bob@example.com/phone" {
+				t.Errorf("got %s marker for %q from %s, want %s for m1 from bob@example.com/phone", got.Marker, got.MessageID, got.From, tt.want)
+			}
+		})
+	}
+}
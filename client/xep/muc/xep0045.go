@@ -0,0 +1,767 @@
+// Package muc implements parts of XEP-0045 (Multi-User Chat) and
+// XEP-0249 (Direct MUC Invitations).
+//
+// It supports joining rooms, sending private messages to occupants
+// and sending, receiving and declining invitations. Inbound
+// invitations are delivered as synthetic Invitation stanzas, declined
+// invitations as synthetic Decline stanzas.
+//
+// The status codes of room presences and messages are interpreted as
+// well: our own presence in a room is delivered as SelfPresence, nick
+// changes as NickChanged, occupants that had to leave as Kicked,
+// Banned or Removed, and room notifications as RoomStatus.
+//
+// Rooms announce their subject in groupchat messages that only
+// consist of a subject, which are delivered again as SubjectChanged.
+// Such messages aren't part of the conversation, and IsSubject helps
+// telling them apart from chat messages. Likewise, the messages a
+// room replays from its history when joining it are delivered again
+// as HistoryMessage, and IsHistory tells them apart from live ones.
+// How much history is replayed can be requested with JoinWith.
+package muc
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/delay"
+	"honnef.co/go/xmpp/client/xep/disco"
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+
+	"encoding/xml"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ns       = "http://jabber.org/protocol/muc"
+	nsUser   = "http://jabber.org/protocol/muc#user"
+	nsDirect = "jabber:x:conference"
+)
+
+type Conn struct {
+	core.Client
+
+	// Rejoin is called for every joined room after the connection
+	// has been re-established. Returning false skips rejoining the
+	// room and forgets it. If Rejoin is nil, all rooms are rejoined.
+	Rejoin func(room JoinedRoom) bool
+
+	// RejoinDelay is how long the connection has to be up again
+	// before rooms are rejoined, which keeps a flapping connection
+	// from making us leave and join rooms over and over. Resumed
+	// sessions never rejoin. Zero rejoins right away.
+	RejoinDelay time.Duration
+
+	mu    sync.Mutex
+	rooms map[string]JoinedRoom
+	// reconnects counts reconnects, invalidating delayed rejoins.
+	reconnects uint64
+}
+
+// JoinedRoom is a room that we joined with Join.
+type JoinedRoom struct {
+	// Room is the bare JID of the room.
+	Room     string
+	Nick     string
+	Password string
+	// History is the history requested when joining, which is
+	// requested again when rejoining.
+	History History
+	// Subject is the subject of the room, as last announced by it.
+	Subject string
+}
+
+// JoinOptions are the options of JoinWith.
+type JoinOptions struct {
+	Password string
+	// History limits the messages the room replays from its
+	// history. By default, the room decides.
+	History History
+}
+
+// History limits the history a room replays when joining it. The
+// limits are combined, and zero values don't limit anything.
+type History struct {
+	// MaxStanzas limits the number of messages.
+	MaxStanzas int
+	// MaxChars limits the total size of the messages, in characters
+	// of XML.
+	MaxChars int
+	// Seconds limits the messages to those sent in the last that
+	// many seconds.
+	Seconds int
+	// Since limits the messages to those sent since then.
+	Since time.Time
+	// None asks not to replay any history at all.
+	None bool
+}
+
+// HistoryMessage is emitted for messages that a room replayed from
+// its history, as opposed to live messages.
+type HistoryMessage struct {
+	*core.Message
+	// Room is the bare JID of the room.
+	Room string
+	// Nick is the nickname of the sender.
+	Nick string
+	// Stamp is when the message was originally sent.
+	Stamp time.Time
+}
+
+// Invitation is emitted when we have been invited to a room.
+type Invitation struct {
+	*core.Message
+	// Room is the bare JID of the room.
+	Room string
+	// From is the JID of the inviter. For mediated invitations, this
+	// differs from the sender of the message, which is the room.
+	From     string
+	Reason   string
+	Password string
+	// Direct reports whether this was a direct invitation
+	// (XEP-0249), as opposed to one mediated by the room.
+	Direct bool
+}
+
+// Decline is emitted when an invitee declined our invitation.
+type Decline struct {
+	*core.Message
+	// Room is the bare JID of the room.
+	Room string
+	// From is the JID of the invitee.
+	From   string
+	Reason string
+}
+
+// Status codes (XEP-0045 15.6) that are interpreted by this package.
+const (
+	StatusNonAnonymous       = 100
+	StatusConfigChanged      = 104
+	StatusSelf               = 110
+	StatusLoggingEnabled     = 170
+	StatusLoggingDisabled    = 171
+	StatusRoomCreated        = 201
+	StatusNickAssigned       = 210
+	StatusBanned             = 301
+	StatusNickChanged        = 303
+	StatusKicked             = 307
+	StatusAffiliationChanged = 321
+	StatusMembersOnly        = 322
+	StatusShutdown           = 332
+)
+
+// Status is the list of status codes of a presence or message.
+type Status []int
+
+// Has reports whether the list contains code.
+func (s Status) Has(code int) bool {
+	for _, c := range s {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// SelfPresence is emitted for our own presence in a room, which the
+// room sends when we joined, changed our presence or left.
+type SelfPresence struct {
+	*core.Presence
+	// Room is the bare JID of the room.
+	Room string
+	// Nick is our nickname in the room. If Status contains
+	// StatusNickAssigned, the room changed it from the one we asked
+	// for.
+	Nick   string
+	Status Status
+}
+
+// NickChanged is emitted when an occupant changed its nickname.
+type NickChanged struct {
+	*core.Presence
+	// Room is the bare JID of the room.
+	Room string
+	Old  string
+	New  string
+	// Self reports whether we changed our nickname.
+	Self bool
+}
+
+// Kicked is emitted when an occupant has been kicked from a room.
+type Kicked struct {
+	*core.Presence
+	// Room is the bare JID of the room.
+	Room string
+	Nick string
+	// Actor is the nickname, or if unknown the JID, of the
+	// moderator who kicked the occupant. It is often empty.
+	Actor  string
+	Reason string
+	// Self reports whether we have been kicked.
+	Self bool
+}
+
+// Banned is emitted when an occupant has been banned from a room.
+type Banned struct {
+	*core.Presence
+	// Room is the bare JID of the room.
+	Room string
+	Nick string
+	// Actor is the nickname, or if unknown the JID, of the admin who
+	// banned the occupant. It is often empty.
+	Actor  string
+	Reason string
+	// Self reports whether we have been banned.
+	Self bool
+}
+
+// Removed is emitted when an occupant has been removed from a room for
+// other reasons: because of an affiliation change, because the room
+// became members-only, or because the service is shutting down.
+type Removed struct {
+	*core.Presence
+	// Room is the bare JID of the room.
+	Room string
+	Nick string
+	// Code is StatusAffiliationChanged, StatusMembersOnly or
+	// StatusShutdown.
+	Code   int
+	Reason string
+	// Self reports whether we have been removed.
+	Self bool
+}
+
+// SubjectChanged is emitted when the subject of a room has been
+// set. Rooms also announce their subject to everyone who joins them,
+// as the last step of joining.
+type SubjectChanged struct {
+	*core.Message
+	// Room is the bare JID of the room.
+	Room string
+	// Nick is the nickname of the occupant that set the subject. It
+	// is empty if the room itself did, or doesn't disclose who did.
+	Nick string
+	// Subject is the new subject, which is empty if it has been
+	// removed.
+	Subject string
+}
+
+// RoomStatus is emitted for messages from a room that carry status
+// codes, like StatusConfigChanged.
+type RoomStatus struct {
+	*core.Message
+	// Room is the bare JID of the room.
+	Room   string
+	Status Status
+}
+
+type emptySubject struct {
+	XMLName xml.Name `xml:"subject"`
+}
+
+type directInvite struct {
+	XMLName  xml.Name `xml:"jabber:x:conference x"`
+	JID      string   `xml:"jid,attr"`
+	Reason   string   `xml:"reason,attr,omitempty"`
+	Password string   `xml:"password,attr,omitempty"`
+}
+
+type userInvite struct {
+	From   string `xml:"from,attr,omitempty"`
+	To     string `xml:"to,attr,omitempty"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+type userActor struct {
+	Nick string `xml:"nick,attr"`
+	JID  string `xml:"jid,attr"`
+}
+
+type userItem struct {
+	JID    string     `xml:"jid,attr"`
+	Nick   string     `xml:"nick,attr"`
+	Actor  *userActor `xml:"actor"`
+	Reason string     `xml:"reason"`
+}
+
+type userStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+type userX struct {
+	XMLName  xml.Name     `xml:"http://jabber.org/protocol/muc#user x"`
+	Invite   *userInvite  `xml:"invite"`
+	Decline  *userInvite  `xml:"decline"`
+	Password string       `xml:"password,omitempty"`
+	Items    []userItem   `xml:"item"`
+	Status   []userStatus `xml:"status"`
+}
+
+func (x userX) status() Status {
+	var s Status
+	for _, st := range x.Status {
+		s = append(s, st.Code)
+	}
+	return s
+}
+
+type join struct {
+	XMLName  xml.Name `xml:"http://jabber.org/protocol/muc x"`
+	Password string   `xml:"password,omitempty"`
+	History  *history `xml:"history,omitempty"`
+}
+
+type history struct {
+	// MaxChars is a pointer because maxchars='0' is how to ask for
+	// no history.
+	MaxChars   *int   `xml:"maxchars,attr,omitempty"`
+	MaxStanzas int    `xml:"maxstanzas,attr,omitempty"`
+	Seconds    int    `xml:"seconds,attr,omitempty"`
+	Since      string `xml:"since,attr,omitempty"`
+}
+
+// element returns the history element requesting h, or nil if h
+// doesn't request anything.
+func (h History) element() *history {
+	if h.None {
+		zero := 0
+		return &history{MaxChars: &zero}
+	}
+	if h == (History{}) {
+		return nil
+	}
+	v := &history{
+		MaxStanzas: h.MaxStanzas,
+		Seconds:    h.Seconds,
+	}
+	if h.MaxChars > 0 {
+		v.MaxChars = &h.MaxChars
+	}
+	if !h.Since.IsZero() {
+		v.Since = xmpptime.FormatDateTime(h.Since)
+	}
+	return v
+}
+
+func init() {
+	core.RegisterXEP("muc", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+		rooms:  make(map[string]JoinedRoom),
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+	discovery.AddFeature(nsDirect)
+	c.AddReconnectHandler(conn.rejoin)
+
+	return conn, nil
+}
+
+// Join joins a room with the given nickname. password may be empty.
+// The room is remembered and rejoined after reconnecting, until it is
+// left with Leave.
+func (c *Conn) Join(room, nick, password string) error {
+	return c.JoinWith(room, nick, JoinOptions{Password: password})
+}
+
+// JoinWith behaves like Join, but allows setting the options
+// described by opts.
+func (c *Conn) JoinWith(room, nick string, opts JoinOptions) error {
+	r := JoinedRoom{
+		Room:     bare(room),
+		Nick:     nick,
+		Password: opts.Password,
+		History:  opts.History,
+	}
+	c.mu.Lock()
+	c.rooms[r.Room] = r
+	c.mu.Unlock()
+
+	return c.join(r)
+}
+
+func (c *Conn) join(r JoinedRoom) error {
+	p := core.Presence{
+		Header: core.Header{
+			To: r.Room + "/" + r.Nick,
+		},
+	}
+	p.Inner, _ = core.AppendPayload(nil, join{
+		Password: r.Password,
+		History:  r.History.element(),
+	})
+
+	return c.Encode(p)
+}
+
+// Leave leaves a room.
+func (c *Conn) Leave(room, nick string) error {
+	c.mu.Lock()
+	delete(c.rooms, bare(room))
+	c.mu.Unlock()
+
+	return c.Encode(core.Presence{
+		Header: core.Header{
+			To:   bare(room) + "/" + nick,
+			Type: "unavailable",
+		},
+	})
+}
+
+// Joined returns the rooms that we joined.
+func (c *Conn) Joined() []JoinedRoom {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rooms := make([]JoinedRoom, 0, len(c.rooms))
+	for _, room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// rejoin joins all rooms again after the connection has been
+// re-established, unless the session has been resumed and we're still
+// in them.
+func (c *Conn) rejoin(resumed bool) {
+	if resumed {
+		return
+	}
+	if c.RejoinDelay <= 0 {
+		c.rejoinAll()
+		return
+	}
+
+	c.mu.Lock()
+	c.reconnects++
+	gen := c.reconnects
+	c.mu.Unlock()
+	clock.AfterFunc(c.RejoinDelay, func() {
+		c.mu.Lock()
+		current := c.reconnects == gen
+		c.mu.Unlock()
+		if current && c.State() == core.StateBound {
+			c.rejoinAll()
+		}
+	})
+}
+
+func (c *Conn) rejoinAll() {
+	for _, room := range c.Joined() {
+		if c.Rejoin != nil && !c.Rejoin(room) {
+			c.mu.Lock()
+			delete(c.rooms, room.Room)
+			c.mu.Unlock()
+			continue
+		}
+		c.join(room)
+	}
+}
+
+// SendPrivate sends a private message to the occupant of a room that
+// is using the nickname nick.
+func (c *Conn) SendPrivate(room, nick, body string) error {
+	msg := core.Message{
+		Header: core.Header{
+			To:   bare(room) + "/" + nick,
+			Type: "chat",
+		},
+		Body: body,
+	}
+	// Tell the recipient's clients that this is a private message
+	// and not a one-to-one chat with a bare JID.
+	msg.Inner, _ = core.AppendPayload(nil, userX{})
+
+	return c.Encode(msg)
+}
+
+// SetSubject changes the subject of a room, which requires the
+// permission to do so. An empty subject removes it. The room
+// announces the change to all occupants, including us, as
+// SubjectChanged.
+func (c *Conn) SetSubject(room, subject string) error {
+	msg := core.Message{
+		Header: core.Header{
+			To:   bare(room),
+			Type: "groupchat",
+		},
+		Subject: subject,
+	}
+	if subject == "" {
+		// An empty Subject would be omitted, instead of clearing
+		// the subject.
+		msg.Inner, _ = core.AppendPayload(nil, emptySubject{})
+	}
+	return c.Encode(msg)
+}
+
+// Subject returns the subject of a room we joined, as last announced
+// by the room. It is empty if the room has no subject, or hasn't told
+// us yet.
+func (c *Conn) Subject(room string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rooms[bare(room)].Subject
+}
+
+// IsSubject reports whether msg announces the subject of a room,
+// which is the case for groupchat messages with a subject but no
+// body.
+func IsSubject(msg *core.Message) bool {
+	if msg.Type != "groupchat" || msg.Body != "" {
+		return false
+	}
+	// Subject can't tell an empty subject from a missing one.
+	return msg.Subject != "" ||
+		core.HasPayload(msg.Inner, "", "subject") ||
+		core.HasPayload(msg.Inner, "jabber:client", "subject")
+}
+
+// IsHistory reports whether msg has been replayed from the history
+// of a room, which is the case for delayed groupchat messages.
+func IsHistory(msg *core.Message) bool {
+	_, ok := delay.Get(msg.Inner)
+	return ok && msg.Type == "groupchat"
+}
+
+// Invite sends a mediated invitation to jid via the room. The room
+// will forward the invitation and, if the room is members-only, add
+// jid to the member list.
+func (c *Conn) Invite(room, jid, reason string) error {
+	msg := core.Message{
+		Header: core.Header{
+			To: bare(room),
+		},
+	}
+	msg.Inner, _ = core.AppendPayload(nil, userX{
+		Invite: &userInvite{To: jid, Reason: reason},
+	})
+
+	return c.Encode(msg)
+}
+
+// InviteDirect sends a direct invitation (XEP-0249) to jid, bypassing
+// the room. password may be empty.
+func (c *Conn) InviteDirect(room, jid, reason, password string) error {
+	msg := core.Message{
+		Header: core.Header{
+			To: jid,
+		},
+	}
+	msg.Inner, _ = core.AppendPayload(nil, directInvite{
+		JID:      bare(room),
+		Reason:   reason,
+		Password: password,
+	})
+
+	return c.Encode(msg)
+}
+
+// Decline declines a mediated invitation. Direct invitations are
+// declined by ignoring them.
+func (c *Conn) Decline(inv *Invitation, reason string) error {
+	if inv.Direct {
+		return nil
+	}
+
+	msg := core.Message{
+		Header: core.Header{
+			To: inv.Room,
+		},
+	}
+	msg.Inner, _ = core.AppendPayload(nil, userX{
+		Decline: &userInvite{To: inv.From, Reason: reason},
+	})
+
+	return c.Encode(msg)
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	if p, ok := stanza.(*core.Presence); ok {
+		return c.processPresence(p)
+	}
+
+	msg, ok := stanza.(*core.Message)
+	if !ok || msg.Error != nil {
+		return nil, nil
+	}
+	if IsSubject(msg) {
+		return c.processSubject(msg), nil
+	}
+	if d, ok := delay.Get(msg.Inner); ok && msg.Type == "groupchat" {
+		return []core.Stanza{&HistoryMessage{
+			Message: msg,
+			Room:    bare(msg.From),
+			Nick:    resource(msg.From),
+			Stamp:   d.Stamp,
+		}}, nil
+	}
+
+	var x userX
+	found, err := core.DecodePayload(msg.Inner, nsUser, "x", &x)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		switch {
+		case x.Invite != nil:
+			return []core.Stanza{&Invitation{
+				Message:  msg,
+				Room:     bare(msg.From),
+				From:     x.Invite.From,
+				Reason:   x.Invite.Reason,
+				Password: x.Password,
+			}}, nil
+		case x.Decline != nil:
+			return []core.Stanza{&Decline{
+				Message: msg,
+				Room:    bare(msg.From),
+				From:    x.Decline.From,
+				Reason:  x.Decline.Reason,
+			}}, nil
+		case len(x.Status) > 0 && msg.From == bare(msg.From):
+			// Only the room itself sends status codes, not its
+			// occupants.
+			return []core.Stanza{&RoomStatus{
+				Message: msg,
+				Room:    msg.From,
+				Status:  x.status(),
+			}}, nil
+		}
+	}
+
+	var d directInvite
+	found, err = core.DecodePayload(msg.Inner, nsDirect, "x", &d)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return []core.Stanza{&Invitation{
+			Message:  msg,
+			Room:     bare(d.JID),
+			From:     msg.From,
+			Reason:   d.Reason,
+			Password: d.Password,
+			Direct:   true,
+		}}, nil
+	}
+
+	return nil, nil
+}
+
+// processPresence interprets the status codes of a presence from a
+// room occupant.
+func (c *Conn) processPresence(p *core.Presence) ([]core.Stanza, error) {
+	if p.Type != "" && p.Type != "unavailable" {
+		return nil, nil
+	}
+	var x userX
+	found, err := core.DecodePayload(p.Inner, nsUser, "x", &x)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	room, nick := bare(p.From), resource(p.From)
+	if nick == "" {
+		return nil, nil
+	}
+	status := x.status()
+	self := status.Has(StatusSelf)
+	var item userItem
+	if len(x.Items) > 0 {
+		item = x.Items[0]
+	}
+	var actor string
+	if item.Actor != nil {
+		actor = item.Actor.Nick
+		if actor == "" {
+			actor = item.Actor.JID
+		}
+	}
+
+	var out []core.Stanza
+	if self {
+		out = append(out, &SelfPresence{Presence: p, Room: room, Nick: nick, Status: status})
+		if p.Type == "" && status.Has(StatusNickAssigned) {
+			c.setNick(room, nick)
+		}
+	}
+	if p.Type != "unavailable" {
+		return out, nil
+	}
+
+	gone := true
+	switch {
+	case status.Has(StatusNickChanged):
+		out = append(out, &NickChanged{Presence: p, Room: room, Old: nick, New: item.Nick, Self: self})
+		if self {
+			c.setNick(room, item.Nick)
+		}
+		gone = false
+	case status.Has(StatusBanned):
+		out = append(out, &Banned{Presence: p, Room: room, Nick: nick, Actor: actor, Reason: item.Reason, Self: self})
+	case status.Has(StatusKicked):
+		out = append(out, &Kicked{Presence: p, Room: room, Nick: nick, Actor: actor, Reason: item.Reason, Self: self})
+	case status.Has(StatusAffiliationChanged), status.Has(StatusMembersOnly), status.Has(StatusShutdown):
+		code := StatusShutdown
+		for _, c := range []int{StatusAffiliationChanged, StatusMembersOnly} {
+			if status.Has(c) {
+				code = c
+			}
+		}
+		out = append(out, &Removed{Presence: p, Room: room, Nick: nick, Code: code, Reason: item.Reason, Self: self})
+	}
+
+	if self && gone {
+		// We're not in the room anymore and mustn't rejoin it.
+		c.mu.Lock()
+		delete(c.rooms, room)
+		c.mu.Unlock()
+	}
+	return out, nil
+}
+
+func (c *Conn) processSubject(msg *core.Message) []core.Stanza {
+	room := bare(msg.From)
+	c.mu.Lock()
+	if r, ok := c.rooms[room]; ok {
+		r.Subject = msg.Subject
+		c.rooms[room] = r
+	}
+	c.mu.Unlock()
+
+	return []core.Stanza{&SubjectChanged{
+		Message: msg,
+		Room:    room,
+		Nick:    resource(msg.From),
+		Subject: msg.Subject,
+	}}
+}
+
+// setNick updates the nickname we use in a joined room.
+func (c *Conn) setNick(room, nick string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.rooms[room]; ok {
+		r.Nick = nick
+		c.rooms[room] = r
+	}
+}
+
+func resource(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[i+1:]
+	}
+	return ""
+}
+
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[:i]
+	}
+	return jid
+}
@@ -0,0 +1,405 @@
+package muc_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/muc"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const room = "room@muc.example.com"
+
+// presence is a presence of an occupant with the muc#user payload x.
+func presence(nick, typ, x string) string {
+	return fmt.Sprintf("<presence xmlns='jabber:client' from='%s/%s' type='%s'><x xmlns='http://jabber.org/protocol/muc#user'>%s</x></presence>",
+		room, nick, typ, x)
+}
+
+// join connects a client and joins room as alice with the given
+// options. It returns the join presence as well.
+func join(t *testing.T, opts muc.JoinOptions) (*muc.Conn, *xmpptest.Server, <-chan core.Stanza, xmpptest.Element) {
+	t.Helper()
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := c.RegisterXEP("muc")
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	conn := x.(*muc.Conn)
+	stanzas := xmpptest.Stanzas(c)
+
+	errc := make(chan error, 1)
+	go func() { errc <- conn.JoinWith(room, "alice", opts) }()
+	p, err := s.NextElement()
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return conn, s, stanzas, p
+}
+
+// collect returns what everything sent to the client so far caused
+// it to emit.
+func collect(t *testing.T, s *xmpptest.Server, stanzas <-chan core.Stanza) []core.Stanza {
+	t.Helper()
+	emitted, err := s.EmittedUntilSentinel(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emitted
+}
+
+// describe summarizes the room events emitted by muc.
+func describe(stanza core.Stanza) (string, bool) {
+	switch e := stanza.(type) {
+	case *muc.SelfPresence:
+		return fmt.Sprintf("self %s %v", e.Nick, e.Status), true
+	case *muc.NickChanged:
+		return fmt.Sprintf("nick %s -> %s, self %t", e.Old, e.New, e.Self), true
+	case *muc.Kicked:
+		return fmt.Sprintf("kicked %s by %q: %q, self %t", e.Nick, e.Actor, e.Reason, e.Self), true
+	case *muc.Banned:
+		return fmt.Sprintf("banned %s by %q: %q, self %t", e.Nick, e.Actor, e.Reason, e.Self), true
+	case *muc.Removed:
+		return fmt.Sprintf("removed %s (%d): %q, self %t", e.Nick, e.Code, e.Reason, e.Self), true
+	case *muc.RoomStatus:
+		return fmt.Sprintf("room %v", e.Status), true
+	}
+	return "", false
+}
+
+func TestStatusCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		stanza string
+		want   []string
+		// wantNick is our nickname in the room afterwards, or empty
+		// if we may not be in it anymore.
+		wantNick string
+	}{
+		{
+			name:     "joined",
+			stanza:   presence("alice", "", "<item affiliation='member' role='participant'/><status code='110'/><status code='100'/>"),
+			want:     []string{"self alice [110 100]"},
+			wantNick: "alice",
+		},
+		{
+			name:     "nick assigned",
+			stanza:   presence("Alice (2)", "", "<item affiliation='member' role='participant'/><status code='110'/><status code='210'/>"),
+			want:     []string{"self Alice (2) [110 210]"},
+			wantNick: "Alice (2)",
+		},
+		{
+			name:     "other occupant",
+			stanza:   presence("bob", "", "<item affiliation='member' role='participant'/>"),
+			wantNick: "alice",
+		},
+		{
+			name:     "other nick changed",
+			stanza:   presence("bob", "unavailable", "<item affiliation='member' role='participant' nick='robert'/><status code='303'/>"),
+			want:     []string{"nick bob -> robert, self false"},
+			wantNick: "alice",
+		},
+		{
+			name:     "own nick changed",
+			stanza:   presence("alice", "unavailable", "<item affiliation='member' role='participant' nick='alicia'/><status code='303'/><status code='110'/>"),
+			want:     []string{"self alice [303 110]", "nick alice -> alicia, self true"},
+			wantNick: "alicia",
+		},
+		{
+			name: "other kicked",
+			stanza: presence("bob", "unavailable",
+				"<item affiliation='none' role='none'><actor nick='carol'/><reason>Spam</reason></item><status code='307'/>"),
+			want:     []string{`kicked bob by "carol": "Spam", self false`},
+			wantNick: "alice",
+		},
+		{
+			name: "kicked",
+			stanza: presence("alice", "unavailable",
+				"<item affiliation='none' role='none'><actor jid='carol@example.com'/></item><status code='307'/><status code='110'/>"),
+			want: []string{"self alice [307 110]", `kicked alice by "carol@example.com": "", self true`},
+		},
+		{
+			name:   "banned",
+			stanza: presence("alice", "unavailable", "<item affiliation='outcast' role='none'><reason>Trolling</reason></item><status code='301'/><status code='110'/>"),
+			want:   []string{"self alice [301 110]", `banned alice by "": "Trolling", self true`},
+		},
+		{
+			name:     "other removed by affiliation change",
+			stanza:   presence("bob", "unavailable", "<item affiliation='none' role='none'/><status code='321'/>"),
+			want:     []string{`removed bob (321): "", self false`},
+			wantNick: "alice",
+		},
+		{
+			name:   "shutdown",
+			stanza: presence("alice", "unavailable", "<item affiliation='member' role='none'/><status code='332'/><status code='110'/>"),
+			want:   []string{"self alice [332 110]", `removed alice (332): "", self true`},
+		},
+		{
+			name:   "left",
+			stanza: presence("alice", "unavailable", "<item affiliation='member' role='none'/><status code='110'/>"),
+			want:   []string{"self alice [110]"},
+		},
+		{
+			name:     "room notification",
+			stanza:   "<message xmlns='jabber:client' from='" + room + "' type='groupchat'><x xmlns='http://jabber.org/protocol/muc#user'><status code='104'/></x></message>",
+			want:     []string{"room [104]"},
+			wantNick: "alice",
+		},
+		{
+			// Status codes in messages are only meaningful coming
+			// from the room.
+			name:     "notification from occupant",
+			stanza:   "<message xmlns='jabber:client' from='" + room + "/mallory' type='groupchat'><x xmlns='http://jabber.org/protocol/muc#user'><status code='104'/></x></message>",
+			wantNick: "alice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s, stanzas, _ := join(t, muc.JoinOptions{})
+			defer s.Close()
+
+			s.Send(tt.stanza)
+			var got []string
+			for _, stanza := range collect(t, s, stanzas) {
+				if e, ok := describe(stanza); ok {
+					got = append(got, e)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got events %q, want %q", got, tt.want)
+			}
+
+			joined := conn.Joined()
+			switch {
+			case tt.wantNick == "" && len(joined) != 0:
+				t.Errorf("still in %+v", joined)
+			case tt.wantNick != "" && (len(joined) != 1 || joined[0].Nick != tt.wantNick):
+				t.Errorf("got rooms %+v, want to be in %s as %s", joined, room, tt.wantNick)
+			}
+		})
+	}
+}
+
+func TestSubject(t *testing.T) {
+	tests := []struct {
+		name string
+		// initial is the subject before the message, announced by the
+		// room when joining.
+		initial string
+		from    string
+		typ     string
+		inner   string
+		// want is the SubjectChanged event as the setter's nick and the
+		// subject, or empty if none may be emitted.
+		want        string
+		wantSubject string
+	}{
+		{name: "announced on join", from: room, typ: "groupchat", inner: "<subject>Welcome</subject>", want: `"" set "Welcome"`, wantSubject: "Welcome"},
+		{name: "set by occupant", initial: "Welcome", from: room + "/bob", typ: "groupchat", inner: "<subject>Release day</subject>", want: `"bob" set "Release day"`, wantSubject: "Release day"},
+		{name: "cleared", initial: "Welcome", from: room + "/bob", typ: "groupchat", inner: "<subject/>", want: `"bob" set ""`},
+		{name: "chat message with subject", initial: "Welcome", from: room + "/bob", typ: "groupchat", inner: "<subject>Re: lunch</subject><body>Pizza?</body>", wantSubject: "Welcome"},
+		{name: "chat message", initial: "Welcome", from: room + "/bob", typ: "groupchat", inner: "<body>hi</body>", wantSubject: "Welcome"},
+		{name: "private message", initial: "Welcome", from: room + "/bob", typ: "chat", inner: "<subject>Secret</subject>", wantSubject: "Welcome"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s, stanzas, _ := join(t, muc.JoinOptions{})
+			defer s.Close()
+			if tt.initial != "" {
+				s.Sendf("<message xmlns='jabber:client' from='%s' type='groupchat'><subject>%s</subject></message>", room, tt.initial)
+				collect(t, s, stanzas)
+			}
+
+			s.Sendf("<message xmlns='jabber:client' from='%s' type='%s'>%s</message>", tt.from, tt.typ, tt.inner)
+			var got []string
+			for _, stanza := range collect(t, s, stanzas) {
+				switch stanza := stanza.(type) {
+				case *muc.SubjectChanged:
+					if stanza.Room != room {
+						t.Errorf("got subject of %s, want %s", stanza.Room, room)
+					}
+					got = append(got, fmt.Sprintf("%q set %q", stanza.Nick, stanza.Subject))
+				case *core.Message:
+					// The message itself is still delivered, for
+					// those who don't care about rooms.
+					if muc.IsSubject(stanza) != (tt.want != "") {
+						t.Errorf("IsSubject(%s) = %t", stanza.Inner, tt.want == "")
+					}
+				}
+			}
+			var want []string
+			if tt.want != "" {
+				want = []string{tt.want}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got events %q, want %q", got, want)
+			}
+			if got := conn.Subject(room); got != tt.wantSubject {
+				t.Errorf("got subject %q, want %q", got, tt.wantSubject)
+			}
+		})
+	}
+}
+
+func TestSetSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+	}{
+		{name: "set", subject: "Release day"},
+		// Clearing the subject requires an empty element, not none.
+		{name: "cleared"},
+	}
+
+	conn, s, _, _ := join(t, muc.JoinOptions{})
+	defer s.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			go func() { errc <- conn.SetSubject(room+"/alice", tt.subject) }()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			var got struct {
+				Subject *string `xml:"subject"`
+				Body    *string `xml:"body"`
+			}
+			if err := xml.Unmarshal([]byte("<message>"+string(e.Inner)+"</message>"), &got); err != nil {
+				t.Fatal(err)
+			}
+			if e.XMLName.Local != "message" || e.Attribute("to") != room || e.Attribute("type") != "groupchat" {
+				t.Errorf("got <%s> %v, want a groupchat message to %s", e.XMLName.Local, e.Attr, room)
+			}
+			if got.Subject == nil || *got.Subject != tt.subject || got.Body != nil {
+				t.Errorf("got %s, want only the subject %q", e.Inner, tt.subject)
+			}
+		})
+	}
+}
+
+func TestJoinHistory(t *testing.T) {
+	since := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		history muc.History
+		// want are the history element's attributes, or nil if the
+		// element may not be sent.
+		want map[string]string
+	}{
+		{name: "default"},
+		{name: "last messages", history: muc.History{MaxStanzas: 20}, want: map[string]string{"maxstanzas": "20"}},
+		{name: "size", history: muc.History{MaxChars: 65000}, want: map[string]string{"maxchars": "65000"}},
+		{name: "age", history: muc.History{Seconds: 180}, want: map[string]string{"seconds": "180"}},
+		{name: "since", history: muc.History{Since: since}, want: map[string]string{"since": "2024-03-01T12:30:00Z"}},
+		{
+			name:    "combined",
+			history: muc.History{MaxStanzas: 20, Since: since},
+			want:    map[string]string{"maxstanzas": "20", "since": "2024-03-01T12:30:00Z"},
+		},
+		{name: "none", history: muc.History{None: true}, want: map[string]string{"maxchars": "0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, s, _, p := join(t, muc.JoinOptions{History: tt.history})
+			defer s.Close()
+
+			var x struct {
+				History *struct {
+					Attr []xml.Attr `xml:",any,attr"`
+				} `xml:"http://jabber.org/protocol/muc history"`
+			}
+			if err := xml.Unmarshal(p.Inner, &x); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if x.History != nil {
+					t.Errorf("got %s, want no history element", p.Inner)
+				}
+				return
+			}
+			if x.History == nil {
+				t.Fatalf("got %s, want a history element", p.Inner)
+			}
+			got := make(map[string]string)
+			for _, attr := range x.History.Attr {
+				got[attr.Name.Local] = attr.Value
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got history %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryMessage(t *testing.T) {
+	const stamp = "<delay xmlns='urn:xmpp:delay' from='" + room + "' stamp='2024-03-01T12:30:00Z'/>"
+	tests := []struct {
+		name string
+		from string
+		typ  string
+		// inner is the message's payload.
+		inner       string
+		wantHistory bool
+	}{
+		{name: "replayed", from: room + "/bob", typ: "groupchat", inner: "<body>hi</body>" + stamp, wantHistory: true},
+		{name: "live", from: room + "/bob", typ: "groupchat", inner: "<body>hi</body>"},
+		// Private messages aren't part of the room's history, even
+		// when delivered from offline storage.
+		{name: "delayed private message", from: room + "/bob", typ: "chat", inner: "<body>hi</body>" + stamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, s, stanzas, _ := join(t, muc.JoinOptions{History: muc.History{MaxStanzas: 20}})
+			defer s.Close()
+
+			s.Sendf("<message xmlns='jabber:client' from='%s' type='%s'>%s</message>", tt.from, tt.typ, tt.inner)
+			var got []*muc.HistoryMessage
+			for _, stanza := range collect(t, s, stanzas) {
+				switch stanza := stanza.(type) {
+				case *muc.HistoryMessage:
+					got = append(got, stanza)
+				case *core.Message:
+					if muc.IsHistory(stanza) != tt.wantHistory {
+						t.Errorf("IsHistory = %t, want %t", !tt.wantHistory, tt.wantHistory)
+					}
+				}
+			}
+			if !tt.wantHistory {
+				if len(got) != 0 {
+					t.Errorf("got history message %+v", got[0])
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d history messages, want 1", len(got))
+			}
+			want := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+			if h := got[0]; h.Room != room || h.Nick != "bob" || !h.Stamp.Equal(want) || h.Body != "hi" {
+				t.Errorf("got %q by %s in %s at %v, want %q by bob in %s at %v", h.Body, h.Nick, h.Room, h.Stamp, "hi", room, want)
+			}
+		})
+	}
+}
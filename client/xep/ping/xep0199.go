@@ -0,0 +1,196 @@
+// Package ping implements XEP-0199 (XMPP Ping).
+//
+// Pings from other entities are answered automatically. Ping checks
+// whether an entity is reachable, and EnableKeepalive pings the server
+// periodically to detect dead connections, optionally combined with
+// TCP keep-alive.
+package ping
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+	"errors"
+	"sync"
+	"time"
+)
+
+const ns = "urn:xmpp:ping"
+
+// ErrTimeout is returned by Ping if no reply arrived in time.
+var ErrTimeout = errors.New("xmpp: ping timed out")
+
+type ping struct {
+	XMLName xml.Name `xml:"urn:xmpp:ping ping"`
+}
+
+// KeepaliveOptions configure EnableKeepalive. Either mechanism can be
+// disabled by leaving its fields zero.
+type KeepaliveOptions struct {
+	// TCPPeriod is the period of TCP keep-alive probes, which are
+	// handled by the operating system and detect dead peers without
+	// any traffic on the stream.
+	TCPPeriod time.Duration
+	// Interval is how often the server is pinged.
+	Interval time.Duration
+	// Timeout is how long to wait for the reply to a ping before
+	// considering the connection dead. It defaults to Interval.
+	Timeout time.Duration
+}
+
+type Conn struct {
+	core.Client
+
+	mu   sync.Mutex
+	opts KeepaliveOptions
+	stop chan struct{}
+}
+
+func init() {
+	core.RegisterXEP("ping", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	c.HandleIQ("get", ns, conn.handlePing)
+	c.AddReconnectHandler(conn.reconnected)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
+
+func (c *Conn) handlePing(iq *core.IQ) (interface{}, error) {
+	return nil, nil
+}
+
+// Ping pings an entity and waits up to timeout for the reply. An error
+// reply is returned as such; it still means that the entity, or at
+// least its server, is reachable.
+func (c *Conn) Ping(to string, timeout time.Duration) error {
+	ch, _ := c.SendIQ(to, "get", ping{})
+	timer := clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		if res == nil {
+			return core.ErrClosed
+		}
+		if res.IsError() {
+			return res.Error
+		}
+		return nil
+	case <-timer.C():
+		return ErrTimeout
+	}
+}
+
+// EnableKeepalive enables TCP keep-alive and periodic pings of the
+// server, replacing earlier options. Both settings survive
+// reconnecting.
+//
+// If a ping isn't answered in time, the connection is treated as lost:
+// a read deadline in the past is set on it, which makes reading from
+// the stream fail. Applications must not set read deadlines on the
+// connection themselves, as they would override each other.
+func (c *Conn) EnableKeepalive(opts KeepaliveOptions) error {
+	if opts.Timeout == 0 {
+		opts.Timeout = opts.Interval
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopPinging()
+	c.opts = opts
+
+	if opts.Interval > 0 {
+		c.stop = make(chan struct{})
+		go c.keepalive(opts, c.stop)
+	}
+	if opts.TCPPeriod > 0 {
+		return c.setTCPKeepAlive()
+	}
+	return nil
+}
+
+// DisableKeepalive stops pinging the server and disables TCP
+// keep-alive if it had been enabled with EnableKeepalive.
+func (c *Conn) DisableKeepalive() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopPinging()
+	enabled := c.opts.TCPPeriod > 0
+	c.opts = KeepaliveOptions{}
+
+	if !enabled {
+		return nil
+	}
+	return c.setTCPKeepAlive()
+}
+
+// stopPinging stops the ping loop. The caller must hold mu.
+func (c *Conn) stopPinging() {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// setTCPKeepAlive applies the TCP keep-alive option to the current
+// connection. The caller must hold mu.
+func (c *Conn) setTCPKeepAlive() error {
+	tcp, ok := c.Client.(interface {
+		SetTCPKeepAlive(period time.Duration) error
+	})
+	if !ok {
+		return core.ErrNotTCP
+	}
+	return tcp.SetTCPKeepAlive(c.opts.TCPPeriod)
+}
+
+func (c *Conn) reconnected(resumed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opts.TCPPeriod > 0 {
+		c.setTCPKeepAlive()
+	}
+}
+
+func (c *Conn) keepalive(opts KeepaliveOptions, stop chan struct{}) {
+	ticker := clock.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+
+		if c.State() != core.StateBound {
+			continue
+		}
+		if c.Ping(core.JID(c.JID()).Domain(), opts.Timeout) == ErrTimeout {
+			c.kill()
+		}
+	}
+}
+
+// kill makes the read loop fail, so that the connection is handled as
+// having been lost.
+func (c *Conn) kill() {
+	if conn, ok := c.Client.(interface {
+		SetReadDeadline(t time.Time) error
+	}); ok {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	}
+}
@@ -0,0 +1,98 @@
+package ping_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/ping"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPingTimeout(t *testing.T) {
+	const timeout = 30 * time.Second
+	tests := []struct {
+		name string
+		// reply answers the ping, the IQ's id is passed as the
+		// argument. No reply is sent if it is empty.
+		reply string
+		// advance is how far the clock moves before the reply.
+		advance time.Duration
+		wantErr func(error) bool
+	}{
+		{
+			name:  "answered",
+			reply: "<iq xmlns='jabber:client' type='result' id='%s' from='example.com'/>",
+		},
+		{
+			name:    "answered just in time",
+			reply:   "<iq xmlns='jabber:client' type='result' id='%s' from='example.com'/>",
+			advance: timeout - time.Second,
+		},
+		{
+			name:  "error",
+			reply: "<iq xmlns='jabber:client' type='error' id='%s' from='example.com'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr)
+			},
+		},
+		{
+			name:    "timeout",
+			advance: timeout,
+			wantErr: func(err error) bool { return err == ping.ErrTimeout },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := clock.NewMock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			defer clock.Set(mock)()
+
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("ping")
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			errc := make(chan error, 1)
+			go func() { errc <- x.(*ping.Conn).Ping("example.com", timeout) }()
+
+			req, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.XMLName.Local != "iq" || req.Attribute("to") != "example.com" {
+				t.Fatalf("got <%s> %v, want a ping", req.XMLName.Local, req.Attr)
+			}
+			// The timer is started after the ping has been sent.
+			for mock.Timers() == 0 {
+				runtime.Gosched()
+			}
+			mock.Advance(tt.advance)
+			if tt.reply != "" {
+				s.Sendf(tt.reply, req.Attribute("id"))
+			}
+
+			err = <-errc
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !tt.wantErr(err) {
+				t.Fatalf("got unexpected error %v", err)
+			}
+			if n := mock.Timers(); n != 0 {
+				t.Errorf("%d timers still running", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+// Package pubsub implements node management of XEP-0060
+// (Publish-Subscribe).
+//
+// Nodes are created with CreateNode and administered by their owners
+// with the methods in the pubsub#owner namespace. service is the JID
+// of the pubsub service, or the bare JID of an account for PEP nodes.
+//
+// Nodes are subscribed to with Subscribe. The notifications sent by
+// nodes, usually as headline messages, are delivered as synthetic
+// Event stanzas.
+package pubsub
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+const (
+	ns      = "http://jabber.org/protocol/pubsub"
+	nsOwner = "http://jabber.org/protocol/pubsub#owner"
+	nsEvent = "http://jabber.org/protocol/pubsub#event"
+)
+
+var (
+	ErrNodeExists   = errors.New("xmpp: pubsub node already exists")
+	ErrNodeNotFound = errors.New("xmpp: pubsub node doesn't exist")
+	ErrNotOwner     = errors.New("xmpp: not the owner of the pubsub node")
+	ErrNoForm       = errors.New("xmpp: pubsub service didn't return a form")
+)
+
+// Affiliations defined by XEP-0060.
+const (
+	AffiliationOwner       = "owner"
+	AffiliationPublisher   = "publisher"
+	AffiliationPublishOnly = "publish-only"
+	AffiliationMember      = "member"
+	AffiliationNone        = "none"
+	AffiliationOutcast     = "outcast"
+)
+
+// States of a subscription defined by XEP-0060.
+const (
+	SubscriptionNone         = "none"
+	SubscriptionPending      = "pending"
+	SubscriptionUnconfigured = "unconfigured"
+	SubscriptionSubscribed   = "subscribed"
+)
+
+// Affiliation is an entity's affiliation with a node.
+type Affiliation struct {
+	JID         string `xml:"jid,attr"`
+	Affiliation string `xml:"affiliation,attr"`
+}
+
+type create struct {
+	Node string `xml:"node,attr,omitempty"`
+}
+
+type configure struct {
+	Node string          `xml:"node,attr,omitempty"`
+	Form *dataforms.Form `xml:"jabber:x:data x,omitempty"`
+}
+
+type subscription struct {
+	Node         string `xml:"node,attr"`
+	JID          string `xml:"jid,attr"`
+	Subscription string `xml:"subscription,attr,omitempty"`
+}
+
+type pubsub struct {
+	XMLName      xml.Name      `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Create       *create       `xml:"create,omitempty"`
+	Configure    *configure    `xml:"configure,omitempty"`
+	Subscribe    *subscription `xml:"subscribe,omitempty"`
+	Unsubscribe  *subscription `xml:"unsubscribe,omitempty"`
+	Subscription *subscription `xml:"subscription,omitempty"`
+}
+
+type node struct {
+	Node string `xml:"node,attr"`
+}
+
+type affiliations struct {
+	Node         string        `xml:"node,attr"`
+	Affiliations []Affiliation `xml:"affiliation"`
+}
+
+type owner struct {
+	XMLName      xml.Name      `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+	Configure    *configure    `xml:"configure,omitempty"`
+	Delete       *node         `xml:"delete,omitempty"`
+	Purge        *node         `xml:"purge,omitempty"`
+	Affiliations *affiliations `xml:"affiliations,omitempty"`
+}
+
+// Item is an item published to a node.
+type Item struct {
+	ID string `xml:"id,attr"`
+	// Publisher is the JID of the publisher, if the service
+	// discloses it.
+	Publisher string `xml:"publisher,attr"`
+	// Payload is the XML of the item's payload. It is empty if the
+	// node doesn't deliver payloads, in which case the item has to
+	// be fetched.
+	Payload []byte `xml:",innerxml"`
+}
+
+// Event is emitted for notifications sent by nodes. Depending on
+// what happened, it carries published items, the IDs of retracted
+// items, or reports that the node has been purged or deleted.
+type Event struct {
+	*core.Message
+	// Service is the JID of the pubsub service.
+	Service   string
+	Node      string
+	Items     []Item
+	Retracted []string
+	Purged    bool
+	Deleted   bool
+}
+
+type event struct {
+	Items *struct {
+		Node    string `xml:"node,attr"`
+		Items   []Item `xml:"item"`
+		Retract []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"retract"`
+	} `xml:"items"`
+	Purge  *node `xml:"purge"`
+	Delete *node `xml:"delete"`
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("pubsub", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok || msg.Error != nil {
+		return nil, nil
+	}
+
+	var v event
+	found, err := core.DecodePayload(msg.Inner, nsEvent, "event", &v)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	ev := &Event{Message: msg, Service: msg.From}
+	switch {
+	case v.Items != nil:
+		ev.Node = v.Items.Node
+		ev.Items = v.Items.Items
+		for _, r := range v.Items.Retract {
+			ev.Retracted = append(ev.Retracted, r.ID)
+		}
+	case v.Purge != nil:
+		ev.Node = v.Purge.Node
+		ev.Purged = true
+	case v.Delete != nil:
+		ev.Node = v.Delete.Node
+		ev.Deleted = true
+	default:
+		// Notifications we don't support, like configuration
+		// changes.
+		return nil, nil
+	}
+	return []core.Stanza{ev}, nil
+}
+
+// convertError translates the error conditions of node management
+// into the package's errors.
+func convertError(err *core.Error) error {
+	for _, e := range err.Errors {
+		switch e.(type) {
+		case *core.ErrConflict:
+			return ErrNodeExists
+		case *core.ErrItemNotFound:
+			return ErrNodeNotFound
+		case *core.ErrForbidden:
+			return ErrNotOwner
+		}
+	}
+	return err
+}
+
+// request sends an IQ and waits for the reply, converting errors.
+func (c *Conn) request(to, typ string, v interface{}) (*core.IQ, error) {
+	ch, _ := c.SendIQ(to, typ, v)
+	res := <-ch
+	if res == nil {
+		return nil, core.ErrClosed
+	}
+	if res.IsError() {
+		return nil, convertError(res.Error)
+	}
+	return res, nil
+}
+
+// CreateNode creates a node. If name is empty, the service assigns a
+// name for an instant node. config, which may be nil, is used as the
+// node's initial configuration. The name of the created node is
+// returned.
+//
+// ErrNodeExists is returned if the node already exists.
+func (c *Conn) CreateNode(service, name string, config *dataforms.Form) (string, error) {
+	req := pubsub{Create: &create{name}}
+	if config != nil {
+		req.Configure = &configure{Form: config}
+	}
+
+	res, err := c.request(service, "set", req)
+	if err != nil {
+		return "", err
+	}
+
+	// The service only includes the node if it assigned the name.
+	var created pubsub
+	found, _ := core.DecodePayload(res.Inner, ns, "pubsub", &created)
+	if found && created.Create != nil && created.Create.Node != "" {
+		return created.Create.Node, nil
+	}
+	return name, nil
+}
+
+// Subscribe subscribes our bare JID to a node, after which its
+// notifications are delivered as Event. It returns the state of the
+// subscription, which is SubscriptionPending if the owner has to
+// approve it first.
+func (c *Conn) Subscribe(service, name string) (string, error) {
+	res, err := c.request(service, "set", pubsub{Subscribe: &subscription{Node: name, JID: bare(c.JID())}})
+	if err != nil {
+		return "", err
+	}
+
+	var v pubsub
+	found, _ := core.DecodePayload(res.Inner, ns, "pubsub", &v)
+	if !found || v.Subscription == nil || v.Subscription.Subscription == "" {
+		// Services may reply with an empty result.
+		return SubscriptionSubscribed, nil
+	}
+	return v.Subscription.Subscription, nil
+}
+
+// Unsubscribe cancels our subscription to a node.
+func (c *Conn) Unsubscribe(service, name string) error {
+	_, err := c.request(service, "set", pubsub{Unsubscribe: &subscription{Node: name, JID: bare(c.JID())}})
+	return err
+}
+
+// DeleteNode deletes a node. Subscribers will be notified.
+func (c *Conn) DeleteNode(service, name string) error {
+	_, err := c.request(service, "set", owner{Delete: &node{name}})
+	return err
+}
+
+// PurgeNode deletes all items published to a node.
+func (c *Conn) PurgeNode(service, name string) error {
+	_, err := c.request(service, "set", owner{Purge: &node{name}})
+	return err
+}
+
+// GetNodeConfiguration returns the configuration form of a node. It
+// can be filled in and submitted with ConfigureNode.
+func (c *Conn) GetNodeConfiguration(service, name string) (*dataforms.Form, error) {
+	res, err := c.request(service, "get", owner{Configure: &configure{Node: name}})
+	if err != nil {
+		return nil, err
+	}
+
+	var v owner
+	if err := xml.Unmarshal(res.Inner, &v); err != nil {
+		return nil, err
+	}
+	if v.Configure == nil || v.Configure.Form == nil {
+		return nil, ErrNoForm
+	}
+	return v.Configure.Form, nil
+}
+
+// ConfigureNode changes the configuration of a node. form should be a
+// submit form, usually based on the one returned by
+// GetNodeConfiguration.
+func (c *Conn) ConfigureNode(service, name string, form *dataforms.Form) error {
+	_, err := c.request(service, "set", owner{Configure: &configure{Node: name, Form: form}})
+	return err
+}
+
+// GetAffiliations returns the affiliations of all entities with a
+// node.
+func (c *Conn) GetAffiliations(service, name string) ([]Affiliation, error) {
+	res, err := c.request(service, "get", owner{Affiliations: &affiliations{Node: name}})
+	if err != nil {
+		return nil, err
+	}
+
+	var v owner
+	if err := xml.Unmarshal(res.Inner, &v); err != nil {
+		return nil, err
+	}
+	if v.Affiliations == nil {
+		return nil, nil
+	}
+	return v.Affiliations.Affiliations, nil
+}
+
+// SetAffiliations changes the affiliations of entities with a node.
+// Affiliations can be removed by setting them to AffiliationNone.
+func (c *Conn) SetAffiliations(service, name string, affs []Affiliation) error {
+	_, err := c.request(service, "set", owner{Affiliations: &affiliations{Node: name, Affiliations: affs}})
+	return err
+}
+
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	return jid
+}
@@ -0,0 +1,138 @@
+package pubsub_test
+
+import (
+	"honnef.co/go/xmpp/client/im"
+	"honnef.co/go/xmpp/client/xep/pubsub"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const service = "pubsub.example.com"
+
+func TestEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  string
+		// inner is the message's payload.
+		inner string
+		// want summarizes the Event, or is empty if none may be
+		// emitted.
+		want         string
+		wantHeadline bool
+	}{
+		{
+			name: "published",
+			typ:  "headline",
+			inner: "<event xmlns='http://jabber.org/protocol/pubsub#event'><items node='news'>" +
+				"<item id='i1' publisher='bob@example.com'><entry xmlns='http://www.w3.org/2005/Atom'>Hello</entry></item>" +
+				"<item id='i2'/></items></event>",
+			want:         "news: items [i1 by bob@example.com: <entry xmlns='http://www.w3.org/2005/Atom'>Hello</entry> i2 by : ]",
+			wantHeadline: true,
+		},
+		{
+			name:         "retracted",
+			typ:          "headline",
+			inner:        "<event xmlns='http://jabber.org/protocol/pubsub#event'><items node='news'><retract id='i1'/><retract id='i2'/></items></event>",
+			want:         "news: retracted [i1 i2]",
+			wantHeadline: true,
+		},
+		{
+			name:         "purged",
+			typ:          "headline",
+			inner:        "<event xmlns='http://jabber.org/protocol/pubsub#event'><purge node='news'/></event>",
+			want:         "news: purged",
+			wantHeadline: true,
+		},
+		{
+			name:         "deleted",
+			typ:          "headline",
+			inner:        "<event xmlns='http://jabber.org/protocol/pubsub#event'><delete node='news'/></event>",
+			want:         "news: deleted",
+			wantHeadline: true,
+		},
+		{
+			// Services may send notifications with any type.
+			name:  "normal message",
+			inner: "<event xmlns='http://jabber.org/protocol/pubsub#event'><purge node='news'/></event>",
+			want:  "news: purged",
+		},
+		{
+			name:         "configuration changed",
+			typ:          "headline",
+			inner:        "<event xmlns='http://jabber.org/protocol/pubsub#event'><configuration node='news'/></event>",
+			wantHeadline: true,
+		},
+		{name: "announcement", typ: "headline", inner: "<body>Maintenance tonight</body>", wantHeadline: true},
+		{
+			name:  "bounced",
+			typ:   "error",
+			inner: "<event xmlns='http://jabber.org/protocol/pubsub#event'><purge node='news'/></event><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>",
+		},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := c.RegisterXEP("pubsub"); err != nil {
+		t.Fatal(err)
+	}
+	im.Wrap(c)
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Sendf("<message xmlns='jabber:client' from='%s' type='%s'>%s</message>", service, tt.typ, tt.inner)
+
+			var got []string
+			headline := false
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stanza := range emitted {
+				switch stanza := stanza.(type) {
+				case *pubsub.Event:
+					if stanza.Service != service {
+						t.Errorf("got event from %s, want %s", stanza.Service, service)
+					}
+					got = append(got, summarize(stanza))
+				case *im.Headline:
+					headline = true
+				}
+			}
+
+			var want []string
+			if tt.want != "" {
+				want = []string{tt.want}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got events %q, want %q", got, want)
+			}
+			if headline != tt.wantHeadline {
+				t.Errorf("got headline %t, want %t", headline, tt.wantHeadline)
+			}
+		})
+	}
+}
+
+// summarize describes what an event reports.
+func summarize(ev *pubsub.Event) string {
+	switch {
+	case ev.Purged:
+		return ev.Node + ": purged"
+	case ev.Deleted:
+		return ev.Node + ": deleted"
+	case len(ev.Retracted) > 0:
+		return fmt.Sprintf("%s: retracted %v", ev.Node, ev.Retracted)
+	}
+	var items []string
+	for _, item := range ev.Items {
+		items = append(items, fmt.Sprintf("%s by %s: %s", item.ID, item.Publisher, item.Payload))
+	}
+	return fmt.Sprintf("%s: items %v", ev.Node, items)
+}
@@ -0,0 +1,118 @@
+// Package push implements the client side of XEP-0357 (Push
+// Notifications).
+//
+// Enabling push notifications tells the server to notify an app
+// server whenever something happens while the client isn't connected,
+// for example while its stream management session is suspended. The
+// app server can then wake up the device.
+package push
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+const ns = "urn:xmpp:push:0"
+
+var ErrUnsupported = errors.New("xmpp: server doesn't support push notifications")
+
+type Conn struct {
+	core.Client
+}
+
+type enable struct {
+	XMLName xml.Name        `xml:"urn:xmpp:push:0 enable"`
+	JID     string          `xml:"jid,attr"`
+	Node    string          `xml:"node,attr"`
+	Options *dataforms.Form `xml:",omitempty"`
+}
+
+type disable struct {
+	XMLName xml.Name `xml:"urn:xmpp:push:0 disable"`
+	JID     string   `xml:"jid,attr"`
+	Node    string   `xml:"node,attr,omitempty"`
+}
+
+func init() {
+	core.RegisterXEP("push", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	return &Conn{c}, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
+
+// Supported reports whether the server supports push notifications.
+// Support is advertised by our account, not the server itself.
+func (c *Conn) Supported() (bool, error) {
+	account := c.JID()
+	if i := strings.Index(account, "/"); i >= 0 {
+		account = account[:i]
+	}
+
+	info, err := c.MustGetXEP("disco").(*disco.Conn).GetInfo(account)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range info.Features {
+		if f.Var == ns {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// EnablePush enables push notifications via the app server
+// pushService, which will publish them on node. options are passed
+// on to the app server as publish options, they usually contain
+// credentials and may be nil.
+//
+// ErrUnsupported is returned if the server doesn't support push
+// notifications.
+func (c *Conn) EnablePush(pushService, node string, options *dataforms.Form) error {
+	ok, err := c.Supported()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUnsupported
+	}
+
+	if options != nil && options.Type == "" {
+		options.Type = dataforms.TypeSubmit
+	}
+	ch, _ := c.SendIQ("", "set", enable{
+		JID:     pushService,
+		Node:    node,
+		Options: options,
+	})
+	return result(<-ch)
+}
+
+// DisablePush disables push notifications via pushService. If node
+// is empty, all nodes of the app server are disabled.
+func (c *Conn) DisablePush(pushService, node string) error {
+	ch, _ := c.SendIQ("", "set", disable{
+		JID:  pushService,
+		Node: node,
+	})
+	return result(<-ch)
+}
+
+func result(res *core.IQ) error {
+	if res == nil {
+		return core.ErrClosed
+	}
+	if res.IsError() {
+		return res.Error
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package push_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xep/push"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// request is the payload of an enable or disable request.
+type request struct {
+	XMLName xml.Name
+	JID     string          `xml:"jid,attr"`
+	Node    string          `xml:"node,attr"`
+	Options *dataforms.Form `xml:"jabber:x:data x"`
+}
+
+func TestEnablePush(t *testing.T) {
+	options := func() *dataforms.Form {
+		f := &dataforms.Form{}
+		f.Set("FORM_TYPE", "http://jabber.org/protocol/pubsub#publish-options")
+		f.Set("secret", "eruio234vzxc2kla-91")
+		return f
+	}
+
+	tests := []struct {
+		name string
+		// features are the features advertised by our account.
+		features string
+		options  *dataforms.Form
+		// reply answers the enable request, the IQ's id is passed as
+		// the argument.
+		reply string
+		// want is the expected request, or nil if none may be sent.
+		want    *request
+		wantErr func(error) bool
+	}{
+		{
+			name:     "enabled",
+			features: "<feature var='urn:xmpp:push:0'/>",
+			reply:    "<iq xmlns='jabber:client' type='result' id='%s'/>",
+			want:     &request{XMLName: xml.Name{Space: "urn:xmpp:push:0", Local: "enable"}, JID: "push.example.com", Node: "yxs32uqsflafdk3iuqo"},
+		},
+		{
+			name:     "with options",
+			features: "<feature var='http://jabber.org/protocol/disco#info'/><feature var='urn:xmpp:push:0'/>",
+			options:  options(),
+			reply:    "<iq xmlns='jabber:client' type='result' id='%s'/>",
+			want: &request{
+				XMLName: xml.Name{Space: "urn:xmpp:push:0", Local: "enable"},
+				JID:     "push.example.com",
+				Node:    "yxs32uqsflafdk3iuqo",
+				Options: func() *dataforms.Form {
+					f := options()
+					// Options are submitted.
+					f.XMLName = xml.Name{Space: "jabber:x:data", Local: "x"}
+					f.Type = dataforms.TypeSubmit
+					return f
+				}(),
+			},
+		},
+		{
+			name:     "unsupported",
+			features: "<feature var='http://jabber.org/protocol/disco#info'/>",
+			wantErr:  func(err error) bool { return err == push.ErrUnsupported },
+		},
+		{
+			name:     "rejected",
+			features: "<feature var='urn:xmpp:push:0'/>",
+			reply:    "<iq xmlns='jabber:client' type='error' id='%s'><error type='cancel'><not-allowed xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			want:     &request{XMLName: xml.Name{Space: "urn:xmpp:push:0", Local: "enable"}, JID: "push.example.com", Node: "yxs32uqsflafdk3iuqo"},
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr) && stanzaErr.Type == "cancel"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("push")
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- x.(*push.Conn).EnablePush("push.example.com", "yxs32uqsflafdk3iuqo", tt.options)
+			}()
+
+			// Support is discovered on our account.
+			info, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.XMLName.Local != "iq" || info.Attribute("to") != "alice@example.com" {
+				t.Fatalf("got <%s> %v, want a disco#info request to our account", info.XMLName.Local, info.Attr)
+			}
+			s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='alice@example.com'>"+
+				"<query xmlns='http://jabber.org/protocol/disco#info'>%s</query></iq>",
+				info.Attribute("id"), tt.features)
+
+			if tt.want != nil {
+				iq, err := s.NextElement()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if iq.Attribute("type") != "set" || iq.Attribute("to") != "" {
+					t.Errorf("got request %v, want a set to our account", iq.Attr)
+				}
+				var got request
+				if err := xml.Unmarshal(iq.Inner, &got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(&got, tt.want) {
+					t.Errorf("got request %+v, want %+v", got, *tt.want)
+				}
+				s.Sendf(tt.reply, iq.Attribute("id"))
+			}
+
+			err = <-errc
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !tt.wantErr(err) {
+				t.Fatalf("got unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestDisablePush(t *testing.T) {
+	tests := []struct {
+		name string
+		node string
+	}{
+		{name: "node", node: "yxs32uqsflafdk3iuqo"},
+		// Without a node, all of the app server's nodes are disabled.
+		{name: "all nodes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("push")
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			errc := make(chan error, 1)
+			go func() { errc <- x.(*push.Conn).DisablePush("push.example.com", tt.node) }()
+
+			iq, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got request
+			if err := xml.Unmarshal(iq.Inner, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := request{XMLName: xml.Name{Space: "urn:xmpp:push:0", Local: "disable"}, JID: "push.example.com", Node: tt.node}
+			if iq.Attribute("type") != "set" || !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s request %+v, want a set of %+v", iq.Attribute("type"), got, want)
+			}
+			s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'/>", iq.Attribute("id"))
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Package register implements the account management parts of
+// XEP-0077 (In-Band Registration) that are available to authenticated
+// sessions: changing the password and deleting the account.
+package register
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"encoding/xml"
+	"strings"
+)
+
+type Conn struct {
+	core.Client
+}
+
+type remove struct {
+	XMLName xml.Name `xml:"jabber:iq:register query"`
+	Remove  struct{} `xml:"remove"`
+}
+
+type changePassword struct {
+	XMLName  xml.Name `xml:"jabber:iq:register query"`
+	Username string   `xml:"username"`
+	Password string   `xml:"password"`
+}
+
+func init() {
+	core.RegisterXEP("register", wrap)
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	return &Conn{c}, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
+
+// DeleteAccount deletes our account on the server. Servers may close
+// the stream instead of, or after, confirming the removal; both count
+// as success.
+func (c *Conn) DeleteAccount() error {
+	ch, _ := c.SendIQ("", "set", remove{})
+	res := <-ch
+	if res == nil {
+		// The server closed the stream, as it is allowed to.
+		return nil
+	}
+	if res.IsError() {
+		return res.Error
+	}
+	return nil
+}
+
+// ChangePassword changes the password of our account. The new
+// password will also be used when reconnecting.
+func (c *Conn) ChangePassword(password string) error {
+	user := c.JID()
+	if i := strings.Index(user, "@"); i >= 0 {
+		user = user[:i]
+	}
+
+	ch, _ := c.SendIQ("", "set", changePassword{Username: user, Password: password})
+	res := <-ch
+	if res == nil {
+		return core.ErrClosed
+	}
+	if res.IsError() {
+		return res.Error
+	}
+
+	if conn, ok := c.Client.(interface {
+		SetPassword(string)
+	}); ok {
+		conn.SetPassword(password)
+	}
+	return nil
+}
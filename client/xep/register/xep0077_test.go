@@ -0,0 +1,189 @@
+package register_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/register"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+// query is the payload of a jabber:iq:register request.
+type query struct {
+	XMLName  xml.Name  `xml:"jabber:iq:register query"`
+	Remove   *struct{} `xml:"remove"`
+	Username string    `xml:"username"`
+	Password string    `xml:"password"`
+}
+
+// nextQuery reads the next request sent to the server and checks that
+// it is an IQ set addressed to our account.
+func nextQuery(t *testing.T, s *xmpptest.Server) (query, xmpptest.Element) {
+	t.Helper()
+	iq, err := s.NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iq.XMLName.Local != "iq" || iq.Attribute("type") != "set" || iq.Attribute("to") != "" {
+		t.Fatalf("got <%s> %v, want an IQ set to our account", iq.XMLName.Local, iq.Attr)
+	}
+	var q query
+	if err := xml.Unmarshal(iq.Inner, &q); err != nil {
+		t.Fatal(err)
+	}
+	return q, iq
+}
+
+func TestDeleteAccount(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply answers the request, the IQ's id is passed as the
+		// argument. No reply is sent if it is empty.
+		reply string
+		// hangUp closes the stream after sending the reply.
+		hangUp  bool
+		wantErr func(error) bool
+	}{
+		{name: "removed", reply: "<iq xmlns='jabber:client' type='result' id='%s'/>"},
+		{name: "removed, stream closed", reply: "<iq xmlns='jabber:client' type='result' id='%s'/>", hangUp: true},
+		// Servers may close the stream without confirming the
+		// removal.
+		{name: "stream closed", hangUp: true},
+		{
+			name:  "forbidden",
+			reply: "<iq xmlns='jabber:client' type='error' id='%s'><error type='auth'><forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr) && stanzaErr.Type == "auth"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Conn.Close()
+			x, err := c.RegisterXEP("register")
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			errc := make(chan error, 1)
+			go func() { errc <- x.(*register.Conn).DeleteAccount() }()
+
+			q, iq := nextQuery(t, s)
+			if q.Remove == nil || q.Username != "" || q.Password != "" {
+				t.Errorf("got %s, want a lone <remove/>", iq.Inner)
+			}
+			if tt.reply != "" {
+				s.Sendf(tt.reply, iq.Attribute("id"))
+			}
+			if tt.hangUp {
+				s.Close()
+			}
+
+			err = <-errc
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !tt.wantErr(err) {
+				t.Fatalf("got unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply answers the request, the IQ's id is passed as the
+		// argument. The stream is closed instead if it is empty.
+		reply   string
+		wantErr func(error) bool
+	}{
+		{name: "changed", reply: "<iq xmlns='jabber:client' type='result' id='%s'/>"},
+		{
+			name:  "not acceptable",
+			reply: "<iq xmlns='jabber:client' type='error' id='%s'><error type='modify'><not-acceptable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr) && stanzaErr.Type == "modify"
+			},
+		},
+		{
+			name:    "closed",
+			wantErr: func(err error) bool { return err == core.ErrClosed },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := xmpptest.Pipe()
+			defer s.Conn.Close()
+			c := core.NewConnection(conn, "alice", s.Domain, "secret")
+			c.AllowReconnect = true
+			states := make(chan core.State, 16)
+			c.OnStateChange(func(old, new core.State) { states <- new })
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			if errs := c.Dial(); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			x, err := c.RegisterXEP("register")
+			if err != nil {
+				t.Fatal(err)
+			}
+			xmpptest.Stanzas(c)
+
+			go func() { errc <- x.(*register.Conn).ChangePassword("n3w") }()
+			q, iq := nextQuery(t, s)
+			if q.Username != "alice" || q.Password != "n3w" || q.Remove != nil {
+				t.Errorf("got %s, want username alice and password n3w", iq.Inner)
+			}
+			if tt.reply != "" {
+				s.Sendf(tt.reply, iq.Attribute("id"))
+			} else {
+				s.Close()
+			}
+
+			err = <-errc
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("got unexpected error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The new password is used when reconnecting.
+			s.Conn.Close()
+			for state := range states {
+				if state == core.StateDisconnected {
+					break
+				}
+			}
+			conn2, s2 := xmpptest.Pipe()
+			defer s2.Conn.Close()
+			s2.Password = "n3w"
+			go func() { errc <- s2.Negotiate() }()
+			if errs := c.Reconnect(conn2); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
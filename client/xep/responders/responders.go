@@ -0,0 +1,203 @@
+// Package responders answers the queries that every client or bot is
+// expected to answer, without having to register and wire up each XEP
+// separately: pings (XEP-0199), software version (XEP-0092), entity
+// time (XEP-0202) and last activity (XEP-0012). The corresponding
+// features are advertised via service discovery (XEP-0030) and, in
+// presences, entity capabilities (XEP-0115).
+package responders
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/internal/clock"
+	"honnef.co/go/xmpp/client/xep/disco"
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+
+	// Registered by name in EnableStandardResponders.
+	_ "honnef.co/go/xmpp/client/xep/caps"
+	_ "honnef.co/go/xmpp/client/xep/ping"
+
+	"encoding/xml"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	nsVersion = "jabber:iq:version"
+	nsTime    = "urn:xmpp:time"
+	nsLast    = "jabber:iq:last"
+)
+
+// ErrLastRegistered is returned by EnableStandardResponders if the
+// last XEP, which leaves answering last activity queries to the
+// application, has been registered and LastActivity isn't disabled.
+var ErrLastRegistered = errors.New("xmpp: last activity queries are already answered by the last XEP")
+
+// Responder identifies one of the responders, for disabling it.
+type Responder int
+
+const (
+	Ping Responder = 1 << iota
+	Version
+	Time
+	LastActivity
+	// Caps stops capabilities from being included in presences.
+	Caps
+)
+
+// ResponderInfo configures EnableStandardResponders. The zero value
+// enables all responders with their defaults.
+type ResponderInfo struct {
+	// Name and Version are the name and version of the software,
+	// returned for software version queries. Name defaults to the
+	// last element of the main module's path, or to the name of the
+	// executable, and Version to the main module's version, both as
+	// recorded in the build info.
+	Name    string
+	Version string
+	// OS is the operating system returned for software version
+	// queries. It is omitted if empty, as it reveals more about the
+	// user than most clients want to.
+	OS string
+
+	// Identity is advertised via service discovery, unless other
+	// identities have been added. Bots should use the category
+	// "client" and the type "bot".
+	Identity *disco.Identity
+
+	// Now returns the time for entity time queries, in the time
+	// zone to report. It defaults to time.Now.
+	Now func() time.Time
+
+	// Idle returns for how long the user has been idle, for last
+	// activity queries. It defaults to reporting that the user is
+	// active, which is always true for bots.
+	Idle func() time.Duration
+
+	// Disable lists responders that shouldn't be enabled, for
+	// example Version|LastActivity.
+	Disable Responder
+}
+
+func (info *ResponderInfo) defaults() {
+	if info.Name == "" || info.Version == "" {
+		name, version := buildInfo()
+		if info.Name == "" {
+			info.Name = name
+		}
+		if info.Version == "" {
+			info.Version = version
+		}
+	}
+	if info.Now == nil {
+		info.Now = clock.Now
+	}
+	if info.Idle == nil {
+		info.Idle = func() time.Duration { return 0 }
+	}
+}
+
+func buildInfo() (name, version string) {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Path != "" {
+		name = path.Base(bi.Main.Path)
+		if bi.Main.Version != "(devel)" {
+			version = bi.Main.Version
+		}
+	}
+	if name == "" && len(os.Args) > 0 {
+		name = filepath.Base(os.Args[0])
+	}
+	return name, version
+}
+
+func (info ResponderInfo) enabled(r Responder) bool {
+	return info.Disable&r == 0
+}
+
+// EnableStandardResponders registers the XEPs and IQ handlers that
+// answer the standard queries and advertises their features. It
+// should be called before sending initial presence, so that the
+// announced capabilities are complete.
+//
+// Last activity queries have a single owner: if the last XEP has been
+// registered, LastActivity has to be disabled, otherwise
+// ErrLastRegistered is returned before anything is enabled.
+// Registering the last XEP afterwards takes over answering them.
+func EnableStandardResponders(c core.Client, info ResponderInfo) error {
+	info.defaults()
+	if _, ok := c.GetXEP("last"); ok && info.enabled(LastActivity) {
+		return ErrLastRegistered
+	}
+
+	x, err := c.RegisterXEP("disco")
+	if err != nil {
+		return err
+	}
+	discovery := x.(*disco.Conn)
+	if info.Identity != nil {
+		discovery.AddIdentity(*info.Identity)
+	}
+
+	if info.enabled(Ping) {
+		if _, err := c.RegisterXEP("ping"); err != nil {
+			return err
+		}
+	}
+	if info.enabled(Version) {
+		discovery.AddFeature(nsVersion)
+		c.HandleIQ("get", nsVersion, info.handleVersion)
+	}
+	if info.enabled(Time) {
+		discovery.AddFeature(nsTime)
+		c.HandleIQ("get", nsTime, info.handleTime)
+	}
+	if info.enabled(LastActivity) {
+		discovery.AddFeature(nsLast)
+		c.HandleIQ("get", nsLast, info.handleLast)
+	}
+	// Capabilities are computed from the disco features when a
+	// presence is sent, so they include everything added above.
+	if info.enabled(Caps) {
+		if _, err := c.RegisterXEP("caps"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (info ResponderInfo) handleVersion(*core.IQ) (interface{}, error) {
+	return struct {
+		XMLName xml.Name `xml:"jabber:iq:version query"`
+		Name    string   `xml:"name"`
+		Version string   `xml:"version"`
+		OS      string   `xml:"os,omitempty"`
+	}{
+		Name:    info.Name,
+		Version: info.Version,
+		OS:      info.OS,
+	}, nil
+}
+
+func (info ResponderInfo) handleTime(*core.IQ) (interface{}, error) {
+	now := info.Now()
+	return struct {
+		XMLName xml.Name `xml:"urn:xmpp:time time"`
+		TZO     string   `xml:"tzo"`
+		UTC     string   `xml:"utc"`
+	}{
+		TZO: now.Format("-07:00"),
+		UTC: xmpptime.FormatDateTime(now),
+	}, nil
+}
+
+func (info ResponderInfo) handleLast(*core.IQ) (interface{}, error) {
+	return struct {
+		XMLName xml.Name `xml:"jabber:iq:last query"`
+		Seconds uint64   `xml:"seconds,attr"`
+	}{
+		Seconds: uint64(info.Idle() / time.Second),
+	}, nil
+}
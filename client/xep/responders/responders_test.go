@@ -0,0 +1,252 @@
+package responders_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+	"honnef.co/go/xmpp/client/xep/last"
+	"honnef.co/go/xmpp/client/xep/responders"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLastActivityOwner(t *testing.T) {
+	tests := []struct {
+		name string
+		// before and after register the last XEP before or after
+		// enabling the responders.
+		before  bool
+		after   bool
+		disable responders.Responder
+		wantErr error
+		// wantSeconds is the idle time in the reply, 90 if it comes
+		// from the responders and 5 if from the application.
+		wantSeconds string
+	}{
+		{name: "responders", wantSeconds: "90"},
+		{name: "last registered before", before: true, wantErr: responders.ErrLastRegistered},
+		{name: "last registered before, responder disabled", before: true, disable: responders.LastActivity, wantSeconds: "5"},
+		{name: "last registered after", after: true, wantSeconds: "5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			stanzas := xmpptest.Stanzas(c)
+
+			if tt.before {
+				c.MustRegisterXEP("last")
+			}
+			err = responders.EnableStandardResponders(c, responders.ResponderInfo{
+				Idle:    func() time.Duration { return 90 * time.Second },
+				Disable: tt.disable,
+			})
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.after {
+				c.MustRegisterXEP("last")
+			}
+
+			s.Send("<iq xmlns='jabber:client' type='get' id='l1' from='bob@example.com/phone'><query xmlns='jabber:iq:last'/></iq>")
+			if tt.wantSeconds == "5" {
+				go last.Reply(nextRequest(t, stanzas), 5)
+			}
+			reply, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Attribute("id") != "l1" || reply.Attribute("type") != "result" {
+				t.Fatalf("got %s reply to %q: %s", reply.Attribute("type"), reply.Attribute("id"), reply.Inner)
+			}
+			want := `<query xmlns="jabber:iq:last" seconds="` + tt.wantSeconds + `"></query>`
+			if string(reply.Inner) != want {
+				t.Errorf("got %s, want %s", reply.Inner, want)
+			}
+		})
+	}
+}
+
+func nextRequest(t *testing.T, stanzas <-chan core.Stanza) *last.LastActivityRequest {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case stanza := <-stanzas:
+			if req, ok := stanza.(*last.LastActivityRequest); ok {
+				return req
+			}
+		case <-timeout:
+			t.Fatal("no request emitted")
+		}
+	}
+}
+
+func TestStandardResponders(t *testing.T) {
+	type version struct {
+		Name    string  `xml:"name"`
+		Version string  `xml:"version"`
+		OS      *string `xml:"os"`
+	}
+	linux := "Linux"
+	zone := time.FixedZone("", -(3*60+30)*60)
+
+	tests := []struct {
+		name string
+		info responders.ResponderInfo
+		// wantVersion, wantTZO, wantUTC and wantSeconds are the
+		// expected replies, empty for a default that can't be
+		// predicted.
+		wantVersion  version
+		wantTZO      string
+		wantUTC      string
+		wantSeconds  string
+		wantIdentity disco.Identity
+		// missing are the features that mustn't be advertised.
+		missing  []string
+		wantCaps bool
+	}{
+		{
+			name:         "defaults",
+			wantSeconds:  "0",
+			wantIdentity: disco.DefaultIdentity,
+			wantCaps:     true,
+		},
+		{
+			name: "configured",
+			info: responders.ResponderInfo{
+				Name:     "echobot",
+				Version:  "1.2.3",
+				OS:       linux,
+				Identity: &disco.Identity{Category: "client", Type: "bot", Name: "Echo"},
+				Now:      func() time.Time { return time.Date(2024, 3, 1, 8, 0, 0, 0, zone) },
+				Idle:     func() time.Duration { return 90*time.Second + 500*time.Millisecond },
+			},
+			wantVersion:  version{Name: "echobot", Version: "1.2.3", OS: &linux},
+			wantTZO:      "-03:30",
+			wantUTC:      "2024-03-01T11:30:00Z",
+			wantSeconds:  "90",
+			wantIdentity: disco.Identity{Category: "client", Type: "bot", Name: "Echo"},
+			wantCaps:     true,
+		},
+		{
+			name:         "disabled",
+			info:         responders.ResponderInfo{Disable: responders.Version | responders.Time | responders.Caps},
+			wantSeconds:  "0",
+			wantIdentity: disco.DefaultIdentity,
+			missing:      []string{"jabber:iq:version", "urn:xmpp:time"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			xmpptest.Stanzas(c)
+			if err := responders.EnableStandardResponders(c, tt.info); err != nil {
+				t.Fatal(err)
+			}
+			disabled := make(map[string]bool)
+			for _, ns := range tt.missing {
+				disabled[ns] = true
+			}
+
+			// query sends a query from bob and returns the result.
+			query := func(id, payload string, v interface{}) {
+				t.Helper()
+				s.Sendf("<iq xmlns='jabber:client' type='get' id='%s' from='bob@example.com/phone'>%s</iq>", id, payload)
+				reply, err := s.NextElement()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reply.Attribute("id") != id || reply.Attribute("type") != "result" || reply.Attribute("to") != "bob@example.com/phone" {
+					t.Fatalf("got %v %s in reply to %s", reply.Attr, reply.Inner, id)
+				}
+				if v != nil {
+					if err := xml.Unmarshal(reply.Inner, v); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			var info struct {
+				Identities []disco.Identity `xml:"identity"`
+				Features   []disco.Feature  `xml:"feature"`
+			}
+			query("d1", "<query xmlns='http://jabber.org/protocol/disco#info'/>", &info)
+			advertised := make(map[string]bool)
+			for _, f := range info.Features {
+				advertised[f.Var] = true
+			}
+			for _, ns := range []string{"urn:xmpp:ping", "jabber:iq:version", "urn:xmpp:time", "jabber:iq:last"} {
+				if advertised[ns] == disabled[ns] {
+					t.Errorf("%s advertised: %t, want %t", ns, advertised[ns], !disabled[ns])
+				}
+			}
+			if len(info.Identities) != 1 || info.Identities[0] != tt.wantIdentity {
+				t.Errorf("got identities %+v, want %+v", info.Identities, tt.wantIdentity)
+			}
+
+			query("p1", "<ping xmlns='urn:xmpp:ping'/>", nil)
+
+			var last struct {
+				Seconds string `xml:"seconds,attr"`
+			}
+			query("l1", "<query xmlns='jabber:iq:last'/>", &last)
+			if last.Seconds != tt.wantSeconds {
+				t.Errorf("got idle time %s, want %s", last.Seconds, tt.wantSeconds)
+			}
+
+			if !disabled["jabber:iq:version"] {
+				var got version
+				query("v1", "<query xmlns='jabber:iq:version'/>", &got)
+				if tt.wantVersion.Name == "" {
+					// Taken from the build info.
+					if got.Name == "" || got.OS != nil {
+						t.Errorf("got %+v, want a name and no OS", got)
+					}
+				} else if got.Name != tt.wantVersion.Name || got.Version != tt.wantVersion.Version || got.OS == nil || *got.OS != *tt.wantVersion.OS {
+					t.Errorf("got %+v, want %+v", got, tt.wantVersion)
+				}
+			}
+
+			if !disabled["urn:xmpp:time"] {
+				var got struct {
+					TZO string `xml:"tzo"`
+					UTC string `xml:"utc"`
+				}
+				query("t1", "<time xmlns='urn:xmpp:time'/>", &got)
+				if tt.wantUTC == "" {
+					utc, err := time.Parse(time.RFC3339, got.UTC)
+					if err != nil || time.Since(utc) > time.Minute || time.Until(utc) > time.Minute {
+						t.Errorf("got time %s (%v), want the current time", got.UTC, err)
+					}
+				} else if got.TZO != tt.wantTZO || got.UTC != tt.wantUTC {
+					t.Errorf("got time %s in %s, want %s in %s", got.UTC, got.TZO, tt.wantUTC, tt.wantTZO)
+				}
+			}
+
+			go c.SendPresence(core.Presence{})
+			p, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasCaps := strings.Contains(string(p.Inner), "http://jabber.org/protocol/caps"); hasCaps != tt.wantCaps {
+				t.Errorf("got presence %s, want capabilities: %t", p.Inner, tt.wantCaps)
+			}
+		})
+	}
+}
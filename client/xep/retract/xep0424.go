@@ -0,0 +1,110 @@
+// Package retract implements XEP-0424 (Message Retraction).
+//
+// A retraction asks the recipients of a message to no longer display
+// it. Messages are identified by their origin ID (XEP-0359), or by
+// the stanza ID assigned by the room for messages sent to rooms.
+// Inbound retractions are delivered as synthetic Retraction stanzas.
+package retract
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/xml"
+)
+
+const (
+	ns         = "urn:xmpp:message-retract:1"
+	nsFallback = "urn:xmpp:fallback:0"
+)
+
+// FallbackBody is sent as the body of retractions, for clients that
+// don't support them.
+var FallbackBody = "This person attempted to retract a previous message, but it's unsupported by your client."
+
+type retract struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-retract:1 retract"`
+	ID      string   `xml:"id,attr"`
+}
+
+type fallback struct {
+	XMLName xml.Name `xml:"urn:xmpp:fallback:0 fallback"`
+	For     string   `xml:"for,attr"`
+}
+
+type store struct {
+	XMLName xml.Name `xml:"urn:xmpp:hints store"`
+}
+
+// Retraction is emitted when the sender of a message retracted it.
+//
+// Applications must only remove the retracted message if it has been
+// sent by the sender of the retraction.
+type Retraction struct {
+	*core.Message
+	// RetractedID is the origin ID of the retracted message, or its
+	// stanza ID for messages in rooms.
+	RetractedID string
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("retract", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+// RetractMessage retracts a message that we sent to to. originalID is
+// the origin ID of the message.
+func (c *Conn) RetractMessage(to, originalID string) error {
+	return c.send("chat", to, originalID)
+}
+
+// RetractRoomMessage retracts a message that we sent to a room.
+// stanzaID is the stanza ID that the room assigned to the message.
+func (c *Conn) RetractRoomMessage(room, stanzaID string) error {
+	return c.send("groupchat", room, stanzaID)
+}
+
+func (c *Conn) send(typ, to, id string) error {
+	msg := core.Message{
+		Header: core.Header{
+			To:   to,
+			Type: typ,
+			Id:   c.NewID(),
+		},
+		Body: FallbackBody,
+	}
+	msg.Inner, _ = core.AppendPayload(msg.Inner, retract{ID: id})
+	msg.Inner, _ = core.AppendPayload(msg.Inner, fallback{For: ns})
+	msg.Inner, _ = core.AppendPayload(msg.Inner, store{})
+
+	return c.Encode(msg)
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok || msg.Type == "error" {
+		return nil, nil
+	}
+
+	var v retract
+	found, err := core.DecodePayload(msg.Inner, ns, "retract", &v)
+	if err != nil || !found || v.ID == "" {
+		return nil, err
+	}
+
+	return []core.Stanza{&Retraction{msg, v.ID}}, nil
+}
@@ -0,0 +1,152 @@
+package retract_test
+
+import (
+	"honnef.co/go/xmpp/client/xep/retract"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"testing"
+)
+
+// retraction is a retraction as sent on the wire.
+type retraction struct {
+	Body    string `xml:"body"`
+	Retract *struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:message-retract:1 retract"`
+	Fallback *struct {
+		For string `xml:"for,attr"`
+	} `xml:"urn:xmpp:fallback:0 fallback"`
+	Store *struct{} `xml:"urn:xmpp:hints store"`
+}
+
+func TestRetractMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		room     bool
+		to       string
+		id       string
+		wantType string
+	}{
+		{name: "chat", to: "bob@example.com", id: "origin-1", wantType: "chat"},
+		{name: "room", room: true, to: "room@muc.example.com", id: "stanza-1", wantType: "groupchat"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	x, err := c.RegisterXEP("retract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := x.(*retract.Conn)
+	xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			go func() {
+				if tt.room {
+					errc <- conn.RetractRoomMessage(tt.to, tt.id)
+				} else {
+					errc <- conn.RetractMessage(tt.to, tt.id)
+				}
+			}()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			if e.XMLName.Local != "message" || e.Attribute("to") != tt.to || e.Attribute("type") != tt.wantType || e.Attribute("id") == "" {
+				t.Errorf("got <%s> %v, want a message of type %s to %s with an ID", e.XMLName.Local, e.Attr, tt.wantType, tt.to)
+			}
+			if e.Attribute("id") == tt.id {
+				t.Error("the retraction reuses the ID of the retracted message")
+			}
+			var got retraction
+			if err := xml.Unmarshal([]byte("<message>"+string(e.Inner)+"</message>"), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Retract == nil || got.Retract.ID != tt.id {
+				t.Errorf("got %s, want <retract id=%q/>", e.Inner, tt.id)
+			}
+			if got.Body != retract.FallbackBody || got.Fallback == nil || got.Fallback.For != "urn:xmpp:message-retract:1" {
+				t.Errorf("got %s, want a fallback body marked as such", e.Inner)
+			}
+			// Retractions have to reach offline recipients and the
+			// archive to be effective.
+			if got.Store == nil {
+				t.Errorf("got %s, want a store hint", e.Inner)
+			}
+		})
+	}
+}
+
+func TestRetraction(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  string
+		// inner is the message's payload.
+		inner string
+		// want is the retracted ID, or empty if no retraction may be
+		// emitted.
+		want string
+	}{
+		{
+			name:  "chat",
+			typ:   "chat",
+			inner: "<retract xmlns='urn:xmpp:message-retract:1' id='origin-1'/><fallback xmlns='urn:xmpp:fallback:0' for='urn:xmpp:message-retract:1'/><body>retracted</body>",
+			want:  "origin-1",
+		},
+		{name: "groupchat", typ: "groupchat", inner: "<retract xmlns='urn:xmpp:message-retract:1' id='stanza-1'/>", want: "stanza-1"},
+		{name: "without ID", typ: "chat", inner: "<retract xmlns='urn:xmpp:message-retract:1'/>"},
+		{name: "old namespace", typ: "chat", inner: "<retract xmlns='urn:xmpp:message-retract:0' id='origin-1'/>"},
+		{name: "bounced", typ: "error", inner: "<retract xmlns='urn:xmpp:message-retract:1' id='origin-1'/><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>"},
+		{name: "plain message", typ: "chat", inner: "<body>hi</body>"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := c.RegisterXEP("retract"); err != nil {
+		t.Fatal(err)
+	}
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Sendf("<message xmlns='jabber:client' from='bob@example.com/phone' type='%s'>%s</message>", tt.typ, tt.inner)
+
+			var got []*retract.Retraction
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stanza := range emitted {
+				if stanza, ok := stanza.(*retract.Retraction); ok {
+					got = append(got, stanza)
+				}
+			}
+
+			if tt.want == "" {
+				if len(got) != 0 {
+					t.Fatalf("got retraction of %q", got[0].RetractedID)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d retractions, want 1", len(got))
+			}
+			if got[0].RetractedID != tt.want || got[0].From != "bob@example.com/phone" {
+				t.Errorf("got retraction of %q by %s, want %q by bob@example.com/phone", got[0].RetractedID, got[0].From, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// Package si implements XEP-0095 (Stream Initiation) with the file
+// transfer profile of XEP-0096 (SI File Transfer).
+//
+// Files are offered with SendFile and transferred over SOCKS5
+// bytestreams (XEP-0065). Offers made to us are delivered as
+// synthetic FileOffer stanzas, which can be accepted or declined.
+package si
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/bytestreams"
+	"honnef.co/go/xmpp/client/xep/dataforms"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	ns              = "http://jabber.org/protocol/si"
+	nsFileTransfer  = "http://jabber.org/protocol/si/profile/file-transfer"
+	nsFeatureNeg    = "http://jabber.org/protocol/feature-neg"
+	nsBytestreams   = "http://jabber.org/protocol/bytestreams"
+	fieldStreamMeth = "stream-method"
+)
+
+var ErrNoStreamMethod = errors.New("xmpp: no common stream method")
+
+// File describes a file being offered.
+type File struct {
+	Name string     `xml:"name,attr"`
+	Size int64      `xml:"size,attr"`
+	Hash string     `xml:"hash,attr,omitempty"`
+	Date *time.Time `xml:"date,attr,omitempty"`
+	Desc string     `xml:"desc,omitempty"`
+}
+
+type fileElement struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/si/profile/file-transfer file"`
+	File
+}
+
+type feature struct {
+	XMLName xml.Name        `xml:"http://jabber.org/protocol/feature-neg feature"`
+	Form    *dataforms.Form `xml:"jabber:x:data x"`
+}
+
+type si struct {
+	XMLName  xml.Name     `xml:"http://jabber.org/protocol/si si"`
+	ID       string       `xml:"id,attr,omitempty"`
+	Profile  string       `xml:"profile,attr,omitempty"`
+	MimeType string       `xml:"mime-type,attr,omitempty"`
+	File     *fileElement `xml:"file,omitempty"`
+	Feature  feature      `xml:"feature"`
+}
+
+// FileOffer is emitted when somebody offers to send us a file.
+type FileOffer struct {
+	*core.IQ
+	File     File
+	MimeType string
+	sid      string
+	c        *Conn
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("si", wrap, "disco", "bytestreams")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+	discovery.AddFeature(nsFileTransfer)
+	// Offers are answered by the application once Process emitted
+	// them as FileOffers.
+	c.DeliverIQ("set", ns)
+
+	return conn, nil
+}
+
+func (c *Conn) bytestreams() *bytestreams.Conn {
+	return c.MustGetXEP("bytestreams").(*bytestreams.Conn)
+}
+
+func newSID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SendFile offers a file to an entity and, once the offer has been
+// accepted, returns a writer for the file's contents. The writer has
+// to be closed once the whole file has been written.
+func (c *Conn) SendFile(to string, f File, mimeType string) (io.WriteCloser, error) {
+	sid := newSID()
+
+	form := &dataforms.Form{Type: dataforms.TypeForm}
+	form.Fields = []dataforms.Field{{
+		Var:     fieldStreamMeth,
+		Type:    "list-single",
+		Options: []dataforms.Option{{Value: nsBytestreams}},
+	}}
+	ch, _ := c.SendIQ(to, "set", si{
+		ID:       sid,
+		Profile:  nsFileTransfer,
+		MimeType: mimeType,
+		File:     &fileElement{File: f},
+		Feature:  feature{Form: form},
+	})
+
+	res := <-ch
+	if res == nil {
+		return nil, core.ErrClosed
+	}
+	if res.IsError() {
+		return nil, res.Error
+	}
+
+	var answer si
+	if err := xml.Unmarshal(res.Inner, &answer); err != nil {
+		return nil, err
+	}
+	if answer.Feature.Form == nil || answer.Feature.Form.Get(fieldStreamMeth) != nsBytestreams {
+		return nil, ErrNoStreamMethod
+	}
+
+	return c.bytestreams().Open(to, sid)
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	iq, ok := stanza.(*core.IQ)
+	if !ok || iq.Type != "set" {
+		return nil, nil
+	}
+
+	var offer si
+	found, err := core.DecodePayload(iq.Inner, ns, "si", &offer)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if offer.Profile != nsFileTransfer || offer.File == nil {
+		c.SendError(iq, "cancel", "", core.ErrBadRequest{})
+		return nil, nil
+	}
+
+	return []core.Stanza{&FileOffer{
+		IQ:       iq,
+		File:     offer.File.File,
+		MimeType: offer.MimeType,
+		sid:      offer.ID,
+		c:        c,
+	}}, nil
+}
+
+// Accept accepts the offer and returns a reader for the file's
+// contents. The reader has to be closed once done.
+func (o *FileOffer) Accept() (io.ReadCloser, error) {
+	var offered si
+	core.DecodePayload(o.Inner, ns, "si", &offered)
+
+	supported := false
+	if offered.Feature.Form != nil {
+		for _, field := range offered.Feature.Form.Fields {
+			if field.Var != fieldStreamMeth {
+				continue
+			}
+			for _, opt := range field.Options {
+				if opt.Value == nsBytestreams {
+					supported = true
+				}
+			}
+		}
+	}
+	if !supported {
+		o.c.SendError(o.IQ, "cancel", "", core.ErrBadRequest{})
+		return nil, ErrNoStreamMethod
+	}
+
+	// Register for the bytestream before the initiator can offer it.
+	bs := o.c.bytestreams()
+	expected := bs.Expect(o.sid)
+
+	form := dataforms.NewSubmitForm("")
+	form.Set(fieldStreamMeth, nsBytestreams)
+	o.c.SendIQReply(o.IQ, "result", si{Feature: feature{Form: form}})
+
+	return bs.AcceptExpected(o.sid, expected)
+}
+
+// Decline declines the offer.
+func (o *FileOffer) Decline() {
+	o.c.SendError(o.IQ, "cancel", "Offer declined", core.ErrForbidden{})
+}
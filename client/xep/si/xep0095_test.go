@@ -0,0 +1,255 @@
+package si_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/bytestreams"
+	"honnef.co/go/xmpp/client/xep/si"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const offer = "<iq xmlns='jabber:client' type='set' id='offer' from='alice@example.com/desktop'>" +
+	"<si xmlns='http://jabber.org/protocol/si' id='s1' profile='%s' mime-type='text/plain'>" +
+	"<file xmlns='http://jabber.org/protocol/si/profile/file-transfer' name='notes.txt' size='5'/>" +
+	"<feature xmlns='http://jabber.org/protocol/feature-neg'><x xmlns='jabber:x:data' type='form'>" +
+	"<field var='stream-method' type='list-single'><option><value>%s</value></option></field>" +
+	"</x></feature></si></iq>"
+
+const (
+	profile       = "http://jabber.org/protocol/si/profile/file-transfer"
+	bytestreamsNS = "http://jabber.org/protocol/bytestreams"
+	ibb           = "http://jabber.org/protocol/ibb"
+)
+
+// connect returns a client with stream initiation registered.
+func connect(t *testing.T, user string) (*core.Conn, *si.Conn, *xmpptest.Server) {
+	t.Helper()
+	c, s, err := xmpptest.Connect(user, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	x, err := c.RegisterXEP("si")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, x.(*si.Conn), s
+}
+
+// nextOffer returns the next file offer emitted by c.
+func nextOffer(t *testing.T, c *core.Conn) *si.FileOffer {
+	t.Helper()
+	for {
+		stanza, err := c.NextStanza()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offer, ok := stanza.(*si.FileOffer); ok {
+			return offer
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	const content = "hello"
+	alice, sender, s1 := connect(t, "alice")
+	bob, _, s2 := connect(t, "bob")
+	xmpptest.Stanzas(alice)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	alice.MustGetXEP("bytestreams").(*bytestreams.Conn).Listener = l
+
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	file := si.File{Name: "notes.txt", Size: int64(len(content)), Date: &date, Desc: "Meeting notes"}
+	errc := make(chan error, 2)
+	go func() {
+		w, err := sender.SendFile(s2.JID(), file, "text/plain")
+		if err != nil {
+			errc <- err
+			return
+		}
+		io.WriteString(w, content)
+		errc <- w.Close()
+	}()
+
+	if _, err := s1.Forward(s2); err != nil {
+		t.Fatal(err)
+	}
+	got := nextOffer(t, bob)
+	if got.From != s1.JID() || got.File.Name != file.Name || got.File.Size != file.Size ||
+		got.File.Desc != file.Desc || got.File.Date == nil || !got.File.Date.Equal(date) || got.MimeType != "text/plain" {
+		t.Fatalf("got offer of %+v (%s) from %s, want %+v (text/plain) from %s", got.File, got.MimeType, got.From, file, s1.JID())
+	}
+	xmpptest.Stanzas(bob)
+	received := make(chan []byte, 1)
+	go func() {
+		r, err := got.Accept()
+		if err != nil {
+			errc <- err
+			received <- nil
+			return
+		}
+		defer r.Close()
+		b, _ := io.ReadAll(r)
+		received <- b
+	}()
+
+	// The stream initiation is accepted, followed by the bytestream
+	// being offered and accepted.
+	for _, route := range []struct{ from, to *xmpptest.Server }{{s2, s1}, {s1, s2}, {s2, s1}} {
+		if _, err := route.from.Forward(route.to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b := <-received; string(b) != content {
+		t.Errorf("received %q, want %q", b, content)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileOffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		method  string
+		decline bool
+		// wantOffer is false for offers that are answered without
+		// being emitted.
+		wantOffer bool
+		wantErr   error
+		// wantReply is the condition of the error we answer with.
+		wantReply string
+	}{
+		{name: "unknown profile", profile: "urn:example:profile", method: bytestreamsNS, wantReply: "bad-request"},
+		{name: "no common method", profile: profile, method: ibb, wantOffer: true, wantErr: si.ErrNoStreamMethod, wantReply: "bad-request"},
+		{name: "declined", profile: profile, method: bytestreamsNS, wantOffer: true, decline: true, wantReply: "forbidden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, s := connect(t, "bob")
+			stanzas := xmpptest.Stanzas(c)
+			s.Sendf(offer, tt.profile, tt.method)
+			var reply xmpptest.Element
+			var err error
+			if !tt.wantOffer {
+				// Offers we can't handle are answered right away.
+				if reply, err = s.NextElement(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *si.FileOffer
+			for _, stanza := range emitted {
+				if stanza, ok := stanza.(*si.FileOffer); ok {
+					got = stanza
+				}
+			}
+			if (got != nil) != tt.wantOffer {
+				t.Fatalf("got offer %v, want one: %t", got, tt.wantOffer)
+			}
+
+			errc := make(chan error, 1)
+			switch {
+			case got == nil:
+				errc <- nil
+			case tt.decline:
+				go func() {
+					got.Decline()
+					errc <- nil
+				}()
+			default:
+				go func() {
+					_, err := got.Accept()
+					errc <- err
+				}()
+			}
+			if got != nil {
+				if reply, err = s.NextElement(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := <-errc; !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if reply.Attribute("type") != "error" || reply.Attribute("id") != "offer" || !bytes.Contains(reply.Inner, []byte(tt.wantReply)) {
+				t.Errorf("got reply %v %s, want a %s error", reply.Attr, reply.Inner, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	const to = "bob@example.com/phone"
+	tests := []struct {
+		name    string
+		reply   string
+		wantErr func(error) bool
+	}{
+		{
+			name:  "refused",
+			reply: "<iq xmlns='jabber:client' type='error' id='%s' from='" + to + "'><error type='cancel'><forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+			wantErr: func(err error) bool {
+				var stanzaErr *core.Error
+				return errors.As(err, &stanzaErr)
+			},
+		},
+		{
+			name: "other method",
+			reply: "<iq xmlns='jabber:client' type='result' id='%s' from='" + to + "'><si xmlns='http://jabber.org/protocol/si'>" +
+				"<feature xmlns='http://jabber.org/protocol/feature-neg'><x xmlns='jabber:x:data' type='submit'>" +
+				"<field var='stream-method'><value>" + ibb + "</value></field></x></feature></si></iq>",
+			wantErr: func(err error) bool { return err == si.ErrNoStreamMethod },
+		},
+		{
+			// Without a listener or proxies, the bytestream can't
+			// be offered.
+			name: "no stream hosts",
+			reply: "<iq xmlns='jabber:client' type='result' id='%s' from='" + to + "'><si xmlns='http://jabber.org/protocol/si'>" +
+				"<feature xmlns='http://jabber.org/protocol/feature-neg'><x xmlns='jabber:x:data' type='submit'>" +
+				"<field var='stream-method'><value>" + bytestreamsNS + "</value></field></x></feature></si></iq>",
+			wantErr: func(err error) bool { return err == bytestreams.ErrNoStreamHosts },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, sender, s := connect(t, "alice")
+			xmpptest.Stanzas(c)
+
+			errc := make(chan error, 1)
+			go func() {
+				_, err := sender.SendFile(to, si.File{Name: "notes.txt", Size: 5}, "")
+				errc <- err
+			}()
+			req, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Attribute("to") != to || !bytes.Contains(req.Inner, []byte(profile)) {
+				t.Fatalf("got %v %s, want a file transfer offer", req.Attr, req.Inner)
+			}
+			s.Sendf(tt.reply, req.Attribute("id"))
+
+			if err := <-errc; !tt.wantErr(err) {
+				t.Errorf("got unexpected error %v", err)
+			}
+		})
+	}
+}
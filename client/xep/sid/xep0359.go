@@ -0,0 +1,249 @@
+// Package sid implements XEP-0359 (Unique and Stable Stanza IDs).
+//
+// Origin IDs are attached to outgoing messages by the sender, stanza
+// IDs are stamped onto messages by the server or room that archives
+// them. Both stay the same when a message is delivered again, for
+// example via carbons or the archive, and can be used to deduplicate
+// messages, which Deduplicator does.
+package sid
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/carbons"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"bytes"
+	"container/list"
+	"encoding/xml"
+	"strings"
+	"sync"
+)
+
+const ns = "urn:xmpp:sid:0"
+
+// StanzaID is an ID assigned to a message by the entity By.
+type StanzaID struct {
+	ID string `xml:"id,attr"`
+	By string `xml:"by,attr"`
+}
+
+type originID struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 origin-id"`
+	ID      string   `xml:"id,attr"`
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("sid", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
+
+// AddOriginID attaches a new origin ID to an outgoing message and
+// returns it. If the message doesn't have an ID yet, the origin ID is
+// used as its ID, too.
+func (c *Conn) AddOriginID(m *core.Message) string {
+	id := c.NewID()
+	if m.Id == "" {
+		m.Id = id
+	}
+	m.Inner, _ = core.AppendPayload(m.Inner, originID{ID: id})
+	return id
+}
+
+// OriginID returns the origin ID of a message, or the empty string.
+func OriginID(m *core.Message) string {
+	var v originID
+	core.DecodePayload(m.Inner, ns, "origin-id", &v)
+	return v.ID
+}
+
+// StanzaIDs returns all stanza IDs of a message.
+//
+// Stanza IDs can be forged by the sender. Only IDs assigned by
+// entities that are known to stamp them, like our own server or a
+// room, should be trusted, see StanzaIDBy.
+func StanzaIDs(m *core.Message) []StanzaID {
+	var ids []StanzaID
+	d := xml.NewDecoder(bytes.NewReader(m.Inner))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ids
+		}
+
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Space == ns && start.Name.Local == "stanza-id" {
+			var id StanzaID
+			if d.DecodeElement(&id, &start) == nil {
+				ids = append(ids, id)
+			}
+			continue
+		}
+		if d.Skip() != nil {
+			return ids
+		}
+	}
+}
+
+// StanzaIDBy returns the stanza ID assigned to a message by the entity
+// by, usually our bare JID or the bare JID of a room.
+func StanzaIDBy(m *core.Message, by string) (string, bool) {
+	for _, id := range StanzaIDs(m) {
+		if id.By == by {
+			return id.ID, true
+		}
+	}
+	return "", false
+}
+
+// Deduplicator remembers the IDs of recently seen messages to detect
+// messages that are delivered more than once, for example live and
+// again when catching up with the archive, or both directly and as a
+// carbon copy.
+//
+// Messages are identified by their origin ID and the stanza ID
+// assigned by the archive of the conversation, which is our own for
+// one-on-one conversations and the room's for groupchats. Messages
+// without either are identified by their ID, which isn't guaranteed
+// to be unique but is better than nothing. A message is a duplicate
+// if any of its IDs has been seen in the same conversation before.
+type Deduplicator struct {
+	// own is our bare JID.
+	own string
+
+	mu   sync.Mutex
+	size int
+	// seen maps keys to their elements in order, which is ordered
+	// from least to most recently seen.
+	seen  map[string]*list.Element
+	order *list.List
+}
+
+// NewDeduplicator returns a Deduplicator that remembers the IDs of up
+// to size messages. own is our JID, whose archive stamps the stanza
+// IDs of one-on-one conversations.
+func NewDeduplicator(size int, own string) *Deduplicator {
+	return &Deduplicator{
+		own:   bare(own),
+		size:  size,
+		seen:  make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Duplicate records a message that is part of the conversation with
+// the bare JID conversation, and reports whether it has been seen
+// before.
+func (d *Deduplicator) Duplicate(conversation string, m *core.Message) bool {
+	return d.duplicate(conversation, "", m)
+}
+
+// DuplicateArchived is like Duplicate, for messages retrieved from an
+// archive (XEP-0313). archiveID is the ID the archive assigned to the
+// message, which is its stanza ID.
+func (d *Deduplicator) DuplicateArchived(conversation, archiveID string, m *core.Message) bool {
+	return d.duplicate(conversation, archiveID, m)
+}
+
+func (d *Deduplicator) duplicate(conversation, archiveID string, m *core.Message) bool {
+	conversation = bare(conversation)
+	by := d.own
+	if m.Type == "groupchat" {
+		by = conversation
+	}
+
+	var keys []string
+	if id := OriginID(m); id != "" {
+		keys = append(keys, "origin "+id)
+	}
+	if archiveID != "" {
+		keys = append(keys, "stanza "+archiveID)
+	} else if id, ok := StanzaIDBy(m, by); ok {
+		keys = append(keys, "stanza "+id)
+	}
+	if len(keys) == 0 {
+		if m.Id == "" {
+			return false
+		}
+		keys = append(keys, "id "+m.Id)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dup := false
+	for _, key := range keys {
+		key = conversation + " " + key
+		if e, ok := d.seen[key]; ok {
+			dup = true
+			d.order.MoveToBack(e)
+			continue
+		}
+		d.seen[key] = d.order.PushBack(key)
+	}
+	for d.order.Len() > d.size {
+		e := d.order.Front()
+		delete(d.seen, e.Value.(string))
+		d.order.Remove(e)
+	}
+	return dup
+}
+
+// EnableDeduplication adds a filter that drops duplicate messages,
+// including duplicate carbon copies (XEP-0280), before they are
+// delivered. The returned Deduplicator remembers up to size messages
+// and should be used to check messages retrieved from the archive as
+// well, so that messages received live aren't shown again.
+//
+// It has to be called once the connection has been bound.
+func (c *Conn) EnableDeduplication(size int) *Deduplicator {
+	d := NewDeduplicator(size, c.JID())
+	c.AddFilter(func(s core.Stanza) bool {
+		m, ok := s.(*core.Message)
+		if !ok || m.Type == "error" {
+			return true
+		}
+
+		conversation := m.From
+		if carbon, ok := carbons.Unwrap(m, c.JID()); ok {
+			m = carbon.Message
+			conversation = m.From
+			if carbon.Direction == carbons.Sent {
+				conversation = m.To
+			}
+		}
+		if m.Body == "" {
+			// Only messages with content are shown, and chat
+			// states and the like may reuse IDs.
+			return true
+		}
+		return !d.Duplicate(conversation, m)
+	})
+	return d
+}
+
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	return jid
+}
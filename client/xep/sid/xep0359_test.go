@@ -0,0 +1,296 @@
+package sid_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/carbons"
+	"honnef.co/go/xmpp/client/xep/sid"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		// id is the message's ID before the origin ID is added.
+		id string
+		// stamped are the stanza IDs the server adds, as raw XML.
+		stamped string
+		want    []sid.StanzaID
+		// wantOwn is the stanza ID assigned by our account.
+		wantOwn string
+	}{
+		{name: "no stanza ID"},
+		{name: "own ID", id: "m1"},
+		{
+			name:    "stamped by our account",
+			stamped: "<stanza-id xmlns='urn:xmpp:sid:0' id='5f3dbc5e-e1d3-4077-a492-693f3769c7ad' by='alice@example.com'/>",
+			want:    []sid.StanzaID{{ID: "5f3dbc5e-e1d3-4077-a492-693f3769c7ad", By: "alice@example.com"}},
+			wantOwn: "5f3dbc5e-e1d3-4077-a492-693f3769c7ad",
+		},
+		{
+			name: "stamped by others",
+			stamped: "<stanza-id xmlns='urn:xmpp:sid:0' id='room-1' by='room@muc.example.com'/>" +
+				"<stanza-id xmlns='urn:xmpp:sid:0' id='forged' by='mallory@example.net'/>",
+			want: []sid.StanzaID{{ID: "room-1", By: "room@muc.example.com"}, {ID: "forged", By: "mallory@example.net"}},
+		},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	x, err := c.RegisterXEP("sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := x.(*sid.Conn)
+	stanzas := xmpptest.Stanzas(c)
+
+	seen := make(map[string]bool)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := core.Message{Header: core.Header{To: "bob@example.com", Type: "chat", Id: tt.id}, Body: "hi"}
+			originID := conn.AddOriginID(&msg)
+			if originID == "" || seen[originID] {
+				t.Fatalf("got origin ID %q, which isn't unique", originID)
+			}
+			seen[originID] = true
+			wantID := tt.id
+			if wantID == "" {
+				wantID = originID
+			}
+			if msg.Id != wantID {
+				t.Errorf("got message ID %q, want %q", msg.Id, wantID)
+			}
+
+			errc := make(chan error, 1)
+			go func() { errc <- c.SendElement(msg) }()
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			// Reflect the message back, as if it had been copied to
+			// another of our clients, with the server's stamps.
+			s.Sendf("<message xmlns='jabber:client' from='alice@example.com/xmpptest' to='bob@example.com' type='chat' id='%s'>%s%s</message>",
+				e.Attribute("id"), e.Inner, tt.stamped)
+			var got *core.Message
+			select {
+			case stanza := <-stanzas:
+				got = stanza.(*core.Message)
+			case <-time.After(5 * time.Second):
+				t.Fatal("message wasn't delivered")
+			}
+
+			if id := sid.OriginID(got); id != originID {
+				t.Errorf("got origin ID %q, want %q", id, originID)
+			}
+			if ids := sid.StanzaIDs(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got stanza IDs %v, want %v", ids, tt.want)
+			}
+			id, ok := sid.StanzaIDBy(got, "alice@example.com")
+			if id != tt.wantOwn || ok != (tt.wantOwn != "") {
+				t.Errorf("got stanza ID %q, %t by our account, want %q", id, ok, tt.wantOwn)
+			}
+		})
+	}
+}
+
+// chat is a message from bob to alice with the given payload.
+func chat(id, body, inner string) string {
+	return fmt.Sprintf("<message xmlns='jabber:client' from='bob@example.com/phone' to='alice@example.com/xmpptest' type='chat' id='%s'><body>%s</body>%s</message>",
+		id, body, inner)
+}
+
+// carbon wraps a message as a carbon copy.
+func carbon(dir, msg string) string {
+	return "<message xmlns='jabber:client' from='alice@example.com' to='alice@example.com/xmpptest'><" + dir + " xmlns='urn:xmpp:carbons:2'>" +
+		"<forwarded xmlns='urn:xmpp:forward:0'>" + msg + "</forwarded></" + dir + "></message>"
+}
+
+func origin(id string) string {
+	return "<origin-id xmlns='urn:xmpp:sid:0' id='" + id + "'/>"
+}
+
+func stanzaID(id, by string) string {
+	return "<stanza-id xmlns='urn:xmpp:sid:0' id='" + id + "' by='" + by + "'/>"
+}
+
+func TestDeduplication(t *testing.T) {
+	sent := "<message xmlns='jabber:client' from='alice@example.com/laptop' to='bob@example.com' type='chat' id='m1'><body>sent</body>" + origin("o1") + "</message>"
+	groupchat := func(body string) string {
+		return "<message xmlns='jabber:client' from='room@muc.example.com/bob' type='groupchat' id='g1'><body>" + body + "</body>" +
+			stanzaID("r1", "room@muc.example.com") + "</message>"
+	}
+
+	tests := []struct {
+		name string
+		size int
+		// live are the messages received before the archived
+		// message is checked, and after it if afterArchive is set.
+		live         []string
+		afterArchive bool
+		// want are the bodies of the delivered messages, including
+		// carbon copies.
+		want []string
+		// archived is a message retrieved from our archive with the
+		// ID archiveID, if any.
+		archived  string
+		archiveID string
+		wantDup   bool
+	}{
+		{
+			name: "carbon after live",
+			live: []string{chat("m1", "one", origin("o1")), carbon("received", chat("m1", "two", origin("o1")))},
+			want: []string{"one"},
+		},
+		{
+			name: "sent carbon twice",
+			live: []string{carbon("sent", sent), carbon("sent", sent)},
+			want: []string{"sent"},
+		},
+		{
+			name:      "archive after carbon",
+			live:      []string{carbon("received", chat("m1", "one", origin("o1")+stanzaID("s1", "alice@example.com")))},
+			want:      []string{"one"},
+			archived:  chat("m1", "one", ""),
+			archiveID: "s1",
+			wantDup:   true,
+		},
+		{
+			name:     "archive after live by origin ID",
+			live:     []string{chat("m1", "one", origin("o1"))},
+			want:     []string{"one"},
+			archived: chat("m1", "one", origin("o1")),
+			// The archive always assigns its own ID.
+			archiveID: "s1",
+			wantDup:   true,
+		},
+		{
+			name:         "live after archive",
+			live:         []string{chat("m1", "one", origin("o1")+stanzaID("s1", "alice@example.com"))},
+			afterArchive: true,
+			archived:     chat("m1", "one", origin("o1")),
+			archiveID:    "s1",
+		},
+		{
+			name:      "new in archive",
+			live:      []string{chat("m1", "one", origin("o1"))},
+			want:      []string{"one"},
+			archived:  chat("m2", "two", origin("o2")),
+			archiveID: "s2",
+		},
+		{
+			name: "other conversations",
+			live: []string{
+				chat("m1", "one", origin("o1")),
+				strings.Replace(chat("m1", "two", origin("o1")), "bob@", "carol@", 1),
+			},
+			want: []string{"one", "two"},
+		},
+		{
+			name: "groupchat",
+			live: []string{groupchat("one"), groupchat("two")},
+			want: []string{"one"},
+		},
+		{
+			// Stanza IDs not assigned by the conversation's archive
+			// can't be trusted.
+			name: "foreign stanza ID",
+			live: []string{chat("m1", "one", stanzaID("s1", "mallory@example.net")), chat("m2", "two", stanzaID("s1", "mallory@example.net"))},
+			want: []string{"one", "two"},
+		},
+		{
+			name: "plain ID",
+			live: []string{chat("m1", "one", ""), chat("m1", "two", ""), chat("m2", "three", "")},
+			want: []string{"one", "three"},
+		},
+		{
+			name: "no ID",
+			live: []string{chat("", "one", ""), chat("", "two", "")},
+			want: []string{"one", "two"},
+		},
+		{
+			name: "forgotten",
+			size: 2,
+			live: []string{chat("m1", "one", origin("o1")), chat("m2", "two", origin("o2")), chat("m3", "three", origin("o3")), chat("m1", "four", origin("o1"))},
+			want: []string{"one", "two", "three", "four"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("sid")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.RegisterXEP("carbons"); err != nil {
+				t.Fatal(err)
+			}
+			size := tt.size
+			if size == 0 {
+				size = 100
+			}
+			d := x.(*sid.Conn).EnableDeduplication(size)
+			stanzas := xmpptest.Stanzas(c)
+
+			checkArchived := func() {
+				if tt.archived == "" {
+					return
+				}
+				var m core.Message
+				if err := xml.Unmarshal([]byte(tt.archived), &m); err != nil {
+					t.Fatal(err)
+				}
+				if dup := d.DuplicateArchived("bob@example.com", tt.archiveID, &m); dup != tt.wantDup {
+					t.Errorf("archived message reported as duplicate: %t, want %t", dup, tt.wantDup)
+				}
+			}
+
+			if tt.afterArchive {
+				checkArchived()
+			}
+			for _, msg := range tt.live {
+				s.Send(msg)
+			}
+
+			var got []string
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stanza := range emitted {
+				switch stanza := stanza.(type) {
+				case *carbons.Carbon:
+					got = append(got, stanza.Body)
+				case *core.Message:
+					if stanza.Body != "" {
+						got = append(got, stanza.Body)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got messages %q, want %q", got, tt.want)
+			}
+
+			if !tt.afterArchive {
+				checkArchived()
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Package vcard implements XEP-0054 (vcard-temp).
+//
+// Only the most commonly used fields of a vCard are represented
+// directly. All other fields are preserved in Other, so that a vCard
+// can be retrieved, modified and stored again without losing data.
+package vcard
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+)
+
+const ns = "vcard-temp"
+
+// Photo is an embedded image, usually an avatar.
+type Photo struct {
+	// Type is the image's MIME type.
+	Type string `xml:"TYPE"`
+	// BinVal is the base64 encoded image.
+	BinVal string `xml:"BINVAL"`
+}
+
+// Data returns the decoded image.
+func (p *Photo) Data() ([]byte, error) {
+	// Many clients wrap the base64 data in lines.
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, p.BinVal)
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// NewPhoto returns a photo containing data.
+func NewPhoto(data []byte, mimeType string) *Photo {
+	return &Photo{Type: mimeType, BinVal: base64.StdEncoding.EncodeToString(data)}
+}
+
+// Element is a vCard field that isn't represented by VCard.
+type Element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+type VCard struct {
+	XMLName  xml.Name  `xml:"vcard-temp vCard"`
+	FullName string    `xml:"FN,omitempty"`
+	Nickname string    `xml:"NICKNAME,omitempty"`
+	Photo    *Photo    `xml:"PHOTO,omitempty"`
+	Other    []Element `xml:",any"`
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("vcard", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	return nil, nil
+}
+
+// Get retrieves the vCard of a bare JID, or our own if jid is empty.
+// An empty vCard is returned if the entity doesn't have one.
+func (c *Conn) Get(jid string) (*VCard, error) {
+	ch, _ := c.SendIQ(jid, "get", VCard{})
+	res := <-ch
+	if res == nil {
+		return nil, core.ErrClosed
+	}
+	if res.IsError() {
+		for _, e := range res.Error.Errors {
+			if _, ok := e.(*core.ErrItemNotFound); ok {
+				return &VCard{}, nil
+			}
+		}
+		return nil, res.Error
+	}
+
+	v := &VCard{}
+	found, err := core.DecodePayload(res.Inner, ns, "vCard", v)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &VCard{}, nil
+	}
+	return v, nil
+}
+
+// Set replaces our own vCard. To change individual fields, modify
+// the vCard returned by Get.
+func (c *Conn) Set(v *VCard) error {
+	ch, _ := c.SendIQ("", "set", v)
+	res := <-ch
+	if res == nil {
+		return core.ErrClosed
+	}
+	if res.IsError() {
+		return res.Error
+	}
+	return nil
+}
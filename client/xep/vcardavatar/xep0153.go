@@ -0,0 +1,209 @@
+// Package vcardavatar implements XEP-0153 (vCard-Based Avatars).
+//
+// Contacts announce the SHA-1 hash of their avatar, which is stored
+// in their vCard, in their presence. Announcements of changed avatars
+// are delivered as synthetic AvatarUpdate stanzas, and Avatar fetches
+// the current avatar of a contact, caching it by hash.
+//
+// Our own avatar is published with Publish and announced in all
+// presences broadcast afterwards.
+package vcardavatar
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/vcard"
+
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+)
+
+const ns = "vcard-temp:x:update"
+
+// ErrNoAvatar is returned by Avatar if the contact doesn't have an
+// avatar, or hasn't announced one.
+var ErrNoAvatar = errors.New("xmpp: contact has no avatar")
+
+type update struct {
+	XMLName xml.Name `xml:"vcard-temp:x:update x"`
+	Photo   *string  `xml:"photo"`
+}
+
+// Avatar is an image and its MIME type.
+type Avatar struct {
+	Data []byte
+	Type string
+}
+
+// AvatarUpdate is emitted when a contact announces a different avatar
+// than before.
+type AvatarUpdate struct {
+	*core.Presence
+	// Hash is the hash of the new avatar, or the empty string if the
+	// contact removed its avatar.
+	Hash string
+}
+
+type Conn struct {
+	core.Client
+
+	mu sync.Mutex
+	// hashes maps bare JIDs to their announced avatar hashes.
+	hashes map[string]string
+	// avatars caches avatars by hash.
+	avatars map[string]Avatar
+	// ours is the hash of our own avatar, nil if we haven't
+	// published one.
+	ours *string
+}
+
+func init() {
+	core.RegisterXEP("vcardavatar", wrap, "vcard")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client:  c,
+		hashes:  make(map[string]string),
+		avatars: make(map[string]Avatar),
+	}
+
+	c.AddPresenceDecorator(conn.announce)
+
+	return conn, nil
+}
+
+// Hash returns the hash identifying an avatar.
+func Hash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// announced returns the hash announced in a presence. ok is false if
+// the presence doesn't announce anything, which is different from
+// announcing that there is no avatar.
+func announced(p *core.Presence) (hash string, ok bool) {
+	var v update
+	found, err := core.DecodePayload(p.Inner, ns, "x", &v)
+	if err != nil || !found || v.Photo == nil {
+		return "", false
+	}
+	return strings.ToLower(strings.TrimSpace(*v.Photo)), true
+}
+
+// changed records the hash announced by jid and reports whether it
+// differs from the one announced before.
+func (c *Conn) changed(jid, hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, known := c.hashes[jid]
+	c.hashes[jid] = hash
+	return !known || old != hash
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	p, ok := stanza.(*core.Presence)
+	if !ok || p.Type != "" {
+		return nil, nil
+	}
+
+	hash, ok := announced(p)
+	if !ok || !c.changed(bare(p.From), hash) {
+		return nil, nil
+	}
+	return []core.Stanza{&AvatarUpdate{p, hash}}, nil
+}
+
+// Avatar returns the avatar a contact announced last, fetching it
+// from the contact's vCard unless it has been cached already.
+func (c *Conn) Avatar(jid string) (Avatar, error) {
+	jid = bare(jid)
+	c.mu.Lock()
+	hash := c.hashes[jid]
+	avatar, cached := c.avatars[hash]
+	c.mu.Unlock()
+
+	if hash == "" {
+		return Avatar{}, ErrNoAvatar
+	}
+	if cached {
+		return avatar, nil
+	}
+
+	v, err := c.MustGetXEP("vcard").(*vcard.Conn).Get(jid)
+	if err != nil {
+		return Avatar{}, err
+	}
+	if v.Photo == nil {
+		return Avatar{}, ErrNoAvatar
+	}
+	data, err := v.Photo.Data()
+	if err != nil {
+		return Avatar{}, err
+	}
+
+	avatar = Avatar{Data: data, Type: v.Photo.Type}
+	// Only cache avatars that match their hash, so that a stale
+	// vCard is fetched again.
+	if Hash(data) == hash {
+		c.mu.Lock()
+		c.avatars[hash] = avatar
+		c.mu.Unlock()
+	}
+	return avatar, nil
+}
+
+// Publish stores an avatar in our vCard, keeping its other fields,
+// and announces it in the presences broadcast from now on. A nil data
+// removes the avatar. The current presence has to be broadcast again
+// for contacts to learn about the change.
+func (c *Conn) Publish(data []byte, mimeType string) error {
+	vc := c.MustGetXEP("vcard").(*vcard.Conn)
+	v, err := vc.Get("")
+	if err != nil {
+		return err
+	}
+
+	hash := ""
+	if data == nil {
+		v.Photo = nil
+	} else {
+		v.Photo = vcard.NewPhoto(data, mimeType)
+		hash = Hash(data)
+	}
+	if err := vc.Set(v); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.ours = &hash
+	c.mu.Unlock()
+	return nil
+}
+
+// announce includes the hash of our avatar in broadcast presences.
+func (c *Conn) announce(p *core.Presence) {
+	if p.To != "" || p.Type != "" || core.HasPayload(p.Inner, ns, "x") {
+		return
+	}
+
+	c.mu.Lock()
+	ours := c.ours
+	c.mu.Unlock()
+	if ours == nil {
+		// Not announcing anything tells contacts that we don't
+		// know our avatar, as opposed to not having one.
+		return
+	}
+	p.Inner, _ = core.AppendPayload(p.Inner, update{Photo: ours})
+}
+
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		jid = jid[:i]
+	}
+	return jid
+}
@@ -0,0 +1,367 @@
+package vcardavatar_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/vcard"
+	"honnef.co/go/xmpp/client/xep/vcardavatar"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	png     = []byte("\x89PNG\r\n\x1a\nnot quite an image")
+	pngHash = vcardavatar.Hash(png)
+)
+
+// photo is a presence's vCard update as raw XML.
+func photo(hash string) string {
+	return "<x xmlns='vcard-temp:x:update'><photo>" + hash + "</photo></x>"
+}
+
+func TestAvatarUpdate(t *testing.T) {
+	type presence struct {
+		from  string
+		typ   string
+		inner string
+	}
+
+	tests := []struct {
+		name      string
+		presences []presence
+		// want are the hashes of the emitted updates.
+		want []string
+	}{
+		{
+			name:      "first announcement",
+			presences: []presence{{from: "bob@example.com/phone", inner: photo("abc")}},
+			want:      []string{"abc"},
+		},
+		{
+			name: "unchanged",
+			presences: []presence{
+				{from: "bob@example.com/phone", inner: photo("abc")},
+				{from: "bob@example.com/phone", inner: "<show>away</show>" + photo("abc")},
+			},
+			want: []string{"abc"},
+		},
+		{
+			// Hashes are per account, not per resource.
+			name: "other resource",
+			presences: []presence{
+				{from: "bob@example.com/phone", inner: photo("abc")},
+				{from: "bob@example.com/laptop", inner: photo("abc")},
+			},
+			want: []string{"abc"},
+		},
+		{
+			name: "changed",
+			presences: []presence{
+				{from: "bob@example.com/phone", inner: photo("abc")},
+				{from: "bob@example.com/phone", inner: photo("def")},
+			},
+			want: []string{"abc", "def"},
+		},
+		{
+			name: "removed",
+			presences: []presence{
+				{from: "bob@example.com/phone", inner: photo("abc")},
+				{from: "bob@example.com/phone", inner: photo("")},
+			},
+			want: []string{"abc", ""},
+		},
+		{
+			name: "case and whitespace",
+			presences: []presence{
+				{from: "bob@example.com/phone", inner: photo("abc")},
+				{from: "bob@example.com/phone", inner: photo("\n  ABC\n")},
+			},
+			want: []string{"abc"},
+		},
+		{
+			name: "different contacts",
+			presences: []presence{
+				{from: "bob@example.com/phone", inner: photo("abc")},
+				{from: "carol@example.com/phone", inner: photo("abc")},
+			},
+			want: []string{"abc", "abc"},
+		},
+		{
+			// An update without a photo means that the contact
+			// doesn't know its avatar yet.
+			name: "not ready",
+			presences: []presence{
+				{from: "bob@example.com/phone", inner: photo("abc")},
+				{from: "bob@example.com/phone", inner: "<x xmlns='vcard-temp:x:update'/>"},
+			},
+			want: []string{"abc"},
+		},
+		{
+			name:      "unavailable",
+			presences: []presence{{from: "bob@example.com/phone", typ: "unavailable", inner: photo("abc")}},
+		},
+		{
+			name:      "no announcement",
+			presences: []presence{{from: "bob@example.com/phone", inner: "<status>Hi</status>"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if _, err := c.RegisterXEP("vcardavatar"); err != nil {
+				t.Fatal(err)
+			}
+			stanzas := xmpptest.Stanzas(c)
+
+			for _, p := range tt.presences {
+				s.Sendf("<presence xmlns='jabber:client' from='%s' type='%s'>%s</presence>", p.from, p.typ, p.inner)
+			}
+
+			var got []string
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stanza := range emitted {
+				if stanza, ok := stanza.(*vcardavatar.AvatarUpdate); ok {
+					got = append(got, stanza.Hash)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got updates %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvatar(t *testing.T) {
+	tests := []struct {
+		name string
+		// announced is the hash bob announces, if any.
+		announced string
+		// vcard is bob's vCard as raw XML.
+		vcard string
+		// wantFetches is the number of vCard requests made by
+		// fetching the avatar twice.
+		wantFetches int
+		wantErr     error
+	}{
+		{
+			name:        "cached",
+			announced:   pngHash,
+			vcard:       "<vCard xmlns='vcard-temp'><PHOTO><TYPE>image/png</TYPE><BINVAL>" + base64.StdEncoding.EncodeToString(png) + "</BINVAL></PHOTO></vCard>",
+			wantFetches: 1,
+		},
+		{
+			name:      "wrapped base64",
+			announced: pngHash,
+			vcard: "<vCard xmlns='vcard-temp'><PHOTO><TYPE>image/png</TYPE><BINVAL>\n" +
+				base64.StdEncoding.EncodeToString(png[:12]) + "\n" + base64.StdEncoding.EncodeToString(png[12:]) + "\n</BINVAL></PHOTO></vCard>",
+			wantFetches: 1,
+		},
+		{
+			// A vCard that doesn't match the announced hash hasn't
+			// been updated yet and is fetched again.
+			name:        "stale",
+			announced:   vcardavatar.Hash([]byte("newer")),
+			vcard:       "<vCard xmlns='vcard-temp'><PHOTO><TYPE>image/png</TYPE><BINVAL>" + base64.StdEncoding.EncodeToString(png) + "</BINVAL></PHOTO></vCard>",
+			wantFetches: 2,
+		},
+		{
+			name:        "no photo",
+			announced:   pngHash,
+			vcard:       "<vCard xmlns='vcard-temp'><FN>Bob</FN></vCard>",
+			wantFetches: 2,
+			wantErr:     vcardavatar.ErrNoAvatar,
+		},
+		{
+			name:    "not announced",
+			wantErr: vcardavatar.ErrNoAvatar,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("vcardavatar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := x.(*vcardavatar.Conn)
+			stanzas := xmpptest.Stanzas(c)
+
+			if tt.announced != "" {
+				s.Sendf("<presence xmlns='jabber:client' from='bob@example.com/phone'>%s</presence>", photo(tt.announced))
+				select {
+				case <-stanzas:
+				case <-time.After(5 * time.Second):
+					t.Fatal("presence wasn't delivered")
+				}
+			}
+
+			fetches := make(chan string, 2)
+			go func() {
+				for {
+					iq, err := s.NextElement()
+					if err != nil {
+						return
+					}
+					fetches <- iq.Attribute("to")
+					s.Sendf("<iq xmlns='jabber:client' type='result' id='%s' from='bob@example.com'>%s</iq>", iq.Attribute("id"), tt.vcard)
+				}
+			}()
+
+			for i := 0; i < 2; i++ {
+				avatar, err := conn.Avatar("bob@example.com/phone")
+				if tt.wantErr != nil {
+					if err != tt.wantErr {
+						t.Fatalf("got %v, want %v", err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(avatar.Data, png) || avatar.Type != "image/png" {
+					t.Errorf("got %q of type %s, want the PNG", avatar.Data, avatar.Type)
+				}
+			}
+			if len(fetches) != tt.wantFetches {
+				t.Errorf("got %d vCard requests, want %d", len(fetches), tt.wantFetches)
+			}
+			for len(fetches) > 0 {
+				if to := <-fetches; to != "bob@example.com" {
+					t.Errorf("requested the vCard of %q, want bob@example.com", to)
+				}
+			}
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	tests := []struct {
+		name string
+		// publish is false if nothing is published before sending
+		// presence.
+		publish bool
+		data    []byte
+		// want is the announced hash, nil if none may be announced.
+		want *string
+	}{
+		{name: "unknown"},
+		{name: "avatar", publish: true, data: png, want: &pngHash},
+		{name: "no avatar", publish: true, want: new(string)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s, err := xmpptest.Connect("alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			x, err := c.RegisterXEP("vcardavatar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := x.(*vcardavatar.Conn)
+			xmpptest.Stanzas(c)
+
+			if tt.publish {
+				errc := make(chan error, 1)
+				go func() {
+					err := func() error {
+						iq, err := s.NextElement()
+						if err != nil {
+							return err
+						}
+						if iq.Attribute("type") != "get" || iq.Attribute("to") != "" {
+							return fmt.Errorf("got %v, want a request for our own vCard", iq.Attr)
+						}
+						s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'><vCard xmlns='vcard-temp'><FN>Alice</FN>"+
+							"<PHOTO><TYPE>image/jpeg</TYPE><BINVAL>b2xk</BINVAL></PHOTO><BDAY>1815-12-10</BDAY></vCard></iq>", iq.Attribute("id"))
+
+						iq, err = s.NextElement()
+						if err != nil {
+							return err
+						}
+						var v vcard.VCard
+						if err := xml.Unmarshal(iq.Inner, &v); err != nil {
+							return err
+						}
+						if iq.Attribute("type") != "set" || v.FullName != "Alice" || len(v.Other) != 1 || v.Other[0].XMLName.Local != "BDAY" {
+							return fmt.Errorf("got %v %s, want our vCard with its other fields kept", iq.Attr, iq.Inner)
+						}
+						switch {
+						case tt.data == nil && v.Photo != nil:
+							return fmt.Errorf("got photo %+v, want it removed", v.Photo)
+						case tt.data != nil && (v.Photo == nil || v.Photo.Type != "image/png"):
+							return fmt.Errorf("got photo %+v, want the PNG", v.Photo)
+						case tt.data != nil:
+							if data, err := v.Photo.Data(); err != nil || !bytes.Equal(data, tt.data) {
+								return fmt.Errorf("got photo %q, %v, want the PNG", data, err)
+							}
+						}
+						return s.Sendf("<iq xmlns='jabber:client' type='result' id='%s'/>", iq.Attribute("id"))
+					}()
+					if err != nil {
+						// Unblock the client.
+						s.Conn.Close()
+					}
+					errc <- err
+				}()
+				err := conn.Publish(tt.data, "image/png")
+				if e := <-errc; e != nil {
+					t.Fatal(e)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				_, err := c.SendPresence(core.Presence{})
+				errc <- err
+			}()
+			p, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Update *struct {
+					Photo *string `xml:"photo"`
+				} `xml:"vcard-temp:x:update x"`
+			}
+			if err := xml.Unmarshal([]byte("<presence>"+string(p.Inner)+"</presence>"), &got); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want == nil && got.Update != nil:
+				t.Errorf("got %s, want no announcement", p.Inner)
+			case tt.want != nil && (got.Update == nil || got.Update.Photo == nil):
+				t.Errorf("got %s, want an announcement of %q", p.Inner, *tt.want)
+			case tt.want != nil && *got.Update.Photo != *tt.want:
+				t.Errorf("announced %q, want %q", *got.Update.Photo, *tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+// Package xhtmlim implements XEP-0071 (XHTML-IM).
+//
+// XHTML-IM adds a formatted version of the body to messages. The
+// plain body is always required as a fallback for clients that don't
+// render XHTML. Formatted bodies, both inbound and outbound, are
+// restricted to the elements and attributes recommended by XEP-0071;
+// everything else is stripped. Inbound formatted bodies are delivered
+// as synthetic Message stanzas.
+package xhtmlim
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/disco"
+
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	ns      = "http://jabber.org/protocol/xhtml-im"
+	nsXHTML = "http://www.w3.org/1999/xhtml"
+)
+
+var ErrNoFallback = errors.New("xmpp: XHTML-IM requires a plain text body")
+
+// allowed maps the elements of the XEP-0071 recommended profile to
+// their allowed attributes.
+var allowed = map[string][]string{
+	"a":          {"href", "style", "type"},
+	"blockquote": {"style"},
+	"br":         nil,
+	"cite":       {"style"},
+	"code":       nil,
+	"em":         nil,
+	"img":        {"alt", "height", "src", "width"},
+	"li":         {"style"},
+	"ol":         {"style"},
+	"p":          {"style"},
+	"span":       {"style"},
+	"strong":     nil,
+	"ul":         {"style"},
+}
+
+// properties are the CSS properties recommended by XEP-0071. Style
+// declarations of other properties are removed.
+var properties = map[string]bool{
+	"background-color": true,
+	"color":            true,
+	"font-family":      true,
+	"font-size":        true,
+	"font-style":       true,
+	"font-weight":      true,
+	"margin-left":      true,
+	"margin-right":     true,
+	"text-align":       true,
+	"text-decoration":  true,
+}
+
+// dropped are elements whose content is removed along with them, as
+// opposed to only the markup.
+var dropped = map[string]bool{
+	"head":   true,
+	"script": true,
+	"style":  true,
+	"title":  true,
+}
+
+// Message is emitted for messages with a formatted body.
+type Message struct {
+	*core.Message
+	// XHTML is the sanitized content of the XHTML body, without the
+	// surrounding body element.
+	XHTML string
+}
+
+type html struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/xhtml-im html"`
+	Body    struct {
+		Inner []byte `xml:",innerxml"`
+	} `xml:"http://www.w3.org/1999/xhtml body"`
+}
+
+type Conn struct {
+	core.Client
+}
+
+func init() {
+	core.RegisterXEP("xhtmlim", wrap, "disco")
+}
+
+func wrap(c core.Client) (core.XEP, error) {
+	conn := &Conn{
+		Client: c,
+	}
+
+	discovery := conn.MustGetXEP("disco").(*disco.Conn)
+	discovery.AddFeature(ns)
+
+	return conn, nil
+}
+
+func (c *Conn) Process(stanza core.Stanza) ([]core.Stanza, error) {
+	msg, ok := stanza.(*core.Message)
+	if !ok {
+		return nil, nil
+	}
+
+	s, ok, err := Body(msg)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return []core.Stanza{&Message{msg, s}}, nil
+}
+
+// Attach adds a formatted body to an outgoing message. xhtml is the
+// content of the body element and is sanitized before being attached.
+// The message must already have a plain text body.
+func Attach(m *core.Message, xhtml string) error {
+	if m.Body == "" {
+		return ErrNoFallback
+	}
+
+	s, err := Sanitize(xhtml)
+	if err != nil {
+		return err
+	}
+
+	m.Inner = append(m.Inner, `<html xmlns="`+ns+`"><body xmlns="`+nsXHTML+`">`...)
+	m.Inner = append(m.Inner, s...)
+	m.Inner = append(m.Inner, "</body></html>"...)
+	return nil
+}
+
+// Body returns the sanitized formatted body of a message and reports
+// whether the message had one.
+func Body(m *core.Message) (string, bool, error) {
+	var v html
+	found, err := core.DecodePayload(m.Inner, ns, "html", &v)
+	if err != nil || !found {
+		return "", false, err
+	}
+
+	s, err := Sanitize(string(v.Body.Inner))
+	if err != nil {
+		return "", false, err
+	}
+	return s, true, nil
+}
+
+// Sanitize restricts XHTML to the elements and attributes recommended
+// by XEP-0071. The markup of other elements is removed, keeping their
+// text, except for elements like script, which are removed entirely.
+// Links and images may only refer to http, https, mailto and xmpp
+// URIs, and styles may only use the CSS properties recommended by
+// XEP-0071, without references to external resources. s is the content of a body element.
+func Sanitize(s string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(`<body xmlns="` + nsXHTML + `">` + s + `</body>`))
+	d.Entity = xml.HTMLEntity
+
+	const (
+		written = iota
+		unwrapped
+		skipped
+	)
+
+	var b bytes.Buffer
+	// open holds for every open element how it was handled. The
+	// wrapping body element counts as unwrapped.
+	var open []int
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			attrs, ok := allowed[t.Name.Local]
+			switch {
+			case len(open) == 0:
+				open = append(open, unwrapped)
+				continue
+			case open[len(open)-1] == skipped || dropped[t.Name.Local] || t.Name.Space != nsXHTML:
+				open = append(open, skipped)
+				continue
+			case !ok:
+				open = append(open, unwrapped)
+				continue
+			}
+			open = append(open, written)
+
+			b.WriteString("<" + t.Name.Local)
+			for _, attr := range t.Attr {
+				if attr.Name.Space != "" || !contains(attrs, attr.Name.Local) {
+					continue
+				}
+				if (attr.Name.Local == "href" || attr.Name.Local == "src") && !safeURI(attr.Value) {
+					continue
+				}
+				if attr.Name.Local == "style" {
+					attr.Value = sanitizeStyle(attr.Value)
+					if attr.Value == "" {
+						continue
+					}
+				}
+				b.WriteString(" " + attr.Name.Local + `="`)
+				xml.EscapeText(&b, []byte(attr.Value))
+				b.WriteString(`"`)
+			}
+			if void(t.Name.Local) {
+				b.WriteString("/>")
+			} else {
+				b.WriteString(">")
+			}
+		case xml.EndElement:
+			state := open[len(open)-1]
+			open = open[:len(open)-1]
+			if state == written && !void(t.Name.Local) {
+				b.WriteString("</" + t.Name.Local + ">")
+			}
+		case xml.CharData:
+			if len(open) > 0 && open[len(open)-1] != skipped {
+				xml.EscapeText(&b, t)
+			}
+		}
+	}
+
+	return b.String(), nil
+}
+
+// void reports whether an element never has content.
+func void(name string) bool {
+	return name == "br" || name == "img"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func safeURI(uri string) bool {
+	uri = strings.ToLower(strings.TrimSpace(uri))
+	for _, scheme := range []string{"http:", "https:", "mailto:", "xmpp:"} {
+		if strings.HasPrefix(uri, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeStyle removes all declarations from a style attribute that
+// don't use one of the recommended properties or that could refer to
+// external resources. Declarations that make use of CSS escapes or
+// comments are removed as well, as they could hide either.
+func sanitizeStyle(style string) string {
+	var out []string
+	for _, decl := range strings.Split(style, ";") {
+		prop, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		value = strings.TrimSpace(value)
+		lower := strings.ToLower(value)
+		if !properties[prop] || value == "" ||
+			strings.ContainsAny(value, `\<>`) ||
+			strings.Contains(lower, "url(") ||
+			strings.Contains(lower, "expression(") ||
+			strings.Contains(lower, "/*") {
+			continue
+		}
+		out = append(out, prop+": "+value)
+	}
+	return strings.Join(out, "; ")
+}
@@ -0,0 +1,127 @@
+package xhtmlim_test
+
+import (
+	"honnef.co/go/xmpp/client/core"
+	"honnef.co/go/xmpp/client/xep/xhtmlim"
+	"honnef.co/go/xmpp/client/xmpptest"
+
+	"testing"
+	"time"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "allowed", in: "<p>a <strong>bold</strong> <em>move</em><br/></p>", want: "<p>a <strong>bold</strong> <em>move</em><br/></p>"},
+		{name: "unknown element", in: "<div><b>kept</b> text</div>", want: "kept text"},
+		{name: "script", in: "<p>hi<script>alert(1)</script></p>", want: "<p>hi</p>"},
+		{name: "nested script", in: "<script><p>hidden</p></script>shown", want: "shown"},
+		{name: "foreign namespace", in: "<p>hi<svg xmlns='http://www.w3.org/2000/svg'><text>drawn</text></svg></p>", want: "<p>hi</p>"},
+		{name: "event handler", in: "<p onclick='steal()'>hi</p>", want: "<p>hi</p>"},
+		{name: "namespaced attribute", in: "<a xmlns:x='urn:x' x:href='https://example.com'>hi</a>", want: "<a>hi</a>"},
+		{name: "http link", in: "<a href='https://example.com/?a=1&amp;b=2'>hi</a>", want: `<a href="https://example.com/?a=1&amp;b=2">hi</a>`},
+		{name: "xmpp link", in: "<a href='xmpp:bob@example.com'>bob</a>", want: `<a href="xmpp:bob@example.com">bob</a>`},
+		{name: "javascript link", in: "<a href=' JavaScript:steal()'>hi</a>", want: "<a>hi</a>"},
+		{name: "data image", in: "<img src='data:image/png;base64,AAAA' alt='x'/>", want: `<img alt="x"/>`},
+		{name: "allowed style", in: "<span style='color: red; FONT-WEIGHT:bold'>hi</span>", want: `<span style="color: red; font-weight: bold">hi</span>`},
+		{name: "unknown property", in: "<span style='position: fixed; color: red'>hi</span>", want: `<span style="color: red">hi</span>`},
+		{name: "url", in: "<p style='background-color: URL(https://tracker.example.com/)'>hi</p>", want: "<p>hi</p>"},
+		{name: "expression", in: "<p style='color: expression(steal())'>hi</p>", want: "<p>hi</p>"},
+		{name: "escaped url", in: `<p style='background-color: \75 rl(https://tracker.example.com/)'>hi</p>`, want: "<p>hi</p>"},
+		{name: "comment", in: "<p style='color: red/**/; font-size: large'>hi</p>", want: `<p style="font-size: large">hi</p>`},
+		{name: "style on element without styles", in: "<strong style='color: red'>hi</strong>", want: "<strong>hi</strong>"},
+		{name: "entities", in: "<p>a &lt;b&gt; &amp; &nbsp;c</p>", want: "<p>a &lt;b&gt; &amp;  c</p>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := xhtmlim.Sanitize(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachRequiresBody(t *testing.T) {
+	if err := xhtmlim.Attach(&core.Message{}, "<strong>hi</strong>"); err != xhtmlim.ErrNoFallback {
+		t.Fatalf("got %v, want %v", err, xhtmlim.ErrNoFallback)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		xhtml string
+		want  string
+	}{
+		{name: "bold and italic", body: "bold and italic", xhtml: "<strong>bold</strong> and <em>italic</em>", want: "<strong>bold</strong> and <em>italic</em>"},
+		{name: "styled", body: "red", xhtml: "<span style='color: red; position: absolute'>red</span>", want: `<span style="color: red">red</span>`},
+		{name: "script", body: "hi", xhtml: "<p>hi<script>alert(1)</script></p>", want: "<p>hi</p>"},
+	}
+
+	c, s, err := xmpptest.Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := c.RegisterXEP("xhtmlim"); err != nil {
+		t.Fatal(err)
+	}
+	stanzas := xmpptest.Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := core.Message{Header: core.Header{To: "bob@example.com", Type: "chat"}, Body: tt.body}
+			if err := xhtmlim.Attach(&msg, tt.xhtml); err != nil {
+				t.Fatal(err)
+			}
+			errc := make(chan error, 1)
+			go func() { errc <- c.SendElement(msg) }()
+
+			// Reflect the message back to the client, as if bob had
+			// sent it.
+			e, err := s.NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.XMLName.Local != "message" {
+				t.Fatalf("got <%s>, want <message>", e.XMLName.Local)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			s.Sendf("<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'>%s</message>", e.Inner)
+
+			got := nextMessage(t, stanzas)
+			if got.Body != tt.body {
+				t.Errorf("got fallback body %q, want %q", got.Body, tt.body)
+			}
+			if got.XHTML != tt.want {
+				t.Errorf("got XHTML %q, want %q", got.XHTML, tt.want)
+			}
+		})
+	}
+}
+
+func nextMessage(t *testing.T, stanzas <-chan core.Stanza) *xhtmlim.Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case stanza := <-stanzas:
+			if msg, ok := stanza.(*xhtmlim.Message); ok {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("no formatted message emitted")
+		}
+	}
+}
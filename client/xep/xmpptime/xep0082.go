@@ -0,0 +1,85 @@
+// Package xmpptime implements XEP-0082 (XMPP Date and Time Profiles).
+//
+// The profiles are subsets of ISO 8601 that all XEPs use for dates and
+// times: DateTime (CCYY-MM-DDThh:mm:ss[.sss]TZD), Date (CCYY-MM-DD) and
+// Time (hh:mm:ss[.sss][TZD]). The parsers are stricter than
+// time.Parse, which for example accepts hours without a leading zero
+// or a comma before the fractional seconds.
+package xmpptime
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+// ErrInvalidFormat is returned when a string doesn't conform to the
+// profile it's parsed as.
+var ErrInvalidFormat = errors.New("xmpp: invalid date or time")
+
+var (
+	reDateTime = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$`)
+	reDate     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	reTime     = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`)
+)
+
+// ParseDateTime parses a timestamp in the DateTime profile. The
+// returned time has the time zone offset of the timestamp.
+func ParseDateTime(s string) (time.Time, error) {
+	if !reDateTime.MatchString(s) {
+		return time.Time{}, ErrInvalidFormat
+	}
+	return parse(time.RFC3339Nano, s)
+}
+
+// FormatDateTime formats t in the DateTime profile. The time is
+// converted to UTC, and fractional seconds are only included if t has
+// any.
+func FormatDateTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.999999999Z")
+}
+
+// ParseDate parses a date in the Date profile. The returned time is
+// midnight UTC of that date.
+func ParseDate(s string) (time.Time, error) {
+	if !reDate.MatchString(s) {
+		return time.Time{}, ErrInvalidFormat
+	}
+	return parse("2006-01-02", s)
+}
+
+// FormatDate formats the date of t, in t's location, in the Date
+// profile.
+func FormatDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// ParseTime parses a time of day in the Time profile. The date of the
+// returned time is January 1, year 0. Times without a time zone offset
+// are returned as UTC.
+func ParseTime(s string) (time.Time, error) {
+	m := reTime.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, ErrInvalidFormat
+	}
+	if m[2] == "" {
+		return parse("15:04:05.999999999", s)
+	}
+	return parse("15:04:05.999999999Z07:00", s)
+}
+
+// FormatTime formats the time of day of t in the Time profile. The
+// time is converted to UTC.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("15:04:05.999999999Z")
+}
+
+// parse parses a string that is known to have the right shape, which
+// can still hold out of range values like a 13th month.
+func parse(layout, s string) (time.Time, error) {
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return time.Time{}, ErrInvalidFormat
+	}
+	return t, nil
+}
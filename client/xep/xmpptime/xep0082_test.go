@@ -0,0 +1,85 @@
+package xmpptime_test
+
+import (
+	"honnef.co/go/xmpp/client/xep/xmpptime"
+
+	"testing"
+	"time"
+)
+
+// moonLanding is the example used throughout XEP-0082.
+var moonLanding = time.Date(1969, 7, 21, 2, 56, 15, 0, time.UTC)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(string) (time.Time, error)
+		in    string
+		// want is the expected time, or zero if parsing has to fail.
+		want time.Time
+	}{
+		{name: "DateTime", parse: xmpptime.ParseDateTime, in: "1969-07-21T02:56:15Z", want: moonLanding},
+		{name: "DateTime offset", parse: xmpptime.ParseDateTime, in: "1969-07-20T21:56:15-05:00", want: moonLanding},
+		{name: "DateTime fraction", parse: xmpptime.ParseDateTime, in: "1969-07-21T02:56:15.123Z", want: moonLanding.Add(123 * time.Millisecond)},
+		{name: "DateTime without zone", parse: xmpptime.ParseDateTime, in: "1969-07-21T02:56:15"},
+		{name: "DateTime without seconds", parse: xmpptime.ParseDateTime, in: "1969-07-21T02:56Z"},
+		{name: "DateTime short hour", parse: xmpptime.ParseDateTime, in: "1969-07-21T2:56:15Z"},
+		{name: "DateTime short month", parse: xmpptime.ParseDateTime, in: "1969-7-21T02:56:15Z"},
+		{name: "DateTime 13th month", parse: xmpptime.ParseDateTime, in: "1969-13-21T02:56:15Z"},
+		{name: "DateTime comma", parse: xmpptime.ParseDateTime, in: "1969-07-21T02:56:15,5Z"},
+		{name: "DateTime lower case", parse: xmpptime.ParseDateTime, in: "1969-07-21t02:56:15z"},
+		{name: "DateTime date only", parse: xmpptime.ParseDateTime, in: "1969-07-21"},
+		{name: "Date", parse: xmpptime.ParseDate, in: "1776-07-04", want: time.Date(1776, 7, 4, 0, 0, 0, 0, time.UTC)},
+		{name: "Date with time", parse: xmpptime.ParseDate, in: "1776-07-04T00:00:00Z"},
+		{name: "Date 30 February", parse: xmpptime.ParseDate, in: "1776-02-30"},
+		{name: "Time", parse: xmpptime.ParseTime, in: "16:00:00", want: time.Date(0, 1, 1, 16, 0, 0, 0, time.UTC)},
+		{name: "Time UTC", parse: xmpptime.ParseTime, in: "16:00:00Z", want: time.Date(0, 1, 1, 16, 0, 0, 0, time.UTC)},
+		{name: "Time offset", parse: xmpptime.ParseTime, in: "16:00:00.5+01:00", want: time.Date(0, 1, 1, 15, 0, 0, 5e8, time.UTC)},
+		{name: "Time 25th hour", parse: xmpptime.ParseTime, in: "25:00:00"},
+		{name: "Time without seconds", parse: xmpptime.ParseTime, in: "16:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse(tt.in)
+			if tt.want.IsZero() {
+				if err != xmpptime.ErrInvalidFormat {
+					t.Fatalf("parsing %q: got %v, %v, want ErrInvalidFormat", tt.in, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parsing %q: got %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	est := time.FixedZone("EST", -5*60*60)
+	tests := []struct {
+		name   string
+		format func(time.Time) string
+		in     time.Time
+		want   string
+	}{
+		{name: "DateTime", format: xmpptime.FormatDateTime, in: moonLanding, want: "1969-07-21T02:56:15Z"},
+		{name: "DateTime converted to UTC", format: xmpptime.FormatDateTime, in: moonLanding.In(est), want: "1969-07-21T02:56:15Z"},
+		{name: "DateTime fraction", format: xmpptime.FormatDateTime, in: moonLanding.Add(123 * time.Millisecond), want: "1969-07-21T02:56:15.123Z"},
+		// The date is the one in the time's own location.
+		{name: "Date", format: xmpptime.FormatDate, in: moonLanding.In(est), want: "1969-07-20"},
+		{name: "Time", format: xmpptime.FormatTime, in: moonLanding.In(est), want: "02:56:15Z"},
+		{name: "Time fraction", format: xmpptime.FormatTime, in: moonLanding.Add(500 * time.Millisecond), want: "02:56:15.5Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.format(tt.in); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+// Package xmpptest provides a scripted, in-memory XMPP server for
+// exercising clients without DNS or real network connections.
+//
+// A Server and a client transport are created as the two ends of a
+// net.Pipe. Because net.Pipe is synchronous, every write by one side
+// blocks until the other side reads it. Tests have to keep reading
+// from the Server (for example with NextElement) for as long as the
+// client is expected to send data.
+package xmpptest
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	nsStream = "http://etherx.jabber.org/streams"
+	nsSASL   = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind   = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsTLS    = "urn:ietf:params:xml:ns:xmpp-tls"
+)
+
+// Element is a generic XML element as read by the Server.
+type Element struct {
+	XMLName xml.Name
+	Attr    []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// Attribute returns the value of the attribute with the given local
+// name, or an empty string if there is no such attribute.
+func (e Element) Attribute(name string) string {
+	for _, attr := range e.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+
+	return ""
+}
+
+// Server is the scripted server end of an in-memory connection.
+type Server struct {
+	net.Conn
+	decoder *xml.Decoder
+
+	// Domain is used as the 'from' of the stream header and as the
+	// domain of the JID assigned during resource binding.
+	Domain string
+	// Resource is the resource assigned during resource binding.
+	Resource string
+	// Mechanisms are the SASL mechanisms offered to the client.
+	Mechanisms []string
+	// Password, if not empty, is checked against the password sent
+	// by the client during SASL PLAIN.
+	Password string
+	// StreamID is sent as the 'id' of every stream header.
+	StreamID string
+	// Features are additional stream features offered after
+	// authentication, as raw XML.
+	Features string
+
+	user string
+}
+
+// Pipe creates an in-memory connection. The returned net.Conn is
+// meant to be passed to core.NewConnection, the Server is its scripted
+// peer.
+func Pipe() (net.Conn, *Server) {
+	client, server := net.Pipe()
+	return client, NewServer(server)
+}
+
+// NewServer returns a Server that talks to a client over conn. It is
+// an alternative to Pipe for tests that need a real network
+// connection, for example to negotiate TLS, which deadlocks on the
+// synchronous net.Pipe.
+func NewServer(conn net.Conn) *Server {
+	s := &Server{
+		Conn:       conn,
+		Domain:     "example.com",
+		Resource:   "xmpptest",
+		Mechanisms: []string{"PLAIN"},
+		StreamID:   "xmpptest",
+	}
+	s.reset()
+
+	return s
+}
+
+// TCPPipe is like Pipe but connects the client and the Server over
+// the loopback interface. It is needed for negotiating TLS, whose
+// handshake deadlocks on the synchronous connections created by
+// Pipe.
+func TCPPipe() (net.Conn, *Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server := <-accepted
+	if server == nil {
+		client.Close()
+		return nil, nil, errors.New("xmpptest: failed to accept connection")
+	}
+
+	return client, NewServer(server), nil
+}
+
+// Certificate creates a self-signed certificate for the given DNS
+// names, valid for an hour.
+func Certificate(names ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Connect creates an in-memory connection and negotiates a stream,
+// authentication and resource binding between a new client and a
+// Server. The client connection is ready for use once Connect
+// returns.
+func Connect(user, password string) (*core.Conn, *Server, error) {
+	conn, s := Pipe()
+	c := core.NewConnection(conn, user, s.Domain, password)
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Negotiate() }()
+
+	errs := c.Dial()
+	if err := <-errc; err != nil {
+		s.Conn.Close()
+		return nil, nil, err
+	}
+	if len(errs) > 0 {
+		s.Conn.Close()
+		return nil, nil, errs[0]
+	}
+
+	return c, s, nil
+}
+
+// JID returns the JID that has been assigned to the client during
+// resource binding.
+func (s *Server) JID() string {
+	return s.user + "@" + s.Domain + "/" + s.Resource
+}
+
+func (s *Server) reset() {
+	s.decoder = xml.NewDecoder(s.Conn)
+}
+
+// RestartStream reads the new stream header the client sends after
+// a stream restart, for example after authenticating. Unlike
+// ReadStreamHeader, it discards the state of the previous stream
+// first.
+func (s *Server) RestartStream() (xml.StartElement, error) {
+	s.reset()
+	return s.ReadStreamHeader()
+}
+
+// Send writes raw XML to the client.
+func (s *Server) Send(raw string) error {
+	_, err := io.WriteString(s.Conn, raw)
+	return err
+}
+
+// Sendf formats according to a format specifier and writes the
+// result to the client.
+func (s *Server) Sendf(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(s.Conn, format, args...)
+	return err
+}
+
+// ReadStreamHeader reads tokens until the client's stream header has
+// been received.
+func (s *Server) ReadStreamHeader() (xml.StartElement, error) {
+	for {
+		t, err := s.decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+
+		if t, ok := t.(xml.StartElement); ok {
+			if t.Name.Space != nsStream || t.Name.Local != "stream" {
+				return t, fmt.Errorf("xmpptest: expected stream header, got <%s>", t.Name.Local)
+			}
+			return t, nil
+		}
+	}
+}
+
+// OpenStream sends a stream header followed by the given stream
+// features. features must be the raw XML of the features' children.
+func (s *Server) OpenStream(features string) error {
+	return s.Sendf("<?xml version='1.0'?>"+
+		"<stream:stream xmlns='jabber:client' xmlns:stream='%s' id='%s' from='%s' version='1.0' xml:lang='en'>"+
+		"<stream:features>%s</stream:features>",
+		nsStream, s.StreamID, s.Domain, features)
+}
+
+// NextElement reads the next top-level element sent by the client.
+// It returns io.EOF when the client closes the stream.
+func (s *Server) NextElement() (Element, error) {
+	var e Element
+	for {
+		t, err := s.decoder.Token()
+		if err != nil {
+			return e, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			err = s.decoder.DecodeElement(&e, &t)
+			return e, err
+		case xml.EndElement:
+			if t.Name.Space == nsStream && t.Name.Local == "stream" {
+				return e, io.EOF
+			}
+		}
+	}
+}
+
+// Negotiate performs the server side of a stream negotiation: It
+// offers SASL, accepts the authentication, restarts the stream,
+// offers resource binding and answers the client's bind request.
+func (s *Server) Negotiate() error {
+	if _, err := s.ReadStreamHeader(); err != nil {
+		return err
+	}
+
+	var mechanisms string
+	for _, m := range s.Mechanisms {
+		mechanisms += "<mechanism>" + m + "</mechanism>"
+	}
+	err := s.OpenStream("<mechanisms xmlns='" + nsSASL + "'>" + mechanisms + "</mechanisms>")
+	if err != nil {
+		return err
+	}
+
+	if err := s.authenticate(); err != nil {
+		return err
+	}
+
+	s.reset()
+	if _, err := s.ReadStreamHeader(); err != nil {
+		return err
+	}
+	if err := s.OpenStream("<bind xmlns='" + nsBind + "'/>" + s.Features); err != nil {
+		return err
+	}
+
+	return s.HandleBind()
+}
+
+// StartTLS performs the server side of STARTTLS: It opens a stream
+// requiring TLS, waits for the client to request it and completes the
+// TLS handshake using config. The client restarts the stream
+// afterwards, which Negotiate expects. The Server has to have been
+// created with TCPPipe or on another real network connection.
+func (s *Server) StartTLS(config *tls.Config) error {
+	if _, err := s.ReadStreamHeader(); err != nil {
+		return err
+	}
+	if err := s.OpenStream("<starttls xmlns='" + nsTLS + "'><required/></starttls>"); err != nil {
+		return err
+	}
+
+	req, err := s.NextElement()
+	if err != nil {
+		return err
+	}
+	if req.XMLName.Space != nsTLS || req.XMLName.Local != "starttls" {
+		return fmt.Errorf("xmpptest: expected <starttls>, got <%s>", req.XMLName.Local)
+	}
+	if err := s.Send("<proceed xmlns='" + nsTLS + "'/>"); err != nil {
+		return err
+	}
+
+	conn := tls.Server(s.Conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	s.Conn = conn
+	s.reset()
+	return nil
+}
+
+// NegotiateComponent performs the server side of an external
+// component's handshake (XEP-0114), accepting the component if it
+// proves knowledge of secret. The stream is sent in the component
+// namespace from then on.
+func (s *Server) NegotiateComponent(secret string) error {
+	header, err := s.ReadStreamHeader()
+	if err != nil {
+		return err
+	}
+	for _, attr := range header.Attr {
+		if attr.Name.Local == "to" {
+			s.Domain = attr.Value
+		}
+	}
+
+	err = s.Sendf("<?xml version='1.0'?>"+
+		"<stream:stream xmlns='jabber:component:accept' xmlns:stream='%s' id='%s' from='%s'>",
+		nsStream, s.StreamID, s.Domain)
+	if err != nil {
+		return err
+	}
+
+	handshake, err := s.NextElement()
+	if err != nil {
+		return err
+	}
+	if handshake.XMLName.Local != "handshake" {
+		return fmt.Errorf("xmpptest: expected <handshake>, got <%s>", handshake.XMLName.Local)
+	}
+	sum := sha1.Sum([]byte(s.StreamID + secret))
+	if string(handshake.Inner) != hex.EncodeToString(sum[:]) {
+		s.Send("<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>")
+		s.Close()
+		return errors.New("xmpptest: wrong secret")
+	}
+
+	return s.Send("<handshake/>")
+}
+
+func (s *Server) authenticate() error {
+	auth, err := s.NextElement()
+	if err != nil {
+		return err
+	}
+
+	if auth.XMLName.Space != nsSASL || auth.XMLName.Local != "auth" {
+		return fmt.Errorf("xmpptest: expected <auth>, got <%s>", auth.XMLName.Local)
+	}
+
+	if auth.Attribute("mechanism") == "PLAIN" {
+		payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(auth.Inner)))
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(string(payload), "\x00")
+		if len(parts) != 3 {
+			return errors.New("xmpptest: malformed PLAIN payload")
+		}
+		s.user = parts[1]
+		if s.Password != "" && parts[2] != s.Password {
+			s.Send("<failure xmlns='" + nsSASL + "'><not-authorized/></failure>")
+			return errors.New("xmpptest: wrong password")
+		}
+	}
+
+	return s.Send("<success xmlns='" + nsSASL + "'/>")
+}
+
+// HandleBind reads the client's bind request and assigns it the JID
+// returned by JID.
+func (s *Server) HandleBind() error {
+	iq, err := s.NextElement()
+	if err != nil {
+		return err
+	}
+
+	if iq.XMLName.Local != "iq" || iq.Attribute("type") != "set" {
+		return fmt.Errorf("xmpptest: expected bind request, got <%s>", iq.XMLName.Local)
+	}
+
+	return s.Sendf("<iq type='result' id='%s'><bind xmlns='%s'><jid>%s</jid></bind></iq>",
+		iq.Attribute("id"), nsBind, s.JID())
+}
+
+// Stanzas reads stanzas from c with NextStanza in a new goroutine
+// and delivers them on the returned channel, which is closed once
+// the connection has been closed for good. Errors are skipped.
+// Reading stanzas is what lets XEPs process them, so tests use it to
+// have the client answer requests sent by the Server. Stanzas that
+// aren't received from the channel are dropped once its buffer is
+// full.
+func Stanzas(c core.Client) <-chan core.Stanza {
+	ch := make(chan core.Stanza, 64)
+	go func() {
+		defer close(ch)
+		for {
+			stanza, err := c.NextStanza()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			select {
+			case ch <- stanza:
+			default:
+			}
+		}
+	}()
+	return ch
+}
+
+// EmittedUntilSentinel sends a message with the ID "sentinel" to the
+// client and returns the stanzas received from stanzas, as returned
+// by Stanzas, until the sentinel arrives. Stanzas are delivered in
+// order, each followed by what XEPs emitted for it, so the result is
+// everything that what the Server sent before caused the client to
+// emit. The sentinel itself isn't included.
+func (s *Server) EmittedUntilSentinel(stanzas <-chan core.Stanza) ([]core.Stanza, error) {
+	if err := s.Send("<message xmlns='jabber:client' from='" + s.Domain + "' id='sentinel'/>"); err != nil {
+		return nil, err
+	}
+
+	var out []core.Stanza
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case stanza, ok := <-stanzas:
+			if !ok {
+				return out, errors.New("xmpptest: connection closed before the sentinel arrived")
+			}
+			if m, ok := stanza.(*core.Message); ok && m.Id == "sentinel" {
+				return out, nil
+			}
+			out = append(out, stanza)
+		case <-timeout:
+			return out, errors.New("xmpptest: sentinel wasn't delivered")
+		}
+	}
+}
+
+// CollectUntilClosed reads elements in a new goroutine until the
+// client ends its stream or the connection breaks, and then delivers
+// all of them on the returned channel. Tests use it to check what the
+// client sends while closing.
+func (s *Server) CollectUntilClosed() <-chan []Element {
+	ch := make(chan []Element, 1)
+	go func() {
+		var elements []Element
+		for {
+			e, err := s.NextElement()
+			if err != nil {
+				ch <- elements
+				return
+			}
+			elements = append(elements, e)
+		}
+	}()
+	return ch
+}
+
+// Forward reads the next element sent by the client and delivers it
+// to the client of another Server, as a server routing stanzas
+// between two clients would. Its 'from' is set to the JID of our
+// client and its 'to' to the JID of the other one. Tests use it to
+// let two clients, for example the initiator and the target of a
+// transfer, talk to each other.
+func (s *Server) Forward(to *Server) (Element, error) {
+	e, err := s.NextElement()
+	if err != nil {
+		return e, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s xmlns='jabber:client'", e.XMLName.Local)
+	for _, attr := range e.Attr {
+		if attr.Name.Space != "" || attr.Name.Local == "xmlns" || attr.Name.Local == "from" || attr.Name.Local == "to" {
+			continue
+		}
+		fmt.Fprintf(&b, " %s='", attr.Name.Local)
+		xml.EscapeText(&b, []byte(attr.Value))
+		b.WriteString("'")
+	}
+	fmt.Fprintf(&b, " from='%s' to='%s'>%s</%s>", s.JID(), to.JID(), e.Inner, e.XMLName.Local)
+	return e, to.Send(b.String())
+}
+
+// Close sends the closing stream tag and closes the connection.
+func (s *Server) Close() error {
+	s.Send("</stream:stream>")
+	return s.Conn.Close()
+}
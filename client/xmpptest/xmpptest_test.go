@@ -0,0 +1,198 @@
+package xmpptest
+
+import (
+	"honnef.co/go/xmpp/client/core"
+
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		client   string
+		resource string
+		wantErr  bool
+	}{
+		{name: "any password", client: "secret", resource: "xmpptest"},
+		{name: "matching password", server: "secret", client: "secret", resource: "xmpptest"},
+		{name: "custom resource", client: "secret", resource: "laptop"},
+		{name: "wrong password", server: "secret", client: "guess", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := Pipe()
+			defer s.Conn.Close()
+			s.Password = tt.server
+			if tt.resource != "" {
+				s.Resource = tt.resource
+			}
+			c := core.NewConnection(conn, "alice", s.Domain, tt.client)
+
+			errc := make(chan error, 1)
+			go func() { errc <- s.Negotiate() }()
+			errs := c.Dial()
+			serr := <-errc
+
+			if tt.wantErr {
+				if len(errs) == 0 || serr == nil {
+					t.Fatalf("got client errors %v and server error %v, want both to fail", errs, serr)
+				}
+				return
+			}
+			if len(errs) > 0 || serr != nil {
+				t.Fatalf("got client errors %v and server error %v", errs, serr)
+			}
+			if want := "alice@example.com/" + tt.resource; c.JID() != want {
+				t.Errorf("got JID %q, want %q", c.JID(), want)
+			}
+			if c.State() != core.StateBound {
+				t.Errorf("got state %v, want %v", c.State(), core.StateBound)
+			}
+		})
+	}
+}
+
+func TestNegotiateComponent(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{name: "shared secret", secret: "secret"},
+		{name: "wrong secret", secret: "guess", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, s := Pipe()
+			defer s.Conn.Close()
+			c := core.NewComponentConnection(conn, "bot.example.com", tt.secret)
+
+			errc := make(chan error, 1)
+			go func() { errc <- s.NegotiateComponent("secret") }()
+			errs := c.Dial()
+			serr := <-errc
+
+			if (len(errs) > 0) != tt.wantErr || (serr != nil) != tt.wantErr {
+				t.Fatalf("got client errors %v and server error %v, want failure: %t", errs, serr, tt.wantErr)
+			}
+			if !tt.wantErr && s.Domain != "bot.example.com" {
+				t.Errorf("got domain %q, want the component's name", s.Domain)
+			}
+		})
+	}
+}
+
+func TestStanzas(t *testing.T) {
+	c, s, err := Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanzas := Stanzas(c)
+
+	s.Send("<message xmlns='jabber:client' from='bob@example.com/phone' type='chat'><body>hi</body></message>")
+	select {
+	case stanza := <-stanzas:
+		msg, ok := stanza.(*core.Message)
+		if !ok || msg.Body != "hi" || msg.From != "bob@example.com/phone" {
+			t.Fatalf("got %#v, want the message sent by the server", stanza)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+
+	s.Close()
+	select {
+	case _, ok := <-stanzas:
+		if ok {
+			t.Fatal("got a stanza after the stream was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after the stream was closed")
+	}
+}
+
+func TestEmittedUntilSentinel(t *testing.T) {
+	tests := []struct {
+		name string
+		// sent are the messages sent before the sentinel, by ID.
+		sent []string
+	}{
+		{name: "nothing"},
+		{name: "messages", sent: []string{"m1", "m2", "m3"}},
+	}
+
+	c, s, err := Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stanzas := Stanzas(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, id := range tt.sent {
+				s.Sendf("<message xmlns='jabber:client' from='bob@example.com/phone' id='%s'/>", id)
+			}
+			emitted, err := s.EmittedUntilSentinel(stanzas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, stanza := range emitted {
+				got = append(got, stanza.ID())
+			}
+			if !reflect.DeepEqual(got, tt.sent) {
+				t.Errorf("got %q, want %q", got, tt.sent)
+			}
+		})
+	}
+
+	// The sentinel never arrives on a closed connection.
+	go io.Copy(io.Discard, s.Conn)
+	c.Close()
+	if _, err := s.EmittedUntilSentinel(stanzas); err == nil {
+		t.Error("got no error after closing")
+	}
+}
+
+func TestForward(t *testing.T) {
+	alice, s1, err := Connect("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	bob, s2, err := Connect("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	stanzas := Stanzas(bob)
+
+	go alice.Encode(core.Message{
+		Header: core.Header{To: "bob@example.com", Id: "m1", Type: "chat"},
+		Body:   "<3 & more",
+	})
+	if _, err := s1.Forward(s2); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case stanza := <-stanzas:
+		msg, ok := stanza.(*core.Message)
+		if !ok {
+			t.Fatalf("got %T, want a message", stanza)
+		}
+		want := core.Header{From: s1.JID(), To: s2.JID(), Id: "m1", Type: "chat"}
+		if msg.Header != want || msg.Body != "<3 & more" {
+			t.Errorf("got %+v %q, want %+v %q", msg.Header, msg.Body, want, "<3 & more")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message wasn't forwarded")
+	}
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Link relations of alternative connection methods (XEP-0156).
+const (
+	relWebSocket = "urn:xmpp:alt-connections:websocket"
+	relBOSH      = "urn:xmpp:alt-connections:xbosh"
+)
+
+// ErrNoConnectionMethods is returned by DiscoverConnectionMethods if
+// the domain doesn't advertise any alternative connection methods.
+var ErrNoConnectionMethods = errors.New("xmpp: no alternative connection methods advertised")
+
+// ConnectionMethods are the endpoints of alternative connection
+// methods (XEP-0156) of a domain.
+type ConnectionMethods struct {
+	// WebSocket lists WebSocket (RFC 7395) URLs.
+	WebSocket []string
+	// BOSH lists BOSH (XEP-0206) URLs.
+	BOSH []string
+	// FromDNS reports whether the methods have been found via DNS
+	// instead of the domain's host-meta file. DNS lookups aren't
+	// authenticated, so an attacker can direct us to an endpoint
+	// with a valid certificate for a host other than the domain.
+	FromDNS bool
+}
+
+// A Discoverer looks up alternative connection methods. Its zero value
+// uses the system resolver and http.DefaultClient.
+type Discoverer struct {
+	// LookupTXT looks up TXT records. It defaults to net.LookupTXT.
+	LookupTXT func(name string) ([]string, error)
+	// Client is used to fetch host-meta files.
+	Client *http.Client
+}
+
+// DiscoverConnectionMethods looks up the alternative connection
+// methods of a domain with a zero Discoverer.
+func DiscoverConnectionMethods(domain string) (ConnectionMethods, error) {
+	return Discoverer{}.Discover(context.Background(), domain)
+}
+
+// Discover looks up the alternative connection methods of a domain.
+// The host-meta file, which is fetched via HTTPS and thus
+// authenticated, takes precedence. DNS TXT records at
+// _xmppconnect.<domain> are only consulted if the file doesn't exist
+// or doesn't list any methods.
+func (d Discoverer) Discover(ctx context.Context, domain string) (ConnectionMethods, error) {
+	methods, err := d.hostMeta(ctx, domain)
+	if err == nil && (len(methods.WebSocket) > 0 || len(methods.BOSH) > 0) {
+		return methods, nil
+	}
+
+	methods, txtErr := d.txt(domain)
+	if txtErr == nil && (len(methods.WebSocket) > 0 || len(methods.BOSH) > 0) {
+		return methods, nil
+	}
+	if err == nil {
+		err = txtErr
+	}
+	if err == nil {
+		err = ErrNoConnectionMethods
+	}
+	return ConnectionMethods{}, err
+}
+
+type link struct {
+	Rel  string `xml:"rel,attr" json:"rel"`
+	Href string `xml:"href,attr" json:"href"`
+}
+
+func (m *ConnectionMethods) add(rel, href string) {
+	switch rel {
+	case relWebSocket:
+		m.WebSocket = append(m.WebSocket, href)
+	case relBOSH:
+		m.BOSH = append(m.BOSH, href)
+	}
+}
+
+// hostMeta fetches the XRD host-meta file, falling back to the JRD
+// one.
+func (d Discoverer) hostMeta(ctx context.Context, domain string) (ConnectionMethods, error) {
+	var methods ConnectionMethods
+
+	body, err := d.fetch(ctx, "https://"+domain+"/.well-known/host-meta")
+	if err == nil {
+		var xrd struct {
+			Links []link `xml:"http://docs.oasis-open.org/ns/xri/xrd-1.0 Link"`
+		}
+		if err = xml.Unmarshal(body, &xrd); err == nil {
+			for _, l := range xrd.Links {
+				methods.add(l.Rel, l.Href)
+			}
+			return methods, nil
+		}
+	}
+
+	body, jsonErr := d.fetch(ctx, "https://"+domain+"/.well-known/host-meta.json")
+	if jsonErr != nil {
+		return methods, err
+	}
+	var jrd struct {
+		Links []link `json:"links"`
+	}
+	if err := json.Unmarshal(body, &jrd); err != nil {
+		return methods, err
+	}
+	for _, l := range jrd.Links {
+		methods.add(l.Rel, l.Href)
+	}
+	return methods, nil
+}
+
+func (d Discoverer) fetch(ctx context.Context, url string) ([]byte, error) {
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("xmpp: fetching " + url + ": " + res.Status)
+	}
+	// host-meta files are small, don't read arbitrary amounts of
+	// data.
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+// txt looks up TXT records of the form _xmpp-client-websocket=<url>
+// and _xmpp-client-xbosh=<url>.
+func (d Discoverer) txt(domain string) (ConnectionMethods, error) {
+	lookup := d.LookupTXT
+	if lookup == nil {
+		lookup = net.LookupTXT
+	}
+	records, err := lookup("_xmppconnect." + domain)
+	if err != nil {
+		return ConnectionMethods{}, err
+	}
+
+	methods := ConnectionMethods{FromDNS: true}
+	for _, record := range records {
+		key, value, ok := strings.Cut(record, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "_xmpp-client-websocket":
+			methods.add(relWebSocket, value)
+		case "_xmpp-client-xbosh":
+			methods.add(relBOSH, value)
+		}
+	}
+	return methods, nil
+}
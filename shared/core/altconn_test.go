@@ -0,0 +1,133 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/shared/core"
+
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverConnectionMethods(t *testing.T) {
+	const (
+		xrd = `<?xml version='1.0' encoding='utf-8'?>
+<XRD xmlns='http://docs.oasis-open.org/ns/xri/xrd-1.0'>
+  <Link rel="urn:xmpp:alt-connections:xbosh" href="https://example.com/http-bind" />
+  <Link rel="urn:xmpp:alt-connections:websocket" href="wss://example.com/xmpp-websocket" />
+  <Link rel="lrdd" href="https://example.com/lrdd" />
+</XRD>`
+		jrd = `{"links": [
+  {"rel": "urn:xmpp:alt-connections:websocket", "href": "wss://ws.example.com/xmpp"},
+  {"rel": "urn:xmpp:alt-connections:websocket", "href": "wss://ws2.example.com/xmpp"}
+]}`
+		empty = `<XRD xmlns='http://docs.oasis-open.org/ns/xri/xrd-1.0'/>`
+	)
+	dnsErr := errors.New("no such host")
+
+	tests := []struct {
+		name string
+		// files maps paths to host-meta files, others don't exist.
+		files map[string]string
+		txt   []string
+		// txtErr fails the TXT lookup.
+		txtErr  error
+		want    core.ConnectionMethods
+		wantErr bool
+	}{
+		{
+			name:  "xrd",
+			files: map[string]string{"/.well-known/host-meta": xrd},
+			txt:   []string{"_xmpp-client-websocket=wss://dns.example.com/xmpp"},
+			want: core.ConnectionMethods{
+				WebSocket: []string{"wss://example.com/xmpp-websocket"},
+				BOSH:      []string{"https://example.com/http-bind"},
+			},
+		},
+		{
+			name:  "jrd",
+			files: map[string]string{"/.well-known/host-meta.json": jrd},
+			want:  core.ConnectionMethods{WebSocket: []string{"wss://ws.example.com/xmpp", "wss://ws2.example.com/xmpp"}},
+		},
+		{
+			name:  "malformed xrd",
+			files: map[string]string{"/.well-known/host-meta": "<XRD", "/.well-known/host-meta.json": jrd},
+			want:  core.ConnectionMethods{WebSocket: []string{"wss://ws.example.com/xmpp", "wss://ws2.example.com/xmpp"}},
+		},
+		{
+			name: "dns",
+			txt: []string{
+				"_xmpp-client-xbosh=https://example.com/bosh",
+				"v=spf1 -all",
+				"_xmpp-client-websocket=wss://example.com/ws",
+			},
+			want: core.ConnectionMethods{
+				WebSocket: []string{"wss://example.com/ws"},
+				BOSH:      []string{"https://example.com/bosh"},
+				FromDNS:   true,
+			},
+		},
+		{
+			name:  "host-meta without methods",
+			files: map[string]string{"/.well-known/host-meta": empty},
+			txt:   []string{"_xmpp-client-websocket=wss://example.com/ws"},
+			want:  core.ConnectionMethods{WebSocket: []string{"wss://example.com/ws"}, FromDNS: true},
+		},
+		{name: "nothing", files: map[string]string{"/.well-known/host-meta": empty}, txt: []string{"v=spf1 -all"}, wantErr: true},
+		{name: "no host-meta and no records", txtErr: dnsErr, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				file, ok := tt.files[r.URL.Path]
+				if !ok || r.Host != "example.com" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(file))
+			}))
+			// Connections that are still being set up when the test
+			// ends aren't worth logging.
+			srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+			srv.StartTLS()
+			defer srv.Close()
+			// The test server's certificate is valid for example.com,
+			// which is directed to it.
+			client := srv.Client()
+			client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			}
+
+			var lookups []string
+			d := core.Discoverer{
+				LookupTXT: func(name string) ([]string, error) {
+					lookups = append(lookups, name)
+					return tt.txt, tt.txtErr
+				},
+				Client: client,
+			}
+			got, err := d.Discover(context.Background(), "example.com")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.FromDNS && !reflect.DeepEqual(lookups, []string{"_xmppconnect.example.com"}) {
+				t.Errorf("looked up %v, want _xmppconnect.example.com", lookups)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"net"
+	"strings"
 )
 
 const (
@@ -18,7 +19,24 @@ type Address struct {
 // ResolveFQDN resolves an FQDN to all IP+port pairs to attempt to
 // connect to. service must be either xmpp-client or xmpp-server, for
 // c2s or s2s connections respectively.
+//
+// IP literals, including bracketed IPv6 addresses, are used as they
+// are, with the default port of the service.
 func ResolveFQDN(host, service string) ([]Address, []error) {
+	var port int
+	switch service {
+	case "xmpp-client":
+		port = DefaultClientPort
+	case "xmpp-server":
+		port = DefaultServerPort
+	default:
+		panic("invalid service name")
+	}
+
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+		return []Address{{[]net.IP{ip}, port}}, nil
+	}
+
 	// First attempt using SRV. If that fails for any reason, attempt
 	// A/AAAA lookup. All errors will be recorded.
 	var errors []error
@@ -30,16 +48,6 @@ func ResolveFQDN(host, service string) ([]Address, []error) {
 			return nil, []error{err}
 		}
 
-		var port int
-		switch service {
-		case "xmpp-client":
-			port = DefaultClientPort
-		case "xmpp-server":
-			port = DefaultServerPort
-		default:
-			panic("invalid service name")
-		}
-
 		return []Address{Address{ips, port}}, nil
 	}
 
@@ -0,0 +1,34 @@
+package core_test
+
+import (
+	"honnef.co/go/xmpp/shared/core"
+
+	"net"
+	"testing"
+)
+
+func TestResolveFQDNLiteral(t *testing.T) {
+	tests := []struct {
+		host     string
+		service  string
+		wantIP   net.IP
+		wantPort int
+	}{
+		{host: "::1", service: "xmpp-client", wantIP: net.IPv6loopback, wantPort: core.DefaultClientPort},
+		{host: "[::1]", service: "xmpp-client", wantIP: net.IPv6loopback, wantPort: core.DefaultClientPort},
+		{host: "[2001:db8::1]", service: "xmpp-server", wantIP: net.ParseIP("2001:db8::1"), wantPort: core.DefaultServerPort},
+		{host: "192.0.2.1", service: "xmpp-client", wantIP: net.ParseIP("192.0.2.1"), wantPort: core.DefaultClientPort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			addrs, errs := core.ResolveFQDN(tt.host, tt.service)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if len(addrs) != 1 || len(addrs[0].IPs) != 1 || !addrs[0].IPs[0].Equal(tt.wantIP) || addrs[0].Port != tt.wantPort {
+				t.Fatalf("got %v, want %s port %d", addrs, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}